@@ -3,6 +3,7 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
@@ -14,17 +15,22 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/buildkite/terminal"
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
 
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -35,7 +41,7 @@ func getDigestFromRequest(req *http.Request) (*util.Digest, error) {
 	if err != nil {
 		return nil, err
 	}
-	return util.NewDigest(
+	return util.NewDigestFromClient(
 		vars["instance"],
 		&remoteexecution.Digest{
 			Hash:      vars["hash"],
@@ -43,6 +49,25 @@ func getDigestFromRequest(req *http.Request) (*util.Digest, error) {
 		})
 }
 
+// getDigestFromKey parses a digest that is provided in the form of
+// "${hash}-${sizeBytes}".
+func getDigestFromKey(instance string, key string) (*util.Digest, error) {
+	separator := strings.LastIndexByte(key, '-')
+	if separator < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Digest %#v does not contain a size", key)
+	}
+	sizeBytes, err := strconv.ParseInt(key[separator+1:], 10, 64)
+	if err != nil {
+		return nil, util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid size in digest %#v", key)
+	}
+	return util.NewDigestFromClient(
+		instance,
+		&remoteexecution.Digest{
+			Hash:      key[:separator],
+			SizeBytes: sizeBytes,
+		})
+}
+
 // BrowserService implements a web service that can be used to explore
 // data stored in the Content Addressable Storage and Action Cache. It
 // can show the details of actions and download their input and output
@@ -52,22 +77,53 @@ type BrowserService struct {
 	contentAddressableStorageBlobAccess blobstore.BlobAccess
 	actionCache                         ac.ActionCache
 	templates                           *template.Template
+	liveOutputTransportOption           grpc.DialOption
+	liveOutputWorkerAddressPatterns     []string
+
+	liveOutputConnectionsLock sync.Mutex
+	liveOutputConnections     map[string]*liveOutputConnection
+	liveOutputIdleConnections *list.List
+}
+
+// liveOutputConnection is a connection to the live output service of
+// a worker that is cached by BrowserService. Connections that are not
+// in use are placed in a list, so that the least recently used ones
+// can be closed.
+type liveOutputConnection struct {
+	conn        *grpc.ClientConn
+	users       int
+	idleElement *list.Element
 }
 
+// maximumLiveOutputConnections is the maximum number of connections
+// to the live output services of workers that are kept open while not
+// in use.
+const maximumLiveOutputConnections = 100
+
 // NewBrowserService constructs a BrowserService that accesses storage
-// through a set of handles.
-func NewBrowserService(contentAddressableStorage cas.ContentAddressableStorage, contentAddressableStorageBlobAccess blobstore.BlobAccess, actionCache ac.ActionCache, templates *template.Template, router *mux.Router) *BrowserService {
+// through a set of handles. Connections to the live output services of
+// workers are established using the provided transport option. Only
+// workers whose address matches one of the provided patterns (e.g.,
+// "bbb-worker-*:8983") are contacted, as the address is taken from the
+// URL.
+func NewBrowserService(contentAddressableStorage cas.ContentAddressableStorage, contentAddressableStorageBlobAccess blobstore.BlobAccess, actionCache ac.ActionCache, templates *template.Template, liveOutputTransportOption grpc.DialOption, liveOutputWorkerAddressPatterns []string, router *mux.Router) *BrowserService {
 	s := &BrowserService{
 		contentAddressableStorage:           contentAddressableStorage,
 		contentAddressableStorageBlobAccess: contentAddressableStorageBlobAccess,
 		actionCache:                         actionCache,
 		templates:                           templates,
+		liveOutputTransportOption:           liveOutputTransportOption,
+		liveOutputWorkerAddressPatterns:     liveOutputWorkerAddressPatterns,
+		liveOutputConnections:               map[string]*liveOutputConnection{},
+		liveOutputIdleConnections:           list.New(),
 	}
 	router.HandleFunc("/action/{instance}/{hash}/{sizeBytes}/", s.handleAction)
 	router.HandleFunc("/actionfailure/{instance}/{hash}/{sizeBytes}/", s.handleActionFailure)
 	router.HandleFunc("/command/{instance}/{hash}/{sizeBytes}/", s.handleCommand)
 	router.HandleFunc("/directory/{instance}/{hash}/{sizeBytes}/", s.handleDirectory)
 	router.HandleFunc("/file/{instance}/{hash}/{sizeBytes}/{name}", s.handleFile)
+	router.HandleFunc("/liveoutput/{name:.+}", s.handleLiveOutput)
+	router.HandleFunc("/liveoutput_raw/{name:.+}", s.handleLiveOutputRaw)
 	router.HandleFunc("/tree/{instance}/{hash}/{sizeBytes}/{subdirectory:(?:.*/)?}", s.handleTree)
 	return s
 }
@@ -100,7 +156,23 @@ func (s *BrowserService) handleAction(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	s.handleActionCommon(w, req, digest, actionResult)
+	// Resource usage statistics cannot be stored in the Action
+	// Cache. Links generated by workers provide them through a query
+	// parameter instead.
+	var resourceUsage *resourceusage.ResourceUsage
+	if resourceUsageKey := req.URL.Query().Get(builder.ResourceUsageServerLogName); resourceUsageKey != "" {
+		resourceUsageDigest, err := getDigestFromKey(digest.GetInstance(), resourceUsageKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resourceUsage, err = s.contentAddressableStorage.GetResourceUsage(ctx, resourceUsageDigest)
+		if err != nil && status.Code(err) != codes.NotFound {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.handleActionCommon(w, req, digest, actionResult, resourceUsage)
 }
 
 func (s *BrowserService) handleActionFailure(w http.ResponseWriter, req *http.Request) {
@@ -120,7 +192,20 @@ func (s *BrowserService) handleActionFailure(w http.ResponseWriter, req *http.Re
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.handleActionCommon(w, req, actionDigest, actionFailure.ActionResult)
+	var resourceUsage *resourceusage.ResourceUsage
+	if actionFailure.ResourceUsageDigest != nil {
+		resourceUsageDigest, err := digest.NewDerivedDigest(actionFailure.ResourceUsageDigest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resourceUsage, err = s.contentAddressableStorage.GetResourceUsage(ctx, resourceUsageDigest)
+		if err != nil && status.Code(err) != codes.NotFound {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.handleActionCommon(w, req, actionDigest, actionFailure.ActionResult, resourceUsage)
 }
 
 func (s *BrowserService) getLogInfo(ctx context.Context, name string, instance string, logDigest *remoteexecution.Digest) (*logInfo, error) {
@@ -171,7 +256,7 @@ func (s *BrowserService) getLogInfo(ctx context.Context, name string, instance s
 	}
 }
 
-func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Request, digest *util.Digest, actionResult *remoteexecution.ActionResult) {
+func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Request, digest *util.Digest, actionResult *remoteexecution.ActionResult, resourceUsage *resourceusage.ResourceUsage) {
 	instance := digest.GetInstance()
 	actionInfo := struct {
 		Instance string
@@ -179,9 +264,10 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 
 		Command *remoteexecution.Command
 
-		ActionResult *remoteexecution.ActionResult
-		StdoutInfo   *logInfo
-		StderrInfo   *logInfo
+		ActionResult  *remoteexecution.ActionResult
+		StdoutInfo    *logInfo
+		StderrInfo    *logInfo
+		ResourceUsage *resourceusage.ResourceUsage
 
 		InputRoot *directoryInfo
 
@@ -191,8 +277,9 @@ func (s *BrowserService) handleActionCommon(w http.ResponseWriter, req *http.Req
 		MissingDirectories []string
 		MissingFiles       []string
 	}{
-		Instance:     instance,
-		ActionResult: actionResult,
+		Instance:      instance,
+		ActionResult:  actionResult,
+		ResourceUsage: resourceUsage,
 	}
 
 	ctx := req.Context()
@@ -455,6 +542,157 @@ func (s *BrowserService) handleFile(w http.ResponseWriter, req *http.Request) {
 	io.Copy(w, r)
 }
 
+func (s *BrowserService) handleLiveOutput(w http.ResponseWriter, req *http.Request) {
+	if err := s.templates.ExecuteTemplate(w, "page_live_output.html", mux.Vars(req)["name"]); err != nil {
+		log.Print(err)
+	}
+}
+
+// isLiveOutputWorkerAddress returns whether an address matches one of
+// the patterns of addresses of workers whose live output services may
+// be contacted.
+func (s *BrowserService) isLiveOutputWorkerAddress(address string) bool {
+	for _, pattern := range s.liveOutputWorkerAddressPatterns {
+		if matched, _ := path.Match(pattern, address); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// getLiveOutputClient returns a ByteStream client for the worker on
+// which a stream of live output of a running action is stored. The
+// address of the worker is part of the name of the stream. The
+// returned function must be called when the client is no longer used.
+func (s *BrowserService) getLiveOutputClient(name string) (bytestream.ByteStreamClient, func(), error) {
+	i := strings.Index(name, builder.LiveOutputResourceNameComponent)
+	if i <= 0 {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "Stream name %#v does not contain a worker address", name)
+	}
+	address := name[:i]
+	if !s.isLiveOutputWorkerAddress(address) {
+		return nil, nil, status.Errorf(codes.PermissionDenied, "Address %#v does not belong to a known worker", address)
+	}
+
+	s.liveOutputConnectionsLock.Lock()
+	defer s.liveOutputConnectionsLock.Unlock()
+	c, ok := s.liveOutputConnections[address]
+	if ok {
+		if c.users == 0 {
+			s.liveOutputIdleConnections.Remove(c.idleElement)
+			c.idleElement = nil
+		}
+	} else {
+		conn, err := grpc.Dial(address, s.liveOutputTransportOption)
+		if err != nil {
+			return nil, nil, err
+		}
+		c = &liveOutputConnection{conn: conn}
+		s.liveOutputConnections[address] = c
+	}
+	c.users++
+	return bytestream.NewByteStreamClient(c.conn), func() {
+		s.releaseLiveOutputConnection(address, c)
+	}, nil
+}
+
+// releaseLiveOutputConnection decrements the number of users of a
+// connection returned by getLiveOutputClient(). Once the number of
+// idle connections exceeds the maximum, the least recently used ones
+// are closed.
+func (s *BrowserService) releaseLiveOutputConnection(address string, c *liveOutputConnection) {
+	s.liveOutputConnectionsLock.Lock()
+	defer s.liveOutputConnectionsLock.Unlock()
+	c.users--
+	if c.users == 0 {
+		c.idleElement = s.liveOutputIdleConnections.PushBack(address)
+	}
+	for s.liveOutputIdleConnections.Len() > maximumLiveOutputConnections {
+		oldestAddress := s.liveOutputIdleConnections.Remove(s.liveOutputIdleConnections.Front()).(string)
+		if err := s.liveOutputConnections[oldestAddress].conn.Close(); err != nil {
+			log.Printf("Failed to close connection to %s: %s", oldestAddress, err)
+		}
+		delete(s.liveOutputConnections, oldestAddress)
+	}
+}
+
+func (s *BrowserService) handleLiveOutputRaw(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	client, release, err := s.getLiveOutputClient(name)
+	if err != nil {
+		if status.Code(err) == codes.PermissionDenied {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	defer release()
+	ctx := req.Context()
+	stream, err := client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: name,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only start setting response headers once the first chunk of
+	// data has been received successfully.
+	response, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	var offset int64
+	for {
+		// Workers only retain the most recent output. Announce
+		// any output that has been discarded.
+		if header, headerErr := stream.Header(); headerErr == nil {
+			if values := header.Get(builder.LiveOutputReadOffsetMetadataKey); len(values) > 0 {
+				if readOffset, parseErr := strconv.ParseInt(values[0], 10, 64); parseErr == nil && readOffset > offset {
+					fmt.Fprintf(w, "\n[%d bytes of output discarded]\n", readOffset-offset)
+					offset = readOffset
+				}
+			}
+		}
+		for err == nil {
+			if _, err := w.Write(response.Data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			offset += int64(len(response.Data))
+			response, err = stream.Recv()
+		}
+
+		// Resume reading if this client fell behind and output
+		// got discarded in the meantime.
+		if status.Code(err) != codes.OutOfRange {
+			return
+		}
+		stream, err = client.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: name,
+			ReadOffset:   offset,
+		})
+		if err != nil {
+			return
+		}
+		response, err = stream.Recv()
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (s *BrowserService) handleTree(w http.ResponseWriter, req *http.Request) {
 	digest, err := getDigestFromRequest(req)
 	if err != nil {
@@ -1,37 +1,72 @@
 package main
 
 import (
-	"flag"
 	"html/template"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"path"
 	"strings"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_browser"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/duration"
 	"github.com/gorilla/mux"
 	"github.com/kballard/go-shellquote"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	var (
-		blobstoreConfig  = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: bbb_browser bbb_browser.jsonnet")
+	}
+	var configuration bbb_browser.ApplicationConfiguration
+	if err := util.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		log.Fatalf("Failed to read configuration from %s: %s", os.Args[1], err)
+	}
+	if configuration.MaximumMessageSizeBytes <= 0 {
+		log.Fatal("Maximum message size must be positive")
+	}
 
-	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	// Storage access. Backends are recreated when the configuration
+	// file is modified or SIGHUP is received.
+	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := blobstore_configuration.CreateBlobAccessObjectsFromConfig(configuration.Blobstore)
 	if err != nil {
 		log.Fatal("Failed to create blob access: ", err)
 	}
+	blobstore_configuration.ReloadBlobAccessObjectsOnChange(os.Args[1], configuration.Blobstore, contentAddressableStorageBlobAccess, actionCacheBlobAccess, func() (*blobstore_pb.BlobstoreConfiguration, error) {
+		var newConfiguration bbb_browser.ApplicationConfiguration
+		if err := util.UnmarshalConfigurationFromFile(os.Args[1], &newConfiguration); err != nil {
+			return nil, err
+		}
+		return newConfiguration.Blobstore, nil
+	})
+
+	liveOutputTransportOption, err := util.NewGRPCTransportDialOption(configuration.LiveOutputTls)
+	if err != nil {
+		log.Fatal("Failed to create live output TLS configuration: ", err)
+	}
+	for _, pattern := range configuration.LiveOutputWorkerAddressPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid live output worker address pattern %#v: %s", pattern, err)
+		}
+	}
 
 	templates, err := template.New("templates").Funcs(template.FuncMap{
 		"basename": path.Base,
+		"duration": func(in *duration.Duration) string {
+			d, err := ptypes.Duration(in)
+			if err != nil {
+				return err.Error()
+			}
+			return d.String()
+		},
 		"shellquote": func(in string) string {
 			// Use non-breaking hyphens to improve readability of output.
 			return strings.Replace(shellquote.Join(in), "-", "‑", -1)
@@ -45,10 +80,12 @@ func main() {
 	router.Handle("/metrics", promhttp.Handler())
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 	NewBrowserService(
-		cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageBlobAccess),
+		cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageBlobAccess, int(configuration.MaximumMessageSizeBytes)),
 		contentAddressableStorageBlobAccess,
 		ac.NewBlobAccessActionCache(actionCacheBlobAccess),
 		templates,
+		liveOutputTransportOption,
+		configuration.LiveOutputWorkerAddressPatterns,
 		router)
-	log.Fatal(http.ListenAndServe(*webListenAddress, router))
+	log.Fatal(http.ListenAndServe(configuration.ListenAddress, router))
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+)
+
+// bbb_circular_fsck validates the consistency of the files created by
+// the circular storage backend. It checks whether all entries in the
+// offset files refer to data that lies between the read and write
+// cursors stored in the state file. Entries of the Content Addressable
+// Storage may optionally be validated by rehashing the data they
+// refer to.
+//
+// This command must not be run while the storage backend is in use.
+// The file sizes provided must match the ones in the storage
+// configuration.
+
+// dataFilesFlag is a command line flag that may be provided multiple
+// times, specifying the data files as "<path>:<size in bytes>".
+type dataFilesFlag struct {
+	files []circular.ReadWriterAt
+	sizes []uint64
+}
+
+func (f *dataFilesFlag) String() string {
+	return ""
+}
+
+func (f *dataFilesFlag) Set(value string) error {
+	separator := strings.LastIndexByte(value, ':')
+	if separator < 0 {
+		return fmt.Errorf("Data file %#v does not have the form <path>:<size>", value)
+	}
+	size, err := strconv.ParseUint(value[separator+1:], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid size for data file %#v: %s", value, err)
+	}
+	file, err := os.Open(value[:separator])
+	if err != nil {
+		return err
+	}
+	f.files = append(f.files, file)
+	f.sizes = append(f.sizes, size)
+	return nil
+}
+
+func main() {
+	var dataFiles dataFilesFlag
+	flag.Var(&dataFiles, "data-file", "Data file and its size, as \"<path>:<size>\", used instead of the data file in the directory. May be provided multiple times")
+	var (
+		dataFileSizeBytes   = flag.Uint64("data-file-size-bytes", 0, "Maximum size of the circular file containing data")
+		directory           = flag.String("directory", "", "Directory where the files created by the circular storage backend are located")
+		offsetFileSizeBytes = flag.Uint64("offset-file-size-bytes", 0, "Maximum size of the hash table containing data offsets")
+		rehash              = flag.Bool("rehash", false, "Validate the checksums of data referenced by the Content Addressable Storage offset file")
+		repair              = flag.Bool("repair", false, "Remove inconsistent entries from the offset files")
+	)
+	flag.Parse()
+
+	circularDirectory, err := filesystem.NewLocalDirectory(*directory)
+	if err != nil {
+		log.Fatal("Failed to open directory: ", err)
+	}
+	defer circularDirectory.Close()
+
+	openFlag := os.O_RDONLY
+	if *repair {
+		openFlag = os.O_RDWR
+	}
+	var dataFile circular.ReadWriterAt
+	if len(dataFiles.files) > 0 {
+		dataFile = circular.NewConcatenatedReadWriterAt(dataFiles.files, dataFiles.sizes)
+		*dataFileSizeBytes = 0
+		for _, size := range dataFiles.sizes {
+			*dataFileSizeBytes += size
+		}
+	} else {
+		dataFile, err = circularDirectory.OpenFile("data", os.O_RDONLY, 0)
+		if err != nil {
+			log.Fatal("Failed to open data file: ", err)
+		}
+	}
+	stateFile, err := circularDirectory.OpenFile("state", os.O_RDONLY, 0)
+	if err != nil {
+		log.Fatal("Failed to open state file: ", err)
+	}
+	defer stateFile.Close()
+	cursors, dataLayout, err := circular.ReadFileState(stateFile, *dataFileSizeBytes)
+	if err != nil {
+		log.Fatal("Failed to read state file: ", err)
+	}
+	log.Printf("Read cursor: %d, write cursor: %d, data layout: %+v", cursors.Read, cursors.Write, dataLayout)
+
+	// The Content Addressable Storage uses a single offset file,
+	// while the Action Cache uses either one offset file per
+	// instance, or a single offset file in which entries for all
+	// instances are folded together.
+	entries, err := circularDirectory.ReadDir()
+	if err != nil {
+		log.Fatal("Failed to read directory: ", err)
+	}
+	inconsistent := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != "offset" && name != "offset_folded" && !strings.HasPrefix(name, "offset.") {
+			continue
+		}
+		var dataStore circular.DataStore
+		if *rehash && name == "offset" {
+			dataStore = circular.NewFileDataStore(dataFile, dataLayout)
+		}
+
+		offsetFile, err := circularDirectory.OpenFile(name, openFlag, 0)
+		if err != nil {
+			log.Fatalf("Failed to open offset file %#v: %s", name, err)
+		}
+		results, err := circular.CheckFileOffsetStore(offsetFile, *offsetFileSizeBytes, cursors, dataStore, *repair)
+		offsetFile.Close()
+		if err != nil {
+			log.Fatalf("Failed to check offset file %#v: %s", name, err)
+		}
+		log.Printf("Offset file %#v: %+v", name, results)
+		if results.Malformed+results.BeyondWriteCursor+results.Corrupted > results.Removed {
+			inconsistent = true
+		}
+	}
+	if inconsistent {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// bbb_copy_blobs copies blobs between two storage configurations. It
+// can be used to complete a migration after changing the layout of a
+// sharded storage cluster (e.g., by adjusting the weights of shards).
+// The source configuration should describe the previous layout, while
+// the target configuration should describe the new layout.
+//
+// By default, the blobs to copy are obtained by enumerating the
+// backends of the source configuration. This is supported for Redis
+// (using SCAN) and S3 (using ListObjectsV2), including Redis and S3
+// backends that are part of a sharded or size distinguishing
+// configuration. Objects whose keys are not valid blob keys are
+// ignored.
+//
+// For other backends, the keys of the blobs to copy may be provided
+// through stdin, one per line, by passing -keys-from-stdin. These keys
+// use the same format as the ones used by the Redis and S3 backends
+// (i.e., "<hash>-<size>" for the Content Addressable Storage and
+// "<hash>-<size>-<instance>" for the Action Cache, optionally prefixed
+// with "blake3:").
+//
+// Blobs that are already present in the target are skipped.
+
+func copyBlob(ctx context.Context, source blobstore.BlobAccess, target blobstore.BlobAccess, digest *util.Digest) (bool, error) {
+	missing, err := target.FindMissing(ctx, []*util.Digest{digest})
+	if err != nil {
+		return false, util.StatusWrap(err, "Failed to check existence in target")
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+	sizeBytes, r, err := source.Get(ctx, digest)
+	if err != nil {
+		return false, util.StatusWrap(err, "Failed to read from source")
+	}
+	if err := target.Put(ctx, digest, sizeBytes, r); err != nil {
+		return false, util.StatusWrap(err, "Failed to write to target")
+	}
+	return true, nil
+}
+
+func main() {
+	var (
+		concurrency           = flag.Int("concurrency", 10, "Number of blobs to copy concurrently")
+		keysFromStdin         = flag.Bool("keys-from-stdin", false, "Read the keys of the blobs to copy from stdin, as opposed to enumerating the source")
+		sourceBlobstoreConfig = flag.String("source-blobstore-config", "", "Configuration file (Jsonnet, JSON or YAML) for blob storage from which blobs are read")
+		storageType           = flag.String("storage-type", "cas", "Type of storage of which blobs are copied, either \"ac\" or \"cas\"")
+		targetBlobstoreConfig = flag.String("target-blobstore-config", "", "Configuration file (Jsonnet, JSON or YAML) for blob storage to which blobs are written")
+	)
+	flag.Parse()
+
+	var sourceConfiguration, targetConfiguration pb.BlobstoreConfiguration
+	if err := util.UnmarshalConfigurationFromFile(*sourceBlobstoreConfig, &sourceConfiguration); err != nil {
+		log.Fatal("Failed to read source blob storage configuration: ", err)
+	}
+	if err := util.UnmarshalConfigurationFromFile(*targetBlobstoreConfig, &targetConfiguration); err != nil {
+		log.Fatal("Failed to read target blob storage configuration: ", err)
+	}
+	sourceContentAddressableStorage, sourceActionCache, err := configuration.CreateBlobAccessObjectsFromConfig(&sourceConfiguration)
+	if err != nil {
+		log.Fatal("Failed to create source blob access: ", err)
+	}
+	targetContentAddressableStorage, targetActionCache, err := configuration.CreateBlobAccessObjectsFromConfig(&targetConfiguration)
+	if err != nil {
+		log.Fatal("Failed to create target blob access: ", err)
+	}
+	var source, target blobstore.BlobAccess
+	var sourceBackend *pb.BlobAccessConfiguration
+	var digestKeyFormat util.DigestKeyFormat
+	switch *storageType {
+	case "ac":
+		source, target, digestKeyFormat = sourceActionCache, targetActionCache, util.DigestKeyWithInstance
+		sourceBackend = sourceConfiguration.ActionCache
+	case "cas":
+		source, target, digestKeyFormat = sourceContentAddressableStorage, targetContentAddressableStorage, util.DigestKeyWithoutInstance
+		sourceBackend = sourceConfiguration.ContentAddressableStorage
+	default:
+		log.Fatalf("Unknown storage type %#v", *storageType)
+	}
+
+	// Copy blobs concurrently.
+	var blobsCopied, blobsSkipped, blobsFailed uint64
+	digests := make(chan *util.Digest)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for digest := range digests {
+				if copied, err := copyBlob(context.Background(), source, target, digest); err != nil {
+					log.Printf("Failed to copy blob %s: %s", digest, err)
+					atomic.AddUint64(&blobsFailed, 1)
+				} else if copied {
+					atomic.AddUint64(&blobsCopied, 1)
+				} else {
+					atomic.AddUint64(&blobsSkipped, 1)
+				}
+			}
+		}()
+	}
+
+	if *keysFromStdin {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if key := strings.TrimSpace(scanner.Text()); key != "" {
+				digest, err := util.NewDigestFromKey(key, digestKeyFormat)
+				if err != nil {
+					log.Printf("Invalid key %#v: %s", key, err)
+					blobsFailed++
+					continue
+				}
+				digests <- digest
+			}
+		}
+		close(digests)
+		wg.Wait()
+		if err := scanner.Err(); err != nil {
+			log.Fatal("Failed to read keys: ", err)
+		}
+	} else {
+		var keysIgnored uint64
+		err := configuration.EnumerateBlobKeysFromConfig(context.Background(), sourceBackend, func(key string) error {
+			digest, err := util.NewDigestFromKey(key, digestKeyFormat)
+			if err != nil {
+				keysIgnored++
+				return nil
+			}
+			digests <- digest
+			return nil
+		})
+		close(digests)
+		wg.Wait()
+		if err != nil {
+			log.Fatal("Failed to enumerate source: ", err)
+		}
+		if keysIgnored > 0 {
+			log.Printf("Ignored %d objects in the source that are not blobs", keysIgnored)
+		}
+	}
+
+	fmt.Printf("Copied %d blobs, skipped %d blobs that were already present, failed to copy %d blobs\n", blobsCopied, blobsSkipped, blobsFailed)
+	if blobsFailed > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
-	"flag"
 	"log"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"strings"
+	"os"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	auth_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_frontend"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ratelimit"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"google.golang.org/genproto/googleapis/bytestream"
@@ -24,71 +27,117 @@ import (
 )
 
 func main() {
-	var schedulersList util.StringList
-	var (
-		actionCacheAllowUpdates = flag.Bool("ac-allow-updates", false, "Allow clients to write into the action cache")
-		blobstoreConfig         = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		webListenAddress        = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Var(&schedulersList, "scheduler", "Backend capable of executing build actions. Example: debian8|hostname-of-debian8-scheduler:8981")
-	flag.Parse()
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: bbb_frontend bbb_frontend.jsonnet")
+	}
+	var configuration bbb_frontend.ApplicationConfiguration
+	if err := util.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		log.Fatalf("Failed to read configuration from %s: %s", os.Args[1], err)
+	}
+	if configuration.ByteStreamReadChunkSizeBytes <= 0 {
+		log.Fatal("ByteStream read chunk size must be positive")
+	}
+	if configuration.MaximumBatchTotalSizeBytes < 0 {
+		log.Fatal("Maximum batch total size must be non-negative")
+	}
 
 	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
+	if configuration.MetricsListenAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(configuration.MetricsListenAddress, nil))
+		}()
+	}
 
-	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	// Storage access. Backends are recreated when the configuration
+	// file is modified or SIGHUP is received.
+	swappableContentAddressableStorage, swappableActionCache, err := blobstore_configuration.CreateBlobAccessObjectsFromConfig(configuration.Blobstore)
 	if err != nil {
 		log.Fatal("Failed to create blob access: ", err)
 	}
+	blobstore_configuration.ReloadBlobAccessObjectsOnChange(os.Args[1], configuration.Blobstore, swappableContentAddressableStorage, swappableActionCache, func() (*blobstore_pb.BlobstoreConfiguration, error) {
+		var newConfiguration bbb_frontend.ApplicationConfiguration
+		if err := util.UnmarshalConfigurationFromFile(os.Args[1], &newConfiguration); err != nil {
+			return nil, err
+		}
+		return newConfiguration.Blobstore, nil
+	})
+	var contentAddressableStorageBlobAccess blobstore.BlobAccess = swappableContentAddressableStorage
+	var actionCacheBlobAccess blobstore.BlobAccess = swappableActionCache
+
+	// Authentication of clients and authorization of operations
+	// performed by them on a per-instance basis.
+	serverAuth, err := auth.CreateServerAuthFromConfig(configuration.Auth)
+	if err != nil {
+		log.Fatal("Failed to create authentication and authorization: ", err)
+	}
+	contentAddressableStorageBlobAccess = blobstore.NewAuthorizingBlobAccess(
+		contentAddressableStorageBlobAccess, serverAuth.Authorizer, auth_pb.Operation_CAS_READ, auth_pb.Operation_CAS_WRITE)
+	if isolation := serverAuth.ActionCacheIsolation; isolation != nil {
+		actionCacheBlobAccess = blobstore.NewActionCacheIsolatingBlobAccess(
+			actionCacheBlobAccess, serverAuth.Authorizer, isolation.PerIdentity)
+	}
+	actionCacheBlobAccess = blobstore.NewAuthorizingBlobAccess(
+		actionCacheBlobAccess, serverAuth.Authorizer, auth_pb.Operation_AC_READ, auth_pb.Operation_AC_WRITE)
 	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
 
+	// Quotas on requests, enforced after clients are authenticated.
+	rateLimitUnaryInterceptor, rateLimitStreamInterceptor, err := ratelimit.CreateInterceptorsFromConfig(configuration.RateLimit)
+	if err != nil {
+		log.Fatal("Failed to create rate limits: ", err)
+	}
+
 	// Backends capable of compiling.
 	schedulers := map[string]builder.BuildQueue{}
-	for _, schedulerEntry := range schedulersList {
-		components := strings.SplitN(schedulerEntry, "|", 2)
-		if len(components) != 2 {
-			log.Fatal("Invalid scheduler entry: ", schedulerEntry)
+	for instance, schedulerConfiguration := range configuration.Schedulers {
+		if canonical, err := util.CanonicalizeInstanceName(instance); err != nil || canonical != instance {
+			log.Fatalf("Invalid scheduler instance name %#v: must be valid and in canonical form", instance)
 		}
-		scheduler, err := grpc.Dial(
-			components[1],
-			grpc.WithInsecure(),
-			grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-			grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+		scheduler, err := util.NewGRPCClientFromConfiguration(schedulerConfiguration)
 		if err != nil {
-			log.Fatal("Failed to create scheduler RPC client: ", err)
+			log.Fatalf("Failed to create scheduler RPC client for instance %#v: %s", instance, err)
 		}
-		schedulers[components[0]] = builder.NewForwardingBuildQueue(scheduler)
+		schedulers[instance] = builder.NewForwardingBuildQueue(scheduler)
 	}
-	buildQueue := builder.NewDemultiplexingBuildQueue(func(instance string) (builder.BuildQueue, error) {
+	buildQueueGetter := func(instance string) (builder.BuildQueue, error) {
 		scheduler, ok := schedulers[instance]
 		if !ok {
-			return nil, status.Errorf(codes.InvalidArgument, "Unknown instance name")
+			return nil, status.Errorf(codes.NotFound, "No scheduler configured for instance")
 		}
 		return scheduler, nil
-	})
+	}
+	buildQueue := builder.NewAuthorizingBuildQueue(
+		builder.NewDemultiplexingBuildQueue(buildQueueGetter),
+		serverAuth.Authorizer)
 
-	// RPC server.
-	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
-	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, *actionCacheAllowUpdates))
-	remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
-	bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16))
-	remoteexecution.RegisterCapabilitiesServer(s, buildQueue)
-	remoteexecution.RegisterExecutionServer(s, buildQueue)
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.Register(s)
+	// Capabilities of the storage provided by this process. These
+	// are combined with the execution capabilities of the scheduler
+	// responsible for the instance, if any.
+	capabilitiesServer := builder.NewCapabilitiesServer(
+		&remoteexecution.CacheCapabilities{
+			DigestFunction: util.InferableDigestFunctions(),
+			ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
+				UpdateEnabled: configuration.ActionCacheAllowUpdates,
+			},
+			// CachePriorityCapabilities: Priorities not supported.
+			MaxBatchTotalSizeBytes:      configuration.MaximumBatchTotalSizeBytes,
+			SymlinkAbsolutePathStrategy: remoteexecution.CacheCapabilities_ALLOWED,
+		},
+		buildQueueGetter,
+		serverAuth.Authorizer)
 
-	sock, err := net.Listen("tcp", ":8980")
-	if err != nil {
-		log.Fatal("Failed to create listening socket: ", err)
-	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
-	}
+	// RPC servers.
+	log.Fatal(
+		"Failed to serve RPC server: ",
+		util.ServeGRPC(
+			configuration.GrpcServers,
+			[]grpc.UnaryServerInterceptor{serverAuth.UnaryInterceptor, rateLimitUnaryInterceptor},
+			[]grpc.StreamServerInterceptor{serverAuth.StreamInterceptor, rateLimitStreamInterceptor},
+			func(s *grpc.Server) {
+				remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, configuration.ActionCacheAllowUpdates))
+				remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess, configuration.MaximumBatchTotalSizeBytes))
+				bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, int(configuration.ByteStreamReadChunkSizeBytes)))
+				remoteexecution.RegisterCapabilitiesServer(s, capabilitiesServer)
+				remoteexecution.RegisterExecutionServer(s, buildQueue)
+			}))
 }
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"flag"
 	"log"
-	"net"
 	"os"
 
+	"github.com/EdSchouten/bazel-buildbarn/pkg/containerimage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 
@@ -15,49 +15,63 @@ import (
 )
 
 func main() {
-	var tempDirectoriesList util.StringList
-	var (
-		buildDirectoryPath = flag.String("build-directory", "/worker/build", "Directory where builds take place")
-		listenPath         = flag.String("listen-path", "/worker/runner", "Path on which this process should bind its UNIX socket to wait for incoming requests through GRPC")
-	)
-	flag.Var(&tempDirectoriesList, "temp-directory", "Temporary directory that should be cleaned up after a build action. Example: /tmp")
-	flag.Parse()
-
-	buildDirectory, err := filesystem.NewLocalDirectory(*buildDirectoryPath)
+	// Build actions that run inside container images are launched
+	// by re-executing the runner.
+	environment.RunContainerInitIfRequested()
+
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: bbb_runner bbb_runner.jsonnet")
+	}
+	var configuration bbb_runner.ApplicationConfiguration
+	if err := util.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		log.Fatalf("Failed to read configuration from %s: %s", os.Args[1], err)
+	}
+
+	buildDirectory, err := filesystem.NewLocalDirectory(configuration.BuildDirectoryPath)
 	if err != nil {
 		log.Fatal("Failed to open build directory: ", err)
 	}
 
-	env := environment.NewLocalExecutionEnvironment(buildDirectory, *buildDirectoryPath)
-	var runnerServer runner.RunnerServer
-	// When temporary directories need cleaning prior to executing a build
-	// action, attach a series of TempDirectoryCleaningManagers.
-	if len(tempDirectoriesList) > 0 {
-		m := environment.NewSingletonManager(env)
-		for _, d := range tempDirectoriesList {
-			directory, err := filesystem.NewLocalDirectory(d)
-			if err != nil {
-				log.Fatalf("Failed to open temporary directory %#v: %s", d, err)
-			}
-			m = environment.NewTempDirectoryCleaningManager(m, directory)
+	// Requests are processed by a Manager, so that temporary
+	// directories may be cleaned and container images may be used
+	// prior to executing a build action.
+	m := environment.NewSingletonManager(
+		environment.NewLocalExecutionEnvironment(buildDirectory, configuration.BuildDirectoryPath, configuration.CgroupDirectoryPath))
+	for _, d := range configuration.TemporaryDirectoryPaths {
+		directory, err := filesystem.NewLocalDirectory(d)
+		if err != nil {
+			log.Fatalf("Failed to open temporary directory %#v: %s", d, err)
 		}
-		runnerServer = environment.NewRunnerServer(environment.NewConcurrentManager(m))
-	} else {
-		runnerServer = env
+		m = environment.NewTempDirectoryCleaningManager(m, directory)
 	}
+	m = environment.NewConcurrentManager(m)
 
-	s := grpc.NewServer()
-	runner.RegisterRunnerServer(s, runnerServer)
-
-	if err := os.Remove(*listenPath); err != nil && !os.IsNotExist(err) {
-		log.Fatalf("Could not remove stale socket %#v: %s", *listenPath, err)
+	// Run build actions inside the root filesystem of the container
+	// image selected through platform properties.
+	if configuration.ContainerImageCacheDirectoryPath != "" {
+		var imageSource containerimage.ImageSource
+		if configuration.ContainerImageDirectoryPath != "" {
+			imageSource = containerimage.NewLocalDirectoryImageSource(configuration.ContainerImageDirectoryPath)
+		} else if configuration.ContainerImageRegistryMirrorUrl != "" {
+			imageSource = containerimage.NewRegistryMirrorImageSource(configuration.ContainerImageRegistryMirrorUrl)
+		} else {
+			log.Fatal("Container image support requires either a container image directory or registry mirror URL to be set")
+		}
+		m = environment.NewContainerImageManager(
+			m,
+			containerimage.NewLocalRootFilesystemCache(imageSource, configuration.ContainerImageCacheDirectoryPath),
+			buildDirectory,
+			configuration.BuildDirectoryPath,
+			configuration.CgroupDirectoryPath)
 	}
 
-	sock, err := net.Listen("unix", *listenPath)
-	if err != nil {
-		log.Fatalf("Failed to create listening socket %#v: %s", *listenPath, err)
-	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
-	}
+	log.Fatal(
+		"Failed to serve RPC server: ",
+		util.ServeGRPC(
+			configuration.GrpcServers,
+			nil,
+			nil,
+			func(s *grpc.Server) {
+				runner.RegisterRunnerServer(s, environment.NewRunnerServer(m))
+			}))
 }
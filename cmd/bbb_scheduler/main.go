@@ -1,53 +1,53 @@
 package main
 
 import (
-	"flag"
 	"log"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"google.golang.org/grpc"
 )
 
 func main() {
-	var (
-		jobsPendingMax   = flag.Uint("jobs-pending-max", 100, "Maximum number of build actions to be enqueued")
-		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: bbb_scheduler bbb_scheduler.jsonnet")
+	}
+	var configuration bbb_scheduler.ApplicationConfiguration
+	if err := util.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		log.Fatalf("Failed to read configuration from %s: %s", os.Args[1], err)
+	}
+	if configuration.JobsPendingMax == 0 {
+		log.Fatal("Maximum number of pending jobs must be positive")
+	}
 
 	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
-
-	executionServer, schedulerServer := builder.NewWorkerBuildQueue(util.DigestKeyWithInstance, *jobsPendingMax)
-
-	// RPC server.
-	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
-	remoteexecution.RegisterCapabilitiesServer(s, executionServer)
-	remoteexecution.RegisterExecutionServer(s, executionServer)
-	scheduler.RegisterSchedulerServer(s, schedulerServer)
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.Register(s)
-
-	sock, err := net.Listen("tcp", ":8981")
-	if err != nil {
-		log.Fatal("Failed to create listening socket: ", err)
-	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
+	if configuration.MetricsListenAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(configuration.MetricsListenAddress, nil))
+		}()
 	}
+
+	executionServer, schedulerServer := builder.NewWorkerBuildQueue(util.DigestKeyWithInstance, uint(configuration.JobsPendingMax))
+
+	// RPC servers.
+	log.Fatal(
+		"Failed to serve RPC server: ",
+		util.ServeGRPC(
+			configuration.GrpcServers,
+			nil,
+			nil,
+			func(s *grpc.Server) {
+				remoteexecution.RegisterCapabilitiesServer(s, executionServer)
+				remoteexecution.RegisterExecutionServer(s, executionServer)
+				scheduler.RegisterSchedulerServer(s, schedulerServer)
+			}))
 }
@@ -1,17 +1,21 @@
 package main
 
 import (
-	"flag"
 	"log"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	auth_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_storage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"google.golang.org/genproto/googleapis/bytestream"
@@ -19,41 +23,67 @@ import (
 )
 
 func main() {
-	var (
-		blobstoreConfig  = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		webListenAddress = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: bbb_storage bbb_storage.jsonnet")
+	}
+	var configuration bbb_storage.ApplicationConfiguration
+	if err := util.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		log.Fatalf("Failed to read configuration from %s: %s", os.Args[1], err)
+	}
+	if configuration.ByteStreamReadChunkSizeBytes <= 0 {
+		log.Fatal("ByteStream read chunk size must be positive")
+	}
 
 	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
+	if configuration.MetricsListenAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(configuration.MetricsListenAddress, nil))
+		}()
+	}
 
-	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	// Storage access. Backends are recreated when the configuration
+	// file is modified or SIGHUP is received.
+	swappableContentAddressableStorage, swappableActionCache, err := blobstore_configuration.CreateBlobAccessObjectsFromConfig(configuration.Blobstore)
 	if err != nil {
 		log.Fatal("Failed to create blob access: ", err)
 	}
-	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
+	blobstore_configuration.ReloadBlobAccessObjectsOnChange(os.Args[1], configuration.Blobstore, swappableContentAddressableStorage, swappableActionCache, func() (*blobstore_pb.BlobstoreConfiguration, error) {
+		var newConfiguration bbb_storage.ApplicationConfiguration
+		if err := util.UnmarshalConfigurationFromFile(os.Args[1], &newConfiguration); err != nil {
+			return nil, err
+		}
+		return newConfiguration.Blobstore, nil
+	})
+	var contentAddressableStorageBlobAccess blobstore.BlobAccess = swappableContentAddressableStorage
+	var actionCacheBlobAccess blobstore.BlobAccess = swappableActionCache
 
-	// RPC server.
-	s := grpc.NewServer(
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
-	remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, true))
-	remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess))
-	bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, 1<<16))
-	grpc_prometheus.EnableHandlingTimeHistogram()
-	grpc_prometheus.Register(s)
-
-	sock, err := net.Listen("tcp", ":8982")
+	// Authentication of clients and authorization of operations
+	// performed by them on a per-instance basis.
+	serverAuth, err := auth.CreateServerAuthFromConfig(configuration.Auth)
 	if err != nil {
-		log.Fatal("Failed to create listening socket: ", err)
+		log.Fatal("Failed to create authentication and authorization: ", err)
 	}
-	if err := s.Serve(sock); err != nil {
-		log.Fatal("Failed to serve RPC server: ", err)
+	contentAddressableStorageBlobAccess = blobstore.NewAuthorizingBlobAccess(
+		contentAddressableStorageBlobAccess, serverAuth.Authorizer, auth_pb.Operation_CAS_READ, auth_pb.Operation_CAS_WRITE)
+	if isolation := serverAuth.ActionCacheIsolation; isolation != nil {
+		actionCacheBlobAccess = blobstore.NewActionCacheIsolatingBlobAccess(
+			actionCacheBlobAccess, serverAuth.Authorizer, isolation.PerIdentity)
 	}
+	actionCacheBlobAccess = blobstore.NewAuthorizingBlobAccess(
+		actionCacheBlobAccess, serverAuth.Authorizer, auth_pb.Operation_AC_READ, auth_pb.Operation_AC_WRITE)
+	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
+
+	// RPC servers.
+	log.Fatal(
+		"Failed to serve RPC server: ",
+		util.ServeGRPC(
+			configuration.GrpcServers,
+			[]grpc.UnaryServerInterceptor{serverAuth.UnaryInterceptor},
+			[]grpc.StreamServerInterceptor{serverAuth.StreamInterceptor},
+			func(s *grpc.Server) {
+				remoteexecution.RegisterActionCacheServer(s, ac.NewActionCacheServer(actionCache, true))
+				remoteexecution.RegisterContentAddressableStorageServer(s, cas.NewContentAddressableStorageServer(contentAddressableStorageBlobAccess, 0))
+				bytestream.RegisterByteStreamServer(s, cas.NewByteStreamServer(contentAddressableStorageBlobAccess, int(configuration.ByteStreamReadChunkSizeBytes)))
+			}))
 }
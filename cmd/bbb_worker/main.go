@@ -2,42 +2,46 @@ package main
 
 import (
 	"context"
-	"flag"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
+	"os"
 	"syscall"
 	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
-	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
+	blobstore_configuration "github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/configuration"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	blobstore_pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/bbb_worker"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
-	"github.com/grpc-ecosystem/go-grpc-prometheus"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
 )
 
 func main() {
-	var (
-		blobstoreConfig    = flag.String("blobstore-config", "/config/blobstore.conf", "Configuration for blob storage")
-		browserURLString   = flag.String("browser-url", "http://bbb-browser/", "URL of the Bazel Buildbarn Browser, accessible by the user through 'bazel build --verbose_failures'")
-		buildDirectoryPath = flag.String("build-directory", "/worker/build", "Directory where builds take place")
-		cacheDirectoryPath = flag.String("cache-directory", "/worker/cache", "Directory where build input files are cached")
-		concurrency        = flag.Int("concurrency", 1, "Number of actions to run concurrently")
-		runnerAddress      = flag.String("runner", "unix:///worker/runner", "Address of the runner to which to connect")
-		schedulerAddress   = flag.String("scheduler", "", "Address of the scheduler to which to connect")
-		webListenAddress   = flag.String("web.listen-address", ":80", "Port on which to expose metrics")
-	)
-	flag.Parse()
+	if len(os.Args) != 2 {
+		log.Fatal("Usage: bbb_worker bbb_worker.jsonnet")
+	}
+	var configuration bbb_worker.ApplicationConfiguration
+	if err := util.UnmarshalConfigurationFromFile(os.Args[1], &configuration); err != nil {
+		log.Fatalf("Failed to read configuration from %s: %s", os.Args[1], err)
+	}
+	if err := validateConfiguration(&configuration); err != nil {
+		log.Fatalf("Invalid configuration in %s: %s", os.Args[1], err)
+	}
 
 	// To ease privilege separation, clear the umask. This process
 	// either writes files into directories that can easily be
@@ -45,31 +49,48 @@ func main() {
 	// secure.
 	syscall.Umask(0)
 
-	browserURL, err := url.Parse(*browserURLString)
+	browserURL, err := url.Parse(configuration.BrowserUrl)
 	if err != nil {
 		log.Fatal("Failed to parse browser URL: ", err)
 	}
+	var outputSizeCheckInterval time.Duration
+	if configuration.OutputSizeCheckInterval != nil {
+		outputSizeCheckInterval, err = ptypes.Duration(configuration.OutputSizeCheckInterval)
+		if err != nil {
+			log.Fatal("Failed to parse output size check interval: ", err)
+		}
+	}
 
 	// Web server for metrics and profiling.
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		log.Fatal(http.ListenAndServe(*webListenAddress, nil))
-	}()
+	if configuration.MetricsListenAddress != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(configuration.MetricsListenAddress, nil))
+		}()
+	}
 
-	// Storage access.
-	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := configuration.CreateBlobAccessObjectsFromConfig(*blobstoreConfig)
+	// Storage access. Backends are recreated when the configuration
+	// file is modified or SIGHUP is received.
+	contentAddressableStorageBlobAccess, actionCacheBlobAccess, err := blobstore_configuration.CreateBlobAccessObjectsFromConfig(configuration.Blobstore)
 	if err != nil {
 		log.Fatal("Failed to create blob access: ", err)
 	}
+	blobstore_configuration.ReloadBlobAccessObjectsOnChange(os.Args[1], configuration.Blobstore, contentAddressableStorageBlobAccess, actionCacheBlobAccess, func() (*blobstore_pb.BlobstoreConfiguration, error) {
+		var newConfiguration bbb_worker.ApplicationConfiguration
+		if err := util.UnmarshalConfigurationFromFile(os.Args[1], &newConfiguration); err != nil {
+			return nil, err
+		}
+		return newConfiguration.Blobstore, nil
+	})
 
 	// Directories where builds take place.
-	buildDirectory, err := filesystem.NewLocalDirectory(*buildDirectoryPath)
+	buildDirectory, err := filesystem.NewLocalDirectory(configuration.BuildDirectoryPath)
 	if err != nil {
 		log.Fatal("Failed to open cache directory: ", err)
 	}
 
 	// On-disk caching of content for efficient linking into build environments.
-	cacheDirectory, err := filesystem.NewLocalDirectory(*cacheDirectoryPath)
+	cacheDirectory, err := filesystem.NewLocalDirectory(configuration.CacheDirectoryPath)
 	if err != nil {
 		log.Fatal("Failed to open cache directory: ", err)
 	}
@@ -82,17 +103,33 @@ func main() {
 	contentAddressableStorageReader := cas.NewDirectoryCachingContentAddressableStorage(
 		cas.NewHardlinkingContentAddressableStorage(
 			cas.NewBlobAccessContentAddressableStorage(
-				blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess)),
-			util.DigestKeyWithoutInstance, cacheDirectory, 10000, 1<<30),
-		util.DigestKeyWithoutInstance, 1000)
+				blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess),
+				int(configuration.MaximumMessageSizeBytes)),
+			util.DigestKeyWithoutInstance,
+			cacheDirectory,
+			int(configuration.FileCacheMaximumFiles),
+			configuration.FileCacheMaximumSizeBytes),
+		util.DigestKeyWithoutInstance,
+		int(configuration.DirectoryCacheMaximumDirectories))
 	actionCache := ac.NewBlobAccessActionCache(actionCacheBlobAccess)
 
+	// Prefetching of inputs of the next action into the caches
+	// above. Files are temporarily placed in a subdirectory of the
+	// cache directory, so that they can be hardlinked into the cache.
+	if err := cacheDirectory.Mkdir("prefetch", 0700); err != nil {
+		log.Fatal("Failed to create prefetch directory: ", err)
+	}
+	prefetchDirectory, err := cacheDirectory.Enter("prefetch")
+	if err != nil {
+		log.Fatal("Failed to open prefetch directory: ", err)
+	}
+	inputPrefetcher := builder.NewContentAddressableStorageInputPrefetcher(
+		contentAddressableStorageReader,
+		prefetchDirectory,
+		configuration.MaximumPrefetchSizeBytes)
+
 	// Create connection with scheduler.
-	schedulerConnection, err := grpc.Dial(
-		*schedulerAddress,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+	schedulerConnection, err := util.NewGRPCClientFromConfiguration(configuration.Scheduler)
 	if err != nil {
 		log.Fatal("Failed to create scheduler RPC client: ", err)
 	}
@@ -104,11 +141,7 @@ func main() {
 	// used in combination with a runner process. Having a separate
 	// runner process also makes it possible to apply privilege
 	// separation.
-	runnerConnection, err := grpc.Dial(
-		*runnerAddress,
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+	runnerConnection, err := util.NewGRPCClientFromConfiguration(configuration.Runner)
 	if err != nil {
 		log.Fatal("Failed to create runner RPC client: ", err)
 	}
@@ -130,25 +163,52 @@ func main() {
 		environment.NewConcurrentManager(environmentManager),
 		util.DigestKeyWithoutInstance)
 
-	for i := 0; i < *concurrency; i++ {
+	// Expose output of running actions through the ByteStream
+	// protocol, so that it can be tailed through bbb_browser.
+	var liveOutputServer builder.LiveOutputServer
+	if configuration.LiveOutputAddress != "" {
+		liveOutputServer = builder.NewLiveOutputServer(configuration.LiveOutputAddress, int(configuration.LiveOutputMaximumStreamSizeBytes))
+		go func() {
+			log.Fatal(
+				"Failed to serve live output RPC server: ",
+				util.ServeGRPC(
+					configuration.LiveOutputGrpcServers,
+					nil,
+					nil,
+					func(s *grpc.Server) {
+						bytestream.RegisterByteStreamServer(s, liveOutputServer)
+					}))
+		}()
+	}
+
+	for i := 0; i < int(configuration.Concurrency); i++ {
 		go func(i int) {
 			// Per-worker separate writer of the Content
 			// Addressable Storage that batches writes after
 			// completing the build action.
 			contentAddressableStorageWriter, contentAddressableStorageFlusher := blobstore.NewBatchedStoreBlobAccess(
 				blobstore.NewExistencePreconditionBlobAccess(contentAddressableStorageBlobAccess),
-				util.DigestKeyWithoutInstance, 100)
+				util.DigestKeyWithoutInstance, int(configuration.BatchedStoreMaximumBlobs))
 			contentAddressableStorageWriter = blobstore.NewMetricsBlobAccess(
 				contentAddressableStorageWriter,
 				"cas_batched_store")
 			contentAddressableStorage := cas.NewReadWriteDecouplingContentAddressableStorage(
 				contentAddressableStorageReader,
-				cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageWriter))
+				cas.NewBlobAccessContentAddressableStorage(contentAddressableStorageWriter, int(configuration.MaximumMessageSizeBytes)))
 			buildExecutor := builder.NewStorageFlushingBuildExecutor(
-				builder.NewCachingBuildExecutor(
-					builder.NewLocalBuildExecutor(
+				builder.NewActionCacheCheckingBuildExecutor(
+					builder.NewCachingBuildExecutor(
+						builder.NewLocalBuildExecutor(
+							contentAddressableStorage,
+							environmentManager,
+							liveOutputServer,
+							configuration.MaximumInputSizeBytes,
+							configuration.MaximumOutputSizeBytes,
+							configuration.MaximumOutputFileSizeBytes,
+							outputSizeCheckInterval),
 						contentAddressableStorage,
-						environmentManager),
+						actionCache,
+						browserURL),
 					contentAddressableStorage,
 					actionCache,
 					browserURL),
@@ -156,7 +216,7 @@ func main() {
 
 			// Repeatedly ask the scheduler for work.
 			for {
-				err := subscribeAndExecute(schedulerClient, buildExecutor, browserURL)
+				err := subscribeAndExecute(schedulerClient, buildExecutor, inputPrefetcher, browserURL)
 				log.Print("Failed to subscribe and execute: ", err)
 				time.Sleep(time.Second * 3)
 			}
@@ -165,18 +225,85 @@ func main() {
 	select {}
 }
 
-func subscribeAndExecute(schedulerClient scheduler.SchedulerClient, buildExecutor builder.BuildExecutor, browserURL *url.URL) error {
-	stream, err := schedulerClient.GetWork(context.Background())
+// validateConfiguration checks whether the values in the worker's
+// configuration are within acceptable bounds, so that problems are
+// reported at startup, as opposed to while executing build actions.
+func validateConfiguration(configuration *bbb_worker.ApplicationConfiguration) error {
+	if configuration.Concurrency <= 0 {
+		return errors.New("Concurrency must be positive")
+	}
+	if configuration.BuildDirectoryPath == "" || configuration.CacheDirectoryPath == "" {
+		return errors.New("Build and cache directory paths must be set")
+	}
+	if configuration.FileCacheMaximumFiles <= 0 || configuration.FileCacheMaximumSizeBytes <= 0 {
+		return errors.New("File cache maximum number of files and size must be positive")
+	}
+	if configuration.DirectoryCacheMaximumDirectories <= 0 {
+		return errors.New("Directory cache maximum number of directories must be positive")
+	}
+	if configuration.BatchedStoreMaximumBlobs <= 0 {
+		return errors.New("Batched store maximum number of blobs must be positive")
+	}
+	if configuration.MaximumMessageSizeBytes <= 0 ||
+		configuration.MaximumInputSizeBytes <= 0 ||
+		configuration.MaximumOutputSizeBytes <= 0 ||
+		configuration.MaximumOutputFileSizeBytes <= 0 {
+		return errors.New("Maximum message, input, output and output file sizes must be positive")
+	}
+	if configuration.MaximumPrefetchSizeBytes < 0 {
+		return errors.New("Maximum prefetch size cannot be negative")
+	}
+	if configuration.LiveOutputAddress != "" && configuration.LiveOutputMaximumStreamSizeBytes <= 0 {
+		return errors.New("Live output maximum stream size must be positive")
+	}
+	return nil
+}
+
+func subscribeAndExecute(schedulerClient scheduler.SchedulerClient, buildExecutor builder.BuildExecutor, inputPrefetcher builder.InputPrefetcher, browserURL *url.URL) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := schedulerClient.GetWork(ctx)
 	if err != nil {
 		return err
 	}
 	defer stream.CloseSend()
 
+	// Receive requests in the background, so that requests sent
+	// ahead of time by the scheduler can be picked up while
+	// executing the current request.
+	requests := make(chan *remoteexecution.ExecuteRequest)
+	receiveErrors := make(chan error, 1)
+	go func() {
+		for {
+			request, err := stream.Recv()
+			if err != nil {
+				receiveErrors <- err
+				return
+			}
+			select {
+			case requests <- request:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var nextRequest *remoteexecution.ExecuteRequest
+	var nextRequestPrefetched <-chan struct{}
 	for {
-		request, err := stream.Recv()
-		if err != nil {
-			return err
+		request := nextRequest
+		if request == nil {
+			select {
+			case request = <-requests:
+			case err := <-receiveErrors:
+				return err
+			}
+		} else {
+			// Let prefetching of the inputs complete, so
+			// that they are not downloaded twice.
+			<-nextRequestPrefetched
 		}
+		nextRequest = nil
 
 		// Print URL of the action into the log before execution.
 		actionURL, err := browserURL.Parse(
@@ -190,9 +317,65 @@ func subscribeAndExecute(schedulerClient scheduler.SchedulerClient, buildExecuto
 		}
 		log.Print("Action: ", actionURL.String())
 
-		response, _ := buildExecutor.Execute(stream.Context(), request)
+		// Execute the request, while forwarding updates to the
+		// operation metadata to the scheduler.
+		executionStateUpdates := make(chan *remoteexecution.ExecuteOperationMetadata, 1)
+		executeResponses := make(chan *remoteexecution.ExecuteResponse, 1)
+		go func() {
+			response, _ := buildExecutor.Execute(ctx, request, executionStateUpdates)
+			close(executionStateUpdates)
+			executeResponses <- response
+		}()
+
+		// Ask the scheduler for the next request, so that its
+		// inputs can be prefetched while the current request is
+		// being executed.
+		sendErr := stream.Send(&scheduler.WorkerUpdate{
+			Update: &scheduler.WorkerUpdate_PrefetchRequest{
+				PrefetchRequest: &scheduler.PrefetchRequest{},
+			},
+		})
+		prefetchableRequests := requests
+		for executionStateUpdates != nil {
+			select {
+			case executionStateUpdate, ok := <-executionStateUpdates:
+				if !ok {
+					executionStateUpdates = nil
+				} else if sendErr == nil {
+					if name := executionStateUpdate.StdoutStreamName; name != "" {
+						if liveOutputURL, err := browserURL.Parse("/liveoutput/" + name); err == nil {
+							log.Print("Live output: ", liveOutputURL.String())
+						}
+					}
+					sendErr = stream.Send(&scheduler.WorkerUpdate{
+						Update: &scheduler.WorkerUpdate_ExecuteOperationMetadata{
+							ExecuteOperationMetadata: executionStateUpdate,
+						},
+					})
+				}
+			case nextRequest = <-prefetchableRequests:
+				prefetchableRequests = nil
+				prefetched := make(chan struct{})
+				nextRequestPrefetched = prefetched
+				go func(request *remoteexecution.ExecuteRequest) {
+					if err := inputPrefetcher.Prefetch(ctx, request); err != nil {
+						log.Print("Failed to prefetch inputs: ", err)
+					}
+					close(prefetched)
+				}(nextRequest)
+			}
+		}
+		response := <-executeResponses
+		if sendErr != nil {
+			return sendErr
+		}
+
 		log.Print("ExecuteResponse: ", response)
-		if err := stream.Send(response); err != nil {
+		if err := stream.Send(&scheduler.WorkerUpdate{
+			Update: &scheduler.WorkerUpdate_ExecuteResponse{
+				ExecuteResponse: response,
+			},
+		}); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,7 @@
+{
+  blobstore: {
+    contentAddressableStorage: { grpc: { endpoint: 'localhost:8982' } },
+    actionCache: { grpc: { endpoint: 'localhost:8982' } },
+  },
+  maximumMessageSizeBytes: 16 * 1024 * 1024,
+}
@@ -22,7 +22,8 @@ ARCH="$(uname | tr '[A-Z]' '[a-z]')_amd64_pure_stripped"
 # Location where the Buildbarn source tree is stored.
 BBB_SRC="$(pwd)/../.."
 
-CURWD="$(pwd)"
+# Absolute path of this directory, used by the configuration files.
+export CURWD="$(pwd)"
 trap 'kill $(jobs -p)' EXIT TERM INT
 
 # Clean up data from previous run.
@@ -30,30 +31,12 @@ rm -f runner
 mkdir -p build cache storage-ac storage-cas
 
 # Launch frontend, scheduler, storage, browser and worker.
-"${BBB_SRC}/bazel-bin/cmd/bbb_frontend/${ARCH}/bbb_frontend" \
-    -blobstore-config frontend-worker-blobstore.conf \
-    -scheduler 'local|localhost:8981' \
-    -web.listen-address localhost:7980 &
-"${BBB_SRC}/bazel-bin/cmd/bbb_scheduler/${ARCH}/bbb_scheduler" \
-    -web.listen-address localhost:7981 &
-"${BBB_SRC}/bazel-bin/cmd/bbb_storage/${ARCH}/bbb_storage" \
-    -blobstore-config storage-blobstore.conf \
-    -web.listen-address localhost:7982 &
+"${BBB_SRC}/bazel-bin/cmd/bbb_frontend/${ARCH}/bbb_frontend" frontend.jsonnet &
+"${BBB_SRC}/bazel-bin/cmd/bbb_scheduler/${ARCH}/bbb_scheduler" scheduler.jsonnet &
+"${BBB_SRC}/bazel-bin/cmd/bbb_storage/${ARCH}/bbb_storage" storage.jsonnet &
 (cd "${BBB_SRC}/cmd/bbb_browser" &&
- exec "${BBB_SRC}/bazel-bin/cmd/bbb_browser/${ARCH}/bbb_browser" \
-    -blobstore-config "${CURWD}/frontend-worker-blobstore.conf" \
-    -web.listen-address localhost:7983) &
-"${BBB_SRC}/bazel-bin/cmd/bbb_worker/${ARCH}/bbb_worker" \
-    -blobstore-config "${CURWD}/frontend-worker-blobstore.conf" \
-    -browser-url http://localhost:7983/ \
-    -build-directory build \
-    -cache-directory cache \
-    -concurrency 4 \
-    -runner "unix://${CURWD}/runner" \
-    -scheduler localhost:8981 \
-    -web.listen-address localhost:7984 &
-"${BBB_SRC}/bazel-bin/cmd/bbb_runner/${ARCH}/bbb_runner" \
-    -build-directory build \
-    -listen-path "${CURWD}/runner" &
+ exec "${BBB_SRC}/bazel-bin/cmd/bbb_browser/${ARCH}/bbb_browser" "${CURWD}/browser.jsonnet") &
+"${BBB_SRC}/bazel-bin/cmd/bbb_worker/${ARCH}/bbb_worker" worker.jsonnet &
+"${BBB_SRC}/bazel-bin/cmd/bbb_runner/${ARCH}/bbb_runner" runner.jsonnet &
 
 wait
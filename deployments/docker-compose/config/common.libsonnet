@@ -0,0 +1,31 @@
+{
+  // Storage is sharded across two bbb_storage instances. Hash
+  // initialization values are strings, as Jsonnet numbers cannot
+  // represent 64-bit integers accurately.
+  blobstore: {
+    contentAddressableStorage: {
+      sharding: {
+        hashInitialization: '11946695773637837490',
+        shard: [
+          { backend: { grpc: { endpoint: 'bbb-storage-0:8982' } }, weight: 1 },
+          { backend: { grpc: { endpoint: 'bbb-storage-1:8982' } }, weight: 1 },
+          // Reserve some space for even more storage backends.
+          { weight: 2 },
+        ],
+      },
+    },
+    actionCache: {
+      sharding: {
+        hashInitialization: '14897363947481274433',
+        shard: [
+          { backend: { grpc: { endpoint: 'bbb-storage-0:8982' } }, weight: 1 },
+          { backend: { grpc: { endpoint: 'bbb-storage-1:8982' } }, weight: 1 },
+          // Reserve some space for even more storage backends.
+          { weight: 2 },
+        ],
+      },
+    },
+  },
+  browserUrl: 'http://localhost:7983/',
+  maximumMessageSizeBytes: 16 * 1024 * 1024,
+}
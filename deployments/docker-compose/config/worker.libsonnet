@@ -0,0 +1,24 @@
+local common = import 'common.libsonnet';
+
+// Configuration shared by all workers. Workers for a specific instance
+// only need to provide the address of their scheduler.
+function(schedulerAddress) {
+  blobstore: common.blobstore,
+  metricsListenAddress: ':80',
+  browserUrl: common.browserUrl,
+  scheduler: { address: schedulerAddress },
+  runner: { address: 'unix:///worker/runner' },
+  concurrency: 4,
+  buildDirectoryPath: '/worker/build',
+  cacheDirectoryPath: '/worker/cache',
+  fileCacheMaximumFiles: 10000,
+  fileCacheMaximumSizeBytes: 1024 * 1024 * 1024,
+  directoryCacheMaximumDirectories: 1000,
+  batchedStoreMaximumBlobs: 100,
+  maximumMessageSizeBytes: common.maximumMessageSizeBytes,
+  maximumInputSizeBytes: 16 * 1024 * 1024 * 1024,
+  maximumOutputSizeBytes: 16 * 1024 * 1024 * 1024,
+  maximumOutputFileSizeBytes: 4 * 1024 * 1024 * 1024,
+  outputSizeCheckInterval: '10s',
+  maximumPrefetchSizeBytes: 256 * 1024 * 1024,
+}
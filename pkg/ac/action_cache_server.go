@@ -25,7 +25,7 @@ func NewActionCacheServer(actionCache ActionCache, allowUpdates bool) remoteexec
 }
 
 func (s *actionCacheServer) GetActionResult(ctx context.Context, in *remoteexecution.GetActionResultRequest) (*remoteexecution.ActionResult, error) {
-	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
+	digest, err := util.NewDigestFromClient(in.InstanceName, in.ActionDigest)
 	if err != nil {
 		return nil, err
 	}
@@ -36,7 +36,7 @@ func (s *actionCacheServer) UpdateActionResult(ctx context.Context, in *remoteex
 	if !s.allowUpdates {
 		return nil, status.Error(codes.Unimplemented, "This service can only be used to get action results")
 	}
-	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
+	digest, err := util.NewDigestFromClient(in.InstanceName, in.ActionDigest)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticator determines the identity of the client that issued a
+// GRPC request. Implementations return an error with code
+// UNAUTHENTICATED if the client did not provide valid credentials.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (string, error)
+}
+
+type anyAuthenticator struct {
+	authenticators []Authenticator
+}
+
+// NewAnyAuthenticator creates an Authenticator that tries a list of
+// Authenticators in order, returning the identity yielded by the first
+// one that succeeds.
+func NewAnyAuthenticator(authenticators []Authenticator) Authenticator {
+	return &anyAuthenticator{
+		authenticators: authenticators,
+	}
+}
+
+func (a *anyAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	var messages []string
+	for _, authenticator := range a.authenticators {
+		identity, err := authenticator.Authenticate(ctx)
+		if err == nil {
+			return identity, nil
+		}
+		messages = append(messages, status.Convert(err).Message())
+	}
+	if len(messages) == 0 {
+		return "", status.Error(codes.Unauthenticated, "No authentication methods configured")
+	}
+	return "", status.Error(codes.Unauthenticated, strings.Join(messages, ", "))
+}
+
+type identityKey struct{}
+
+// NewContextWithIdentity returns a Context that stores the identity of
+// an authenticated client.
+func NewContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// GetIdentity returns the identity of the authenticated client that
+// issued the request associated with a Context. The boolean return
+// value is false if the client is anonymous.
+func GetIdentity(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
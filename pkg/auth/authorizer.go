@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authorizer determines whether the client that issued a request may
+// perform an operation on an instance. Implementations return an error
+// with code PERMISSION_DENIED if access is denied.
+type Authorizer interface {
+	Authorize(ctx context.Context, instanceName string, operation pb.Operation) error
+}
+
+type allowAllAuthorizer struct{}
+
+// NewAllowAllAuthorizer creates an Authorizer that permits all
+// operations. It is used when no authorization policy is configured.
+func NewAllowAllAuthorizer() Authorizer {
+	return allowAllAuthorizer{}
+}
+
+func (a allowAllAuthorizer) Authorize(ctx context.Context, instanceName string, operation pb.Operation) error {
+	return nil
+}
+
+type ruleBasedAuthorizer struct {
+	rules []*pb.AuthorizationRule
+}
+
+// NewRuleBasedAuthorizer creates an Authorizer that permits operations
+// only if one of the provided rules matches the instance name, the
+// identity of the client (as obtained through GetIdentity()) and the
+// operation.
+func NewRuleBasedAuthorizer(rules []*pb.AuthorizationRule) Authorizer {
+	return &ruleBasedAuthorizer{
+		rules: rules,
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ruleBasedAuthorizer) ruleMatches(rule *pb.AuthorizationRule, instanceName string, identity string, authenticated bool, operation pb.Operation) bool {
+	if len(rule.InstanceNames) > 0 && !containsString(rule.InstanceNames, instanceName) {
+		return false
+	}
+	if authenticated {
+		if !containsString(rule.Identities, "*") && !containsString(rule.Identities, identity) {
+			return false
+		}
+	} else if !rule.AllowAnonymous {
+		return false
+	}
+	for _, o := range rule.Operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ruleBasedAuthorizer) Authorize(ctx context.Context, instanceName string, operation pb.Operation) error {
+	identity, authenticated := GetIdentity(ctx)
+	for _, rule := range a.rules {
+		if a.ruleMatches(rule, instanceName, identity, authenticated, operation) {
+			return nil
+		}
+	}
+	if authenticated {
+		return status.Errorf(codes.PermissionDenied, "Client %#v is not permitted to perform operation %s on instance %#v", identity, operation, instanceName)
+	}
+	return status.Errorf(codes.PermissionDenied, "Anonymous clients are not permitted to perform operation %s on instance %#v", operation, instanceName)
+}
@@ -0,0 +1,73 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRuleBasedAuthorizer(t *testing.T) {
+	authorizer := auth.NewRuleBasedAuthorizer([]*pb.AuthorizationRule{
+		// Anyone may read from the CAS of the "public" instance.
+		{
+			InstanceNames:  []string{"public"},
+			Identities:     []string{"*"},
+			AllowAnonymous: true,
+			Operations:     []pb.Operation{pb.Operation_CAS_READ},
+		},
+		// Authenticated clients may read from all instances.
+		{
+			Identities: []string{"*"},
+			Operations: []pb.Operation{pb.Operation_CAS_READ, pb.Operation_AC_READ},
+		},
+		// Only CI may write into the Action Cache.
+		{
+			InstanceNames: []string{"public", "private"},
+			Identities:    []string{"ci"},
+			Operations:    []pb.Operation{pb.Operation_AC_WRITE, pb.Operation_EXECUTE},
+		},
+	})
+	anonymous := context.Background()
+	alice := auth.NewContextWithIdentity(context.Background(), "alice")
+	ci := auth.NewContextWithIdentity(context.Background(), "ci")
+
+	t.Run("Anonymous", func(t *testing.T) {
+		require.NoError(t, authorizer.Authorize(anonymous, "public", pb.Operation_CAS_READ))
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Anonymous clients are not permitted to perform operation AC_READ on instance \"public\""),
+			authorizer.Authorize(anonymous, "public", pb.Operation_AC_READ))
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Anonymous clients are not permitted to perform operation CAS_READ on instance \"private\""),
+			authorizer.Authorize(anonymous, "private", pb.Operation_CAS_READ))
+	})
+
+	t.Run("Authenticated", func(t *testing.T) {
+		require.NoError(t, authorizer.Authorize(alice, "private", pb.Operation_CAS_READ))
+		require.NoError(t, authorizer.Authorize(alice, "private", pb.Operation_AC_READ))
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Client \"alice\" is not permitted to perform operation AC_WRITE on instance \"private\""),
+			authorizer.Authorize(alice, "private", pb.Operation_AC_WRITE))
+	})
+
+	t.Run("SpecificIdentity", func(t *testing.T) {
+		require.NoError(t, authorizer.Authorize(ci, "private", pb.Operation_AC_WRITE))
+		require.NoError(t, authorizer.Authorize(ci, "public", pb.Operation_EXECUTE))
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Client \"ci\" is not permitted to perform operation EXECUTE on instance \"other\""),
+			authorizer.Authorize(ci, "other", pb.Operation_EXECUTE))
+		require.Equal(
+			t,
+			status.Error(codes.PermissionDenied, "Client \"ci\" is not permitted to perform operation CAS_WRITE on instance \"public\""),
+			authorizer.Authorize(ci, "public", pb.Operation_CAS_WRITE))
+	})
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ServerAuth contains the objects needed to authenticate clients of a
+// GRPC server and to authorize the operations they perform.
+type ServerAuth struct {
+	UnaryInterceptor  grpc.UnaryServerInterceptor
+	StreamInterceptor grpc.StreamServerInterceptor
+	Authorizer        Authorizer
+
+	// If non-nil, action results stored by untrusted clients should
+	// be isolated from the ones stored by trusted clients.
+	ActionCacheIsolation *pb.ActionCacheIsolationConfiguration
+}
+
+// CreateServerAuthFromConfig creates GRPC interceptors that
+// authenticate clients and an Authorizer that controls access to
+// instances, based on a configuration message. If no configuration is
+// provided, all clients are permitted to perform all operations
+// anonymously.
+func CreateServerAuthFromConfig(config *pb.AuthConfiguration) (*ServerAuth, error) {
+	if config == nil {
+		authenticator := NewAnyAuthenticator(nil)
+		return &ServerAuth{
+			UnaryInterceptor:  NewAuthenticatingUnaryInterceptor(authenticator, true),
+			StreamInterceptor: NewAuthenticatingStreamInterceptor(authenticator, true),
+			Authorizer:        NewAllowAllAuthorizer(),
+		}, nil
+	}
+
+	var authenticators []Authenticator
+	for _, authenticatorConfig := range config.Authenticators {
+		switch backend := authenticatorConfig.Backend.(type) {
+		case *pb.AuthenticatorConfiguration_TlsClientCertificate:
+			authenticators = append(authenticators, NewTLSClientCertificateAuthenticator())
+		case *pb.AuthenticatorConfiguration_Jwt:
+			authenticator, err := NewJWTAuthenticator(backend.Jwt.JwksFile, backend.Jwt.Issuer, backend.Jwt.Audience)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, authenticator)
+		default:
+			return nil, status.Error(codes.InvalidArgument, "Authenticator configuration did not contain a backend")
+		}
+	}
+	for i, rule := range config.Rules {
+		if len(rule.Operations) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Authorization rule at index %d does not permit any operations", i)
+		}
+	}
+	authenticator := NewAnyAuthenticator(authenticators)
+	return &ServerAuth{
+		UnaryInterceptor:     NewAuthenticatingUnaryInterceptor(authenticator, config.AllowAnonymous),
+		StreamInterceptor:    NewAuthenticatingStreamInterceptor(authenticator, config.AllowAnonymous),
+		Authorizer:           NewRuleBasedAuthorizer(config.Rules),
+		ActionCacheIsolation: config.ActionCacheIsolation,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// authenticate determines the identity of the client and stores it in
+// the Context, so that it can be used by Authorizers.
+func authenticate(ctx context.Context, authenticator Authenticator, allowAnonymous bool) (context.Context, error) {
+	identity, err := authenticator.Authenticate(ctx)
+	if err != nil {
+		if allowAnonymous && status.Code(err) == codes.Unauthenticated {
+			return ctx, nil
+		}
+		return nil, err
+	}
+	return NewContextWithIdentity(ctx, identity), nil
+}
+
+// NewAuthenticatingUnaryInterceptor creates a GRPC interceptor for
+// unary calls that authenticates clients. Calls from clients that fail
+// to authenticate are rejected, unless anonymous access is allowed.
+func NewAuthenticatingUnaryInterceptor(authenticator Authenticator, allowAnonymous bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, authenticator, allowAnonymous)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type authenticatedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// NewAuthenticatingStreamInterceptor creates a GRPC interceptor for
+// streaming calls that authenticates clients. Calls from clients that
+// fail to authenticate are rejected, unless anonymous access is
+// allowed.
+func NewAuthenticatingStreamInterceptor(authenticator Authenticator, allowAnonymous bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), authenticator, allowAnonymous)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedServerStream{
+			ServerStream: ss,
+			ctx:          ctx,
+		})
+	}
+}
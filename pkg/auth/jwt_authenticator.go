@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	// Register the hash functions used by the supported algorithms.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// jsonWebKey is a single public key, as stored in a JSON Web Key Set
+// (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKey is a key from a JSON Web Key Set that has been converted to
+// its native representation.
+type publicKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseJSONWebKeySet(data []byte) ([]publicKey, error) {
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to parse JSON Web Key Set")
+	}
+	var keys []publicKey
+	for i, key := range keySet.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			n, err := decodeBigInt(key.N)
+			if err != nil {
+				return nil, util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid modulus for key at index %d", i)
+			}
+			e, err := decodeBigInt(key.E)
+			if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid exponent for key at index %d", i)
+			}
+			keys = append(keys, publicKey{
+				kid: key.Kid,
+				key: &rsa.PublicKey{N: n, E: int(e.Int64())},
+			})
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, status.Errorf(codes.InvalidArgument, "Unsupported curve %#v for key at index %d", key.Crv, i)
+			}
+			x, err := decodeBigInt(key.X)
+			if err != nil {
+				return nil, util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid X coordinate for key at index %d", i)
+			}
+			y, err := decodeBigInt(key.Y)
+			if err != nil {
+				return nil, util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid Y coordinate for key at index %d", i)
+			}
+			if !curve.IsOnCurve(x, y) {
+				return nil, status.Errorf(codes.InvalidArgument, "Key at index %d is not on curve %s", i, key.Crv)
+			}
+			keys = append(keys, publicKey{
+				kid: key.Kid,
+				key: &ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+			})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "JSON Web Key Set contains no supported signing keys")
+	}
+	return keys, nil
+}
+
+// verifySignature checks whether a signature of a JSON Web Token is
+// valid, using a given algorithm and public key.
+func verifySignature(algorithm string, key crypto.PublicKey, signingInput []byte, signature []byte) bool {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return algorithm[0] == 'R' && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// ECDSA signatures consist of two integers of the size
+		// of the curve, concatenated.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if algorithm[0] != 'E' || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	default:
+		return false
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+}
+
+// hasAudience returns whether the "aud" claim of a token, which may
+// either be a string or an array of strings, contains a given value.
+func (c *jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(c.Aud, &single); err == nil {
+		return single == audience
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.Aud, &multiple); err == nil {
+		for _, a := range multiple {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type jwtAuthenticator struct {
+	keys     *util.FileReloader
+	issuer   string
+	audience string
+}
+
+// NewJWTAuthenticator creates an Authenticator that identifies clients
+// by the "sub" claim of a JSON Web Token, provided in the form of an
+// "Authorization: Bearer ..." header. Signatures of tokens are
+// validated against the public keys stored in a JSON Web Key Set file,
+// which is reloaded when modified. Tokens must carry an "exp" claim. If
+// non-empty, the "iss" and "aud" claims of tokens must match the
+// provided issuer and audience.
+func NewJWTAuthenticator(jwksFile string, issuer string, audience string) (Authenticator, error) {
+	keys, err := util.NewFileReloader([]string{jwksFile}, func() (interface{}, error) {
+		data, err := ioutil.ReadFile(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseJSONWebKeySet(data)
+	})
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to load JSON Web Key Set %#v", jwksFile)
+	}
+	return &jwtAuthenticator{
+		keys:     keys,
+		issuer:   issuer,
+		audience: audience,
+	}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	for _, value := range md.Get("authorization") {
+		if len(value) > 7 && strings.EqualFold(value[:7], "Bearer ") {
+			token = value[7:]
+			break
+		}
+	}
+	if token == "" {
+		return "", status.Error(codes.Unauthenticated, "No bearer token provided")
+	}
+
+	// Decode the token and validate its signature.
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", status.Error(codes.Unauthenticated, "Bearer token is not a JSON Web Token")
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Unauthenticated, "Failed to decode JSON Web Token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Unauthenticated, "Failed to parse JSON Web Token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Unauthenticated, "Failed to decode JSON Web Token signature")
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	validSignature := false
+	for _, key := range a.keys.Get().([]publicKey) {
+		if (header.Kid == "" || key.kid == header.Kid) && verifySignature(header.Alg, key.key, signingInput, signature) {
+			validSignature = true
+			break
+		}
+	}
+	if !validSignature {
+		return "", status.Error(codes.Unauthenticated, "JSON Web Token has an invalid signature")
+	}
+
+	// Validate the claims contained in the token.
+	claimsData, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Unauthenticated, "Failed to decode JSON Web Token claims")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsData, &claims); err != nil {
+		return "", util.StatusWrapWithCode(err, codes.Unauthenticated, "Failed to parse JSON Web Token claims")
+	}
+	now := float64(time.Now().Unix())
+	if claims.Exp == nil {
+		// Tokens without an expiration time would remain valid
+		// indefinitely if leaked.
+		return "", status.Error(codes.Unauthenticated, "JSON Web Token has no expiration time")
+	}
+	if now >= *claims.Exp {
+		return "", status.Error(codes.Unauthenticated, "JSON Web Token has expired")
+	}
+	if claims.Nbf != nil && now < *claims.Nbf {
+		return "", status.Error(codes.Unauthenticated, "JSON Web Token is not yet valid")
+	}
+	if a.issuer != "" && claims.Iss != a.issuer {
+		return "", status.Errorf(codes.Unauthenticated, "JSON Web Token has issuer %#v, while %#v was expected", claims.Iss, a.issuer)
+	}
+	if a.audience != "" && !claims.hasAudience(a.audience) {
+		return "", status.Errorf(codes.Unauthenticated, "JSON Web Token is not intended for audience %#v", a.audience)
+	}
+	if claims.Sub == "" {
+		return "", status.Error(codes.Unauthenticated, "JSON Web Token has no subject")
+	}
+	return claims.Sub, nil
+}
@@ -0,0 +1,132 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken creates a JSON Web Token with a given set of claims,
+// signed using ES256.
+func signToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func contextWithToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// Write a JSON Web Key Set containing the public key to disk.
+	directory, err := ioutil.TempDir("", "jwks")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+	jwksFile := filepath.Join(directory, "jwks.json")
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "EC",
+				"kid": "key1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+				"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(jwksFile, jwks, 0644))
+
+	authenticator, err := auth.NewJWTAuthenticator(jwksFile, "https://issuer", "buildbarn")
+	require.NoError(t, err)
+	now := time.Now().Unix()
+
+	t.Run("Success", func(t *testing.T) {
+		identity, err := authenticator.Authenticate(contextWithToken(signToken(t, key, "key1", map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://issuer",
+			"aud": []string{"other", "buildbarn"},
+			"exp": now + 3600,
+		})))
+		require.NoError(t, err)
+		require.Equal(t, "alice", identity)
+	})
+
+	t.Run("NoToken", func(t *testing.T) {
+		_, err := authenticator.Authenticate(context.Background())
+		require.Equal(t, status.Error(codes.Unauthenticated, "No bearer token provided"), err)
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		_, err := authenticator.Authenticate(contextWithToken(signToken(t, otherKey, "key1", map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://issuer",
+			"aud": "buildbarn",
+			"exp": now + 3600,
+		})))
+		require.Equal(t, status.Error(codes.Unauthenticated, "JSON Web Token has an invalid signature"), err)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		_, err := authenticator.Authenticate(contextWithToken(signToken(t, key, "key1", map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://issuer",
+			"aud": "buildbarn",
+			"exp": now - 60,
+		})))
+		require.Equal(t, status.Error(codes.Unauthenticated, "JSON Web Token has expired"), err)
+	})
+
+	t.Run("NoExpirationTime", func(t *testing.T) {
+		_, err := authenticator.Authenticate(contextWithToken(signToken(t, key, "key1", map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://issuer",
+			"aud": "buildbarn",
+		})))
+		require.Equal(t, status.Error(codes.Unauthenticated, "JSON Web Token has no expiration time"), err)
+	})
+
+	t.Run("WrongAudience", func(t *testing.T) {
+		_, err := authenticator.Authenticate(contextWithToken(signToken(t, key, "key1", map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://issuer",
+			"aud": "other",
+			"exp": now + 3600,
+		})))
+		require.Equal(t, status.Error(codes.Unauthenticated, "JSON Web Token is not intended for audience \"buildbarn\""), err)
+	})
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type tlsClientCertificateAuthenticator struct{}
+
+// NewTLSClientCertificateAuthenticator creates an Authenticator that
+// identifies clients by the common name of the certificate they
+// presented while establishing a mutual TLS connection. The
+// certificate must have been verified by the server, meaning that the
+// server must be configured to validate client certificates against a
+// set of certificate authorities.
+func NewTLSClientCertificateAuthenticator() Authenticator {
+	return tlsClientCertificateAuthenticator{}
+}
+
+func (a tlsClientCertificateAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "Connection has no peer information")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "Connection was not established using TLS")
+	}
+	verifiedChains := tlsInfo.State.VerifiedChains
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return "", status.Error(codes.Unauthenticated, "Client did not present a verified certificate")
+	}
+	commonName := verifiedChains[0][0].Subject.CommonName
+	if commonName == "" {
+		return "", status.Error(codes.Unauthenticated, "Client certificate has no common name")
+	}
+	return commonName, nil
+}
@@ -0,0 +1,135 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type actionCacheIsolatingBlobAccess struct {
+	blobAccess  BlobAccess
+	authorizer  auth.Authorizer
+	perIdentity bool
+}
+
+// NewActionCacheIsolatingBlobAccess creates a decorator for an Action
+// Cache BlobAccess that prevents clients that are not trusted from
+// poisoning the results used by trusted clients. Clients are trusted
+// if they are permitted to perform operation AC_TRUSTED on the
+// instance.
+//
+// Trusted clients access the Action Cache as is. Untrusted clients
+// store results in a separate namespace, derived from the instance
+// name. When reading, they first consult their own namespace, followed
+// by the one used by trusted clients.
+//
+// The namespace of untrusted clients is instance name
+// "<instance>/untrusted", optionally followed by a hexadecimal SHA-256
+// hash of the identity of the client. Hashes are used, as identities
+// may contain characters that are not permitted in instance names.
+func NewActionCacheIsolatingBlobAccess(blobAccess BlobAccess, authorizer auth.Authorizer, perIdentity bool) BlobAccess {
+	return &actionCacheIsolatingBlobAccess{
+		blobAccess:  blobAccess,
+		authorizer:  authorizer,
+		perIdentity: perIdentity,
+	}
+}
+
+// getUntrustedDigest returns the digest under which an action result
+// is stored for the client, or nil if the client is trusted.
+func (ba *actionCacheIsolatingBlobAccess) getUntrustedDigest(ctx context.Context, digest *util.Digest) (*util.Digest, error) {
+	if ba.authorizer.Authorize(ctx, digest.GetInstance(), pb.Operation_AC_TRUSTED) == nil {
+		return nil, nil
+	}
+	components := []string{digest.GetInstance(), "untrusted"}
+	if identity, ok := auth.GetIdentity(ctx); ok && ba.perIdentity {
+		identityHash := sha256.Sum256([]byte(identity))
+		components = append(components, hex.EncodeToString(identityHash[:]))
+	}
+	instance, err := util.CanonicalizeInstanceName(strings.Join(components, "/"))
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to derive instance name for untrusted client")
+	}
+	return digest.NewDigestWithInstance(instance), nil
+}
+
+func (ba *actionCacheIsolatingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	untrustedDigest, err := ba.getUntrustedDigest(ctx, digest)
+	if err != nil {
+		return 0, nil, err
+	}
+	if untrustedDigest != nil {
+		length, r, err := ba.blobAccess.Get(ctx, untrustedDigest)
+		if status.Code(err) != codes.NotFound {
+			return length, r, err
+		}
+	}
+	return ba.blobAccess.Get(ctx, digest)
+}
+
+func (ba *actionCacheIsolatingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	untrustedDigest, err := ba.getUntrustedDigest(ctx, digest)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	if untrustedDigest != nil {
+		return ba.blobAccess.Put(ctx, untrustedDigest, sizeBytes, r)
+	}
+	return ba.blobAccess.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *actionCacheIsolatingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	untrustedDigest, err := ba.getUntrustedDigest(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if untrustedDigest != nil {
+		return ba.blobAccess.Delete(ctx, untrustedDigest)
+	}
+	return ba.blobAccess.Delete(ctx, digest)
+}
+
+func (ba *actionCacheIsolatingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Translate digests to the namespaces of untrusted clients.
+	var untrustedDigests []*util.Digest
+	originalDigests := map[string]*util.Digest{}
+	var trustedDigests []*util.Digest
+	for _, digest := range digests {
+		untrustedDigest, err := ba.getUntrustedDigest(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+		if untrustedDigest == nil {
+			trustedDigests = append(trustedDigests, digest)
+		} else {
+			untrustedDigests = append(untrustedDigests, untrustedDigest)
+			originalDigests[untrustedDigest.GetKey(util.DigestKeyWithInstance)] = digest
+		}
+	}
+
+	// Entries that are missing from the namespaces of untrusted
+	// clients may still be present in the shared namespace.
+	if len(untrustedDigests) > 0 {
+		missing, err := ba.blobAccess.FindMissing(ctx, untrustedDigests)
+		if err != nil {
+			return nil, err
+		}
+		for _, digest := range missing {
+			trustedDigests = append(trustedDigests, originalDigests[digest.GetKey(util.DigestKeyWithInstance)])
+		}
+	}
+	if len(trustedDigests) == 0 {
+		return nil, nil
+	}
+	return ba.blobAccess.FindMissing(ctx, trustedDigests)
+}
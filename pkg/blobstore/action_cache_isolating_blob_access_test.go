@@ -0,0 +1,129 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestActionCacheIsolatingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	bottomBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewActionCacheIsolatingBlobAccess(
+		bottomBlobAccess,
+		auth.NewRuleBasedAuthorizer([]*pb.AuthorizationRule{
+			{
+				Identities: []string{"ci"},
+				Operations: []pb.Operation{pb.Operation_AC_TRUSTED},
+			},
+		}),
+		true)
+	partialDigest := &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}
+	trustedDigest := util.MustNewDigest("debian8", partialDigest)
+	aliceDigest := util.MustNewDigest("debian8/untrusted/2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90", partialDigest)
+	anonymousDigest := util.MustNewDigest("debian8/untrusted", partialDigest)
+	ciCtx := auth.NewContextWithIdentity(ctx, "ci")
+	aliceCtx := auth.NewContextWithIdentity(ctx, "alice")
+
+	// Namespaces of untrusted clients need to be valid instance
+	// names, as they are subject to the same validation as the
+	// instance names provided by clients.
+	for _, digest := range []*util.Digest{aliceDigest, anonymousDigest} {
+		canonical, err := util.CanonicalizeInstanceName(digest.GetInstance())
+		require.NoError(t, err)
+		require.Equal(t, digest.GetInstance(), canonical)
+	}
+
+	t.Run("TrustedPut", func(t *testing.T) {
+		r := ioutil.NopCloser(bytes.NewBufferString("Hello"))
+		bottomBlobAccess.EXPECT().Put(ciCtx, trustedDigest, int64(5), r).Return(nil)
+		require.NoError(t, blobAccess.Put(ciCtx, trustedDigest, 5, r))
+	})
+
+	t.Run("UntrustedPut", func(t *testing.T) {
+		r := ioutil.NopCloser(bytes.NewBufferString("Hello"))
+		bottomBlobAccess.EXPECT().Put(aliceCtx, aliceDigest, int64(5), r).Return(nil)
+		require.NoError(t, blobAccess.Put(aliceCtx, trustedDigest, 5, r))
+
+		r = ioutil.NopCloser(bytes.NewBufferString("Hello"))
+		bottomBlobAccess.EXPECT().Put(ctx, anonymousDigest, int64(5), r).Return(nil)
+		require.NoError(t, blobAccess.Put(ctx, trustedDigest, 5, r))
+	})
+
+	t.Run("TrustedGet", func(t *testing.T) {
+		// Trusted clients should never read results stored by
+		// untrusted clients.
+		bottomBlobAccess.EXPECT().Get(ciCtx, trustedDigest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+		_, _, err := blobAccess.Get(ciCtx, trustedDigest)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	})
+
+	t.Run("UntrustedGetFallback", func(t *testing.T) {
+		// Untrusted clients should first consult their own
+		// namespace, followed by the shared namespace.
+		r := ioutil.NopCloser(bytes.NewBufferString("Hello"))
+		gomock.InOrder(
+			bottomBlobAccess.EXPECT().Get(aliceCtx, aliceDigest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found")),
+			bottomBlobAccess.EXPECT().Get(aliceCtx, trustedDigest).Return(int64(5), r, nil))
+		length, r2, err := blobAccess.Get(aliceCtx, trustedDigest)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), length)
+		require.Equal(t, r, r2)
+	})
+
+	t.Run("UntrustedFindMissing", func(t *testing.T) {
+		otherPartialDigest := &remoteexecution.Digest{
+			Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+			SizeBytes: 7,
+		}
+		gomock.InOrder(
+			bottomBlobAccess.EXPECT().FindMissing(aliceCtx, []*util.Digest{
+				aliceDigest,
+				util.MustNewDigest("debian8/untrusted/2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90", otherPartialDigest),
+			}).Return([]*util.Digest{
+				util.MustNewDigest("debian8/untrusted/2bd806c97f0e00af1a1fc3328fa763a9269723c8db8fac4f93af71db186d6e90", otherPartialDigest),
+			}, nil),
+			bottomBlobAccess.EXPECT().FindMissing(aliceCtx, []*util.Digest{
+				util.MustNewDigest("debian8", otherPartialDigest),
+			}).Return(nil, nil))
+		missing, err := blobAccess.FindMissing(aliceCtx, []*util.Digest{
+			trustedDigest,
+			util.MustNewDigest("debian8", otherPartialDigest),
+		})
+		require.NoError(t, err)
+		require.Empty(t, missing)
+	})
+	t.Run("UntrustedPutEmptyInstance", func(t *testing.T) {
+		r := ioutil.NopCloser(bytes.NewBufferString("Hello"))
+		bottomBlobAccess.EXPECT().Put(ctx, util.MustNewDigest("untrusted", partialDigest), int64(5), r).Return(nil)
+		require.NoError(t, blobAccess.Put(ctx, util.MustNewDigest("", partialDigest), 5, r))
+	})
+
+	t.Run("UntrustedPutInstanceTooLong", func(t *testing.T) {
+		// Instance names that are valid, but would become too
+		// long when turned into a namespace for untrusted
+		// clients, should be rejected.
+		r := ioutil.NopCloser(bytes.NewBufferString("Hello"))
+		err := blobAccess.Put(aliceCtx, util.MustNewDigest(strings.Repeat("a", 150), partialDigest), 5, r)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
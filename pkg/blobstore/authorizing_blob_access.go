@@ -0,0 +1,69 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+type authorizingBlobAccess struct {
+	blobAccess     BlobAccess
+	authorizer     auth.Authorizer
+	readOperation  pb.Operation
+	writeOperation pb.Operation
+}
+
+// NewAuthorizingBlobAccess creates a decorator for BlobAccess that
+// only forwards requests if the client is permitted to perform the
+// operation on the instance of the blob. Get() and FindMissing()
+// require readOperation to be permitted, while Put() and Delete()
+// require writeOperation to be permitted.
+func NewAuthorizingBlobAccess(blobAccess BlobAccess, authorizer auth.Authorizer, readOperation pb.Operation, writeOperation pb.Operation) BlobAccess {
+	return &authorizingBlobAccess{
+		blobAccess:     blobAccess,
+		authorizer:     authorizer,
+		readOperation:  readOperation,
+		writeOperation: writeOperation,
+	}
+}
+
+func (ba *authorizingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	if err := ba.authorizer.Authorize(ctx, digest.GetInstance(), ba.readOperation); err != nil {
+		return 0, nil, err
+	}
+	return ba.blobAccess.Get(ctx, digest)
+}
+
+func (ba *authorizingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if err := ba.authorizer.Authorize(ctx, digest.GetInstance(), ba.writeOperation); err != nil {
+		r.Close()
+		return err
+	}
+	return ba.blobAccess.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *authorizingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	if err := ba.authorizer.Authorize(ctx, digest.GetInstance(), ba.writeOperation); err != nil {
+		return err
+	}
+	return ba.blobAccess.Delete(ctx, digest)
+}
+
+func (ba *authorizingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Only check each instance name once, as requests typically
+	// contain many digests for the same instance.
+	checked := map[string]bool{}
+	for _, digest := range digests {
+		instance := digest.GetInstance()
+		if !checked[instance] {
+			if err := ba.authorizer.Authorize(ctx, instance, ba.readOperation); err != nil {
+				return nil, err
+			}
+			checked[instance] = true
+		}
+	}
+	return ba.blobAccess.FindMissing(ctx, digests)
+}
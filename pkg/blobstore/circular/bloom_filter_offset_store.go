@@ -0,0 +1,179 @@
+package circular
+
+import (
+	"encoding/binary"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	bloomFilterOffsetStoreGetsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "circular_bloom_filter_offset_store_gets_total",
+			Help:      "Number of offset store lookups, split by whether the Bloom filter was able to reject them.",
+		},
+		[]string{"result"})
+	bloomFilterOffsetStoreGetsTotalRejected = bloomFilterOffsetStoreGetsTotal.WithLabelValues("Rejected")
+	bloomFilterOffsetStoreGetsTotalPassed   = bloomFilterOffsetStoreGetsTotal.WithLabelValues("Passed")
+)
+
+func init() {
+	prometheus.MustRegister(bloomFilterOffsetStoreGetsTotal)
+}
+
+// bloomFilterGeneration is a Bloom filter containing the digests of
+// blobs stored in a contiguous region of the data file.
+type bloomFilterGeneration struct {
+	bits        []uint64
+	startOffset uint64
+	// The highest offset of any blob in this generation. Once the
+	// read cursor has moved past it, all blobs in this generation
+	// have been invalidated.
+	maximumOffset uint64
+}
+
+func newBloomFilterGeneration(bitsCount uint64, startOffset uint64) *bloomFilterGeneration {
+	return &bloomFilterGeneration{
+		bits:          make([]uint64, (bitsCount+63)/64),
+		startOffset:   startOffset,
+		maximumOffset: startOffset,
+	}
+}
+
+type bloomFilterOffsetStore struct {
+	backend             OffsetStore
+	generationSizeBytes uint64
+	bitsPerGeneration   uint64
+	hashFunctionsCount  uint32
+
+	// Generations, ordered from oldest to newest. Puts are always
+	// applied against the last generation.
+	generations []*bloomFilterGeneration
+}
+
+// NewBloomFilterOffsetStore is an adapter for OffsetStore that keeps
+// track of the digests of all blobs in the offset store using Bloom
+// filters. Calls to Get() for digests that are definitely absent are
+// answered without consulting the backend. This significantly reduces
+// the number of read operations on underlying storage for
+// FindMissing() calls, which typically contain many digests of blobs
+// that are absent.
+//
+// As Bloom filters don't support removal, a sequence of filters
+// (generations) is kept, each covering generationSizeBytes of the
+// data file. Generations are discarded once the read cursor moves past
+// all blobs that they contain. Memory usage is thus bounded by
+// approximately (dataSize / generationSizeBytes + 2) *
+// bitsPerGeneration / 8 bytes.
+//
+// The Bloom filter is initially populated with all records in an offset
+// file created by NewFileOffsetStore that are contained within the
+// cursors, which is expected to be the backend's underlying storage.
+// No records may be added to the offset file through other means.
+func NewBloomFilterOffsetStore(backend OffsetStore, offsetFile ReadWriterAt, offsetFileSize uint64, cursors Cursors, generationSizeBytes uint64, bitsPerGeneration uint64, hashFunctionsCount uint32) (OffsetStore, error) {
+	os := &bloomFilterOffsetStore{
+		backend:             backend,
+		generationSizeBytes: generationSizeBytes,
+		bitsPerGeneration:   bitsPerGeneration,
+		hashFunctionsCount:  hashFunctionsCount,
+	}
+
+	// Records in the offset file are not ordered by offset. Place
+	// them all in a single generation, which is discarded once the
+	// read cursor has moved past all of them.
+	initialGeneration := newBloomFilterGeneration(bitsPerGeneration, cursors.Read)
+	fileOffsetStore := &fileOffsetStore{
+		file: offsetFile,
+		size: offsetFileSize,
+	}
+	if err := fileOffsetStore.forEachRecord(func(record offsetRecord, position int64) error {
+		offset := record.getOffset()
+		if cursors.Contains(offset, record.getLength()) {
+			var digest simpleDigest
+			copy(digest[:], record[:])
+			os.addToGeneration(initialGeneration, digest, offset)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	os.generations = []*bloomFilterGeneration{
+		initialGeneration,
+		newBloomFilterGeneration(bitsPerGeneration, cursors.Write),
+	}
+	return os, nil
+}
+
+// getBitIndices computes the positions of the bits in a Bloom filter
+// that correspond to a digest. As the digest already contains a
+// cryptographic hash, its bytes can be used directly, combined using
+// double hashing.
+func (os *bloomFilterOffsetStore) getBitIndices(digest simpleDigest, callback func(index uint64) bool) bool {
+	h1 := binary.LittleEndian.Uint64(digest[:]) ^ binary.LittleEndian.Uint64(digest[len(digest)-8:])
+	h2 := binary.LittleEndian.Uint64(digest[8:]) | 1
+	for i := uint32(0); i < os.hashFunctionsCount; i++ {
+		if !callback((h1 + uint64(i)*h2) % os.bitsPerGeneration) {
+			return false
+		}
+	}
+	return true
+}
+
+func (os *bloomFilterOffsetStore) addToGeneration(generation *bloomFilterGeneration, digest simpleDigest, offset uint64) {
+	os.getBitIndices(digest, func(index uint64) bool {
+		generation.bits[index/64] |= 1 << (index % 64)
+		return true
+	})
+	if generation.maximumOffset < offset {
+		generation.maximumOffset = offset
+	}
+}
+
+func (os *bloomFilterOffsetStore) generationContains(generation *bloomFilterGeneration, digest simpleDigest) bool {
+	return os.getBitIndices(digest, func(index uint64) bool {
+		return generation.bits[index/64]&(1<<(index%64)) != 0
+	})
+}
+
+// removeStaleGenerations discards all generations that only contain
+// blobs that have been invalidated. The last generation is always
+// retained, as it is used for insertions.
+func (os *bloomFilterOffsetStore) removeStaleGenerations(cursors Cursors) {
+	removed := 0
+	for removed < len(os.generations)-1 && os.generations[removed].maximumOffset < cursors.Read {
+		os.generations[removed] = nil
+		removed++
+	}
+	os.generations = os.generations[removed:]
+}
+
+func (os *bloomFilterOffsetStore) Get(digest *util.Digest, cursors Cursors) (uint64, int64, bool, error) {
+	os.removeStaleGenerations(cursors)
+	simpleDigest := newSimpleDigest(digest)
+	for _, generation := range os.generations {
+		if os.generationContains(generation, simpleDigest) {
+			bloomFilterOffsetStoreGetsTotalPassed.Inc()
+			return os.backend.Get(digest, cursors)
+		}
+	}
+	bloomFilterOffsetStoreGetsTotalRejected.Inc()
+	return 0, 0, false, nil
+}
+
+func (os *bloomFilterOffsetStore) Put(digest *util.Digest, offset uint64, length int64, cursors Cursors) error {
+	if err := os.backend.Put(digest, offset, length, cursors); err != nil {
+		return err
+	}
+
+	os.removeStaleGenerations(cursors)
+	generation := os.generations[len(os.generations)-1]
+	if offset >= generation.startOffset+os.generationSizeBytes {
+		generation = newBloomFilterGeneration(os.bitsPerGeneration, offset)
+		os.generations = append(os.generations, generation)
+	}
+	os.addToGeneration(generation, newSimpleDigest(digest), offset)
+	return nil
+}
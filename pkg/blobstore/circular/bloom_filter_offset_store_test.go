@@ -0,0 +1,174 @@
+package circular_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func newBloomFilterTestDigest(i int) *util.Digest {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("Blob %d", i)))
+	return util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hash[:]),
+		SizeBytes: 10,
+	})
+}
+
+func TestBloomFilterOffsetStoreNoFalseNegatives(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Use a Bloom filter that is small enough to yield false
+	// positives, spreading the blobs across many generations.
+	backend := mock.NewMockOffsetStore(ctrl)
+	offsetStore, err := circular.NewBloomFilterOffsetStore(backend, newMemoryFile(offsetFileSize), offsetFileSize, circular.Cursors{}, 100, 64, 3)
+	require.NoError(t, err)
+
+	cursors := circular.Cursors{Read: 0, Write: 1000}
+	for i := 0; i < 100; i++ {
+		digest := newBloomFilterTestDigest(i)
+		backend.EXPECT().Put(digest, uint64(i*10), int64(10), cursors).Return(nil)
+		require.NoError(t, offsetStore.Put(digest, uint64(i*10), 10, cursors))
+	}
+
+	// All blobs that were stored should be forwarded to the
+	// backend.
+	for i := 0; i < 100; i++ {
+		digest := newBloomFilterTestDigest(i)
+		backend.EXPECT().Get(digest, cursors).Return(uint64(i*10), int64(10), true, nil)
+		offset, length, found, err := offsetStore.Get(digest, cursors)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, uint64(i*10), offset)
+		require.Equal(t, int64(10), length)
+	}
+}
+
+func TestBloomFilterOffsetStoreRejection(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	backend := mock.NewMockOffsetStore(ctrl)
+	offsetStore, err := circular.NewBloomFilterOffsetStore(backend, newMemoryFile(offsetFileSize), offsetFileSize, circular.Cursors{}, 100, 1<<16, 3)
+	require.NoError(t, err)
+
+	// Lookups against an empty Bloom filter should not be
+	// forwarded to the backend.
+	cursors := circular.Cursors{Read: 0, Write: 1000}
+	_, _, found, err := offsetStore.Get(newBloomFilterTestDigest(1), cursors)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	// The same holds for digests that were not stored.
+	backend.EXPECT().Put(newBloomFilterTestDigest(1), uint64(0), int64(10), cursors).Return(nil)
+	require.NoError(t, offsetStore.Put(newBloomFilterTestDigest(1), 0, 10, cursors))
+	for i := 2; i < 100; i++ {
+		_, _, found, err := offsetStore.Get(newBloomFilterTestDigest(i), cursors)
+		require.NoError(t, err)
+		require.False(t, found)
+	}
+}
+
+func TestBloomFilterOffsetStoreGenerations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	backend := mock.NewMockOffsetStore(ctrl)
+	offsetStore, err := circular.NewBloomFilterOffsetStore(backend, newMemoryFile(offsetFileSize), offsetFileSize, circular.Cursors{}, 100, 1<<16, 3)
+	require.NoError(t, err)
+
+	// Store blobs in three generations, covering offsets [0, 100),
+	// [150, 250) and [250, 350).
+	cursors := circular.Cursors{Read: 0, Write: 300}
+	for _, entry := range []struct {
+		blob   int
+		offset uint64
+	}{
+		{1, 0},
+		{2, 90},
+		{3, 150},
+		{4, 250},
+	} {
+		digest := newBloomFilterTestDigest(entry.blob)
+		backend.EXPECT().Put(digest, entry.offset, int64(10), cursors).Return(nil)
+		require.NoError(t, offsetStore.Put(digest, entry.offset, 10, cursors))
+	}
+
+	getBlobs := func(cursors circular.Cursors, present []int, absent []int) {
+		for _, blob := range present {
+			digest := newBloomFilterTestDigest(blob)
+			backend.EXPECT().Get(digest, cursors).Return(uint64(0), int64(10), true, nil)
+			_, _, found, err := offsetStore.Get(digest, cursors)
+			require.NoError(t, err)
+			require.True(t, found)
+		}
+		for _, blob := range absent {
+			_, _, found, err := offsetStore.Get(newBloomFilterTestDigest(blob), cursors)
+			require.NoError(t, err)
+			require.False(t, found, "Blob %d", blob)
+		}
+	}
+
+	// Generations should only be discarded once the read cursor
+	// has moved past all blobs contained in them.
+	getBlobs(circular.Cursors{Read: 0, Write: 300}, []int{1, 2, 3, 4}, nil)
+	getBlobs(circular.Cursors{Read: 90, Write: 390}, []int{1, 2, 3, 4}, nil)
+	getBlobs(circular.Cursors{Read: 91, Write: 391}, []int{3, 4}, []int{1, 2})
+	getBlobs(circular.Cursors{Read: 251, Write: 551}, []int{4}, []int{1, 2, 3})
+
+	// The last generation is retained, even if all blobs in it have
+	// been invalidated, as it is used for insertions.
+	getBlobs(circular.Cursors{Read: 1000, Write: 1300}, []int{4}, []int{1, 2, 3})
+	cursors = circular.Cursors{Read: 1000, Write: 1300}
+	backend.EXPECT().Put(newBloomFilterTestDigest(5), uint64(1200), int64(10), cursors).Return(nil)
+	require.NoError(t, offsetStore.Put(newBloomFilterTestDigest(5), 1200, 10, cursors))
+	getBlobs(circular.Cursors{Read: 1001, Write: 1301}, []int{5}, []int{1, 2, 3, 4})
+}
+
+func TestBloomFilterOffsetStoreStartup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Populate an offset file with a couple of records.
+	offsetFile := newMemoryFile(offsetFileSize)
+	fileOffsetStore := circular.NewFileOffsetStore(offsetFile, offsetFileSize)
+	putCursors := circular.Cursors{Read: 0, Write: 100}
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, fileOffsetStore.Put(newBloomFilterTestDigest(i), uint64(i*20), 10, putCursors))
+	}
+
+	// Records that are no longer contained within the cursors
+	// should not be added to the Bloom filter upon startup.
+	backend := mock.NewMockOffsetStore(ctrl)
+	startupCursors := circular.Cursors{Read: 40, Write: 100}
+	offsetStore, err := circular.NewBloomFilterOffsetStore(backend, offsetFile, offsetFileSize, startupCursors, 100, 1<<16, 3)
+	require.NoError(t, err)
+
+	_, _, found, err := offsetStore.Get(newBloomFilterTestDigest(1), startupCursors)
+	require.NoError(t, err)
+	require.False(t, found)
+	for i := 2; i <= 4; i++ {
+		digest := newBloomFilterTestDigest(i)
+		backend.EXPECT().Get(digest, startupCursors).Return(uint64(i*20), int64(10), true, nil)
+		_, _, found, err := offsetStore.Get(digest, startupCursors)
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+
+	// The initial generation is discarded once the read cursor
+	// moves past all records that were loaded.
+	laterCursors := circular.Cursors{Read: 81, Write: 181}
+	for i := 1; i <= 4; i++ {
+		_, _, found, err := offsetStore.Get(newBloomFilterTestDigest(i), laterCursors)
+		require.NoError(t, err)
+		require.False(t, found)
+	}
+}
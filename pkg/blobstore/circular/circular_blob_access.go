@@ -2,7 +2,6 @@ package circular
 
 import (
 	"context"
-	"errors"
 	"io"
 	"sync"
 
@@ -26,6 +25,7 @@ type OffsetStore interface {
 type DataStore interface {
 	Put(r io.Reader, offset uint64) error
 	Get(offset uint64, size int64) io.ReadCloser
+	SetLayout(layout DataLayout)
 }
 
 // StateStore is where global metadata of the circular storage backend
@@ -35,22 +35,46 @@ type StateStore interface {
 	GetCursors() Cursors
 	Allocate(sizeBytes int64) (uint64, error)
 	Invalidate(offset uint64, sizeBytes int64) error
+	Grow(dataSize uint64) (DataLayout, error)
+}
+
+// GrowableBlobAccess is a BlobAccess backed by circular storage, whose
+// data store can be grown while in use, without discarding any data.
+type GrowableBlobAccess interface {
+	blobstore.BlobAccess
+
+	// Grow the data store to a new size. The caller must ensure
+	// that the data store is capable of storing data up to the new
+	// size before calling this function (e.g., by appending a file
+	// to a ConcatenatedReadWriterAt).
+	Grow(dataSize uint64) error
 }
 
 type circularBlobAccess struct {
 	// Fields that are constant or lockless.
 	dataStore DataStore
 
-	// Fields protected by the lock.
-	lock        sync.Mutex
+	// Fields protected by the state lock. This lock is only held
+	// for short amounts of time to allocate space and to obtain the
+	// cursors, so that copying data in and out of the data store may
+	// happen in parallel.
+	stateLock  sync.Mutex
+	stateStore StateStore
+
+	// Fields protected by the offset lock.
+	offsetLock  sync.Mutex
 	offsetStore OffsetStore
-	stateStore  StateStore
 }
 
 // NewCircularBlobAccess creates a new circular storage backend. Instead
 // of writing data to storage directly, all three storage files are
 // injected through separate interfaces.
-func NewCircularBlobAccess(offsetStore OffsetStore, dataStore DataStore, stateStore StateStore) blobstore.BlobAccess {
+//
+// Data is copied into and out of the data store without holding any
+// locks. Writers reserve space in the data store up front. Readers
+// validate that the data they read has not been overwritten by
+// comparing its location against the cursors after every read.
+func NewCircularBlobAccess(offsetStore OffsetStore, dataStore DataStore, stateStore StateStore) GrowableBlobAccess {
 	return &circularBlobAccess{
 		offsetStore: offsetStore,
 		dataStore:   dataStore,
@@ -58,15 +82,31 @@ func NewCircularBlobAccess(offsetStore OffsetStore, dataStore DataStore, stateSt
 	}
 }
 
-func (ba *circularBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
-	ba.lock.Lock()
+func (ba *circularBlobAccess) getCursors() Cursors {
+	ba.stateLock.Lock()
 	cursors := ba.stateStore.GetCursors()
+	ba.stateLock.Unlock()
+	return cursors
+}
+
+func (ba *circularBlobAccess) getOffset(digest *util.Digest, cursors Cursors) (uint64, int64, bool, error) {
+	ba.offsetLock.Lock()
 	offset, length, ok, err := ba.offsetStore.Get(digest, cursors)
-	ba.lock.Unlock()
+	ba.offsetLock.Unlock()
+	return offset, length, ok, err
+}
+
+func (ba *circularBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	offset, length, ok, err := ba.getOffset(digest, ba.getCursors())
 	if err != nil {
 		return 0, nil, err
 	} else if ok {
-		return length, ba.dataStore.Get(offset, length), nil
+		return length, &validatingReader{
+			ReadCloser: ba.dataStore.Get(offset, length),
+			blobAccess: ba,
+			offset:     offset,
+			length:     length,
+		}, nil
 	}
 	return 0, nil, status.Errorf(codes.NotFound, "Blob not found")
 }
@@ -75,9 +115,9 @@ func (ba *circularBlobAccess) Put(ctx context.Context, digest *util.Digest, size
 	defer r.Close()
 
 	// Allocate space in the data store.
-	ba.lock.Lock()
+	ba.stateLock.Lock()
 	offset, err := ba.stateStore.Allocate(sizeBytes)
-	ba.lock.Unlock()
+	ba.stateLock.Unlock()
 	if err != nil {
 		return err
 	}
@@ -87,35 +127,37 @@ func (ba *circularBlobAccess) Put(ctx context.Context, digest *util.Digest, size
 		return err
 	}
 
-	ba.lock.Lock()
-	cursors := ba.stateStore.GetCursors()
-	if cursors.Contains(offset, sizeBytes) {
-		err = ba.offsetStore.Put(digest, offset, sizeBytes, cursors)
-	} else {
-		err = errors.New("Data became stale before write completed")
+	// Only make the data visible if it has not been overwritten by
+	// other writers in the meantime. Entries in the offset store
+	// are validated against the cursors upon access, meaning it is
+	// safe for the cursors to progress while inserting.
+	cursors := ba.getCursors()
+	if !cursors.Contains(offset, sizeBytes) {
+		return status.Error(codes.Unavailable, "Data became stale before write completed")
 	}
-	ba.lock.Unlock()
+	ba.offsetLock.Lock()
+	err = ba.offsetStore.Put(digest, offset, sizeBytes, cursors)
+	ba.offsetLock.Unlock()
 	return err
 }
 
 func (ba *circularBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
-	ba.lock.Lock()
-	defer ba.lock.Unlock()
-
-	cursors := ba.stateStore.GetCursors()
-	if offset, length, ok, err := ba.offsetStore.Get(digest, cursors); err != nil {
+	if offset, length, ok, err := ba.getOffset(digest, ba.getCursors()); err != nil {
 		return err
 	} else if ok {
+		ba.stateLock.Lock()
+		defer ba.stateLock.Unlock()
 		return ba.stateStore.Invalidate(offset, length)
 	}
 	return nil
 }
 
 func (ba *circularBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	ba.lock.Lock()
-	defer ba.lock.Unlock()
+	cursors := ba.getCursors()
+
+	ba.offsetLock.Lock()
+	defer ba.offsetLock.Unlock()
 
-	cursors := ba.stateStore.GetCursors()
 	var missingDigests []*util.Digest
 	for _, digest := range digests {
 		if _, _, ok, err := ba.offsetStore.Get(digest, cursors); err != nil {
@@ -126,3 +168,40 @@ func (ba *circularBlobAccess) FindMissing(ctx context.Context, digests []*util.D
 	}
 	return missingDigests, nil
 }
+
+func (ba *circularBlobAccess) Grow(dataSize uint64) error {
+	// Hold the state lock, so that no space is allocated while the
+	// layout of the state store and data store differ. Reads and
+	// writes of data that was allocated previously may continue,
+	// as growing the data store does not change its location.
+	ba.stateLock.Lock()
+	defer ba.stateLock.Unlock()
+	layout, err := ba.stateStore.Grow(dataSize)
+	if err != nil {
+		return err
+	}
+	ba.dataStore.SetLayout(layout)
+	return nil
+}
+
+// validatingReader is returned by circularBlobAccess.Get(). As data is
+// read from the data store without holding any locks, it may be
+// overwritten by writers while being read. This reader checks the
+// cursors after every read to detect this.
+type validatingReader struct {
+	io.ReadCloser
+	blobAccess *circularBlobAccess
+	offset     uint64
+	length     int64
+}
+
+func (r *validatingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		cursors := r.blobAccess.getCursors()
+		if !cursors.Contains(r.offset, r.length) {
+			return 0, status.Errorf(codes.NotFound, "Blob was overwritten while being read")
+		}
+	}
+	return n, err
+}
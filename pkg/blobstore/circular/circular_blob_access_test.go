@@ -0,0 +1,173 @@
+package circular_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestBlob(goroutine int, iteration int) ([]byte, *util.Digest) {
+	data := bytes.Repeat([]byte(fmt.Sprintf("%d-%d;", goroutine, iteration)), 1+(goroutine*iteration)%100)
+	hash := sha256.Sum256(data)
+	return data, util.MustNewDigest("", &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hash[:]),
+		SizeBytes: int64(len(data)),
+	})
+}
+
+func TestCircularBlobAccessConcurrentPutGet(t *testing.T) {
+	ctx := context.Background()
+
+	// Data is copied in and out of the data file without holding
+	// any locks. Use an actual file, as concurrent access to an
+	// in-memory file would be reported as a data race.
+	dataFile, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "data")
+	require.NoError(t, err)
+	defer os.Remove(dataFile.Name())
+	defer dataFile.Close()
+
+	// Use a data file that is small compared to the total amount
+	// of data written, so that it wraps around many times.
+	const dataSize = 16 * 1024
+	stateStore, dataLayout, err := circular.NewFileStateStore(newMemoryFile(40), dataSize)
+	require.NoError(t, err)
+	blobAccess := circular.NewCircularBlobAccess(
+		circular.NewFileOffsetStore(newMemoryFile(offsetFileSize), offsetFileSize),
+		circular.NewFileDataStore(dataFile, dataLayout),
+		circular.NewPositiveSizedBlobStateStore(
+			circular.NewBulkAllocatingStateStore(stateStore, 256)))
+
+	// Let writers store blobs and immediately read them back. Blobs
+	// may have been overwritten by other writers in the meantime,
+	// but data that is returned should always be intact.
+	var wg sync.WaitGroup
+	for goroutine := 0; goroutine < 8; goroutine++ {
+		wg.Add(1)
+		go func(goroutine int) {
+			defer wg.Done()
+			for iteration := 0; iteration < 200; iteration++ {
+				data, digest := newTestBlob(goroutine, iteration)
+				if err := blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))); err != nil {
+					require.Equal(t, status.Error(codes.Unavailable, "Data became stale before write completed"), err)
+					continue
+				}
+
+				sizeBytes, r, err := blobAccess.Get(ctx, digest)
+				if status.Code(err) == codes.NotFound {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, digest.GetSizeBytes(), sizeBytes)
+				readData, err := ioutil.ReadAll(r)
+				r.Close()
+				if status.Code(err) == codes.NotFound {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, data, readData)
+			}
+		}(goroutine)
+	}
+	wg.Wait()
+
+	// Blobs written most recently should still be present.
+	data, digest := newTestBlob(0, 199)
+	require.NoError(t, blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))))
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Blobs written at the start should have been overwritten.
+	_, digest = newTestBlob(1, 1)
+	_, _, err = blobAccess.Get(ctx, digest)
+	require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+}
+
+func TestCircularBlobAccessGrowWhileInUse(t *testing.T) {
+	ctx := context.Background()
+
+	var dataFiles []*os.File
+	for i := 0; i < 3; i++ {
+		dataFile, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "data")
+		require.NoError(t, err)
+		defer os.Remove(dataFile.Name())
+		defer dataFile.Close()
+		dataFiles = append(dataFiles, dataFile)
+	}
+
+	const dataFileSize = 16 * 1024
+	stateStore, dataLayout, err := circular.NewFileStateStore(newMemoryFile(40), dataFileSize)
+	require.NoError(t, err)
+	dataFile := circular.NewConcatenatedReadWriterAt([]circular.ReadWriterAt{dataFiles[0]}, []uint64{dataFileSize})
+	blobAccess := circular.NewCircularBlobAccess(
+		circular.NewFileOffsetStore(newMemoryFile(offsetFileSize), offsetFileSize),
+		circular.NewFileDataStore(dataFile, dataLayout),
+		circular.NewPositiveSizedBlobStateStore(
+			circular.NewBulkAllocatingStateStore(stateStore, 256)))
+
+	// Grow the data file while blobs are being written and read.
+	// Data that is returned should always be intact.
+	var wg sync.WaitGroup
+	for goroutine := 0; goroutine < 8; goroutine++ {
+		wg.Add(1)
+		go func(goroutine int) {
+			defer wg.Done()
+			for iteration := 0; iteration < 200; iteration++ {
+				data, digest := newTestBlob(goroutine, iteration)
+				if err := blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))); err != nil {
+					require.Equal(t, status.Error(codes.Unavailable, "Data became stale before write completed"), err)
+					continue
+				}
+
+				sizeBytes, r, err := blobAccess.Get(ctx, digest)
+				if status.Code(err) == codes.NotFound {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, digest.GetSizeBytes(), sizeBytes)
+				readData, err := ioutil.ReadAll(r)
+				r.Close()
+				if status.Code(err) == codes.NotFound {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, data, readData)
+			}
+		}(goroutine)
+	}
+	dataFile.Append(dataFiles[1], dataFileSize)
+	require.NoError(t, blobAccess.Grow(2*dataFileSize))
+	wg.Wait()
+
+	// Blobs written prior to growing the data file should remain
+	// available afterwards.
+	data, digest := newTestBlob(0, 199)
+	require.NoError(t, blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))))
+	dataFile.Append(dataFiles[2], dataFileSize)
+	require.NoError(t, blobAccess.Grow(3*dataFileSize))
+	_, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	readData, err := ioutil.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	require.Equal(t, data, readData)
+
+	// The data file cannot be shrunk, nor can it be grown again
+	// while blobs written prior to the last growth remain.
+	require.Equal(t, codes.InvalidArgument, status.Code(blobAccess.Grow(dataFileSize)))
+	require.Equal(t, codes.FailedPrecondition, status.Code(blobAccess.Grow(4*dataFileSize)))
+}
@@ -0,0 +1,94 @@
+package circular
+
+import (
+	"io"
+	"sync"
+)
+
+// ConcatenatedReadWriterAt is a ReadWriterAt that concatenates multiple
+// files of fixed sizes.
+type ConcatenatedReadWriterAt interface {
+	ReadWriterAt
+
+	// Append a file, causing the total size to grow by sizeBytes.
+	Append(file ReadWriterAt, sizeBytes uint64)
+}
+
+type concatenatedReadWriterAt struct {
+	lock  sync.RWMutex
+	files []ReadWriterAt
+	sizes []uint64
+}
+
+// NewConcatenatedReadWriterAt creates a ReadWriterAt that concatenates
+// multiple files of fixed sizes. This can be used to spread the data
+// file of the circular storage backend across multiple block devices.
+//
+// Files may be appended to the list without affecting the positions of
+// data stored in the existing files. In combination with DataLayout,
+// this allows the data file to be grown without discarding its
+// contents, even while in use.
+func NewConcatenatedReadWriterAt(files []ReadWriterAt, sizes []uint64) ConcatenatedReadWriterAt {
+	return &concatenatedReadWriterAt{
+		files: files,
+		sizes: sizes,
+	}
+}
+
+func (rw *concatenatedReadWriterAt) Append(file ReadWriterAt, sizeBytes uint64) {
+	rw.lock.Lock()
+	rw.files = append(rw.files, file)
+	rw.sizes = append(rw.sizes, sizeBytes)
+	rw.lock.Unlock()
+}
+
+// forEachFile splits up an operation of a given length at a given
+// offset into operations against individual files.
+func (rw *concatenatedReadWriterAt) forEachFile(length int, off int64, callback func(file ReadWriterAt, start int, end int, fileOff int64) (int, error)) (int, error) {
+	rw.lock.RLock()
+	defer rw.lock.RUnlock()
+
+	n := 0
+	for i, file := range rw.files {
+		if n == length {
+			break
+		}
+		size := int64(rw.sizes[i])
+		if off >= size {
+			off -= size
+			continue
+		}
+		chunk := length - n
+		if int64(chunk) > size-off {
+			chunk = int(size - off)
+		}
+		nChunk, err := callback(file, n, n+chunk, off)
+		n += nChunk
+		if err != nil {
+			return n, err
+		}
+		off = 0
+	}
+	if n < length {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (rw *concatenatedReadWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	return rw.forEachFile(len(p), off, func(file ReadWriterAt, start int, end int, fileOff int64) (int, error) {
+		n, err := file.ReadAt(p[start:end], fileOff)
+		if err == io.EOF && n == end-start {
+			// Reads up to the end of an individual file
+			// should not terminate the read.
+			err = nil
+		}
+		return n, err
+	})
+}
+
+func (rw *concatenatedReadWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return rw.forEachFile(len(p), off, func(file ReadWriterAt, start int, end int, fileOff int64) (int, error) {
+		return file.WriteAt(p[start:end], fileOff)
+	})
+}
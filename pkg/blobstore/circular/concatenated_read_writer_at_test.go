@@ -0,0 +1,141 @@
+package circular_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcatenatedReadWriterAt(t *testing.T) {
+	// Files may be larger than the amount of space used.
+	files := []memoryFile{newMemoryFile(4), newMemoryFile(8), newMemoryFile(3)}
+	rw := circular.NewConcatenatedReadWriterAt(
+		[]circular.ReadWriterAt{files[0], files[1], files[2]},
+		[]uint64{4, 6, 3})
+
+	t.Run("WriteAcrossFiles", func(t *testing.T) {
+		n, err := rw.WriteAt([]byte("abcdefghijklm"), 0)
+		require.NoError(t, err)
+		require.Equal(t, 13, n)
+		require.Equal(t, memoryFile("abcd"), files[0])
+		require.Equal(t, memoryFile("efghij\x00\x00"), files[1])
+		require.Equal(t, memoryFile("klm"), files[2])
+	})
+
+	for _, entry := range []struct {
+		name   string
+		offset int64
+		length int
+		data   string
+	}{
+		{"WithinFirstFile", 1, 2, "bc"},
+		{"UpToEndOfFile", 2, 2, "cd"},
+		{"StartOfSecondFile", 4, 3, "efg"},
+		{"AcrossOneBoundary", 3, 3, "def"},
+		{"AcrossTwoBoundaries", 2, 10, "cdefghijkl"},
+		{"LastFile", 10, 3, "klm"},
+	} {
+		t.Run(entry.name, func(t *testing.T) {
+			p := make([]byte, entry.length)
+			n, err := rw.ReadAt(p, entry.offset)
+			require.NoError(t, err)
+			require.Equal(t, entry.length, n)
+			require.Equal(t, entry.data, string(p))
+		})
+	}
+
+	t.Run("WriteAtBoundary", func(t *testing.T) {
+		n, err := rw.WriteAt([]byte("XY"), 9)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		require.Equal(t, memoryFile("efghiX\x00\x00"), files[1])
+		require.Equal(t, memoryFile("Ylm"), files[2])
+	})
+
+	t.Run("ReadBeyondEnd", func(t *testing.T) {
+		p := make([]byte, 4)
+		n, err := rw.ReadAt(p, 11)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, 2, n)
+		require.Equal(t, "lm", string(p[:n]))
+
+		n, err = rw.ReadAt(p, 13)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, 0, n)
+	})
+
+	t.Run("WriteBeyondEnd", func(t *testing.T) {
+		n, err := rw.WriteAt([]byte("zzz"), 12)
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, memoryFile("Ylz"), files[2])
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		// Appending a file should allow writes beyond the
+		// previous end, without affecting existing data.
+		file := newMemoryFile(4)
+		rw.Append(file, 4)
+		n, err := rw.WriteAt([]byte("zzzz"), 12)
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+		require.Equal(t, memoryFile("Ylz"), files[2])
+		require.Equal(t, memoryFile("zzz\x00"), file)
+
+		p := make([]byte, 8)
+		n, err = rw.ReadAt(p, 8)
+		require.NoError(t, err)
+		require.Equal(t, 8, n)
+		require.Equal(t, "iXYlzzzz", string(p))
+	})
+}
+
+func readAllFromDataStore(t *testing.T, dataStore circular.DataStore, offset uint64, size int64) string {
+	data, err := ioutil.ReadAll(dataStore.Get(offset, size))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestConcatenatedReadWriterAtDataLayoutTransition(t *testing.T) {
+	// Grow a data file from a single file of 10 bytes to two files
+	// of 10 bytes. Data written before the transition should
+	// remain accessible until it is overwritten, while data written
+	// afterwards may span both files.
+	files := []memoryFile{newMemoryFile(10), newMemoryFile(10)}
+	before := circular.NewFileDataStore(
+		circular.NewConcatenatedReadWriterAt([]circular.ReadWriterAt{files[0]}, []uint64{10}),
+		circular.DataLayout{Size: 10})
+	require.NoError(t, before.Put(bytes.NewBufferString("0123456"), 0))
+
+	layout := circular.DataLayout{Size: 10}
+	require.True(t, layout.Resize(20, 7))
+	require.Equal(t, circular.DataLayout{Base: 10, Size: 20, PreviousSize: 10}, layout)
+	after := circular.NewFileDataStore(
+		circular.NewConcatenatedReadWriterAt([]circular.ReadWriterAt{files[0], files[1]}, []uint64{10, 10}),
+		layout)
+	require.Equal(t, "0123456", readAllFromDataStore(t, after, 0, 7))
+
+	// Writes below the base wrap around within the previous ring.
+	require.NoError(t, after.Put(bytes.NewBufferString("abc"), 7))
+	require.Equal(t, "abc", readAllFromDataStore(t, after, 7, 3))
+
+	// Writes starting at the base use the new ring, overwriting
+	// data at the start of the first file and crossing into the
+	// second file.
+	require.NoError(t, after.Put(bytes.NewBufferString("ABCDEFGHIJKL"), 10))
+	require.Equal(t, "ABCDEFGHIJKL", readAllFromDataStore(t, after, 10, 12))
+	require.Equal(t, memoryFile("ABCDEFGHIJ"), files[0])
+	require.Equal(t, memoryFile("KL\x00\x00\x00\x00\x00\x00\x00\x00"), files[1])
+	require.Equal(t, uint64(10), layout.GetMinimumReadCursor(22))
+
+	// Writes wrapping around the new ring continue at the start
+	// of the first file.
+	require.NoError(t, after.Put(bytes.NewBufferString("mnopqrstuvwx"), 22))
+	require.Equal(t, "mnopqrstuvwx", readAllFromDataStore(t, after, 22, 12))
+	require.Equal(t, memoryFile("uvwxEFGHIJ"), files[0])
+	require.Equal(t, memoryFile("KLmnopqrst"), files[1])
+}
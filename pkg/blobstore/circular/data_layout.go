@@ -0,0 +1,85 @@
+package circular
+
+// DataLayout describes how offsets of blobs map to positions within
+// the data file. In the common case, the data file is used as a ring of
+// a fixed size, meaning the position of a blob is its offset modulo the
+// size of the data file.
+//
+// To allow the data file to grow without discarding its contents, the
+// layout may be in a transitional state. The size of the ring is then
+// increased starting at offset Base, which is chosen such that it maps
+// to the start of the data file in both the previous and the new ring.
+// Blobs at offsets below Base continue to use the previous ring, until
+// they have all been overwritten.
+type DataLayout struct {
+	Base         uint64
+	Size         uint64
+	PreviousSize uint64
+}
+
+// getPosition returns the position within the data file at which data
+// at a given offset is stored, together with the size of the ring to
+// which it belongs.
+func (l *DataLayout) getPosition(offset uint64) (uint64, uint64) {
+	if offset < l.Base && l.PreviousSize > 0 {
+		return (l.PreviousSize - (l.Base-offset)%l.PreviousSize) % l.PreviousSize, l.PreviousSize
+	}
+	return (offset - l.Base) % l.Size, l.Size
+}
+
+// getMinimumReadCursor returns the lowest read cursor for which all
+// data between the read and write cursors is intact. Data below it has
+// been overwritten.
+func (l *DataLayout) getMinimumReadCursor(writeCursor uint64) uint64 {
+	if l.PreviousSize > 0 {
+		if writeCursor <= l.Base+l.PreviousSize {
+			// Writes in the new ring have only overwritten
+			// the data at the start of the previous ring.
+			return subtractSaturating(writeCursor, l.PreviousSize)
+		}
+		// All data in the previous ring has been overwritten,
+		// but the new ring has not wrapped around yet.
+		if minimum := subtractSaturating(writeCursor, l.Size); minimum > l.Base {
+			return minimum
+		}
+		return l.Base
+	}
+	return subtractSaturating(writeCursor, l.Size)
+}
+
+// resize the layout to a new ring size. If the ring is grown, data
+// written up to writeCursor is retained. The boolean return value
+// indicates whether existing data is retained.
+func (l *DataLayout) resize(size uint64, writeCursor uint64) bool {
+	if l.PreviousSize > 0 && writeCursor >= l.Base+l.Size {
+		// A previous transition has completed.
+		l.PreviousSize = 0
+	}
+	if size == l.Size {
+		return true
+	}
+	if size < l.Size || l.PreviousSize > 0 || writeCursor < l.Base {
+		// Shrinking the ring or growing it while a previous
+		// transition is still in progress. Discard all data.
+		*l = DataLayout{
+			Base: writeCursor,
+			Size: size,
+		}
+		return false
+	}
+	// Let the new ring start at the next point at which the previous
+	// ring wraps around.
+	*l = DataLayout{
+		Base:         l.Base + (writeCursor-l.Base+l.Size-1)/l.Size*l.Size,
+		Size:         size,
+		PreviousSize: l.Size,
+	}
+	return true
+}
+
+func subtractSaturating(a uint64, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
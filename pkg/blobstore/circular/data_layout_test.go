@@ -0,0 +1,165 @@
+package circular_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataLayoutGetPosition(t *testing.T) {
+	for _, entry := range []struct {
+		layout   circular.DataLayout
+		offset   uint64
+		position uint64
+		size     uint64
+	}{
+		// Ring of a fixed size.
+		{circular.DataLayout{Size: 100}, 0, 0, 100},
+		{circular.DataLayout{Size: 100}, 99, 99, 100},
+		{circular.DataLayout{Size: 100}, 100, 0, 100},
+		{circular.DataLayout{Size: 100}, 1234, 34, 100},
+		// Ring of a fixed size, starting at a nonzero offset
+		// due to previously discarded data.
+		{circular.DataLayout{Base: 130, Size: 50}, 130, 0, 50},
+		{circular.DataLayout{Base: 130, Size: 50}, 179, 49, 50},
+		{circular.DataLayout{Base: 130, Size: 50}, 185, 5, 50},
+		// Transition from a ring of 100 bytes to 250 bytes.
+		// Offsets below the base use the previous ring.
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 0, 0, 100},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 130, 30, 100},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 199, 99, 100},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 200, 0, 250},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 449, 249, 250},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 450, 0, 250},
+	} {
+		position, size := entry.layout.GetPosition(entry.offset)
+		require.Equal(t, entry.position, position, "Layout %v, offset %d", entry.layout, entry.offset)
+		require.Equal(t, entry.size, size, "Layout %v, offset %d", entry.layout, entry.offset)
+	}
+}
+
+func TestDataLayoutGetMinimumReadCursor(t *testing.T) {
+	for _, entry := range []struct {
+		layout        circular.DataLayout
+		writeCursor   uint64
+		minimumCursor uint64
+	}{
+		// Ring of a fixed size.
+		{circular.DataLayout{Size: 100}, 0, 0},
+		{circular.DataLayout{Size: 100}, 50, 0},
+		{circular.DataLayout{Size: 100}, 100, 0},
+		{circular.DataLayout{Size: 100}, 150, 50},
+		// Transition from a ring of 100 bytes to 250 bytes.
+		// While the previous ring is still being overwritten,
+		// the amount of intact data equals its size.
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 130, 30},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 200, 100},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 250, 150},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 300, 200},
+		// Once the previous ring has been overwritten entirely,
+		// data grows towards the size of the new ring.
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 350, 200},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 450, 200},
+		{circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100}, 460, 210},
+	} {
+		require.Equal(t, entry.minimumCursor, entry.layout.GetMinimumReadCursor(entry.writeCursor), "Layout %v, write cursor %d", entry.layout, entry.writeCursor)
+	}
+}
+
+func TestDataLayoutResize(t *testing.T) {
+	for _, entry := range []struct {
+		name        string
+		layout      circular.DataLayout
+		size        uint64
+		writeCursor uint64
+		newLayout   circular.DataLayout
+		retained    bool
+	}{
+		{
+			"Unchanged",
+			circular.DataLayout{Size: 100},
+			100, 130,
+			circular.DataLayout{Size: 100},
+			true,
+		},
+		{
+			// The new ring starts where the previous ring
+			// wraps around next.
+			"Grow",
+			circular.DataLayout{Size: 100},
+			250, 130,
+			circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100},
+			true,
+		},
+		{
+			"GrowAtWrapAround",
+			circular.DataLayout{Size: 100},
+			250, 200,
+			circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100},
+			true,
+		},
+		{
+			"GrowEmpty",
+			circular.DataLayout{Size: 100},
+			250, 0,
+			circular.DataLayout{Size: 250, PreviousSize: 100},
+			true,
+		},
+		{
+			"Shrink",
+			circular.DataLayout{Size: 100},
+			50, 130,
+			circular.DataLayout{Base: 130, Size: 50},
+			false,
+		},
+		{
+			"ShrinkDuringTransition",
+			circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100},
+			150, 300,
+			circular.DataLayout{Base: 300, Size: 150},
+			false,
+		},
+		{
+			// Growing while the previous ring has not been
+			// overwritten entirely would require keeping
+			// track of more than two rings.
+			"GrowDuringTransition",
+			circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100},
+			400, 300,
+			circular.DataLayout{Base: 300, Size: 400},
+			false,
+		},
+		{
+			"GrowAfterTransition",
+			circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100},
+			400, 450,
+			circular.DataLayout{Base: 450, Size: 400, PreviousSize: 250},
+			true,
+		},
+		{
+			// A transition that has completed should be
+			// forgotten, even if the size does not change.
+			"CompleteTransition",
+			circular.DataLayout{Base: 200, Size: 250, PreviousSize: 100},
+			250, 460,
+			circular.DataLayout{Base: 200, Size: 250},
+			true,
+		},
+		{
+			// Write cursors below the base can only occur
+			// if the state file is inconsistent.
+			"WriteCursorBelowBase",
+			circular.DataLayout{Base: 200, Size: 100},
+			250, 150,
+			circular.DataLayout{Base: 150, Size: 250},
+			false,
+		},
+	} {
+		t.Run(entry.name, func(t *testing.T) {
+			layout := entry.layout
+			require.Equal(t, entry.retained, layout.Resize(entry.size, entry.writeCursor))
+			require.Equal(t, entry.newLayout, layout)
+		})
+	}
+}
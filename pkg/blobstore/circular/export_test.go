@@ -0,0 +1,15 @@
+package circular
+
+// Expose internals of DataLayout to unit tests.
+
+func (l *DataLayout) GetPosition(offset uint64) (uint64, uint64) {
+	return l.getPosition(offset)
+}
+
+func (l *DataLayout) GetMinimumReadCursor(writeCursor uint64) uint64 {
+	return l.getMinimumReadCursor(writeCursor)
+}
+
+func (l *DataLayout) Resize(size uint64, writeCursor uint64) bool {
+	return l.resize(size, writeCursor)
+}
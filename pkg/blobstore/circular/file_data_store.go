@@ -2,46 +2,60 @@ package circular
 
 import (
 	"io"
+	"sync"
 )
 
 type fileDataStore struct {
 	file ReadWriterAt
-	size uint64
+
+	layoutLock sync.RWMutex
+	layout     DataLayout
 }
 
 // NewFileDataStore creates a new file-based store for blob contents.
 // All data is stored in a single file, where all blobs are concatenated
 // directly. As the file pointer wraps around at a configured size, old
-// data is automatically overwritten by new data.
-func NewFileDataStore(file ReadWriterAt, size uint64) DataStore {
+// data is automatically overwritten by new data. The offset at which
+// the file pointer wraps around is determined by the DataLayout, which
+// may be replaced when the file is grown.
+func NewFileDataStore(file ReadWriterAt, layout DataLayout) DataStore {
 	return &fileDataStore{
-		file: file,
-		size: size,
+		file:   file,
+		layout: layout,
 	}
 }
 
+func (ds *fileDataStore) getPosition(offset uint64) (uint64, uint64) {
+	ds.layoutLock.RLock()
+	defer ds.layoutLock.RUnlock()
+	return ds.layout.getPosition(offset)
+}
+
 func (ds *fileDataStore) Put(r io.Reader, offset uint64) error {
 	for {
 		// Read data. If at the end of the storage file, limit
 		// the size to ensure proper wrap-around.
-		writeOffset := offset % ds.size
+		writeOffset, size := ds.getPosition(offset)
 		var b [65536]byte
 		copyLength := uint64(len(b))
-		if copyLength > ds.size-writeOffset {
-			copyLength = ds.size - writeOffset
-		}
-		n, err := r.Read(b[:])
-		if err == io.EOF {
-			return nil
-		} else if err != nil {
-			return err
+		if copyLength > size-writeOffset {
+			copyLength = size - writeOffset
 		}
+		n, readErr := r.Read(b[:copyLength])
 
-		// Write data to storage.
-		if _, err := ds.file.WriteAt(b[:n], int64(writeOffset)); err != nil {
-			return err
+		// Write data to storage. Readers may return data and an
+		// error at the same time.
+		if n > 0 {
+			if _, err := ds.file.WriteAt(b[:n], int64(writeOffset)); err != nil {
+				return err
+			}
+			offset += uint64(n)
+		}
+		if readErr == io.EOF {
+			return nil
+		} else if readErr != nil {
+			return readErr
 		}
-		offset += uint64(n)
 	}
 }
 
@@ -53,6 +67,12 @@ func (ds *fileDataStore) Get(offset uint64, size int64) io.ReadCloser {
 	}
 }
 
+func (ds *fileDataStore) SetLayout(layout DataLayout) {
+	ds.layoutLock.Lock()
+	ds.layout = layout
+	ds.layoutLock.Unlock()
+}
+
 type fileDataStoreReader struct {
 	ds     *fileDataStore
 	offset uint64
@@ -68,13 +88,13 @@ func (f *fileDataStoreReader) Read(b []byte) (n int, err error) {
 	// Determine which amount of data may be read. Perform a short
 	// read at the end of the storage file, so that a successive
 	// read will start at the beginning of the file.
-	readOffset := f.offset % f.ds.size
+	readOffset, size := f.ds.getPosition(f.offset)
 	readLength := f.size
 	if bLength := uint64(len(b)); readLength > bLength {
 		readLength = bLength
 	}
-	if readLength > f.ds.size-readOffset {
-		readLength = f.ds.size - readOffset
+	if readLength > size-readOffset {
+		readLength = size - readOffset
 	}
 
 	// Perform the read.
@@ -0,0 +1,36 @@
+package circular_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDataStorePutWrapAround(t *testing.T) {
+	// The data file has the exact size of the ring, meaning that
+	// any writes beyond the end of the ring fail.
+	dataFile := newMemoryFile(16)
+	dataStore := circular.NewFileDataStore(dataFile, circular.DataLayout{Size: 16})
+
+	// Readers that return more data than fits before the end of
+	// the ring should cause the data to be split up, so that the
+	// remainder is written at the start of the ring.
+	require.NoError(t, dataStore.Put(bytes.NewBufferString("0123456789"), 12))
+	require.Equal(t, memoryFile("456789\x00\x00\x00\x00\x00\x000123"), dataFile)
+
+	data, err := ioutil.ReadAll(dataStore.Get(12, 10))
+	require.NoError(t, err)
+	require.Equal(t, []byte("0123456789"), data)
+
+	// Data returned together with io.EOF should also be written.
+	require.NoError(t, dataStore.Put(iotest.DataErrReader(bytes.NewBufferString("abcdefghij")), 26))
+	require.Equal(t, memoryFile("ghij89\x00\x00\x00\x00abcdef"), dataFile)
+
+	data, err = ioutil.ReadAll(dataStore.Get(26, 10))
+	require.NoError(t, err)
+	require.Equal(t, []byte("abcdefghij"), data)
+}
@@ -147,6 +147,26 @@ func (os *fileOffsetStore) putRecordAtPosition(record offsetRecord, position int
 	return err
 }
 
+// forEachRecord calls a function for every record in the offset file
+// that is in use. Records are visited in the order in which they are
+// stored in the offset file.
+func (os *fileOffsetStore) forEachRecord(callback func(record offsetRecord, position int64) error) error {
+	recordLen := int64(len(offsetRecord{}))
+	recordsCount := int64(os.size) / recordLen
+	for position := int64(0); position < recordsCount*recordLen; position += recordLen {
+		record, err := os.getRecordAtPosition(position)
+		if err != nil {
+			return err
+		}
+		if record != (offsetRecord{}) {
+			if err := callback(record, position); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (os *fileOffsetStore) Get(digest *util.Digest, cursors Cursors) (uint64, int64, bool, error) {
 	record := newOffsetRecord(newSimpleDigest(digest), 0, 0)
 	for iteration := uint32(1); ; iteration++ {
@@ -0,0 +1,96 @@
+package circular
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// OffsetStoreCheckResults contains counts of the records encountered
+// by CheckFileOffsetStore.
+type OffsetStoreCheckResults struct {
+	// Records that refer to valid data.
+	Valid uint64
+	// Records that refer to data that has been overwritten or
+	// invalidated since. These are a normal occurrence, as the
+	// offset store is self-cleaning.
+	Stale uint64
+	// Records that could never have been written by
+	// fileOffsetStore, whose length does not match the size stored
+	// in the digest, or whose digest function is unknown.
+	Malformed uint64
+	// Records that refer to data beyond the write cursor. These
+	// may be left behind after an unclean shutdown, when updates to
+	// the state file got lost.
+	BeyondWriteCursor uint64
+	// Records whose data did not match the hash stored in the
+	// digest.
+	Corrupted uint64
+	// Number of records that were removed from the offset store.
+	Removed uint64
+}
+
+// CheckFileOffsetStore scans all records stored in an offset file
+// created by NewFileOffsetStore, validating them against the cursors
+// of the state file. This can be used to recover from unclean
+// shutdowns, where writes to the storage files may have been lost or
+// reordered.
+//
+// If a DataStore is provided, the data referenced by every valid
+// record is read back and hashed, so that corrupted data is detected.
+// This is only meaningful for the Content Addressable Storage. If
+// repair is set, records that are malformed, beyond the write cursor
+// or corrupted are cleared. Clearing records may cause records of
+// other blobs that were displaced past them to become unreachable,
+// causing those blobs to be reported as absent.
+func CheckFileOffsetStore(file ReadWriterAt, size uint64, cursors Cursors, dataStore DataStore, repair bool) (OffsetStoreCheckResults, error) {
+	var results OffsetStoreCheckResults
+	os := &fileOffsetStore{
+		file: file,
+		size: size,
+	}
+	err := os.forEachRecord(func(record offsetRecord, position int64) error {
+		var digest simpleDigest
+		copy(digest[:], record[:])
+		offset, length := record.getOffset(), record.getLength()
+		hasher, expectedHash, validDigestFunction := newHasherForSimpleDigest(digest)
+		if record.getAttempt() >= maximumIterations ||
+			os.getPositionOfSlot(record.getSlot()) != position ||
+			length < 0 ||
+			binary.LittleEndian.Uint32(digest[sha256.Size:]) != uint32(length) ||
+			!validDigestFunction {
+			results.Malformed++
+		} else if offset+uint64(length) > cursors.Write {
+			results.BeyondWriteCursor++
+		} else if !cursors.Contains(offset, length) {
+			results.Stale++
+			return nil
+		} else if dataStore != nil {
+			r := dataStore.Get(offset, length)
+			_, err := io.Copy(hasher, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(hasher.Sum(nil), expectedHash) {
+				results.Corrupted++
+			} else {
+				results.Valid++
+				return nil
+			}
+		} else {
+			results.Valid++
+			return nil
+		}
+
+		if repair {
+			if err := os.putRecordAtPosition(offsetRecord{}, position); err != nil {
+				return err
+			}
+			results.Removed++
+		}
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,193 @@
+package circular_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryFile is an in-memory ReadWriterAt of a fixed size.
+type memoryFile []byte
+
+func newMemoryFile(size int) memoryFile {
+	return make(memoryFile, size)
+}
+
+func (f memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(f)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(f[off:], p), nil
+}
+
+// offsetFileSize is the size of offset files used by tests, being
+// large enough to hold a couple of records without collisions.
+const offsetFileSize = 60 * 1024
+
+func TestCheckFileOffsetStoreDigestFunctions(t *testing.T) {
+	offsetFile := newMemoryFile(offsetFileSize)
+	offsetStore := circular.NewFileOffsetStore(offsetFile, offsetFileSize)
+	dataStore := circular.NewFileDataStore(newMemoryFile(1024), circular.DataLayout{Size: 1024})
+	cursors := circular.Cursors{Read: 0, Write: 15}
+
+	// Store blobs using digest functions whose hashes are stored
+	// as is (SHA-256), and folded (SHA-512).
+	for _, blob := range []struct {
+		hash   string
+		data   string
+		offset uint64
+	}{
+		{"185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969", "Hello", 0},
+		{"8ea77393a42ab8fa92500fb077a9509cc32bc95e72712efa116edaf2edfae34fbb682efdd6c5dd13c117e08bd4aaef71291d8aace2f890273081d0677c16df0f", "World", 5},
+		{"3615f80c9d293ed7402687f94b22d58e529b8cc7916f8fac7fddf7fbd5af4cf777d3d795a7a00a16bf7e7f3fb9561ee9baae480da9fe7a18769e71886b03f315", "Hallo", 10},
+	} {
+		digest := util.MustNewDigest("", &remoteexecution.Digest{
+			Hash:      blob.hash,
+			SizeBytes: 5,
+		})
+		require.NoError(t, dataStore.Put(bytes.NewBufferString(blob.data), blob.offset))
+		require.NoError(t, offsetStore.Put(digest, blob.offset, 5, cursors))
+	}
+
+	// Only the final blob, whose data doesn't match the SHA-512
+	// hash of "Hello", should be reported as corrupted.
+	results, err := circular.CheckFileOffsetStore(offsetFile, offsetFileSize, cursors, dataStore, true)
+	require.NoError(t, err)
+	require.Equal(t, circular.OffsetStoreCheckResults{
+		Valid:     2,
+		Corrupted: 1,
+		Removed:   1,
+	}, results)
+
+	results, err = circular.CheckFileOffsetStore(offsetFile, offsetFileSize, cursors, dataStore, false)
+	require.NoError(t, err)
+	require.Equal(t, circular.OffsetStoreCheckResults{
+		Valid: 2,
+	}, results)
+}
+
+func TestCheckFileOffsetStoreClassification(t *testing.T) {
+	offsetFile := newMemoryFile(offsetFileSize)
+	offsetStore := circular.NewFileOffsetStore(offsetFile, offsetFileSize)
+	dataStore := circular.NewFileDataStore(newMemoryFile(1024), circular.DataLayout{Size: 1024})
+	newDigest := func(hash string) *util.Digest {
+		return util.MustNewDigest("", &remoteexecution.Digest{
+			Hash:      hash,
+			SizeBytes: 5,
+		})
+	}
+	validDigest := newDigest("185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969")
+	corruptedDigest := newDigest("78ae647dc5544d227130a0682a51e30bc7777fbb6d8a8f17007463a3ecd1d524")
+	staleDigest := newDigest("753692ec36adb4c794c973945eb2a99c1649703ea6f76bf259abb4fb838e013e")
+	beyondWriteCursorDigest := newDigest("eec5a3713c4ebe33f1cce073ed186155e3cd15fd5268d2651e257299d1378026")
+	malformedDigest := newDigest("87ad936e9d9edfd8a6ec6d7fd7122ce4989e827d91272a399a99cdcbc192e4bb")
+
+	// Store records while the cursors cover all of them.
+	putCursors := circular.Cursors{Read: 0, Write: 100}
+	for _, blob := range []struct {
+		digest *util.Digest
+		data   string
+		offset uint64
+		length int64
+	}{
+		{validDigest, "Hello", 20, 5},
+		{corruptedDigest, "Xorld", 30, 5},
+		{staleDigest, "Hallo", 0, 5},
+		{beyondWriteCursorDigest, "Hillo", 95, 5},
+		// Length that does not match the size in the digest.
+		{malformedDigest, "Hullo!", 40, 6},
+	} {
+		require.NoError(t, dataStore.Put(bytes.NewBufferString(blob.data), blob.offset))
+		require.NoError(t, offsetStore.Put(blob.digest, blob.offset, blob.length, putCursors))
+	}
+
+	// Garbage in an unused slot, as if a write to the offset file
+	// was torn.
+	// Records are 60 bytes in size.
+	garbage := bytes.Repeat([]byte{0xff}, 60)
+	for position := 0; ; position += len(garbage) {
+		if bytes.Equal(offsetFile[position:position+len(garbage)], make([]byte, len(garbage))) {
+			copy(offsetFile[position:], garbage)
+			break
+		}
+	}
+
+	// Check the offset file against cursors that no longer contain
+	// the start of the data and lag behind the write cursor that was
+	// used while storing, as if the state file was not synchronized.
+	checkCursors := circular.Cursors{Read: 10, Write: 90}
+
+	t.Run("WithoutDataStore", func(t *testing.T) {
+		// Corrupted data cannot be detected without reading it.
+		results, err := circular.CheckFileOffsetStore(offsetFile, offsetFileSize, checkCursors, nil, false)
+		require.NoError(t, err)
+		require.Equal(t, circular.OffsetStoreCheckResults{
+			Valid:             2,
+			Stale:             1,
+			Malformed:         2,
+			BeyondWriteCursor: 1,
+		}, results)
+	})
+
+	t.Run("WithoutRepair", func(t *testing.T) {
+		results, err := circular.CheckFileOffsetStore(offsetFile, offsetFileSize, checkCursors, dataStore, false)
+		require.NoError(t, err)
+		require.Equal(t, circular.OffsetStoreCheckResults{
+			Valid:             1,
+			Stale:             1,
+			Malformed:         2,
+			BeyondWriteCursor: 1,
+			Corrupted:         1,
+		}, results)
+	})
+
+	t.Run("WithRepair", func(t *testing.T) {
+		// Stale records are left alone, as they are cleaned
+		// up by the offset store itself.
+		results, err := circular.CheckFileOffsetStore(offsetFile, offsetFileSize, checkCursors, dataStore, true)
+		require.NoError(t, err)
+		require.Equal(t, circular.OffsetStoreCheckResults{
+			Valid:             1,
+			Stale:             1,
+			Malformed:         2,
+			BeyondWriteCursor: 1,
+			Corrupted:         1,
+			Removed:           4,
+		}, results)
+
+		results, err = circular.CheckFileOffsetStore(offsetFile, offsetFileSize, checkCursors, dataStore, false)
+		require.NoError(t, err)
+		require.Equal(t, circular.OffsetStoreCheckResults{
+			Valid: 1,
+			Stale: 1,
+		}, results)
+
+		// Only the valid record should remain accessible.
+		for _, digest := range []*util.Digest{corruptedDigest, beyondWriteCursorDigest, malformedDigest} {
+			_, _, found, err := offsetStore.Get(digest, putCursors)
+			require.NoError(t, err)
+			require.False(t, found, "Digest %s", digest)
+		}
+		offset, length, found, err := offsetStore.Get(validDigest, checkCursors)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, uint64(20), offset)
+		require.Equal(t, int64(5), length)
+	})
+}
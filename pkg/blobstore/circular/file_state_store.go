@@ -4,35 +4,96 @@ import (
 	"encoding/binary"
 	"io"
 	"log"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type fileStateStore struct {
-	file     ReadWriterAt
-	dataSize uint64
-	cursors  Cursors
+	file    ReadWriterAt
+	layout  DataLayout
+	cursors Cursors
 }
 
-// NewFileStateStore creates a new storage for global metadata of a
-// circular storage backend. Right now only a set of read/write cursors
-// are stored.
-func NewFileStateStore(file ReadWriterAt, dataSize uint64) (StateStore, error) {
+// ReadFileState reads the cursors and data layout from a state file
+// created by NewFileStateStore, without modifying it. If the size of
+// the data file differs from the one recorded in the state file, the
+// layout is resized accordingly. Data that is no longer accessible
+// afterwards is excluded from the cursors.
+func ReadFileState(file ReadWriterAt, dataSize uint64) (Cursors, DataLayout, error) {
 	var cursors Cursors
-	var data [16]byte
-	if _, err := file.ReadAt(data[:], 0); err == nil {
+	layout := DataLayout{Size: dataSize}
+	var data [40]byte
+	n, err := file.ReadAt(data[:], 0)
+	if err != nil && err != io.EOF {
+		return Cursors{}, DataLayout{}, err
+	}
+	if n >= 16 {
 		readCursor := binary.LittleEndian.Uint64(data[:])
 		writeCursor := binary.LittleEndian.Uint64(data[8:])
 		if readCursor <= writeCursor {
 			cursors.Read = readCursor
 			cursors.Write = writeCursor
 		}
-	} else if err != io.EOF {
-		return nil, err
-	}
-	return &fileStateStore{
-		file:     file,
-		dataSize: dataSize,
-		cursors:  cursors,
-	}, nil
+	}
+	if n >= 40 {
+		// State files written by older versions only contain
+		// cursors, in which case the ring is assumed to have
+		// the size of the data file.
+		if size := binary.LittleEndian.Uint64(data[24:]); size > 0 {
+			layout = DataLayout{
+				Base:         binary.LittleEndian.Uint64(data[16:]),
+				Size:         size,
+				PreviousSize: binary.LittleEndian.Uint64(data[32:]),
+			}
+		}
+	}
+
+	if previousSize := layout.Size; !layout.resize(dataSize, cursors.Write) {
+		log.Printf("Data size changed from %d to %d bytes, discarding all existing data", previousSize, dataSize)
+		cursors.Read = cursors.Write
+	}
+	if minimum := layout.getMinimumReadCursor(cursors.Write); cursors.Read < minimum {
+		cursors.Read = minimum
+	}
+	return cursors, layout, nil
+}
+
+// NewFileStateStore creates a new storage for global metadata of a
+// circular storage backend. It stores a set of read/write cursors and
+// the layout of the data file. The layout is returned, so that it may
+// be provided to NewFileDataStore.
+func NewFileStateStore(file ReadWriterAt, dataSize uint64) (StateStore, DataLayout, error) {
+	cursors, layout, err := ReadFileState(file, dataSize)
+	if err != nil {
+		return nil, DataLayout{}, err
+	}
+
+	// Store the layout, which may have changed due to resizing.
+	ss := &fileStateStore{
+		file: file,
+	}
+	if err := ss.putLayout(layout); err != nil {
+		return nil, DataLayout{}, err
+	}
+	if err := ss.put(cursors); err != nil {
+		return nil, DataLayout{}, err
+	}
+	return ss, layout, nil
+}
+
+func (ss *fileStateStore) putLayout(layout DataLayout) error {
+	var data [24]byte
+	binary.LittleEndian.PutUint64(data[:], layout.Base)
+	binary.LittleEndian.PutUint64(data[8:], layout.Size)
+	binary.LittleEndian.PutUint64(data[16:], layout.PreviousSize)
+	if _, err := ss.file.WriteAt(data[:], 16); err != nil {
+		return err
+	}
+	ss.layout = layout
+	return nil
 }
 
 func (ss *fileStateStore) GetCursors() Cursors {
@@ -65,9 +126,9 @@ func (ss *fileStateStore) Allocate(sizeBytes int64) (uint64, error) {
 	if cursors.Read > cursors.Write {
 		// Overflow of the write counter. Reset.
 		cursors.Read = cursors.Write
-	} else if cursors.Read+ss.dataSize < cursors.Write {
+	} else if minimum := ss.layout.getMinimumReadCursor(cursors.Write); cursors.Read < minimum {
 		// Invalidate data that is about to be overwritten.
-		cursors.Read = cursors.Write - ss.dataSize
+		cursors.Read = minimum
 	}
 	return offset, ss.put(cursors)
 }
@@ -81,3 +142,20 @@ func (ss *fileStateStore) Invalidate(offset uint64, sizeBytes int64) error {
 	}
 	return ss.put(cursors)
 }
+
+func (ss *fileStateStore) Grow(dataSize uint64) (DataLayout, error) {
+	// Only allow growing the data store in ways that retain all
+	// existing data, as data in the process of being read or
+	// written cannot be invalidated.
+	layout := ss.layout
+	if dataSize < layout.Size {
+		return DataLayout{}, status.Errorf(codes.InvalidArgument, "Data cannot be shrunk from %d to %d bytes while in use", layout.Size, dataSize)
+	}
+	if !layout.resize(dataSize, ss.cursors.Write) {
+		return DataLayout{}, status.Error(codes.FailedPrecondition, "Data cannot be grown while a previous growth is still in progress")
+	}
+	if err := ss.putLayout(layout); err != nil {
+		return DataLayout{}, util.StatusWrapWithCode(err, codes.Internal, "Failed to store data layout")
+	}
+	return layout, nil
+}
@@ -0,0 +1,45 @@
+package circular_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFileStateStoreGrow(t *testing.T) {
+	file := newMemoryFile(40)
+	stateStore, layout, err := circular.NewFileStateStore(file, 100)
+	require.NoError(t, err)
+	require.Equal(t, circular.DataLayout{Size: 100}, layout)
+	_, err = stateStore.Allocate(150)
+	require.NoError(t, err)
+
+	// Growing the data file should let the new ring start at the
+	// point at which the previous ring wraps around next. The new
+	// layout should be persisted.
+	layout, err = stateStore.Grow(200)
+	require.NoError(t, err)
+	require.Equal(t, circular.DataLayout{Base: 200, Size: 200, PreviousSize: 100}, layout)
+	cursors, layout, err := circular.ReadFileState(file, 200)
+	require.NoError(t, err)
+	require.Equal(t, circular.Cursors{Read: 50, Write: 150}, cursors)
+	require.Equal(t, circular.DataLayout{Base: 200, Size: 200, PreviousSize: 100}, layout)
+
+	// Shrinking would discard data that may still be in use.
+	_, err = stateStore.Grow(50)
+	require.Equal(t, status.Error(codes.InvalidArgument, "Data cannot be shrunk from 200 to 50 bytes while in use"), err)
+
+	// Growing again is only possible once all data stored in the
+	// previous ring has been overwritten.
+	_, err = stateStore.Grow(400)
+	require.Equal(t, status.Error(codes.FailedPrecondition, "Data cannot be grown while a previous growth is still in progress"), err)
+	_, err = stateStore.Allocate(300)
+	require.NoError(t, err)
+	layout, err = stateStore.Grow(400)
+	require.NoError(t, err)
+	require.Equal(t, circular.DataLayout{Base: 600, Size: 400, PreviousSize: 200}, layout)
+}
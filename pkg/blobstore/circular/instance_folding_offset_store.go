@@ -0,0 +1,58 @@
+package circular
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+type instanceFoldingOffsetStore struct {
+	backend OffsetStore
+}
+
+// NewInstanceFoldingOffsetStore creates an adapter for OffsetStore that
+// incorporates the instance name into the digests of entries. This
+// allows a single offset store to be used for the Action Cache, where
+// entries of different instances need to be kept apart, without
+// requiring the set of instance names to be known up front.
+//
+// Digests are replaced by a SHA-256 hash of the original hash and the
+// instance name. The size of the blob is retained.
+func NewInstanceFoldingOffsetStore(backend OffsetStore) OffsetStore {
+	return &instanceFoldingOffsetStore{
+		backend: backend,
+	}
+}
+
+func foldInstanceIntoDigest(digest *util.Digest) (*util.Digest, error) {
+	instance := digest.GetInstance()
+	hasher := sha256.New()
+	var instanceLength [8]byte
+	binary.LittleEndian.PutUint64(instanceLength[:], uint64(len(instance)))
+	hasher.Write(instanceLength[:])
+	hasher.Write([]byte(instance))
+	hasher.Write(getSimpleDigestHash(digest))
+	return util.NewDigest("", &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes: digest.GetSizeBytes(),
+	})
+}
+
+func (os *instanceFoldingOffsetStore) Get(digest *util.Digest, cursors Cursors) (uint64, int64, bool, error) {
+	foldedDigest, err := foldInstanceIntoDigest(digest)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return os.backend.Get(foldedDigest, cursors)
+}
+
+func (os *instanceFoldingOffsetStore) Put(digest *util.Digest, offset uint64, length int64, cursors Cursors) error {
+	foldedDigest, err := foldInstanceIntoDigest(digest)
+	if err != nil {
+		return err
+	}
+	return os.backend.Put(foldedDigest, offset, length, cursors)
+}
@@ -0,0 +1,53 @@
+package circular_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceFoldingOffsetStore(t *testing.T) {
+	offsetStore := circular.NewInstanceFoldingOffsetStore(
+		circular.NewFileOffsetStore(newMemoryFile(offsetFileSize), offsetFileSize))
+	cursors := circular.Cursors{Read: 0, Write: 100}
+	partialDigest := &remoteexecution.Digest{
+		Hash:      "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969",
+		SizeBytes: 5,
+	}
+
+	// Store the same digest for two different instances.
+	require.NoError(t, offsetStore.Put(util.MustNewDigest("debian8", partialDigest), 10, 5, cursors))
+	require.NoError(t, offsetStore.Put(util.MustNewDigest("ubuntu1804", partialDigest), 20, 5, cursors))
+
+	// Entries should be kept apart by instance name.
+	offset, length, found, err := offsetStore.Get(util.MustNewDigest("debian8", partialDigest), cursors)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(10), offset)
+	require.Equal(t, int64(5), length)
+
+	offset, length, found, err = offsetStore.Get(util.MustNewDigest("ubuntu1804", partialDigest), cursors)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(20), offset)
+	require.Equal(t, int64(5), length)
+
+	// Instances for which no entry has been stored, including the
+	// empty instance, should not match.
+	for _, instance := range []string{"", "debian", "debian8/x86_64"} {
+		_, _, found, err = offsetStore.Get(util.MustNewDigest(instance, partialDigest), cursors)
+		require.NoError(t, err)
+		require.False(t, found, "Instance %#v", instance)
+	}
+
+	// The same applies to digests that differ in size.
+	_, _, found, err = offsetStore.Get(util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969",
+		SizeBytes: 6,
+	}), cursors)
+	require.NoError(t, err)
+	require.False(t, found)
+}
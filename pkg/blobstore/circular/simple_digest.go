@@ -1,8 +1,12 @@
 package circular
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/binary"
+	"hash"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 )
@@ -11,13 +15,98 @@ import (
 // storage backend uses.
 //
 // Digests are encoded by storing the hash, followed by the size. Enough
-// space is left for a SHA-256 sum.
+// space is left for a SHA-256 sum. The byte following the size
+// identifies the digest function for hashes that have been folded by
+// getSimpleDigestHash(). It is zero for hashes that are stored as is.
 type simpleDigest [sha256.Size + 8]byte
 
+// simpleDigestFoldedFunctionOffset is the offset within simpleDigest
+// at which the digest function of folded hashes is stored.
+const simpleDigestFoldedFunctionOffset = sha256.Size + 4
+
+// isFoldedDigestFunction returns whether hashes of a digest function
+// do not fit in a simpleDigest as is, meaning they are folded.
+func isFoldedDigestFunction(digestFunction util.DigestFunction) bool {
+	switch digestFunction {
+	case util.DigestFunctionMD5, util.DigestFunctionSHA1, util.DigestFunctionSHA256:
+		return false
+	default:
+		return true
+	}
+}
+
+// foldHash computes a SHA-256 hash of the name of the digest function
+// and a hash computed using that digest function.
+func foldHash(digestFunction util.DigestFunction, hash []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte(digestFunction.String()))
+	hasher.Write(hash)
+	return hasher.Sum(nil)
+}
+
+// getSimpleDigestHash returns the hash of a digest that is stored in a
+// simpleDigest. Hashes of digest functions other than MD5, SHA-1 and
+// SHA-256 are replaced by a SHA-256 hash of the name of the digest
+// function and the original hash. This ensures that they fit and that
+// they don't collide with hashes of other digest functions.
+func getSimpleDigestHash(digest *util.Digest) []byte {
+	digestFunction := digest.GetDigestFunction()
+	if isFoldedDigestFunction(digestFunction) {
+		return foldHash(digestFunction, digest.GetHashBytes())
+	}
+	return digest.GetHashBytes()
+}
+
 // NewSimpleDigest converts a Digest to a simpleDigest.
 func newSimpleDigest(digest *util.Digest) simpleDigest {
 	var sd simpleDigest
-	copy(sd[:], digest.GetHashBytes())
+	copy(sd[:], getSimpleDigestHash(digest))
 	binary.LittleEndian.PutUint32(sd[sha256.Size:], uint32(digest.GetSizeBytes()))
+	if digestFunction := digest.GetDigestFunction(); isFoldedDigestFunction(digestFunction) {
+		sd[simpleDigestFoldedFunctionOffset] = byte(digestFunction) + 1
+	}
 	return sd
 }
+
+// foldingHasher is a hash.Hash that returns folded hashes, as computed
+// by getSimpleDigestHash().
+type foldingHasher struct {
+	hash.Hash
+	digestFunction util.DigestFunction
+}
+
+func (h foldingHasher) Sum(b []byte) []byte {
+	return append(b, foldHash(h.digestFunction, h.Hash.Sum(nil))...)
+}
+
+func (h foldingHasher) Size() int {
+	return sha256.Size
+}
+
+// newHasherForSimpleDigest returns a hasher for the algorithm that was
+// used to compute a digest stored in a simpleDigest, together with the
+// hash that data is expected to have. For hashes that are stored as
+// is, the algorithm is inferred from the number of trailing zero bytes,
+// as hashes that are shorter than SHA-256 are padded with zeroes.
+// False is returned if the digest function is not recognized.
+func newHasherForSimpleDigest(digest simpleDigest) (hash.Hash, []byte, bool) {
+	if foldedFunction := digest[simpleDigestFoldedFunctionOffset]; foldedFunction != 0 {
+		digestFunction := util.DigestFunction(foldedFunction - 1)
+		if !digestFunction.IsValid() || !isFoldedDigestFunction(digestFunction) {
+			return nil, nil, false
+		}
+		return foldingHasher{
+			Hash:           digestFunction.NewHasher(),
+			digestFunction: digestFunction,
+		}, digest[:sha256.Size], true
+	}
+
+	var zero [sha256.Size]byte
+	if bytes.Equal(digest[md5.Size:sha256.Size], zero[md5.Size:]) {
+		return md5.New(), digest[:md5.Size], true
+	}
+	if bytes.Equal(digest[sha1.Size:sha256.Size], zero[sha1.Size:]) {
+		return sha1.New(), digest[:sha1.Size], true
+	}
+	return sha256.New(), digest[:sha256.Size], true
+}
@@ -1,10 +1,19 @@
 package configuration
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
@@ -18,7 +27,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/go-redis/redis"
-	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 
 	"google.golang.org/grpc"
@@ -28,35 +37,99 @@ import (
 
 // CreateBlobAccessObjectsFromConfig creates a pair of BlobAccess
 // objects for the Content Addressable Storage and Action cache based on
-// a configuration file.
-func CreateBlobAccessObjectsFromConfig(configurationFile string) (blobstore.BlobAccess, blobstore.BlobAccess, error) {
-	data, err := ioutil.ReadFile(configurationFile)
+// a configuration message. The backends of these objects may be
+// replaced at runtime by calling SwapBlobAccessObjectsFromConfig().
+func CreateBlobAccessObjectsFromConfig(config *pb.BlobstoreConfiguration) (blobstore.SwappableBlobAccess, blobstore.SwappableBlobAccess, error) {
+	contentAddressableStorage, actionCache, release, err := createBlobAccessObjects(config)
 	if err != nil {
 		return nil, nil, err
 	}
-	var config pb.BlobstoreConfiguration
-	if err := proto.UnmarshalText(string(data), &config); err != nil {
-		return nil, nil, err
+	return blobstore.NewSwappableBlobAccess(contentAddressableStorage, release),
+		blobstore.NewSwappableBlobAccess(actionCache, release),
+		nil
+}
+
+// SwapBlobAccessObjectsFromConfig creates new backends for the Content
+// Addressable Storage and Action Cache based on a configuration
+// message, and atomically lets the BlobAccess objects returned by
+// CreateBlobAccessObjectsFromConfig() switch over to them. Resources
+// held by the previous backends are released once all requests against
+// them have completed.
+func SwapBlobAccessObjectsFromConfig(contentAddressableStorage blobstore.SwappableBlobAccess, actionCache blobstore.SwappableBlobAccess, config *pb.BlobstoreConfiguration) error {
+	newContentAddressableStorage, newActionCache, release, err := createBlobAccessObjects(config)
+	if err != nil {
+		return err
+	}
+	contentAddressableStorage.Swap(newContentAddressableStorage, release)
+	actionCache.Swap(newActionCache, release)
+	return nil
+}
+
+// createBlobAccessObjects creates the backends for the Content
+// Addressable Storage and Action Cache. It also returns a function
+// that needs to be called twice (i.e., once for every backend) to
+// release the resources held by them.
+func createBlobAccessObjects(config *pb.BlobstoreConfiguration) (blobstore.BlobAccess, blobstore.BlobAccess, func(), error) {
+	if config == nil {
+		return nil, nil, nil, errors.New("Blobstore configuration not specified")
 	}
 
 	// Create two stores based on definitions in configuration.
-	contentAddressableStorage, err := createBlobAccess(config.ContentAddressableStorage, "cas", util.DigestKeyWithoutInstance)
+	var closers []io.Closer
+	contentAddressableStorage, err := createBlobAccess(config.ContentAddressableStorage, "cas", util.DigestKeyWithoutInstance, &closers)
 	if err != nil {
-		return nil, nil, err
+		closeAll(closers)
+		return nil, nil, nil, err
 	}
-	actionCache, err := createBlobAccess(config.ActionCache, "ac", util.DigestKeyWithInstance)
+	actionCache, err := createBlobAccess(config.ActionCache, "ac", util.DigestKeyWithInstance, &closers)
 	if err != nil {
-		return nil, nil, err
+		closeAll(closers)
+		return nil, nil, nil, err
 	}
 
 	// Stack a mandatory layer on top to protect against data corruption.
 	contentAddressableStorage = blobstore.NewMetricsBlobAccess(
 		blobstore.NewMerkleBlobAccess(contentAddressableStorage),
 		"cas_merkle")
-	return contentAddressableStorage, actionCache, nil
+
+	var lock sync.Mutex
+	remaining := 2
+	release := func() {
+		lock.Lock()
+		remaining--
+		done := remaining == 0
+		lock.Unlock()
+		if done {
+			closeAll(closers)
+		}
+	}
+	return contentAddressableStorage, actionCache, release, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			log.Print("Failed to release storage backend resources: ", err)
+		}
+	}
 }
 
-func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat) (blobstore.BlobAccess, error) {
+// idleConnectionsCloser releases the connections held by an HTTP
+// transport that is owned by a single remote cache backend.
+type idleConnectionsCloser struct {
+	transport *http.Transport
+}
+
+func (c idleConnectionsCloser) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// createBlobAccess creates a BlobAccess object based on a
+// configuration message. Resources that need to be released when the
+// object is no longer used (e.g., network connections) are appended to
+// closers.
+func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, digestKeyFormat util.DigestKeyFormat, closers *[]io.Closer) (blobstore.BlobAccess, error) {
 	var implementation blobstore.BlobAccess
 	var backendType string
 	if config == nil {
@@ -72,39 +145,133 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 			return nil, err
 		}
 		defer circularDirectory.Close()
-		dataFile, err := circularDirectory.OpenFile("data", os.O_RDWR|os.O_CREATE, 0644)
+		var dataFile circular.ReadWriterAt
+		var concatenatedDataFile circular.ConcatenatedReadWriterAt
+		dataFileSizeBytes := backend.Circular.DataFileSizeBytes
+		if len(backend.Circular.DataFiles) > 0 {
+			// Spread data across multiple files.
+			if dataFileSizeBytes != 0 {
+				return nil, status.Error(codes.InvalidArgument, "Data file size cannot be provided when data files are specified explicitly")
+			}
+			var files []circular.ReadWriterAt
+			var sizes []uint64
+			for _, dataFileConfiguration := range backend.Circular.DataFiles {
+				file, err := os.OpenFile(dataFileConfiguration.Path, os.O_RDWR|os.O_CREATE, 0644)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, file)
+				sizes = append(sizes, dataFileConfiguration.SizeBytes)
+				dataFileSizeBytes += dataFileConfiguration.SizeBytes
+			}
+			concatenatedDataFile = circular.NewConcatenatedReadWriterAt(files, sizes)
+			dataFile = concatenatedDataFile
+		} else {
+			dataFile, err = circularDirectory.OpenFile("data", os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+		}
+		stateFile, err := circularDirectory.OpenFile("state", os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			return nil, err
 		}
-		stateFile, err := circularDirectory.OpenFile("state", os.O_RDWR|os.O_CREATE, 0644)
+
+		stateStore, dataLayout, err := circular.NewFileStateStore(stateFile, dataFileSizeBytes)
 		if err != nil {
 			return nil, err
 		}
+		dataStore := circular.NewFileDataStore(dataFile, dataLayout)
+
+		// Only data stored in the Content Addressable Storage can
+		// be validated by computing its checksum.
+		var rehashDataStore circular.DataStore
+		if backend.Circular.RehashOnRecovery {
+			if digestKeyFormat != util.DigestKeyWithoutInstance {
+				return nil, status.Error(codes.InvalidArgument, "Rehashing data on recovery is only supported for the Content Addressable Storage")
+			}
+			rehashDataStore = dataStore
+		}
+		if bloomFilter := backend.Circular.BloomFilter; bloomFilter != nil && (bloomFilter.GenerationSizeBytes == 0 || bloomFilter.BitsPerGeneration == 0 || bloomFilter.HashFunctions == 0) {
+			return nil, status.Error(codes.InvalidArgument, "Bloom filter generation size, bits per generation and hash functions must be positive")
+		}
+		openOffsetStore := func(name string) (circular.OffsetStore, error) {
+			offsetFile, err := circularDirectory.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			if backend.Circular.RecoverOnStartup {
+				results, err := circular.CheckFileOffsetStore(
+					offsetFile,
+					backend.Circular.OffsetFileSizeBytes,
+					stateStore.GetCursors(),
+					rehashDataStore,
+					true)
+				if err != nil {
+					return nil, util.StatusWrapf(err, "Failed to recover offset file %#v", name)
+				}
+				log.Printf("Recovered offset file %#v: %+v", name, results)
+			}
+			offsetStore := circular.NewFileOffsetStore(offsetFile, backend.Circular.OffsetFileSizeBytes)
+			if bloomFilter := backend.Circular.BloomFilter; bloomFilter != nil {
+				offsetStore, err = circular.NewBloomFilterOffsetStore(
+					offsetStore,
+					offsetFile,
+					backend.Circular.OffsetFileSizeBytes,
+					stateStore.GetCursors(),
+					bloomFilter.GenerationSizeBytes,
+					bloomFilter.BitsPerGeneration,
+					bloomFilter.HashFunctions)
+				if err != nil {
+					return nil, util.StatusWrapf(err, "Failed to populate Bloom filter for offset file %#v", name)
+				}
+			}
+			return circular.NewCachingOffsetStore(offsetStore, uint(backend.Circular.OffsetCacheSize)), nil
+		}
 
 		var offsetStore circular.OffsetStore
 		switch digestKeyFormat {
 		case util.DigestKeyWithoutInstance:
 			// Open a single offset file for all entries. This is
 			// sufficient for the Content Addressable Storage.
-			offsetFile, err := circularDirectory.OpenFile("offset", os.O_RDWR|os.O_CREATE, 0644)
+			offsetStore, err = openOffsetStore("offset")
 			if err != nil {
 				return nil, err
 			}
-			offsetStore = circular.NewCachingOffsetStore(
-				circular.NewFileOffsetStore(offsetFile, backend.Circular.OffsetFileSizeBytes),
-				uint(backend.Circular.OffsetCacheSize))
 		case util.DigestKeyWithInstance:
-			// Open an offset file for every instance. This is
-			// required for the Action Cache.
+			if len(backend.Circular.Instance) == 0 {
+				// Store entries for all instances in a
+				// single offset file, making the instance
+				// name part of the key. The offset file is
+				// named differently from the one used by
+				// the Content Addressable Storage, so that
+				// tools like bbb_circular_fsck don't
+				// attempt to validate its entries by
+				// rehashing data. Its name cannot collide
+				// with those of per-instance offset files.
+				offsetStore, err = openOffsetStore("offset_folded")
+				if err != nil {
+					return nil, err
+				}
+				offsetStore = circular.NewInstanceFoldingOffsetStore(offsetStore)
+				break
+			}
+
+			// Open an offset file for every instance, so
+			// that instances don't compete for space.
 			offsetStores := map[string]circular.OffsetStore{}
 			for _, instance := range backend.Circular.Instance {
-				offsetFile, err := circularDirectory.OpenFile("offset."+instance, os.O_RDWR|os.O_CREATE, 0644)
+				// Instance names are used as part of file
+				// names, so they may not contain slashes.
+				if canonical, err := util.CanonicalizeInstanceName(instance); err != nil {
+					return nil, util.StatusWrap(err, "Invalid instance name")
+				} else if canonical != instance || strings.ContainsRune(instance, '/') {
+					return nil, status.Errorf(codes.InvalidArgument, "Instance name %#v cannot be used as part of a file name", instance)
+				}
+				offsetStores[instance], err = openOffsetStore("offset." + instance)
 				if err != nil {
 					return nil, err
 				}
-				offsetStores[instance] = circular.NewCachingOffsetStore(
-					circular.NewFileOffsetStore(offsetFile, backend.Circular.OffsetFileSizeBytes),
-					uint(backend.Circular.OffsetCacheSize))
 			}
 			offsetStore = circular.NewDemultiplexingOffsetStore(func(instance string) (circular.OffsetStore, error) {
 				offsetStore, ok := offsetStores[instance]
@@ -114,31 +281,42 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 				return offsetStore, nil
 			})
 		}
-		stateStore, err := circular.NewFileStateStore(stateFile, backend.Circular.DataFileSizeBytes)
-		if err != nil {
-			return nil, err
-		}
 
-		implementation = circular.NewCircularBlobAccess(
+		circularBlobAccess := circular.NewCircularBlobAccess(
 			offsetStore,
-			circular.NewFileDataStore(dataFile, backend.Circular.DataFileSizeBytes),
+			dataStore,
 			circular.NewPositiveSizedBlobStateStore(
 				circular.NewBulkAllocatingStateStore(
 					stateStore,
 					backend.Circular.DataAllocationChunkSizeBytes)))
+		if concatenatedDataFile != nil {
+			// Allow appending data files when the
+			// configuration is reloaded.
+			registerGrowableCircularBackend(backend.Circular.Directory, &growableCircularBackend{
+				blobAccess: circularBlobAccess,
+				dataFile:   concatenatedDataFile,
+				dataFiles:  append([]*pb.CircularBlobAccessConfiguration_DataFile(nil), backend.Circular.DataFiles...),
+			})
+		}
+		implementation = circularBlobAccess
 	case *pb.BlobAccessConfiguration_Error:
 		backendType = "failing"
 		implementation = blobstore.NewErrorBlobAccess(status.ErrorProto(backend.Error))
 	case *pb.BlobAccessConfiguration_Grpc:
 		backendType = "grpc"
+		transportOption, err := util.NewGRPCTransportDialOption(backend.Grpc.Tls)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to create GRPC TLS configuration")
+		}
 		client, err := grpc.Dial(
 			backend.Grpc.Endpoint,
-			grpc.WithInsecure(),
+			transportOption,
 			grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
 			grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
 		if err != nil {
 			return nil, err
 		}
+		*closers = append(*closers, client)
 		switch storageType {
 		case "ac":
 			implementation = blobstore.NewActionCacheBlobAccess(client)
@@ -147,41 +325,115 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 		}
 	case *pb.BlobAccessConfiguration_Redis:
 		backendType = "redis"
+		redisClient, err := newRedisClient(backend.Redis)
+		if err != nil {
+			return nil, err
+		}
+		var keyTTL time.Duration
+		if backend.Redis.KeyTtl != nil {
+			keyTTL, err = ptypes.Duration(backend.Redis.KeyTtl)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse Redis key TTL")
+			}
+		}
+		*closers = append(*closers, redisClient)
 		implementation = blobstore.NewRedisBlobAccess(
-			redis.NewClient(
-				&redis.Options{
-					Addr: backend.Redis.Endpoint,
-					DB:   int(backend.Redis.Db),
-				}),
-			digestKeyFormat)
+			redisClient,
+			digestKeyFormat,
+			keyTTL,
+			backend.Redis.MaximumBlobSizeBytes)
 	case *pb.BlobAccessConfiguration_Remote:
 		backendType = "remote"
-		implementation = blobstore.NewRemoteBlobAccess(backend.Remote.Address, storageType)
+		client := &http.Client{}
+		tlsConfigProvider, err := util.NewClientTLSConfigFromConfiguration(backend.Remote.Tls)
+		if err != nil {
+			return nil, util.StatusWrap(err, "Failed to create remote cache TLS configuration")
+		}
+		if tlsConfigProvider != nil {
+			address, err := url.Parse(backend.Remote.Address)
+			if err != nil {
+				return nil, util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to parse remote cache address")
+			}
+			transport := &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfigProvider(address.Hostname()),
+			}
+			client.Transport = transport
+			*closers = append(*closers, idleConnectionsCloser{transport: transport})
+		}
+		if backend.Remote.RequestTimeout != nil {
+			requestTimeout, err := ptypes.Duration(backend.Remote.RequestTimeout)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse remote cache request timeout")
+			}
+			client.Timeout = requestTimeout
+		}
+		var authorization string
+		switch authentication := backend.Remote.Authentication.(type) {
+		case *pb.RemoteBlobAccessConfiguration_BasicAuthentication_:
+			authorization = "Basic " + base64.StdEncoding.EncodeToString(
+				[]byte(authentication.BasicAuthentication.Username+":"+authentication.BasicAuthentication.Password))
+		case *pb.RemoteBlobAccessConfiguration_BearerToken:
+			authorization = "Bearer " + authentication.BearerToken
+		}
+		findMissingConcurrency := 1
+		if backend.Remote.FindMissingConcurrency > 0 {
+			findMissingConcurrency = int(backend.Remote.FindMissingConcurrency)
+		}
+		implementation = blobstore.NewRemoteBlobAccess(
+			client,
+			backend.Remote.Address,
+			storageType,
+			authorization,
+			findMissingConcurrency)
 	case *pb.BlobAccessConfiguration_S3:
 		backendType = "s3"
-		cfg := aws.Config{
-			Endpoint:         &backend.S3.Endpoint,
-			Region:           &backend.S3.Region,
-			DisableSSL:       &backend.S3.DisableSsl,
-			S3ForcePathStyle: aws.Bool(true),
-		}
-		// If AccessKeyId isn't specified, allow AWS to search for credentials.
-		// In AWS EC2, this search will include the instance IAM Role.
-		if backend.S3.AccessKeyId != "" {
-			cfg.Credentials = credentials.NewStaticCredentials(backend.S3.AccessKeyId, backend.S3.SecretAccessKey, "")
-		}
-		session := session.New(&cfg)
+		session := newS3Session(backend.S3)
 		s3 := s3.New(session)
-		// Set the uploader concurrency to 1 to drastically reduce memory usage.
-		// TODO(edsch): Maybe the concurrency can be left alone for this process?
+		// Default to an uploader concurrency of 1 to drastically
+		// reduce memory usage.
 		uploader := s3manager.NewUploader(session)
 		uploader.Concurrency = 1
+		if backend.S3.UploadConcurrency > 0 {
+			uploader.Concurrency = int(backend.S3.UploadConcurrency)
+		}
+		if backend.S3.UploadPartSizeBytes > 0 {
+			if backend.S3.UploadPartSizeBytes < s3manager.MinUploadPartSize {
+				return nil, status.Errorf(codes.InvalidArgument, "Upload part size must be at least %d bytes", s3manager.MinUploadPartSize)
+			}
+			uploader.PartSize = backend.S3.UploadPartSizeBytes
+		}
+		var storageClass *string
+		if backend.S3.StorageClass != "" {
+			storageClass = &backend.S3.StorageClass
+		}
+		var tagging *string
+		if len(backend.S3.Tags) > 0 {
+			tags := url.Values{}
+			for key, value := range backend.S3.Tags {
+				tags.Set(key, value)
+			}
+			tagging = aws.String(tags.Encode())
+		}
+		findMissingConcurrency := 1
+		if backend.S3.FindMissingConcurrency > 0 {
+			findMissingConcurrency = int(backend.S3.FindMissingConcurrency)
+		}
+		downloadConcurrency := 1
+		if backend.S3.DownloadConcurrency > 0 {
+			downloadConcurrency = int(backend.S3.DownloadConcurrency)
+		}
 		implementation = blobstore.NewS3BlobAccess(
 			s3,
 			uploader,
 			&backend.S3.Bucket,
 			backend.S3.KeyPrefix,
-			digestKeyFormat)
+			digestKeyFormat,
+			storageClass,
+			tagging,
+			findMissingConcurrency,
+			downloadConcurrency,
+			backend.S3.DownloadPartSizeBytes)
 	case *pb.BlobAccessConfiguration_Sharding:
 		backendType = "sharding"
 		var backends []blobstore.BlobAccess
@@ -193,7 +445,7 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 				backends = append(backends, nil)
 			} else {
 				// Undrained backend.
-				backend, err := createBlobAccess(shard.Backend, storageType, digestKeyFormat)
+				backend, err := createBlobAccess(shard.Backend, storageType, digestKeyFormat, closers)
 				if err != nil {
 					return nil, err
 				}
@@ -209,24 +461,188 @@ func createBlobAccess(config *pb.BlobAccessConfiguration, storageType string, di
 		if !hasUndrainedBackend {
 			return nil, status.Errorf(codes.InvalidArgument, "Cannot create sharding blob access without any undrained backends")
 		}
-		implementation = sharding.NewShardingBlobAccess(
-			backends,
-			sharding.NewWeightedShardPermuter(weights),
-			digestKeyFormat,
-			backend.Sharding.HashInitialization)
+		var healthTracker sharding.HealthTracker
+		if failover := backend.Sharding.Failover; failover != nil {
+			if failover.FailureThreshold == 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "Failover must have a positive failure threshold")
+			}
+			unhealthyDuration, err := ptypes.Duration(failover.UnhealthyDuration)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse unhealthy duration")
+			}
+			failedOverDuration, err := ptypes.Duration(failover.FailedOverDuration)
+			if err != nil {
+				return nil, util.StatusWrap(err, "Failed to parse failed over duration")
+			}
+			healthTracker = sharding.NewConsecutiveFailuresHealthTracker(
+				len(backends),
+				failover.FailureThreshold,
+				unhealthyDuration,
+				failedOverDuration)
+		}
+		if previousLayout := backend.Sharding.PreviousLayout; previousLayout == nil {
+			implementation = sharding.NewShardingBlobAccess(
+				backends,
+				sharding.NewWeightedShardPermuter(weights),
+				digestKeyFormat,
+				backend.Sharding.HashInitialization,
+				healthTracker)
+		} else {
+			if len(previousLayout.Weight) != len(weights) {
+				return nil, status.Errorf(codes.InvalidArgument, "Previous layout has %d weights, while %d shards are specified", len(previousLayout.Weight), len(weights))
+			}
+			hasUndrainedPreviousBackend := false
+			for i, weight := range previousLayout.Weight {
+				if weight > 0 && backends[i] != nil {
+					hasUndrainedPreviousBackend = true
+				}
+			}
+			if !hasUndrainedPreviousBackend {
+				return nil, status.Errorf(codes.InvalidArgument, "Previous layout must have at least one undrained backend with a positive weight")
+			}
+			implementation = sharding.NewMigratingShardingBlobAccess(
+				backends,
+				sharding.NewWeightedShardPermuter(weights),
+				backend.Sharding.HashInitialization,
+				sharding.NewWeightedShardPermuter(previousLayout.Weight),
+				previousLayout.HashInitialization,
+				digestKeyFormat,
+				healthTracker)
+		}
 	case *pb.BlobAccessConfiguration_SizeDistinguishing:
 		backendType = "size_distinguishing"
-		small, err := createBlobAccess(backend.SizeDistinguishing.Small, storageType, digestKeyFormat)
+		small, err := createBlobAccess(backend.SizeDistinguishing.Small, storageType, digestKeyFormat, closers)
 		if err != nil {
 			return nil, err
 		}
-		large, err := createBlobAccess(backend.SizeDistinguishing.Large, storageType, digestKeyFormat)
+		large, err := createBlobAccess(backend.SizeDistinguishing.Large, storageType, digestKeyFormat, closers)
 		if err != nil {
 			return nil, err
 		}
 		implementation = blobstore.NewSizeDistinguishingBlobAccess(small, large, backend.SizeDistinguishing.CutoffSizeBytes)
+	case *pb.BlobAccessConfiguration_Demultiplexing:
+		backendType = "demultiplexing"
+		if len(backend.Demultiplexing.InstanceNamePrefixes) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Demultiplexing storage requires at least one instance name prefix")
+		}
+		backends := map[string]blobstore.DemultiplexedBackend{}
+		for instanceNamePrefix, demultiplexed := range backend.Demultiplexing.InstanceNamePrefixes {
+			if canonical, err := util.CanonicalizeInstanceName(instanceNamePrefix); err != nil {
+				return nil, util.StatusWrap(err, "Invalid instance name prefix")
+			} else if canonical != instanceNamePrefix {
+				return nil, status.Errorf(codes.InvalidArgument, "Instance name prefix %#v is not in canonical form %#v", instanceNamePrefix, canonical)
+			}
+			if demultiplexed == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "No backend specified for instance name prefix %#v", instanceNamePrefix)
+			}
+			blobAccess, err := createBlobAccess(demultiplexed.Backend, storageType, digestKeyFormat, closers)
+			if err != nil {
+				return nil, util.StatusWrapf(err, "Instance name prefix %#v", instanceNamePrefix)
+			}
+			backends[instanceNamePrefix] = blobstore.DemultiplexedBackend{
+				BlobAccess:            blobAccess,
+				AddInstanceNamePrefix: demultiplexed.AddInstanceNamePrefix,
+			}
+		}
+		implementation = blobstore.NewDemultiplexingBlobAccess(backends)
 	default:
 		return nil, errors.New("Configuration did not contain a backend")
 	}
 	return blobstore.NewMetricsBlobAccess(implementation, fmt.Sprintf("%s_%s", storageType, backendType)), nil
 }
+
+// redisClient is the interface that is implemented by all types of
+// Redis clients that may be created from a configuration message.
+type redisClient interface {
+	redis.Cmdable
+	io.Closer
+}
+
+// newRedisClient creates a client for a Redis server, a Redis Cluster
+// or a set of Redis servers managed by Sentinel.
+func newRedisClient(config *pb.RedisBlobAccessConfiguration) (redisClient, error) {
+	tlsConfigProvider, err := util.NewClientTLSConfigFromConfiguration(config.Tls)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to create Redis TLS configuration")
+	}
+
+	switch {
+	case len(config.ClusterEndpoints) > 0:
+		if config.Endpoint != "" || config.Db != 0 || len(config.SentinelEndpoints) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "Redis Cluster endpoints cannot be combined with an endpoint, database or Sentinel endpoints")
+		}
+		tlsConfig, err := getDiscoveredRedisTLSConfig(config.Tls, tlsConfigProvider)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     config.ClusterEndpoints,
+			Password:  config.Password,
+			TLSConfig: tlsConfig,
+		}), nil
+	case len(config.SentinelEndpoints) > 0:
+		if config.Endpoint != "" || config.SentinelMasterName == "" {
+			return nil, status.Error(codes.InvalidArgument, "Redis Sentinel endpoints require a master name and cannot be combined with an endpoint")
+		}
+		tlsConfig, err := getDiscoveredRedisTLSConfig(config.Tls, tlsConfigProvider)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.SentinelMasterName,
+			SentinelAddrs: config.SentinelEndpoints,
+			DB:            int(config.Db),
+			Password:      config.Password,
+			TLSConfig:     tlsConfig,
+		}), nil
+	default:
+		var tlsConfig *tls.Config
+		if tlsConfigProvider != nil {
+			// Validate the server's certificate against the
+			// host name in the endpoint address, unless a
+			// server name is configured explicitly.
+			host, _, err := net.SplitHostPort(config.Endpoint)
+			if err != nil {
+				return nil, util.StatusWrapfWithCode(err, codes.InvalidArgument, "Invalid Redis endpoint %#v", config.Endpoint)
+			}
+			tlsConfig = tlsConfigProvider(host)
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:      config.Endpoint,
+			DB:        int(config.Db),
+			Password:  config.Password,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
+}
+
+// getDiscoveredRedisTLSConfig returns the TLS configuration for
+// connecting to Redis Cluster nodes and Sentinel monitored servers.
+// These are discovered at runtime, meaning that the server name
+// cannot be derived from the configured endpoints. Without a server
+// name, no server certificate can be validated.
+func getDiscoveredRedisTLSConfig(config *pb.ClientTLSConfiguration, tlsConfigProvider util.ClientTLSConfigProvider) (*tls.Config, error) {
+	if tlsConfigProvider == nil {
+		return nil, nil
+	}
+	if config.ServerName == "" {
+		return nil, status.Error(codes.InvalidArgument, "TLS for Redis Cluster and Sentinel requires a server name")
+	}
+	return tlsConfigProvider(""), nil
+}
+
+// newS3Session creates an AWS session for accessing an S3 bucket.
+func newS3Session(config *pb.S3BlobAccessConfiguration) *session.Session {
+	cfg := aws.Config{
+		Endpoint:         &config.Endpoint,
+		Region:           &config.Region,
+		DisableSSL:       &config.DisableSsl,
+		S3ForcePathStyle: aws.Bool(true),
+	}
+	// If AccessKeyId isn't specified, allow AWS to search for credentials.
+	// In AWS EC2, this search will include the instance IAM Role.
+	if config.AccessKeyId != "" {
+		cfg.Credentials = credentials.NewStaticCredentials(config.AccessKeyId, config.SecretAccessKey, "")
+	}
+	return session.New(&cfg)
+}
@@ -0,0 +1,115 @@
+package configuration
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/go-redis/redis"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// redisScanCount is the number of keys that is requested from Redis
+// per call to SCAN.
+const redisScanCount = 1000
+
+// EnumerateBlobKeysFromConfig calls a function for the key of every
+// object stored in the backends described by a configuration message.
+// Keys use the same format as the ones passed to
+// util.NewDigestFromKey(). Sharded and size distinguishing backends
+// are enumerated by enumerating all of their undrained backends. Only
+// Redis and S3 backends can be enumerated themselves, as the other
+// backends provide no way of listing their contents.
+//
+// Backends may contain objects that are not blobs (e.g., when sharing
+// a Redis database with other applications). Their keys are passed to
+// the function as well, meaning that callers should ignore keys that
+// cannot be parsed.
+func EnumerateBlobKeysFromConfig(ctx context.Context, config *pb.BlobAccessConfiguration, keyFunc func(key string) error) error {
+	if config == nil {
+		return status.Error(codes.InvalidArgument, "Configuration not specified")
+	}
+	switch backend := config.Backend.(type) {
+	case *pb.BlobAccessConfiguration_Redis:
+		client, err := newRedisClient(backend.Redis)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if clusterClient, ok := client.(*redis.ClusterClient); ok {
+			// SCAN only returns the keys stored on a
+			// single node of a Redis Cluster. Nodes are
+			// scanned concurrently.
+			var lock sync.Mutex
+			return clusterClient.ForEachMaster(func(client *redis.Client) error {
+				return enumerateRedisKeys(ctx, client, func(key string) error {
+					lock.Lock()
+					defer lock.Unlock()
+					return keyFunc(key)
+				})
+			})
+		}
+		return enumerateRedisKeys(ctx, client, keyFunc)
+	case *pb.BlobAccessConfiguration_S3:
+		var keyFuncErr error
+		if err := s3.New(newS3Session(backend.S3)).ListObjectsV2PagesWithContext(
+			ctx,
+			&s3.ListObjectsV2Input{
+				Bucket: &backend.S3.Bucket,
+				Prefix: &backend.S3.KeyPrefix,
+			},
+			func(output *s3.ListObjectsV2Output, lastPage bool) bool {
+				for _, object := range output.Contents {
+					key := strings.TrimPrefix(aws.StringValue(object.Key), backend.S3.KeyPrefix)
+					if keyFuncErr = keyFunc(key); keyFuncErr != nil {
+						return false
+					}
+				}
+				return true
+			}); err != nil {
+			return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to list objects in S3 bucket")
+		}
+		return keyFuncErr
+	case *pb.BlobAccessConfiguration_Sharding:
+		for i, shard := range backend.Sharding.Shard {
+			if shard.Backend != nil {
+				if err := EnumerateBlobKeysFromConfig(ctx, shard.Backend, keyFunc); err != nil {
+					return util.StatusWrapf(err, "Shard %d", i)
+				}
+			}
+		}
+		return nil
+	case *pb.BlobAccessConfiguration_SizeDistinguishing:
+		if err := EnumerateBlobKeysFromConfig(ctx, backend.SizeDistinguishing.Small, keyFunc); err != nil {
+			return util.StatusWrap(err, "Small backend")
+		}
+		if err := EnumerateBlobKeysFromConfig(ctx, backend.SizeDistinguishing.Large, keyFunc); err != nil {
+			return util.StatusWrap(err, "Large backend")
+		}
+		return nil
+	default:
+		return status.Error(codes.Unimplemented, "Only Redis, S3, sharding and size distinguishing backends can be enumerated")
+	}
+}
+
+func enumerateRedisKeys(ctx context.Context, client redis.Cmdable, keyFunc func(key string) error) error {
+	iterator := client.Scan(0, "", redisScanCount).Iterator()
+	for iterator.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := keyFunc(iterator.Val()); err != nil {
+			return err
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to scan Redis keys")
+	}
+	return nil
+}
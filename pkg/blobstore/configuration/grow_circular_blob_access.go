@@ -0,0 +1,106 @@
+package configuration
+
+import (
+	"os"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/circular"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// growableCircularBackend keeps track of a circular backend whose data
+// files are specified explicitly, so that data files may be appended
+// to it when the storage configuration is reloaded.
+type growableCircularBackend struct {
+	blobAccess circular.GrowableBlobAccess
+	dataFile   circular.ConcatenatedReadWriterAt
+	dataFiles  []*pb.CircularBlobAccessConfiguration_DataFile
+}
+
+var (
+	growableCircularBackendsLock sync.Mutex
+	growableCircularBackends     = map[string]*growableCircularBackend{}
+)
+
+// registerGrowableCircularBackend registers a circular backend that
+// has been created, so that it may be grown by growCircularBackends().
+// Backends are identified by their directory, as this contains the
+// state file that may only be used by a single backend.
+func registerGrowableCircularBackend(directory string, backend *growableCircularBackend) {
+	growableCircularBackendsLock.Lock()
+	growableCircularBackends[directory] = backend
+	growableCircularBackendsLock.Unlock()
+}
+
+// growCircularBackends applies a change to the storage configuration
+// that consists of appending data files to circular backends. Changes
+// of any other kind are rejected, as circular backends cannot be
+// recreated without restarting.
+func growCircularBackends(oldConfig *pb.BlobstoreConfiguration, newConfig *pb.BlobstoreConfiguration) error {
+	oldDataFileCounts := map[string]int{}
+	forEachCircularBackend(oldConfig, func(config *pb.CircularBlobAccessConfiguration) {
+		oldDataFileCounts[config.Directory] = len(config.DataFiles)
+	})
+
+	// Remove the appended data files from the new configuration.
+	// What remains should be identical to the old configuration.
+	trimmedConfig := proto.Clone(newConfig).(*pb.BlobstoreConfiguration)
+	grownDataFiles := map[string][]*pb.CircularBlobAccessConfiguration_DataFile{}
+	forEachCircularBackend(trimmedConfig, func(config *pb.CircularBlobAccessConfiguration) {
+		if count, ok := oldDataFileCounts[config.Directory]; ok && count > 0 && len(config.DataFiles) > count {
+			grownDataFiles[config.Directory] = config.DataFiles
+			config.DataFiles = config.DataFiles[:count]
+		}
+	})
+	if !proto.Equal(oldConfig, trimmedConfig) {
+		return status.Error(codes.InvalidArgument, "Configuration contains changes other than data files being appended to circular backends")
+	}
+
+	for directory, dataFiles := range grownDataFiles {
+		if err := growCircularBackend(directory, dataFiles); err != nil {
+			return util.StatusWrapf(err, "Failed to grow circular backend in directory %#v", directory)
+		}
+	}
+	return nil
+}
+
+func growCircularBackend(directory string, dataFiles []*pb.CircularBlobAccessConfiguration_DataFile) error {
+	growableCircularBackendsLock.Lock()
+	defer growableCircularBackendsLock.Unlock()
+
+	backend, ok := growableCircularBackends[directory]
+	if !ok {
+		return status.Error(codes.FailedPrecondition, "Circular backend was not created with explicitly specified data files")
+	}
+
+	// Data files may already have been appended by a previous
+	// attempt that failed to grow the data store. Only open the
+	// ones that are actually new.
+	if len(dataFiles) < len(backend.dataFiles) {
+		return status.Error(codes.FailedPrecondition, "Data files that have been appended previously cannot be removed")
+	}
+	for i, dataFileConfiguration := range backend.dataFiles {
+		if !proto.Equal(dataFileConfiguration, dataFiles[i]) {
+			return status.Errorf(codes.FailedPrecondition, "Data file %d has been changed after being appended previously", i)
+		}
+	}
+	for _, dataFileConfiguration := range dataFiles[len(backend.dataFiles):] {
+		file, err := os.OpenFile(dataFileConfiguration.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to open data file %#v", dataFileConfiguration.Path)
+		}
+		backend.dataFile.Append(file, dataFileConfiguration.SizeBytes)
+		backend.dataFiles = append(backend.dataFiles, dataFileConfiguration)
+	}
+
+	var dataFileSizeBytes uint64
+	for _, dataFileConfiguration := range backend.dataFiles {
+		dataFileSizeBytes += dataFileConfiguration.SizeBytes
+	}
+	return backend.blobAccess.Grow(dataFileSizeBytes)
+}
@@ -0,0 +1,129 @@
+package configuration
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	"github.com/golang/protobuf/proto"
+)
+
+// configurationFilePollInterval is the interval at which the
+// modification time of the configuration file is checked.
+const configurationFilePollInterval = 10 * time.Second
+
+// ReloadBlobAccessObjectsOnChange launches a goroutine that recreates
+// the backends of the BlobAccess objects returned by
+// CreateBlobAccessObjectsFromConfig() when the process receives
+// SIGHUP, or when the modification time of the configuration file
+// changes. The loadConfig function is called to obtain the new
+// configuration. As files included by the configuration file are not
+// watched, SIGHUP needs to be sent when modifying these.
+//
+// Backends are only recreated if the configuration actually changed.
+// If creating the new backends fails, the existing backends remain in
+// use. Configurations containing circular backends are never
+// recreated, as their data files may not be opened by multiple
+// instances at the same time. The only change that may be made to
+// these without restarting is appending data files to circular
+// backends, which grows them in place.
+func ReloadBlobAccessObjectsOnChange(configurationFile string, config *pb.BlobstoreConfiguration, contentAddressableStorage blobstore.SwappableBlobAccess, actionCache blobstore.SwappableBlobAccess, loadConfig func() (*pb.BlobstoreConfiguration, error)) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	ticker := time.NewTicker(configurationFilePollInterval)
+	modTime := getModTime(configurationFile)
+
+	go func() {
+		for {
+			select {
+			case <-hangups:
+				log.Print("Received SIGHUP, reloading storage configuration")
+			case <-ticker.C:
+				newModTime := getModTime(configurationFile)
+				if newModTime.Equal(modTime) {
+					continue
+				}
+				modTime = newModTime
+				log.Printf("Configuration file %#v modified, reloading storage configuration", configurationFile)
+			}
+
+			newConfig, err := loadConfig()
+			if err != nil {
+				log.Print("Failed to reload storage configuration: ", err)
+				continue
+			}
+			if proto.Equal(config, newConfig) {
+				log.Print("Storage configuration unchanged")
+				continue
+			}
+			if containsCircularBackend(config) || containsCircularBackend(newConfig) {
+				if err := growCircularBackends(config, newConfig); err != nil {
+					log.Print("Not reloading storage configuration, as circular backends can only be changed by restarting, except for appending data files: ", err)
+					continue
+				}
+				config = newConfig
+				log.Print("Data files appended to circular backends")
+				continue
+			}
+			if err := SwapBlobAccessObjectsFromConfig(contentAddressableStorage, actionCache, newConfig); err != nil {
+				log.Print("Failed to create storage backends, continuing to use the previous configuration: ", err)
+				continue
+			}
+			config = newConfig
+			log.Print("Storage configuration reloaded")
+		}
+	}()
+}
+
+func getModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Failed to check configuration file %#v for modifications: %s", path, err)
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func containsCircularBackend(config *pb.BlobstoreConfiguration) bool {
+	found := false
+	forEachCircularBackend(config, func(config *pb.CircularBlobAccessConfiguration) {
+		found = true
+	})
+	return found
+}
+
+// forEachCircularBackend calls a function for every circular backend
+// contained in a storage configuration.
+func forEachCircularBackend(config *pb.BlobstoreConfiguration, fn func(config *pb.CircularBlobAccessConfiguration)) {
+	if config != nil {
+		forEachCircularBackendInBlobAccess(config.ContentAddressableStorage, fn)
+		forEachCircularBackendInBlobAccess(config.ActionCache, fn)
+	}
+}
+
+func forEachCircularBackendInBlobAccess(config *pb.BlobAccessConfiguration, fn func(config *pb.CircularBlobAccessConfiguration)) {
+	if config == nil {
+		return
+	}
+	switch backend := config.Backend.(type) {
+	case *pb.BlobAccessConfiguration_Circular:
+		fn(backend.Circular)
+	case *pb.BlobAccessConfiguration_Sharding:
+		for _, shard := range backend.Sharding.Shard {
+			forEachCircularBackendInBlobAccess(shard.Backend, fn)
+		}
+	case *pb.BlobAccessConfiguration_Demultiplexing:
+		for _, demultiplexed := range backend.Demultiplexing.InstanceNamePrefixes {
+			if demultiplexed != nil {
+				forEachCircularBackendInBlobAccess(demultiplexed.Backend, fn)
+			}
+		}
+	case *pb.BlobAccessConfiguration_SizeDistinguishing:
+		forEachCircularBackendInBlobAccess(backend.SizeDistinguishing.Small, fn)
+		forEachCircularBackendInBlobAccess(backend.SizeDistinguishing.Large, fn)
+	}
+}
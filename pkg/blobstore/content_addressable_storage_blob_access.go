@@ -67,9 +67,9 @@ func (ba *contentAddressableStorageBlobAccess) Get(ctx context.Context, digest *
 	var readRequest bytestream.ReadRequest
 	sizeBytes := digest.GetSizeBytes()
 	if instance := digest.GetInstance(); instance == "" {
-		readRequest.ResourceName = fmt.Sprintf("blobs/%s/%d", digest.GetHashString(), sizeBytes)
+		readRequest.ResourceName = digest.GetByteStreamPath()
 	} else {
-		readRequest.ResourceName = fmt.Sprintf("%s/blobs/%s/%d", instance, digest.GetHashString(), sizeBytes)
+		readRequest.ResourceName = fmt.Sprintf("%s/%s", instance, digest.GetByteStreamPath())
 	}
 	client, err := ba.byteStreamClient.Read(ctx, &readRequest)
 	if err != nil {
@@ -99,9 +99,9 @@ func (ba *contentAddressableStorageBlobAccess) Put(ctx context.Context, digest *
 
 	var resourceName string
 	if instance := digest.GetInstance(); instance == "" {
-		resourceName = fmt.Sprintf("uploads/%s/blobs/%s/%d", uuid.Must(uuid.NewRandom()), digest.GetHashString(), digest.GetSizeBytes())
+		resourceName = fmt.Sprintf("uploads/%s/%s", uuid.Must(uuid.NewRandom()), digest.GetByteStreamPath())
 	} else {
-		resourceName = fmt.Sprintf("%s/uploads/%s/blobs/%s/%d", instance, uuid.Must(uuid.NewRandom()), digest.GetHashString(), digest.GetSizeBytes())
+		resourceName = fmt.Sprintf("%s/uploads/%s/%s", instance, uuid.Must(uuid.NewRandom()), digest.GetByteStreamPath())
 	}
 
 	writeOffset := int64(0)
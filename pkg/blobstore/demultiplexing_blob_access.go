@@ -0,0 +1,166 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DemultiplexedBackend is a backend to which DemultiplexingBlobAccess
+// forwards requests for instance names having a certain prefix.
+type DemultiplexedBackend struct {
+	// The backend to which requests are forwarded.
+	BlobAccess BlobAccess
+
+	// The prefix of the instance name that matched is removed when
+	// forwarding requests. This prefix is prepended to the
+	// remainder of the instance name instead.
+	AddInstanceNamePrefix string
+}
+
+type demultiplexedBackend struct {
+	DemultiplexedBackend
+	instanceNamePrefix string
+}
+
+type demultiplexingBlobAccess struct {
+	backends []demultiplexedBackend
+}
+
+// NewDemultiplexingBlobAccess creates a BlobAccess that forwards
+// requests to one of multiple backends, based on the instance name
+// contained in the digest. Backends are keyed by instance name prefix.
+// Prefixes match entire pathname components, meaning that prefix "a"
+// matches instance names "a" and "a/b", but not "ab". The empty prefix
+// matches all instance names. If multiple prefixes match, the longest
+// one is used.
+func NewDemultiplexingBlobAccess(backends map[string]DemultiplexedBackend) BlobAccess {
+	ba := &demultiplexingBlobAccess{}
+	for instanceNamePrefix, backend := range backends {
+		ba.backends = append(ba.backends, demultiplexedBackend{
+			DemultiplexedBackend: backend,
+			instanceNamePrefix:   instanceNamePrefix,
+		})
+	}
+	sort.Slice(ba.backends, func(i int, j int) bool {
+		return len(ba.backends[i].instanceNamePrefix) > len(ba.backends[j].instanceNamePrefix)
+	})
+	return ba
+}
+
+// getBackend returns the index of the backend to which requests for a
+// digest should be forwarded, and the digest with its instance name
+// rewritten.
+func (ba *demultiplexingBlobAccess) getBackend(digest *util.Digest) (int, *util.Digest, error) {
+	instance := digest.GetInstance()
+	for i, backend := range ba.backends {
+		prefix := backend.instanceNamePrefix
+		var remainder string
+		if prefix == "" {
+			remainder = instance
+		} else if instance == prefix {
+			remainder = ""
+		} else if strings.HasPrefix(instance, prefix+"/") {
+			remainder = instance[len(prefix)+1:]
+		} else {
+			continue
+		}
+
+		newInstance := backend.AddInstanceNamePrefix
+		if newInstance == "" {
+			newInstance = remainder
+		} else if remainder != "" {
+			newInstance += "/" + remainder
+		}
+		if newInstance == instance {
+			return i, digest, nil
+		}
+		return i, digest.NewDigestWithInstance(newInstance), nil
+	}
+	return 0, nil, status.Errorf(codes.InvalidArgument, "No storage backend configured for instance %#v", instance)
+}
+
+func (ba *demultiplexingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	index, newDigest, err := ba.getBackend(digest)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ba.backends[index].BlobAccess.Get(ctx, newDigest)
+}
+
+func (ba *demultiplexingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	index, newDigest, err := ba.getBackend(digest)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	return ba.backends[index].BlobAccess.Put(ctx, newDigest, sizeBytes, r)
+}
+
+func (ba *demultiplexingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	index, newDigest, err := ba.getBackend(digest)
+	if err != nil {
+		return err
+	}
+	return ba.backends[index].BlobAccess.Delete(ctx, newDigest)
+}
+
+func (ba *demultiplexingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Determine which backends to contact, keeping track of the
+	// original digests, so that results can be translated back.
+	digestsPerBackend := map[int][]*util.Digest{}
+	originalDigestsPerBackend := map[int]map[string]*util.Digest{}
+	for _, digest := range digests {
+		index, newDigest, err := ba.getBackend(digest)
+		if err != nil {
+			return nil, err
+		}
+		digestsPerBackend[index] = append(digestsPerBackend[index], newDigest)
+		originalDigests, ok := originalDigestsPerBackend[index]
+		if !ok {
+			originalDigests = map[string]*util.Digest{}
+			originalDigestsPerBackend[index] = originalDigests
+		}
+		originalDigests[newDigest.GetKey(util.DigestKeyWithInstance)] = digest
+	}
+
+	// Asynchronously call FindMissing() on backends.
+	type indexedResults struct {
+		index int
+		findMissingResults
+	}
+	resultsChan := make(chan indexedResults, len(digestsPerBackend))
+	for index, digests := range digestsPerBackend {
+		go func(index int, digests []*util.Digest) {
+			resultsChan <- indexedResults{
+				index:              index,
+				findMissingResults: callFindMissing(ctx, ba.backends[index].BlobAccess, digests),
+			}
+		}(index, digests)
+	}
+
+	// Recombine results.
+	var missingDigests []*util.Digest
+	var err error
+	for i := 0; i < len(digestsPerBackend); i++ {
+		results := <-resultsChan
+		if results.err == nil {
+			originalDigests := originalDigestsPerBackend[results.index]
+			for _, digest := range results.missing {
+				missingDigests = append(missingDigests, originalDigests[digest.GetKey(util.DigestKeyWithInstance)])
+			}
+		} else {
+			err = results.err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return missingDigests, nil
+}
@@ -0,0 +1,90 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDemultiplexingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	releaseBlobAccess := mock.NewMockBlobAccess(ctrl)
+	devBlobAccess := mock.NewMockBlobAccess(ctrl)
+	blobAccess := blobstore.NewDemultiplexingBlobAccess(map[string]blobstore.DemultiplexedBackend{
+		"release": {
+			BlobAccess:            releaseBlobAccess,
+			AddInstanceNamePrefix: "release",
+		},
+		"dev": {
+			BlobAccess: devBlobAccess,
+		},
+		"dev/team": {
+			BlobAccess:            releaseBlobAccess,
+			AddInstanceNamePrefix: "shared",
+		},
+	})
+	partialDigest := &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}
+
+	t.Run("GetUnmodified", func(t *testing.T) {
+		releaseBlobAccess.EXPECT().Get(ctx, util.MustNewDigest("release/linux", partialDigest)).
+			Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+		length, r, err := blobAccess.Get(ctx, util.MustNewDigest("release/linux", partialDigest))
+		require.NoError(t, err)
+		require.Equal(t, int64(5), length)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("PutStripped", func(t *testing.T) {
+		devBlobAccess.EXPECT().Put(ctx, util.MustNewDigest("", partialDigest), int64(5), gomock.Any()).Return(nil)
+		require.NoError(t, blobAccess.Put(ctx, util.MustNewDigest("dev", partialDigest), 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	})
+
+	t.Run("DeleteLongestPrefix", func(t *testing.T) {
+		releaseBlobAccess.EXPECT().Delete(ctx, util.MustNewDigest("shared/frontend", partialDigest)).Return(nil)
+		require.NoError(t, blobAccess.Delete(ctx, util.MustNewDigest("dev/team/frontend", partialDigest)))
+	})
+
+	t.Run("UnknownInstance", func(t *testing.T) {
+		// Prefixes should only match entire pathname components.
+		_, _, err := blobAccess.Get(ctx, util.MustNewDigest("releases", partialDigest))
+		require.Equal(t, status.Error(codes.InvalidArgument, "No storage backend configured for instance \"releases\""), err)
+	})
+
+	t.Run("FindMissing", func(t *testing.T) {
+		releaseBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{
+			util.MustNewDigest("release", partialDigest),
+		}).Return(nil, nil)
+		devBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{
+			util.MustNewDigest("linux", partialDigest),
+		}).Return([]*util.Digest{
+			util.MustNewDigest("linux", partialDigest),
+		}, nil)
+
+		// Missing digests should be reported using their original
+		// instance names.
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{
+			util.MustNewDigest("release", partialDigest),
+			util.MustNewDigest("dev/linux", partialDigest),
+		})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{
+			util.MustNewDigest("dev/linux", partialDigest),
+		}, missing)
+	})
+}
@@ -2,7 +2,6 @@ package blobstore
 
 import (
 	"context"
-	"fmt"
 	"io"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
@@ -34,7 +33,7 @@ func (ba *existencePreconditionBlobAccess) Get(ctx context.Context, digest *util
 				Violations: []*errdetails.PreconditionFailure_Violation{
 					{
 						Type:    "MISSING",
-						Subject: fmt.Sprintf("blobs/%s/%d", digest.GetHashString(), digest.GetSizeBytes()),
+						Subject: digest.GetByteStreamPath(),
 					},
 				},
 			})
@@ -0,0 +1,67 @@
+package blobstore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// findMissingInParallel can be used by implementations of
+// BlobAccess.FindMissing() for backends that can only check for the
+// existence of a single blob at a time. It calls an existence check for
+// every digest, while running at most concurrency checks in parallel.
+// No further checks are started once a check fails or the context is
+// cancelled.
+func findMissingInParallel(ctx context.Context, digests []*util.Digest, concurrency int, exists func(ctx context.Context, digest *util.Digest) (bool, error)) ([]*util.Digest, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	isMissing := make([]bool, len(digests))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	for i, digest := range digests {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int, digest *util.Digest) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			found, err := exists(ctx, digest)
+			if err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				errLock.Unlock()
+				return
+			}
+			isMissing[i] = !found
+		}(i, digest)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []*util.Digest
+	for i, digest := range digests {
+		if isMissing[i] {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
@@ -5,24 +5,36 @@ import (
 	"context"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/go-redis/redis"
 
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type redisBlobAccess struct {
-	redisClient   *redis.Client
-	blobKeyFormat util.DigestKeyFormat
+	redisClient          redis.Cmdable
+	blobKeyFormat        util.DigestKeyFormat
+	keyTTL               time.Duration
+	maximumBlobSizeBytes int64
 }
 
 // NewRedisBlobAccess creates a BlobAccess that uses Redis as its
-// backing store.
-func NewRedisBlobAccess(redisClient *redis.Client, blobKeyFormat util.DigestKeyFormat) BlobAccess {
+// backing store. The client may be connected to a single server, a
+// Redis Cluster or a server monitored by Redis Sentinels.
+//
+// If keyTTL is positive, keys are stored with an expiration time,
+// which is refreshed every time a blob is read or its existence is
+// checked. If maximumBlobSizeBytes is positive, attempts to store
+// blobs larger than it are rejected.
+func NewRedisBlobAccess(redisClient redis.Cmdable, blobKeyFormat util.DigestKeyFormat, keyTTL time.Duration, maximumBlobSizeBytes int64) BlobAccess {
 	return &redisBlobAccess{
-		redisClient:   redisClient,
-		blobKeyFormat: blobKeyFormat,
+		redisClient:          redisClient,
+		blobKeyFormat:        blobKeyFormat,
+		keyTTL:               keyTTL,
+		maximumBlobSizeBytes: maximumBlobSizeBytes,
 	}
 }
 
@@ -30,7 +42,24 @@ func (ba *redisBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64,
 	if err := ctx.Err(); err != nil {
 		return 0, nil, err
 	}
-	value, err := ba.redisClient.Get(digest.GetKey(ba.blobKeyFormat)).Bytes()
+	key := digest.GetKey(ba.blobKeyFormat)
+	var value []byte
+	var err error
+	if ba.keyTTL > 0 {
+		// Refresh the expiration time of the key as part of
+		// the same round trip.
+		var getCmd *redis.StringCmd
+		_, err = ba.redisClient.Pipelined(func(pipeline redis.Pipeliner) error {
+			getCmd = pipeline.Get(key)
+			pipeline.Expire(key, ba.keyTTL)
+			return nil
+		})
+		if err == nil || err == redis.Nil {
+			value, err = getCmd.Bytes()
+		}
+	} else {
+		value, err = ba.redisClient.Get(key).Bytes()
+	}
 	if err != nil {
 		if err == redis.Nil {
 			return 0, nil, util.StatusWrapWithCode(err, codes.NotFound, "Failed to get blob")
@@ -45,12 +74,19 @@ func (ba *redisBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeByt
 		r.Close()
 		return err
 	}
+	if ba.maximumBlobSizeBytes > 0 && sizeBytes > ba.maximumBlobSizeBytes {
+		r.Close()
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while this backend is limited to %d bytes", sizeBytes, ba.maximumBlobSizeBytes)
+	}
 	value, err := ioutil.ReadAll(r)
 	r.Close()
 	if err != nil {
 		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to put blob")
 	}
-	return ba.redisClient.Set(digest.GetKey(ba.blobKeyFormat), value, 0).Err()
+	if err := ba.redisClient.Set(digest.GetKey(ba.blobKeyFormat), value, ba.keyTTL).Err(); err != nil {
+		return util.StatusWrapWithCode(err, codes.Unavailable, "Failed to put blob")
+	}
+	return nil
 }
 
 func (ba *redisBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
@@ -68,19 +104,28 @@ func (ba *redisBlobAccess) FindMissing(ctx context.Context, digests []*util.Dige
 		return nil, nil
 	}
 
-	// Execute "EXISTS" requests all in a single pipeline.
+	// Execute "EXISTS" requests all in a single pipeline. If keys
+	// have an expiration time, use "EXPIRE" instead, as it also
+	// indicates whether keys exist, while refreshing them.
 	pipeline := ba.redisClient.Pipeline()
-	var cmds []*redis.IntCmd
+	var existsFuncs []func() bool
 	for _, digest := range digests {
-		cmds = append(cmds, pipeline.Exists(digest.GetKey(ba.blobKeyFormat)))
+		key := digest.GetKey(ba.blobKeyFormat)
+		if ba.keyTTL > 0 {
+			cmd := pipeline.Expire(key, ba.keyTTL)
+			existsFuncs = append(existsFuncs, cmd.Val)
+		} else {
+			cmd := pipeline.Exists(key)
+			existsFuncs = append(existsFuncs, func() bool { return cmd.Val() != 0 })
+		}
 	}
 	if _, err := pipeline.Exec(); err != nil {
 		return nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to find missing blobs")
 	}
 
 	var missing []*util.Digest
-	for i, cmd := range cmds {
-		if cmd.Val() == 0 {
+	for i, exists := range existsFuncs {
+		if !exists() {
 			missing = append(missing, digests[i])
 		}
 	}
@@ -0,0 +1,178 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/alicebob/miniredis"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestRedisClient creates a Redis client connected to an in-memory
+// Redis server. Every round trip made by the client is recorded as a
+// list of command names, so that tests can validate that commands are
+// pipelined.
+func newTestRedisClient(t *testing.T) (*miniredis.Miniredis, *redis.Client, *[][]string) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	var roundTrips [][]string
+	client.WrapProcess(func(oldProcess func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			roundTrips = append(roundTrips, []string{cmd.Name()})
+			return oldProcess(cmd)
+		}
+	})
+	client.WrapProcessPipeline(func(oldProcess func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			var names []string
+			for _, cmd := range cmds {
+				names = append(names, cmd.Name())
+			}
+			roundTrips = append(roundTrips, names)
+			return oldProcess(cmds)
+		}
+	})
+	return server, client, &roundTrips
+}
+
+var (
+	redisTestDigestPresent = util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969",
+		SizeBytes: 5,
+	})
+	redisTestDigestAbsent = util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "78ae647dc5544d227130a0682a51e30bc7777fbb6d8a8f17007463a3ecd1d524",
+		SizeBytes: 5,
+	})
+)
+
+func TestRedisBlobAccessWithoutTTL(t *testing.T) {
+	ctx := context.Background()
+	server, client, roundTrips := newTestRedisClient(t)
+	defer server.Close()
+	defer client.Close()
+	blobAccess := blobstore.NewRedisBlobAccess(client, util.DigestKeyWithoutInstance, 0, 0)
+
+	// Keys should be stored without an expiration time.
+	require.NoError(t, blobAccess.Put(ctx, redisTestDigestPresent, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	value, err := server.Get("185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969-5")
+	require.NoError(t, err)
+	require.Equal(t, "Hello", value)
+	require.Equal(t, time.Duration(0), server.TTL("185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969-5"))
+
+	// Reading should not require pipelining.
+	sizeBytes, r, err := blobAccess.Get(ctx, redisTestDigestPresent)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), sizeBytes)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+
+	_, _, err = blobAccess.Get(ctx, redisTestDigestAbsent)
+	require.Equal(t, status.Error(codes.NotFound, "Failed to get blob: redis: nil"), err)
+
+	// Existence should be checked using EXISTS, which does not
+	// create any keys.
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{redisTestDigestPresent, redisTestDigestAbsent})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{redisTestDigestAbsent}, missing)
+	require.Equal(t, []string{"185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969-5"}, server.Keys())
+
+	require.Equal(t, [][]string{
+		{"set"},
+		{"get"},
+		{"get"},
+		{"exists", "exists"},
+	}, *roundTrips)
+}
+
+func TestRedisBlobAccessWithTTL(t *testing.T) {
+	ctx := context.Background()
+	server, client, roundTrips := newTestRedisClient(t)
+	defer server.Close()
+	defer client.Close()
+	blobAccess := blobstore.NewRedisBlobAccess(client, util.DigestKeyWithInstance, time.Hour, 0)
+	key := "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969-5-debian8"
+
+	// Keys should be stored with an expiration time.
+	require.NoError(t, blobAccess.Put(ctx, redisTestDigestPresent, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	require.Equal(t, time.Hour, server.TTL(key))
+
+	// Reading a blob should refresh its expiration time as part of
+	// the same round trip.
+	server.FastForward(45 * time.Minute)
+	require.Equal(t, 15*time.Minute, server.TTL(key))
+	sizeBytes, r, err := blobAccess.Get(ctx, redisTestDigestPresent)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), sizeBytes)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+	require.Equal(t, time.Hour, server.TTL(key))
+
+	_, _, err = blobAccess.Get(ctx, redisTestDigestAbsent)
+	require.Equal(t, status.Error(codes.NotFound, "Failed to get blob: redis: nil"), err)
+
+	// Checking for existence should use EXPIRE, which also
+	// refreshes the expiration time, without creating any keys.
+	server.FastForward(45 * time.Minute)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{redisTestDigestPresent, redisTestDigestAbsent})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{redisTestDigestAbsent}, missing)
+	require.Equal(t, time.Hour, server.TTL(key))
+	require.Equal(t, []string{key}, server.Keys())
+
+	// Blobs that are not accessed should expire.
+	server.FastForward(time.Hour)
+	_, _, err = blobAccess.Get(ctx, redisTestDigestPresent)
+	require.Equal(t, status.Error(codes.NotFound, "Failed to get blob: redis: nil"), err)
+	missing, err = blobAccess.FindMissing(ctx, []*util.Digest{redisTestDigestPresent})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{redisTestDigestPresent}, missing)
+
+	require.Equal(t, [][]string{
+		{"set"},
+		{"get", "expire"},
+		{"get", "expire"},
+		{"expire", "expire"},
+		{"get", "expire"},
+		{"expire"},
+	}, *roundTrips)
+}
+
+func TestRedisBlobAccessMaximumBlobSize(t *testing.T) {
+	ctx := context.Background()
+	server, client, roundTrips := newTestRedisClient(t)
+	defer server.Close()
+	defer client.Close()
+	blobAccess := blobstore.NewRedisBlobAccess(client, util.DigestKeyWithoutInstance, 0, 4)
+
+	// Blobs exceeding the maximum size should be rejected without
+	// contacting Redis.
+	require.Equal(
+		t,
+		status.Error(codes.InvalidArgument, "Blob is 5 bytes in size, while this backend is limited to 4 bytes"),
+		blobAccess.Put(ctx, redisTestDigestPresent, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	require.Empty(t, server.Keys())
+	require.Empty(t, *roundTrips)
+
+	// Blobs within the limit should be stored.
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "a9993e364706816aba3e25717850c26c9cd0d89d",
+		SizeBytes: 3,
+	})
+	require.NoError(t, blobAccess.Put(ctx, digest, 3, ioutil.NopCloser(bytes.NewBufferString("abc"))))
+	require.Equal(t, []string{"a9993e364706816aba3e25717850c26c9cd0d89d-3"}, server.Keys())
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
@@ -15,36 +16,93 @@ import (
 )
 
 type remoteBlobAccess struct {
-	address string
-	prefix  string
+	client                 *http.Client
+	address                string
+	prefix                 string
+	authorization          string
+	findMissingConcurrency int
 }
 
 func convertHTTPUnexpectedStatus(resp *http.Response) error {
-	return status.Errorf(codes.Unknown, "Unexpected status code from remote cache: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	code := codes.Unknown
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage, http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	case http.StatusNotImplemented:
+		code = codes.Unimplemented
+	case http.StatusInternalServerError:
+		code = codes.Internal
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Errorf(code, "Unexpected status code from remote cache: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
 }
 
 // NewRemoteBlobAccess for use of HTTP/1.1 cache backend.
 //
+// Requests are sent through the provided HTTP client, which may be
+// configured to use TLS and request timeouts. If authorization is
+// non-empty, it is sent as the value of the Authorization header of
+// every request (e.g., "Bearer <token>"). FindMissing() issues up to
+// findMissingConcurrency HEAD requests in parallel.
+//
 // See: https://docs.bazel.build/versions/master/remote-caching.html#http-caching-protocol
-func NewRemoteBlobAccess(address, prefix string) BlobAccess {
+func NewRemoteBlobAccess(client *http.Client, address, prefix string, authorization string, findMissingConcurrency int) BlobAccess {
 	return &remoteBlobAccess{
-		address: address,
-		prefix:  prefix,
+		client:                 client,
+		address:                address,
+		prefix:                 prefix,
+		authorization:          authorization,
+		findMissingConcurrency: findMissingConcurrency,
 	}
 }
 
-func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+func (ba *remoteBlobAccess) do(ctx context.Context, method string, digest *util.Digest, body io.ReadCloser, contentLength int64) (*http.Response, error) {
 	url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-	resp, err := ctxhttp.Get(ctx, http.DefaultClient, url)
+	if digestFunction := digest.GetDigestFunction(); !digestFunction.IsInferable() {
+		// Prevent collisions with hashes of the same length.
+		url = fmt.Sprintf("%s/%s/%s/%s", ba.address, ba.prefix, digestFunction, digest.GetHashString())
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create request")
+	}
+	if ba.authorization != "" {
+		req.Header.Set("Authorization", ba.authorization)
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	resp, err := ctxhttp.Do(ctx, ba.client, req)
+	if err != nil {
+		return nil, util.StatusWrapWithCode(err, codes.Unavailable, "Failed to contact remote cache")
+	}
+	return resp, nil
+}
+
+func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	resp, err := ba.do(ctx, http.MethodGet, digest, nil, 0)
 	if err != nil {
-		fmt.Printf("Error getting digest. %s\n", err)
 		return 0, nil, err
 	}
 
 	switch resp.StatusCode {
 	case http.StatusNotFound:
 		resp.Body.Close()
-		return 0, nil, status.Error(codes.NotFound, url)
+		return 0, nil, status.Error(codes.NotFound, "Blob not found in remote cache")
 	case http.StatusOK:
 		return resp.ContentLength, resp.Body, nil
 	default:
@@ -54,15 +112,16 @@ func (ba *remoteBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64
 }
 
 func (ba *remoteBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
-	url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-	req, err := http.NewRequest(http.MethodPut, url, r)
+	resp, err := ba.do(ctx, http.MethodPut, digest, r, sizeBytes)
 	if err != nil {
-		r.Close()
 		return err
 	}
-	req.ContentLength = sizeBytes
-	_, err = ctxhttp.Do(ctx, http.DefaultClient, req)
-	return err
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return convertHTTPUnexpectedStatus(resp)
+	}
+	return nil
 }
 
 func (ba *remoteBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
@@ -70,23 +129,19 @@ func (ba *remoteBlobAccess) Delete(ctx context.Context, digest *util.Digest) err
 }
 
 func (ba *remoteBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	var missing []*util.Digest
-	for _, digest := range digests {
-		url := fmt.Sprintf("%s/%s/%s", ba.address, ba.prefix, digest.GetHashString())
-		resp, err := ctxhttp.Head(ctx, http.DefaultClient, url)
+	return findMissingInParallel(ctx, digests, ba.findMissingConcurrency, func(ctx context.Context, digest *util.Digest) (bool, error) {
+		resp, err := ba.do(ctx, http.MethodHead, digest, nil, 0)
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-
+		resp.Body.Close()
 		switch resp.StatusCode {
 		case http.StatusNotFound:
-			missing = append(missing, digest)
+			return false, nil
 		case http.StatusOK:
-			continue
+			return true, nil
 		default:
-			return nil, convertHTTPUnexpectedStatus(resp)
+			return false, convertHTTPUnexpectedStatus(resp)
 		}
-	}
-
-	return missing, nil
+	})
 }
@@ -0,0 +1,165 @@
+package blobstore_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeRemoteCache is a minimal implementation of Bazel's HTTP caching
+// protocol that requires requests to be authorized.
+type fakeRemoteCache struct {
+	lock          sync.Mutex
+	objects       map[string][]byte
+	putStatusCode int
+	requests      int
+}
+
+func (c *fakeRemoteCache) getRequests() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.requests
+}
+
+func (c *fakeRemoteCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests++
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data, ok := c.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if c.putStatusCode != http.StatusOK {
+			w.WriteHeader(c.putStatusCode)
+			return
+		}
+		c.objects[r.URL.Path] = data
+	}
+}
+
+func TestRemoteBlobAccess(t *testing.T) {
+	cache := &fakeRemoteCache{
+		objects:       map[string][]byte{},
+		putStatusCode: http.StatusOK,
+	}
+	server := httptest.NewServer(cache)
+	defer server.Close()
+	blobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", "Bearer token", 4)
+	ctx := context.Background()
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	t.Run("GetNotFound", func(t *testing.T) {
+		_, _, err := blobAccess.Get(ctx, digest)
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("PutSuccess", func(t *testing.T) {
+		require.NoError(t, blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(strings.NewReader("Hello"))))
+		require.Equal(t, []byte("Hello"), cache.objects["/cas/8b1a9953c4611296a827abf8c47804d7"])
+	})
+
+	t.Run("GetSuccess", func(t *testing.T) {
+		length, r, err := blobAccess.Get(ctx, digest)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), length)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("PutInsufficientStorage", func(t *testing.T) {
+		cache.putStatusCode = http.StatusInsufficientStorage
+		defer func() { cache.putStatusCode = http.StatusOK }()
+		err := blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(strings.NewReader("Hello")))
+		require.Equal(t, status.Error(codes.ResourceExhausted, "Unexpected status code from remote cache: 507 - Insufficient Storage"), err)
+	})
+
+	t.Run("FindMissing", func(t *testing.T) {
+		var digests, expectedMissing []*util.Digest
+		for i := 0; i < 20; i++ {
+			hash := fmt.Sprintf("8b1a9953c4611296a827abf8c47804%02d", i)
+			digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+				Hash:      hash,
+				SizeBytes: 5,
+			})
+			digests = append(digests, digest)
+			if i%3 == 0 {
+				cache.objects["/cas/"+hash] = []byte("Hello")
+			} else {
+				expectedMissing = append(expectedMissing, digest)
+			}
+		}
+		missing, err := blobAccess.FindMissing(ctx, digests)
+		require.NoError(t, err)
+		require.Equal(t, expectedMissing, missing)
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		unauthenticatedBlobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", "", 4)
+		_, err := unauthenticatedBlobAccess.FindMissing(ctx, []*util.Digest{digest})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("FindMissingStopsAfterFailure", func(t *testing.T) {
+		// No further requests should be issued once a request
+		// has failed.
+		unauthenticatedBlobAccess := blobstore.NewRemoteBlobAccess(http.DefaultClient, server.URL, "cas", "", 1)
+		var digests []*util.Digest
+		for i := 0; i < 20; i++ {
+			digests = append(digests, util.MustNewDigest("debian8", &remoteexecution.Digest{
+				Hash:      fmt.Sprintf("8b1a9953c4611296a827abf8c47804%02d", i),
+				SizeBytes: 5,
+			}))
+		}
+		requestsBefore := cache.getRequests()
+		_, err := unauthenticatedBlobAccess.FindMissing(ctx, digests)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Equal(t, 1, cache.getRequests()-requestsBefore)
+	})
+
+	t.Run("FindMissingCancelled", func(t *testing.T) {
+		// No requests should be issued if the context has
+		// already been cancelled.
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+		requestsBefore := cache.getRequests()
+		_, err := blobAccess.FindMissing(cancelledCtx, []*util.Digest{digest})
+		require.Equal(t, context.Canceled, err)
+		require.Equal(t, 0, cache.getRequests()-requestsBefore)
+	})
+}
@@ -1,8 +1,11 @@
 package blobstore
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	"github.com/aws/aws-sdk-go/aws"
@@ -27,42 +30,211 @@ func convertS3Error(err error) error {
 }
 
 type s3BlobAccess struct {
-	s3            *s3.S3
-	uploader      *s3manager.Uploader
-	bucketName    *string
-	blobKeyFormat util.DigestKeyFormat
-	keyPrefix     string
+	s3                     *s3.S3
+	uploader               *s3manager.Uploader
+	bucketName             *string
+	blobKeyFormat          util.DigestKeyFormat
+	keyPrefix              string
+	storageClass           *string
+	tagging                *string
+	findMissingConcurrency int
+	downloadConcurrency    int
+	downloadPartSizeBytes  int64
 }
 
 // NewS3BlobAccess creates a BlobAccess that uses an S3 bucket as its backing
 // store.
-func NewS3BlobAccess(s3 *s3.S3, uploader *s3manager.Uploader, bucketName *string, keyPrefix string, blobKeyFormat util.DigestKeyFormat) BlobAccess {
+//
+// Objects are written using the provided storage class and tags, if
+// non-nil. The tags are provided in URL query parameter format (e.g.,
+// "Key1=Value1&Key2=Value2"). They can be used in combination with
+// lifecycle rules of the bucket to expire data.
+//
+// FindMissing() checks for the existence of objects by issuing up to
+// findMissingConcurrency HeadObject requests in parallel. If
+// downloadPartSizeBytes is positive, objects larger than it are
+// downloaded by issuing up to downloadConcurrency ranged GetObject
+// requests in parallel, each buffered in memory.
+func NewS3BlobAccess(s3 *s3.S3, uploader *s3manager.Uploader, bucketName *string, keyPrefix string, blobKeyFormat util.DigestKeyFormat, storageClass *string, tagging *string, findMissingConcurrency int, downloadConcurrency int, downloadPartSizeBytes int64) BlobAccess {
 	return &s3BlobAccess{
-		s3:            s3,
-		uploader:      uploader,
-		bucketName:    bucketName,
-		blobKeyFormat: blobKeyFormat,
-		keyPrefix:     keyPrefix,
+		s3:                     s3,
+		uploader:               uploader,
+		bucketName:             bucketName,
+		blobKeyFormat:          blobKeyFormat,
+		keyPrefix:              keyPrefix,
+		storageClass:           storageClass,
+		tagging:                tagging,
+		findMissingConcurrency: findMissingConcurrency,
+		downloadConcurrency:    downloadConcurrency,
+		downloadPartSizeBytes:  downloadPartSizeBytes,
 	}
 }
 
 func (ba *s3BlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	if ba.downloadPartSizeBytes <= 0 {
+		result, err := ba.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: ba.bucketName,
+			Key:    ba.getKey(digest),
+		})
+		if err != nil {
+			return 0, nil, convertS3Error(err)
+		}
+		return aws.Int64Value(result.ContentLength), result.Body, nil
+	}
+
+	// Request the first part of the object. The response contains
+	// the total size of the object, which determines whether the
+	// remaining parts need to be fetched.
+	key := ba.getKey(digest)
 	result, err := ba.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: ba.bucketName,
-		Key:    ba.getKey(digest),
+		Key:    key,
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", ba.downloadPartSizeBytes-1)),
 	})
 	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidRange" {
+			// Ranges cannot be requested for empty objects.
+			result, err = ba.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+				Bucket: ba.bucketName,
+				Key:    key,
+			})
+			if err != nil {
+				return 0, nil, convertS3Error(err)
+			}
+			return aws.Int64Value(result.ContentLength), result.Body, nil
+		}
 		return 0, nil, convertS3Error(err)
 	}
-	return aws.Int64Value(result.ContentLength), result.Body, nil
+	var firstByte, lastByte, sizeBytes int64
+	if _, err := fmt.Sscanf(aws.StringValue(result.ContentRange), "bytes %d-%d/%d", &firstByte, &lastByte, &sizeBytes); err != nil {
+		result.Body.Close()
+		return 0, nil, status.Errorf(codes.Internal, "Failed to parse content range %#v: %s", aws.StringValue(result.ContentRange), err)
+	}
+	if sizeBytes <= ba.downloadPartSizeBytes {
+		return sizeBytes, result.Body, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &s3ParallelReader{
+		ctx:        ctx,
+		cancel:     cancel,
+		ba:         ba,
+		key:        key,
+		eTag:       result.ETag,
+		sizeBytes:  sizeBytes,
+		current:    result.Body,
+		nextOffset: ba.downloadPartSizeBytes,
+	}
+	r.scheduleParts()
+	return sizeBytes, r, nil
+}
+
+// s3Part is the result of downloading a single range of an object.
+type s3Part struct {
+	data []byte
+	err  error
+}
+
+// s3ParallelReader is returned by s3BlobAccess.Get() for large
+// objects. It returns the contents of an object in order, while
+// downloading subsequent parts of the object in the background.
+type s3ParallelReader struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	ba        *s3BlobAccess
+	key       *string
+	eTag      *string
+	sizeBytes int64
+
+	current    io.ReadCloser
+	pending    []<-chan s3Part
+	nextOffset int64
+}
+
+// scheduleParts starts downloads of parts of the object, until the
+// maximum number of parallel downloads is reached.
+func (r *s3ParallelReader) scheduleParts() {
+	for len(r.pending) < r.ba.downloadConcurrency && r.nextOffset < r.sizeBytes {
+		firstByte := r.nextOffset
+		lastByte := firstByte + r.ba.downloadPartSizeBytes - 1
+		if lastByte >= r.sizeBytes {
+			lastByte = r.sizeBytes - 1
+		}
+		r.nextOffset = lastByte + 1
+
+		c := make(chan s3Part, 1)
+		r.pending = append(r.pending, c)
+		go func() {
+			// Require that the object has not been replaced
+			// since the first part was downloaded.
+			result, err := r.ba.s3.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+				Bucket:  r.ba.bucketName,
+				Key:     r.key,
+				IfMatch: r.eTag,
+				Range:   aws.String(fmt.Sprintf("bytes=%d-%d", firstByte, lastByte)),
+			})
+			if err != nil {
+				c <- s3Part{err: convertS3Error(err)}
+				return
+			}
+			data, err := ioutil.ReadAll(result.Body)
+			result.Body.Close()
+			if err == nil && int64(len(data)) != lastByte-firstByte+1 {
+				err = status.Errorf(codes.Internal, "Range %d-%d of object has length %d", firstByte, lastByte, len(data))
+			}
+			c <- s3Part{data: data, err: err}
+		}()
+	}
+}
+
+func (r *s3ParallelReader) Read(p []byte) (int, error) {
+	for {
+		if r.current != nil {
+			n, err := r.current.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		// Continue reading from the next part.
+		part := <-r.pending[0]
+		r.pending = r.pending[1:]
+		if part.err != nil {
+			return 0, util.StatusWrap(part.err, "Failed to download part of object")
+		}
+		r.current = ioutil.NopCloser(bytes.NewReader(part.data))
+		r.scheduleParts()
+	}
+}
+
+func (r *s3ParallelReader) Close() error {
+	// Parts that are still being downloaded write their results
+	// into buffered channels, meaning they can simply be abandoned.
+	r.cancel()
+	if r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	r.pending = nil
+	return nil
 }
 
 func (ba *s3BlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
 	defer r.Close()
 	_, err := ba.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket: ba.bucketName,
-		Key:    ba.getKey(digest),
-		Body:   r,
+		Bucket:       ba.bucketName,
+		Key:          ba.getKey(digest),
+		Body:         r,
+		StorageClass: ba.storageClass,
+		Tagging:      ba.tagging,
 	})
 	return convertS3Error(err)
 }
@@ -76,8 +248,7 @@ func (ba *s3BlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
 }
 
 func (ba *s3BlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	var missing []*util.Digest
-	for _, digest := range digests {
+	return findMissingInParallel(ctx, digests, ba.findMissingConcurrency, func(ctx context.Context, digest *util.Digest) (bool, error) {
 		_, err := ba.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 			Bucket: ba.bucketName,
 			Key:    ba.getKey(digest),
@@ -85,13 +256,12 @@ func (ba *s3BlobAccess) FindMissing(ctx context.Context, digests []*util.Digest)
 		if err != nil {
 			err = convertS3Error(err)
 			if status.Code(err) == codes.NotFound {
-				missing = append(missing, digest)
-			} else {
-				return nil, err
+				return false, nil
 			}
+			return false, err
 		}
-	}
-	return missing, nil
+		return true, nil
+	})
 }
 
 func (ba *s3BlobAccess) getKey(digest *util.Digest) *string {
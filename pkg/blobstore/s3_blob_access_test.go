@@ -0,0 +1,229 @@
+package blobstore_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeS3Object is an object stored by fakeS3Server.
+type fakeS3Object struct {
+	data   []byte
+	header http.Header
+}
+
+// fakeS3Server is a minimal stand-in for an S3 compatible server (e.g.,
+// Minio), only supporting the requests issued by s3BlobAccess.
+type fakeS3Server struct {
+	lock     sync.Mutex
+	objects  map[string]fakeS3Object
+	requests []string
+}
+
+func (s *fakeS3Server) writeError(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Range"))
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		s.objects[r.URL.Path] = fakeS3Object{
+			data:   data,
+			header: r.Header,
+		}
+		w.Header().Set("ETag", "\"etag\"")
+	case http.MethodHead, http.MethodGet:
+		object, ok := s.objects[r.URL.Path]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				s.writeError(w, http.StatusNotFound, "NoSuchKey")
+			}
+			return
+		}
+		w.Header().Set("ETag", "\"etag\"")
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "\"etag\"" {
+			s.writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data := object.data
+		if byteRange := r.Header.Get("Range"); byteRange != "" {
+			var firstByte, lastByte int
+			fmt.Sscanf(byteRange, "bytes=%d-%d", &firstByte, &lastByte)
+			if firstByte >= len(data) {
+				s.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			if lastByte >= len(data) {
+				lastByte = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", firstByte, lastByte, len(data)))
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", lastByte-firstByte+1))
+			w.WriteHeader(http.StatusPartialContent)
+			if r.Method == http.MethodGet {
+				w.Write(data[firstByte : lastByte+1])
+			}
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		s.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func newS3BlobAccessForTesting(t *testing.T, storageClass *string, tagging *string, downloadPartSizeBytes int64) (blobstore.BlobAccess, *fakeS3Server, func()) {
+	server := &fakeS3Server{
+		objects: map[string]fakeS3Object{},
+	}
+	httpServer := httptest.NewServer(server)
+	session, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(httpServer.URL),
+		Region:           aws.String("eu-west-1"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	require.NoError(t, err)
+	client := s3.New(session)
+	blobAccess := blobstore.NewS3BlobAccess(
+		client,
+		s3manager.NewUploaderWithClient(client),
+		aws.String("bucket"),
+		"cas/",
+		util.DigestKeyWithoutInstance,
+		storageClass,
+		tagging,
+		4,
+		2,
+		downloadPartSizeBytes)
+	return blobAccess, server, httpServer.Close
+}
+
+func TestS3BlobAccessPutWithStorageClassAndTagging(t *testing.T) {
+	blobAccess, server, cleanup := newS3BlobAccessForTesting(t, aws.String("STANDARD_IA"), aws.String("Tier=cold"), 0)
+	defer cleanup()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	require.NoError(t, blobAccess.Put(context.Background(), digest, 5, ioutil.NopCloser(strings.NewReader("Hello"))))
+
+	object := server.objects["/bucket/cas/8b1a9953c4611296a827abf8c47804d7-5"]
+	require.Equal(t, []byte("Hello"), object.data)
+	require.Equal(t, "STANDARD_IA", object.header.Get("X-Amz-Storage-Class"))
+	require.Equal(t, "Tier=cold", object.header.Get("X-Amz-Tagging"))
+}
+
+func TestS3BlobAccessGetParallel(t *testing.T) {
+	blobAccess, server, cleanup := newS3BlobAccessForTesting(t, nil, nil, 4)
+	defer cleanup()
+	server.objects["/bucket/cas/8b1a9953c4611296a827abf8c47804d7-11"] = fakeS3Object{data: []byte("Hello world")}
+	server.objects["/bucket/cas/8b1a9953c4611296a827abf8c47804d7-3"] = fakeS3Object{data: []byte("Hel")}
+	server.objects["/bucket/cas/8b1a9953c4611296a827abf8c47804d7-0"] = fakeS3Object{data: []byte{}}
+
+	t.Run("MultipleParts", func(t *testing.T) {
+		length, r, err := blobAccess.Get(context.Background(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 11,
+		}))
+		require.NoError(t, err)
+		require.Equal(t, int64(11), length)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello world"), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("SinglePart", func(t *testing.T) {
+		length, r, err := blobAccess.Get(context.Background(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 3,
+		}))
+		require.NoError(t, err)
+		require.Equal(t, int64(3), length)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hel"), data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		length, r, err := blobAccess.Get(context.Background(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 0,
+		}))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), length)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Empty(t, data)
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, _, err := blobAccess.Get(context.Background(), util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: 42,
+		}))
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestS3BlobAccessFindMissing(t *testing.T) {
+	blobAccess, server, cleanup := newS3BlobAccessForTesting(t, nil, nil, 0)
+	defer cleanup()
+
+	var digests, expectedMissing []*util.Digest
+	for i := 0; i < 20; i++ {
+		digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+			Hash:      "8b1a9953c4611296a827abf8c47804d7",
+			SizeBytes: int64(i),
+		})
+		digests = append(digests, digest)
+		if i%3 == 0 {
+			server.objects[fmt.Sprintf("/bucket/cas/8b1a9953c4611296a827abf8c47804d7-%d", i)] = fakeS3Object{}
+		} else {
+			expectedMissing = append(expectedMissing, digest)
+		}
+	}
+
+	missing, err := blobAccess.FindMissing(context.Background(), digests)
+	require.NoError(t, err)
+	require.Equal(t, expectedMissing, missing)
+	require.Len(t, server.requests, 20)
+}
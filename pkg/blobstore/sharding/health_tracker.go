@@ -0,0 +1,170 @@
+package sharding
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	shardingBlobAccessBackendHealthTransitionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "blobstore",
+			Name:      "sharding_blob_access_backend_health_transitions_total",
+			Help:      "Total number of times backends of the sharding blob access changed health.",
+		},
+		[]string{"backend", "health"})
+)
+
+func init() {
+	prometheus.MustRegister(shardingBlobAccessBackendHealthTransitionsTotal)
+}
+
+// HealthTracker keeps track of the health of the backends used by
+// ShardingBlobAccess, based on the results of the requests sent to
+// them. Unhealthy backends are skipped when selecting the backend
+// for a blob, causing their traffic to fail over to the next backend
+// in the permutation.
+type HealthTracker interface {
+	// IsHealthy returns whether requests may be sent to a backend.
+	IsHealthy(index int) bool
+	// ClaimProbe returns whether a request may be sent to an
+	// unhealthy backend to determine whether it has recovered. It
+	// returns true at most once per probing interval, meaning that
+	// callers must only call it when they are going to send a
+	// request to the backend.
+	ClaimProbe(index int) bool
+	// HasFailedOver returns whether a backend has been unhealthy
+	// recently, meaning that blobs that belong to it may have been
+	// written to another backend in the meantime.
+	HasFailedOver(index int) bool
+	// ReportResult updates the health of a backend based on the
+	// outcome of a request.
+	ReportResult(index int, err error)
+}
+
+type backendHealth struct {
+	consecutiveFailures uint32
+	unhealthyUntil      time.Time
+	failedOverUntil     time.Time
+}
+
+type consecutiveFailuresHealthTracker struct {
+	failureThreshold   uint32
+	unhealthyDuration  time.Duration
+	failedOverDuration time.Duration
+
+	lock     sync.Mutex
+	backends []backendHealth
+}
+
+// NewConsecutiveFailuresHealthTracker creates a HealthTracker that
+// marks a backend unhealthy once failureThreshold requests in a row
+// have failed with an error that indicates the backend is unavailable
+// (i.e., UNAVAILABLE or a network error).
+// Requests to the backend are suspended for unhealthyDuration.
+// Afterwards, a single request is permitted to probe the backend. If it
+// succeeds, the backend is considered healthy once more. If it fails,
+// requests are suspended again.
+//
+// After recovering, reads for blobs that are absent on the backend
+// continue to be forwarded to the backend that took over its traffic
+// for failedOverDuration, as blobs written during the outage are stored
+// there.
+func NewConsecutiveFailuresHealthTracker(backendsCount int, failureThreshold uint32, unhealthyDuration time.Duration, failedOverDuration time.Duration) HealthTracker {
+	return &consecutiveFailuresHealthTracker{
+		failureThreshold:   failureThreshold,
+		unhealthyDuration:  unhealthyDuration,
+		failedOverDuration: failedOverDuration,
+		backends:           make([]backendHealth, backendsCount),
+	}
+}
+
+func (ht *consecutiveFailuresHealthTracker) IsHealthy(index int) bool {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	return ht.backends[index].consecutiveFailures < ht.failureThreshold
+}
+
+func (ht *consecutiveFailuresHealthTracker) ClaimProbe(index int) bool {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	b := &ht.backends[index]
+	now := time.Now()
+	if b.consecutiveFailures < ht.failureThreshold || now.Before(b.unhealthyUntil) {
+		return false
+	}
+	// Let a single request through to probe whether the backend
+	// has recovered. Other requests will be suspended until the
+	// result of the probe is known.
+	b.unhealthyUntil = now.Add(ht.unhealthyDuration)
+	return true
+}
+
+func (ht *consecutiveFailuresHealthTracker) HasFailedOver(index int) bool {
+	ht.lock.Lock()
+	defer ht.lock.Unlock()
+	return time.Now().Before(ht.backends[index].failedOverUntil)
+}
+
+// isBackendFailure returns whether an error indicates that a backend is
+// unavailable. Only errors that gRPC reports for failing connections
+// and network errors of backends that don't use gRPC are considered.
+// Other errors may be caused by the request itself.
+func isBackendFailure(err error) bool {
+	if status.Code(err) == codes.Unavailable {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && !netErr.Timeout()
+}
+
+// isTimeout returns whether an error indicates that a request did not
+// complete in time. As deadlines are set by clients, this says nothing
+// about the health of the backend.
+func isTimeout(err error) bool {
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded:
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (ht *consecutiveFailuresHealthTracker) ReportResult(index int, err error) {
+	switch {
+	case isBackendFailure(err):
+		ht.lock.Lock()
+		b := &ht.backends[index]
+		b.consecutiveFailures++
+		if b.consecutiveFailures >= ht.failureThreshold {
+			now := time.Now()
+			if b.consecutiveFailures == ht.failureThreshold {
+				shardingBlobAccessBackendHealthTransitionsTotal.WithLabelValues(strconv.FormatInt(int64(index), 10), "Unhealthy").Inc()
+			}
+			b.unhealthyUntil = now.Add(ht.unhealthyDuration)
+			b.failedOverUntil = b.unhealthyUntil.Add(ht.failedOverDuration)
+		}
+		ht.lock.Unlock()
+	case isTimeout(err):
+		// Neither consider the backend to be up or down.
+	default:
+		// Successful requests and errors caused by the request
+		// itself (e.g., NotFound) indicate the backend is up.
+		ht.lock.Lock()
+		b := &ht.backends[index]
+		if b.consecutiveFailures >= ht.failureThreshold {
+			shardingBlobAccessBackendHealthTransitionsTotal.WithLabelValues(strconv.FormatInt(int64(index), 10), "Healthy").Inc()
+			b.failedOverUntil = time.Now().Add(ht.failedOverDuration)
+		}
+		b.consecutiveFailures = 0
+		ht.lock.Unlock()
+	}
+}
@@ -0,0 +1,88 @@
+package sharding
+
+import (
+	"context"
+	"io"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type migratingShardingBlobAccess struct {
+	current  *shardingBlobAccess
+	previous *shardingBlobAccess
+}
+
+// NewMigratingShardingBlobAccess is a variant of ShardingBlobAccess
+// that may be used while transitioning between two layouts of the key
+// space (e.g., after changing the weights of shards or the hash
+// initialization). Both layouts share the same set of backends.
+//
+// Writes are only sent to the backends of the current layout. Reads
+// and existence checks are forwarded to the backends of the previous
+// layout if blobs are absent in the current layout, thereby preventing
+// data from getting lost while it is being migrated. Blobs that reside
+// on the same backend in both layouts are only requested once.
+//
+// Failover of unhealthy backends is applied to both layouts, using the
+// same HealthTracker.
+func NewMigratingShardingBlobAccess(backends []blobstore.BlobAccess, shardPermuter ShardPermuter, hashInitialization uint64, previousShardPermuter ShardPermuter, previousHashInitialization uint64, digestKeyFormat util.DigestKeyFormat, healthTracker HealthTracker) blobstore.BlobAccess {
+	return &migratingShardingBlobAccess{
+		current:  newShardingBlobAccess(backends, shardPermuter, digestKeyFormat, hashInitialization, healthTracker),
+		previous: newShardingBlobAccess(backends, previousShardPermuter, digestKeyFormat, previousHashInitialization, healthTracker),
+	}
+}
+
+func (ba *migratingShardingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	sizeBytes, r, err := ba.current.Get(ctx, digest)
+	if status.Code(err) == codes.NotFound && ba.previous.getPrimaryBackend(digest) != ba.current.getPrimaryBackend(digest) {
+		return ba.previous.Get(ctx, digest)
+	}
+	return sizeBytes, r, err
+}
+
+func (ba *migratingShardingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	return ba.current.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *migratingShardingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	// Remove the blob from both locations, as reads would otherwise
+	// still be able to access the copy in the previous layout.
+	err := ba.current.Delete(ctx, digest)
+	if ba.previous.getPrimaryBackend(digest) != ba.current.getPrimaryBackend(digest) {
+		previousErr := ba.previous.Delete(ctx, digest)
+		if status.Code(err) == codes.NotFound || (err == nil && status.Code(previousErr) != codes.NotFound) {
+			err = previousErr
+		}
+	}
+	return err
+}
+
+func (ba *migratingShardingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	missing, err := ba.current.FindMissing(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the previous layout for blobs that are missing and have
+	// been moved to a different backend.
+	var missingInBoth, moved []*util.Digest
+	for _, digest := range missing {
+		if ba.previous.getPrimaryBackend(digest) != ba.current.getPrimaryBackend(digest) {
+			moved = append(moved, digest)
+		} else {
+			missingInBoth = append(missingInBoth, digest)
+		}
+	}
+	if len(moved) == 0 {
+		return missing, nil
+	}
+	missingInPrevious, err := ba.previous.FindMissing(ctx, moved)
+	if err != nil {
+		return nil, err
+	}
+	return append(missingInBoth, missingInPrevious...), nil
+}
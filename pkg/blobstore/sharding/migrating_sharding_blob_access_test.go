@@ -0,0 +1,162 @@
+package sharding_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/sharding"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMigratingShardingBlobAccess(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// All keys are moved from the second backend to the first.
+	currentBackend := mock.NewMockBlobAccess(ctrl)
+	previousBackend := mock.NewMockBlobAccess(ctrl)
+	blobAccess := sharding.NewMigratingShardingBlobAccess(
+		[]blobstore.BlobAccess{currentBackend, previousBackend},
+		sharding.NewWeightedShardPermuter([]uint32{1, 0}),
+		0x1234,
+		sharding.NewWeightedShardPermuter([]uint32{0, 1}),
+		0x5678,
+		util.DigestKeyWithoutInstance,
+		nil)
+	digest1 := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	digest2 := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+
+	t.Run("GetCurrent", func(t *testing.T) {
+		currentBackend.EXPECT().Get(ctx, digest1).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+		sizeBytes, r, err := blobAccess.Get(ctx, digest1)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), sizeBytes)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+	})
+
+	t.Run("GetPrevious", func(t *testing.T) {
+		currentBackend.EXPECT().Get(ctx, digest1).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+		previousBackend.EXPECT().Get(ctx, digest1).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+
+		sizeBytes, r, err := blobAccess.Get(ctx, digest1)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), sizeBytes)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, []byte("Hello"), data)
+	})
+
+	t.Run("GetFailure", func(t *testing.T) {
+		// Errors other than absence should not cause fallbacks.
+		currentBackend.EXPECT().Get(ctx, digest1).Return(int64(0), nil, status.Error(codes.Internal, "Disk on fire"))
+
+		_, _, err := blobAccess.Get(ctx, digest1)
+		require.Equal(t, status.Error(codes.Internal, "Disk on fire"), err)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		currentBackend.EXPECT().Put(ctx, digest1, int64(5), gomock.Any()).Return(nil)
+
+		require.NoError(t, blobAccess.Put(ctx, digest1, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		currentBackend.EXPECT().Delete(ctx, digest1).Return(status.Error(codes.NotFound, "Blob not found"))
+		previousBackend.EXPECT().Delete(ctx, digest1).Return(nil)
+
+		require.NoError(t, blobAccess.Delete(ctx, digest1))
+	})
+
+	t.Run("FindMissing", func(t *testing.T) {
+		currentBackend.EXPECT().FindMissing(ctx, []*util.Digest{digest1, digest2}).Return([]*util.Digest{digest1, digest2}, nil)
+		previousBackend.EXPECT().FindMissing(ctx, []*util.Digest{digest1, digest2}).Return([]*util.Digest{digest2}, nil)
+
+		missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest1, digest2})
+		require.NoError(t, err)
+		require.Equal(t, []*util.Digest{digest2}, missing)
+	})
+}
+
+func TestMigratingShardingBlobAccessFailover(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// In the current layout, every blob is owned by the first
+	// backend, failing over to the second backend. In the previous
+	// layout, every blob was owned by the third backend.
+	backend0 := mock.NewMockBlobAccess(ctrl)
+	backend1 := mock.NewMockBlobAccess(ctrl)
+	backend2 := mock.NewMockBlobAccess(ctrl)
+	shardPermuter := mock.NewMockShardPermuter(ctrl)
+	shardPermuter.EXPECT().GetShard(gomock.Any(), gomock.Any()).Do(func(hash uint64, selector sharding.ShardSelector) {
+		if selector(0) {
+			selector(1)
+		}
+	}).AnyTimes()
+	previousShardPermuter := mock.NewMockShardPermuter(ctrl)
+	previousShardPermuter.EXPECT().GetShard(gomock.Any(), gomock.Any()).Do(func(hash uint64, selector sharding.ShardSelector) {
+		if selector(2) {
+			selector(1)
+		}
+	}).AnyTimes()
+	blobAccess := sharding.NewMigratingShardingBlobAccess(
+		[]blobstore.BlobAccess{backend0, backend1, backend2},
+		shardPermuter,
+		0x1234,
+		previousShardPermuter,
+		0x5678,
+		util.DigestKeyWithoutInstance,
+		sharding.NewConsecutiveFailuresHealthTracker(3, 1, time.Hour, time.Hour))
+	digest := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// A failure should cause the current layout to fail over to
+	// the second backend.
+	backend0.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(status.Error(codes.Unavailable, "Connection refused"))
+	require.Equal(
+		t,
+		status.Error(codes.Unavailable, "Connection refused"),
+		blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+
+	backend1.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(nil)
+	require.NoError(t, blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+
+	// Reads of blobs that are absent on the backend that was
+	// failed over to should still fall back to the previous layout.
+	backend1.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+	backend2.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	sizeBytes, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), sizeBytes)
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), data)
+
+	backend1.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return([]*util.Digest{digest}, nil)
+	backend2.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
@@ -6,28 +6,58 @@ import (
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// failoverAttemptsPerBackend is the number of backends per configured
+// backend that is requested from the ShardPermuter when searching for a
+// healthy backend to which to fail over. ShardPermuters may return the
+// same backend multiple times, meaning that a margin is needed to give
+// every backend a chance.
+const failoverAttemptsPerBackend = 10
+
 type shardingBlobAccess struct {
-	backends           []blobstore.BlobAccess
-	shardPermuter      ShardPermuter
-	digestKeyFormat    util.DigestKeyFormat
-	hashInitialization uint64
+	backends                []blobstore.BlobAccess
+	shardPermuter           ShardPermuter
+	digestKeyFormat         util.DigestKeyFormat
+	hashInitialization      uint64
+	healthTracker           HealthTracker
+	maximumFailoverAttempts int
 }
 
 // NewShardingBlobAccess is an adapter for BlobAccess that partitions
 // requests across backends by hashing the digest. A ShardPermuter is
 // used to map hashes to backends.
-func NewShardingBlobAccess(backends []blobstore.BlobAccess, shardPermuter ShardPermuter, digestKeyFormat util.DigestKeyFormat, hashInitialization uint64) blobstore.BlobAccess {
+//
+// If a HealthTracker is provided, requests for blobs belonging to an
+// unhealthy backend are temporarily sent to the next healthy backend
+// returned by the ShardPermuter instead. Once the backend has
+// recovered, reads for blobs that are absent on it are forwarded to
+// the next backend for some time, so that blobs written during the
+// outage remain accessible.
+func NewShardingBlobAccess(backends []blobstore.BlobAccess, shardPermuter ShardPermuter, digestKeyFormat util.DigestKeyFormat, hashInitialization uint64, healthTracker HealthTracker) blobstore.BlobAccess {
+	return newShardingBlobAccess(backends, shardPermuter, digestKeyFormat, hashInitialization, healthTracker)
+}
+
+func newShardingBlobAccess(backends []blobstore.BlobAccess, shardPermuter ShardPermuter, digestKeyFormat util.DigestKeyFormat, hashInitialization uint64, healthTracker HealthTracker) *shardingBlobAccess {
 	return &shardingBlobAccess{
 		backends:           backends,
 		shardPermuter:      shardPermuter,
 		digestKeyFormat:    digestKeyFormat,
 		hashInitialization: hashInitialization,
+		healthTracker:      healthTracker,
+
+		maximumFailoverAttempts: failoverAttemptsPerBackend * len(backends),
 	}
 }
 
-func (ba *shardingBlobAccess) getBackend(digest *util.Digest) blobstore.BlobAccess {
+// getBackendIndex returns the index of the first undrained backend
+// returned by the ShardPermuter for a digest that is not skipped. If
+// skip is provided and no such backend is found within a bounded
+// number of attempts, -1 is returned.
+func (ba *shardingBlobAccess) getBackendIndex(digest *util.Digest, skip func(int) bool) int {
 	// Hash the key using FNV-1a.
 	h := ba.hashInitialization
 	for _, c := range digest.GetKey(ba.digestKeyFormat) {
@@ -36,24 +66,103 @@ func (ba *shardingBlobAccess) getBackend(digest *util.Digest) blobstore.BlobAcce
 	}
 
 	// Keep requesting shards until matching one that is undrained.
-	var backend blobstore.BlobAccess
-	ba.shardPermuter.GetShard(h, func(index int) bool {
-		backend = ba.backends[index]
-		return backend == nil
+	index := -1
+	attempts := 0
+	ba.shardPermuter.GetShard(h, func(i int) bool {
+		if ba.backends[i] != nil && (skip == nil || !skip(i)) {
+			index = i
+			return false
+		}
+		attempts++
+		return skip == nil || attempts < ba.maximumFailoverAttempts
 	})
-	return backend
+	return index
+}
+
+// getPrimaryBackend returns the backend that owns a blob, regardless
+// of its health.
+func (ba *shardingBlobAccess) getPrimaryBackend(digest *util.Digest) blobstore.BlobAccess {
+	return ba.backends[ba.getBackendIndex(digest, nil)]
+}
+
+// newUsabilityChecker returns a function that determines whether
+// requests may be sent to a backend. Unhealthy backends are usable if a
+// probe may be sent to them. The results are cached, so that a single
+// probe is claimed per backend when processing multiple digests as part
+// of a single request.
+func (ba *shardingBlobAccess) newUsabilityChecker() func(int) bool {
+	usable := map[int]bool{}
+	return func(index int) bool {
+		isUsable, ok := usable[index]
+		if !ok {
+			isUsable = ba.healthTracker.IsHealthy(index) || ba.healthTracker.ClaimProbe(index)
+			usable[index] = isUsable
+		}
+		return isUsable
+	}
+}
+
+// getBackendIndices returns the index of the backend that owns a
+// blob, and the index of the backend to which requests for the blob
+// should be sent. These are only different if the former is unhealthy.
+func (ba *shardingBlobAccess) getBackendIndices(digest *util.Digest, isUsable func(int) bool) (int, int) {
+	primary := ba.getBackendIndex(digest, nil)
+	if ba.healthTracker == nil || isUsable(primary) {
+		return primary, primary
+	}
+	selected := ba.getBackendIndex(digest, func(i int) bool {
+		return i == primary || !isUsable(i)
+	})
+	if selected < 0 {
+		// All backends are unhealthy. There is no point in
+		// failing over.
+		return primary, primary
+	}
+	return primary, selected
+}
+
+// getReadMissBackendIndex returns the index of the backend that may
+// hold a blob that is absent on its owning backend, due to the owning
+// backend having failed over recently. If no such backend exists, -1
+// is returned.
+func (ba *shardingBlobAccess) getReadMissBackendIndex(digest *util.Digest, primary int, selected int) int {
+	if ba.healthTracker == nil || primary != selected || !ba.healthTracker.HasFailedOver(primary) {
+		return -1
+	}
+	return ba.getBackendIndex(digest, func(i int) bool { return i == primary })
+}
+
+func (ba *shardingBlobAccess) reportResult(index int, err error) {
+	if ba.healthTracker != nil {
+		ba.healthTracker.ReportResult(index, err)
+	}
 }
 
 func (ba *shardingBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
-	return ba.getBackend(digest).Get(ctx, digest)
+	primary, selected := ba.getBackendIndices(digest, ba.newUsabilityChecker())
+	sizeBytes, r, err := ba.backends[selected].Get(ctx, digest)
+	ba.reportResult(selected, err)
+	if status.Code(err) == codes.NotFound {
+		if readMiss := ba.getReadMissBackendIndex(digest, primary, selected); readMiss >= 0 {
+			sizeBytes, r, err = ba.backends[readMiss].Get(ctx, digest)
+			ba.reportResult(readMiss, err)
+		}
+	}
+	return sizeBytes, r, err
 }
 
 func (ba *shardingBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
-	return ba.getBackend(digest).Put(ctx, digest, sizeBytes, r)
+	_, selected := ba.getBackendIndices(digest, ba.newUsabilityChecker())
+	err := ba.backends[selected].Put(ctx, digest, sizeBytes, r)
+	ba.reportResult(selected, err)
+	return err
 }
 
 func (ba *shardingBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
-	return ba.getBackend(digest).Delete(ctx, digest)
+	_, selected := ba.getBackendIndices(digest, ba.newUsabilityChecker())
+	err := ba.backends[selected].Delete(ctx, digest)
+	ba.reportResult(selected, err)
+	return err
 }
 
 type findMissingResults struct {
@@ -66,20 +175,22 @@ func callFindMissing(ctx context.Context, blobAccess blobstore.BlobAccess, diges
 	return findMissingResults{missing: missing, err: err}
 }
 
-func (ba *shardingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
-	// Determine which backends to contact.
-	digestsPerBackend := map[blobstore.BlobAccess][]*util.Digest{}
-	for _, digest := range digests {
-		backend := ba.getBackend(digest)
-		digestsPerBackend[backend] = append(digestsPerBackend[backend], digest)
-	}
-
+// findMissingOnBackends calls FindMissing() on a set of backends
+// concurrently, returning the union of the results.
+func (ba *shardingBlobAccess) findMissingOnBackends(ctx context.Context, digestsPerBackend map[int][]*util.Digest) ([]*util.Digest, error) {
 	// Asynchronously call FindMissing() on backends.
-	resultsChan := make(chan findMissingResults, len(digestsPerBackend))
-	for backend, digests := range digestsPerBackend {
-		go func(backend blobstore.BlobAccess, digests []*util.Digest) {
-			resultsChan <- callFindMissing(ctx, backend, digests)
-		}(backend, digests)
+	type indexedResults struct {
+		index int
+		findMissingResults
+	}
+	resultsChan := make(chan indexedResults, len(digestsPerBackend))
+	for index, digests := range digestsPerBackend {
+		go func(index int, digests []*util.Digest) {
+			resultsChan <- indexedResults{
+				index:              index,
+				findMissingResults: callFindMissing(ctx, ba.backends[index], digests),
+			}
+		}(index, digests)
 	}
 
 	// Recombine results.
@@ -87,6 +198,7 @@ func (ba *shardingBlobAccess) FindMissing(ctx context.Context, digests []*util.D
 	var err error
 	for i := 0; i < len(digestsPerBackend); i++ {
 		results := <-resultsChan
+		ba.reportResult(results.index, results.err)
 		if results.err == nil {
 			missingDigests = append(missingDigests, results.missing...)
 		} else {
@@ -95,3 +207,48 @@ func (ba *shardingBlobAccess) FindMissing(ctx context.Context, digests []*util.D
 	}
 	return missingDigests, err
 }
+
+func (ba *shardingBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	// Determine which backends to contact.
+	type backendIndices struct {
+		primary  int
+		selected int
+	}
+	indicesPerDigest := map[string]backendIndices{}
+	digestsPerBackend := map[int][]*util.Digest{}
+	isUsable := ba.newUsabilityChecker()
+	for _, digest := range digests {
+		primary, selected := ba.getBackendIndices(digest, isUsable)
+		indicesPerDigest[digest.GetKey(ba.digestKeyFormat)] = backendIndices{primary: primary, selected: selected}
+		digestsPerBackend[selected] = append(digestsPerBackend[selected], digest)
+	}
+	missingDigests, err := ba.findMissingOnBackends(ctx, digestsPerBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blobs that are absent on backends that failed over recently
+	// may have been written to other backends in the meantime.
+	var stillMissingDigests []*util.Digest
+	readMissDigestsPerBackend := map[int][]*util.Digest{}
+	for _, digest := range missingDigests {
+		indices, ok := indicesPerDigest[digest.GetKey(ba.digestKeyFormat)]
+		if !ok {
+			stillMissingDigests = append(stillMissingDigests, digest)
+			continue
+		}
+		if readMiss := ba.getReadMissBackendIndex(digest, indices.primary, indices.selected); readMiss >= 0 {
+			readMissDigestsPerBackend[readMiss] = append(readMissDigestsPerBackend[readMiss], digest)
+		} else {
+			stillMissingDigests = append(stillMissingDigests, digest)
+		}
+	}
+	if len(readMissDigestsPerBackend) == 0 {
+		return missingDigests, nil
+	}
+	readMissMissingDigests, err := ba.findMissingOnBackends(ctx, readMissDigestsPerBackend)
+	if err != nil {
+		return nil, err
+	}
+	return append(stillMissingDigests, readMissMissingDigests...), nil
+}
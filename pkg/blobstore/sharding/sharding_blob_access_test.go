@@ -0,0 +1,172 @@
+package sharding_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore/sharding"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestShardingBlobAccessFailover(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	// Every blob is owned by the first backend, failing over to
+	// the second backend.
+	backend0 := mock.NewMockBlobAccess(ctrl)
+	backend1 := mock.NewMockBlobAccess(ctrl)
+	shardPermuter := mock.NewMockShardPermuter(ctrl)
+	shardPermuter.EXPECT().GetShard(gomock.Any(), gomock.Any()).Do(func(hash uint64, selector sharding.ShardSelector) {
+		if selector(0) {
+			selector(1)
+		}
+	}).AnyTimes()
+	blobAccess := sharding.NewShardingBlobAccess(
+		[]blobstore.BlobAccess{backend0, backend1},
+		shardPermuter,
+		util.DigestKeyWithoutInstance,
+		0,
+		sharding.NewConsecutiveFailuresHealthTracker(2, 2, time.Hour, time.Hour))
+	digest := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Errors caused by the request itself should not cause the
+	// backend to become unhealthy.
+	backend0.EXPECT().Get(ctx, digest).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found")).Times(3)
+	for i := 0; i < 3; i++ {
+		_, _, err := blobAccess.Get(ctx, digest)
+		require.Equal(t, status.Error(codes.NotFound, "Blob not found"), err)
+	}
+
+	// Two consecutive failures should cause a failover.
+	backend0.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(status.Error(codes.Unavailable, "Connection refused")).Times(2)
+	for i := 0; i < 2; i++ {
+		require.Equal(
+			t,
+			status.Error(codes.Unavailable, "Connection refused"),
+			blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+	}
+
+	backend1.EXPECT().Put(ctx, digest, int64(5), gomock.Any()).Return(nil)
+	require.NoError(t, blobAccess.Put(ctx, digest, 5, ioutil.NopCloser(bytes.NewBufferString("Hello"))))
+
+	backend1.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	sizeBytes, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), sizeBytes)
+	r.Close()
+
+	backend1.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
+
+func TestShardingBlobAccessRecovery(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	backend0 := mock.NewMockBlobAccess(ctrl)
+	backend1 := mock.NewMockBlobAccess(ctrl)
+	shardPermuter := mock.NewMockShardPermuter(ctrl)
+	shardPermuter.EXPECT().GetShard(gomock.Any(), gomock.Any()).Do(func(hash uint64, selector sharding.ShardSelector) {
+		if selector(0) {
+			selector(1)
+		}
+	}).AnyTimes()
+	// Let unhealthy backends be probed immediately.
+	blobAccess := sharding.NewShardingBlobAccess(
+		[]blobstore.BlobAccess{backend0, backend1},
+		shardPermuter,
+		util.DigestKeyWithoutInstance,
+		0,
+		sharding.NewConsecutiveFailuresHealthTracker(2, 1, 0, time.Hour))
+	digest1 := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	digest2 := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "6fc422233a40a75a1f028e11c3cd1140",
+		SizeBytes: 7,
+	})
+
+	backend0.EXPECT().Delete(ctx, digest1).Return(status.Error(codes.Unavailable, "Connection refused"))
+	require.Equal(t, status.Error(codes.Unavailable, "Connection refused"), blobAccess.Delete(ctx, digest1))
+
+	// The probe succeeds, meaning the backend is healthy again.
+	// As it failed over, blobs absent on the backend should be
+	// looked up on the next backend.
+	backend0.EXPECT().Get(ctx, digest1).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+	backend1.EXPECT().Get(ctx, digest1).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	sizeBytes, r, err := blobAccess.Get(ctx, digest1)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), sizeBytes)
+	r.Close()
+
+	backend0.EXPECT().FindMissing(ctx, []*util.Digest{digest1, digest2}).Return([]*util.Digest{digest1, digest2}, nil)
+	backend1.EXPECT().FindMissing(ctx, []*util.Digest{digest1, digest2}).Return([]*util.Digest{digest2}, nil)
+	missing, err := blobAccess.FindMissing(ctx, []*util.Digest{digest1, digest2})
+	require.NoError(t, err)
+	require.Equal(t, []*util.Digest{digest2}, missing)
+}
+
+func TestShardingBlobAccessFailureClassification(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	backend0 := mock.NewMockBlobAccess(ctrl)
+	backend1 := mock.NewMockBlobAccess(ctrl)
+	shardPermuter := mock.NewMockShardPermuter(ctrl)
+	shardPermuter.EXPECT().GetShard(gomock.Any(), gomock.Any()).Do(func(hash uint64, selector sharding.ShardSelector) {
+		if selector(0) {
+			selector(1)
+		}
+	}).AnyTimes()
+	blobAccess := sharding.NewShardingBlobAccess(
+		[]blobstore.BlobAccess{backend0, backend1},
+		shardPermuter,
+		util.DigestKeyWithoutInstance,
+		0,
+		sharding.NewConsecutiveFailuresHealthTracker(2, 1, time.Hour, time.Hour))
+	digest := util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+
+	// Timeouts and internal errors may be caused by the client or
+	// the request. They should not cause a failover.
+	for _, err := range []error{
+		status.Error(codes.DeadlineExceeded, "Timeout"),
+		status.Error(codes.Canceled, "Request canceled"),
+		status.Error(codes.Internal, "Checksum mismatch"),
+		status.Error(codes.Unknown, "Unknown error"),
+	} {
+		backend0.EXPECT().Delete(ctx, digest).Return(err)
+		require.Equal(t, err, blobAccess.Delete(ctx, digest))
+	}
+
+	// Network errors of backends that don't use gRPC should cause a
+	// failover.
+	networkErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	backend0.EXPECT().Delete(ctx, digest).Return(networkErr)
+	require.Equal(t, networkErr, blobAccess.Delete(ctx, digest))
+
+	backend1.EXPECT().Delete(ctx, digest).Return(nil)
+	require.NoError(t, blobAccess.Delete(ctx, digest))
+}
@@ -0,0 +1,130 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+)
+
+// SwappableBlobAccess is a BlobAccess that forwards all requests to a
+// backend that may be replaced at runtime (e.g., when the storage
+// configuration is reloaded).
+type SwappableBlobAccess interface {
+	BlobAccess
+
+	// Swap atomically replaces the backend to which requests are
+	// forwarded. Requests that are in flight continue to use the
+	// previous backend. The release function that was provided
+	// along with the previous backend is called once all of these
+	// requests have completed, so that its resources may be freed.
+	Swap(blobAccess BlobAccess, release func())
+}
+
+// swappableBackend is a backend of SwappableBlobAccess, having a
+// reference count that is incremented for every request in flight.
+// The reference count is one higher while the backend is in use by
+// SwappableBlobAccess.
+type swappableBackend struct {
+	blobAccess BlobAccess
+	release    func()
+	references uint
+}
+
+type swappableBlobAccess struct {
+	lock    sync.Mutex
+	backend *swappableBackend
+}
+
+// NewSwappableBlobAccess creates a SwappableBlobAccess that initially
+// forwards requests to a given backend. The release function is
+// called when the backend has been swapped out and all requests
+// against it have completed. It may be nil.
+func NewSwappableBlobAccess(blobAccess BlobAccess, release func()) SwappableBlobAccess {
+	return &swappableBlobAccess{
+		backend: &swappableBackend{
+			blobAccess: blobAccess,
+			release:    release,
+			references: 1,
+		},
+	}
+}
+
+func (ba *swappableBlobAccess) acquire() *swappableBackend {
+	ba.lock.Lock()
+	defer ba.lock.Unlock()
+	backend := ba.backend
+	backend.references++
+	return backend
+}
+
+func (ba *swappableBlobAccess) unref(backend *swappableBackend) {
+	ba.lock.Lock()
+	backend.references--
+	drained := backend.references == 0
+	ba.lock.Unlock()
+	if drained && backend.release != nil {
+		backend.release()
+	}
+}
+
+func (ba *swappableBlobAccess) Swap(blobAccess BlobAccess, release func()) {
+	ba.lock.Lock()
+	oldBackend := ba.backend
+	ba.backend = &swappableBackend{
+		blobAccess: blobAccess,
+		release:    release,
+		references: 1,
+	}
+	ba.lock.Unlock()
+	ba.unref(oldBackend)
+}
+
+func (ba *swappableBlobAccess) Get(ctx context.Context, digest *util.Digest) (int64, io.ReadCloser, error) {
+	backend := ba.acquire()
+	length, r, err := backend.blobAccess.Get(ctx, digest)
+	if err != nil {
+		ba.unref(backend)
+		return 0, nil, err
+	}
+	// Keep the backend in use until the caller is done reading.
+	return length, &swappableReadCloser{
+		ReadCloser: r,
+		blobAccess: ba,
+		backend:    backend,
+	}, nil
+}
+
+func (ba *swappableBlobAccess) Put(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+	backend := ba.acquire()
+	defer ba.unref(backend)
+	return backend.blobAccess.Put(ctx, digest, sizeBytes, r)
+}
+
+func (ba *swappableBlobAccess) Delete(ctx context.Context, digest *util.Digest) error {
+	backend := ba.acquire()
+	defer ba.unref(backend)
+	return backend.blobAccess.Delete(ctx, digest)
+}
+
+func (ba *swappableBlobAccess) FindMissing(ctx context.Context, digests []*util.Digest) ([]*util.Digest, error) {
+	backend := ba.acquire()
+	defer ba.unref(backend)
+	return backend.blobAccess.FindMissing(ctx, digests)
+}
+
+type swappableReadCloser struct {
+	io.ReadCloser
+	blobAccess *swappableBlobAccess
+	backend    *swappableBackend
+	closeOnce  sync.Once
+}
+
+func (r *swappableReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.closeOnce.Do(func() {
+		r.blobAccess.unref(r.backend)
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSwappableBlobAccessSwap(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	oldBlobAccess := mock.NewMockBlobAccess(ctrl)
+	oldReleased := false
+	blobAccess := blobstore.NewSwappableBlobAccess(oldBlobAccess, func() { oldReleased = true })
+
+	// Start reading a blob from the old backend.
+	oldBlobAccess.EXPECT().Get(ctx, digest).Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+	length, r, err := blobAccess.Get(ctx, digest)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), length)
+
+	// Requests issued after swapping should go to the new backend.
+	// The old backend may not be released while it is still being
+	// read from.
+	newBlobAccess := mock.NewMockBlobAccess(ctrl)
+	newReleased := false
+	blobAccess.Swap(newBlobAccess, func() { newReleased = true })
+	require.False(t, oldReleased)
+
+	newBlobAccess.EXPECT().FindMissing(ctx, []*util.Digest{digest}).Return(nil, status.Error(codes.Unavailable, "Server not reachable"))
+	_, err = blobAccess.FindMissing(ctx, []*util.Digest{digest})
+	require.Equal(t, status.Error(codes.Unavailable, "Server not reachable"), err)
+
+	// Finishing the read should release the old backend, but not the
+	// new one.
+	buf, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello"), buf)
+	require.NoError(t, r.Close())
+	require.True(t, oldReleased)
+	require.False(t, newReleased)
+}
+
+func TestSwappableBlobAccessSwapIdle(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	digest := util.MustNewDigest("debian8", &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	})
+	oldBlobAccess := mock.NewMockBlobAccess(ctrl)
+	oldReleased := false
+	blobAccess := blobstore.NewSwappableBlobAccess(oldBlobAccess, func() { oldReleased = true })
+
+	oldBlobAccess.EXPECT().Delete(ctx, digest).Return(nil)
+	require.NoError(t, blobAccess.Delete(ctx, digest))
+	require.False(t, oldReleased)
+
+	// Without any requests in flight, the old backend should be
+	// released immediately.
+	blobAccess.Swap(mock.NewMockBlobAccess(ctrl), nil)
+	require.True(t, oldReleased)
+}
@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ac"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type actionCacheCheckingBuildExecutor struct {
+	base                      BuildExecutor
+	contentAddressableStorage cas.ContentAddressableStorage
+	actionCache               ac.ActionCache
+	browserURL                *url.URL
+}
+
+// NewActionCacheCheckingBuildExecutor creates an adapter for
+// BuildExecutor that checks the Action Cache (AC) right before
+// executing an action. If another worker has completed the same action
+// in the meantime (e.g., because it was enqueued under a different
+// instance name or the scheduler was restarted), the cached result is
+// returned without executing the action again.
+//
+// Lookups are skipped for requests that have skip_cache_lookup set and
+// for actions that have do_not_cache set, as results of the latter
+// should never be served from the Action Cache. Failures to access the
+// Content Addressable Storage or the Action Cache are not fatal, as the
+// action can simply be executed instead.
+func NewActionCacheCheckingBuildExecutor(base BuildExecutor, contentAddressableStorage cas.ContentAddressableStorage, actionCache ac.ActionCache, browserURL *url.URL) BuildExecutor {
+	return &actionCacheCheckingBuildExecutor{
+		base:                      base,
+		contentAddressableStorage: contentAddressableStorage,
+		actionCache:               actionCache,
+		browserURL:                browserURL,
+	}
+}
+
+func (be *actionCacheCheckingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest, executionStateUpdates chan<- *remoteexecution.ExecuteOperationMetadata) (*remoteexecution.ExecuteResponse, bool) {
+	if !request.SkipCacheLookup {
+		actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
+		if err != nil {
+			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to extract digest for action")), false
+		}
+		action, err := be.contentAddressableStorage.GetAction(ctx, actionDigest)
+		if err != nil || action.DoNotCache {
+			// Actions that have do_not_cache set must always be
+			// executed. Failures to load the action are reported
+			// by the base BuildExecutor.
+			return be.base.Execute(ctx, request, executionStateUpdates)
+		}
+		actionResult, err := be.actionCache.GetActionResult(ctx, actionDigest)
+		if err == nil {
+			actionURL, err := be.browserURL.Parse(
+				fmt.Sprintf(
+					"/action/%s/%s/%d/",
+					actionDigest.GetInstance(),
+					actionDigest.GetHashString(),
+					actionDigest.GetSizeBytes()))
+			if err != nil {
+				log.Fatal(err)
+			}
+			// The result is already present in the Action
+			// Cache, meaning there is no need to store it
+			// once more.
+			return &remoteexecution.ExecuteResponse{
+				Result:       actionResult,
+				CachedResult: true,
+				Message:      "Action details (cached result): " + actionURL.String(),
+			}, false
+		} else if status.Code(err) != codes.NotFound {
+			log.Printf("Failed to check action cache for action %s: %s", actionDigest, err)
+		}
+	}
+	return be.base.Execute(ctx, request, executionStateUpdates)
+}
@@ -0,0 +1,174 @@
+package builder_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestActionCacheCheckingBuildExecutorHit(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx,
+		util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		})).Return(&remoteexecution.Action{}, nil)
+	actionCache := mock.NewMockActionCache(ctrl)
+	actionCache.EXPECT().GetActionResult(
+		ctx,
+		util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		})).Return(&remoteexecution.ActionResult{
+		StdoutRaw: []byte("Hello, world!"),
+	}, nil)
+	actionCacheCheckingBuildExecutor := builder.NewActionCacheCheckingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	executeResponse, mayBeCached := actionCacheCheckingBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+		CachedResult: true,
+		Message:      "Action details (cached result): https://example.com/action/freebsd12/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c/11/",
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
+func TestActionCacheCheckingBuildExecutorMiss(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	baseBuildExecutor.EXPECT().Execute(ctx, request, nil).Return(&remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+	}, true)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx,
+		util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		})).Return(&remoteexecution.Action{}, nil)
+	actionCache := mock.NewMockActionCache(ctrl)
+	actionCache.EXPECT().GetActionResult(
+		ctx,
+		util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		})).Return(nil, status.Error(codes.NotFound, "Blob not found"))
+	actionCacheCheckingBuildExecutor := builder.NewActionCacheCheckingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	executeResponse, mayBeCached := actionCacheCheckingBuildExecutor.Execute(ctx, request, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+	}, executeResponse)
+	require.True(t, mayBeCached)
+}
+
+func TestActionCacheCheckingBuildExecutorSkipCacheLookup(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+		SkipCacheLookup: true,
+	}
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	baseBuildExecutor.EXPECT().Execute(ctx, request, nil).Return(&remoteexecution.ExecuteResponse{
+		Status: status.New(codes.Internal, "Hard disk on fire").Proto(),
+	}, false)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	actionCache := mock.NewMockActionCache(ctrl)
+	actionCacheCheckingBuildExecutor := builder.NewActionCacheCheckingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	executeResponse, mayBeCached := actionCacheCheckingBuildExecutor.Execute(ctx, request, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.Internal, "Hard disk on fire").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
+func TestActionCacheCheckingBuildExecutorDoNotCache(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	baseBuildExecutor.EXPECT().Execute(ctx, request, nil).Return(&remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+	}, false)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx,
+		util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		})).Return(&remoteexecution.Action{
+		DoNotCache: true,
+	}, nil)
+	actionCache := mock.NewMockActionCache(ctrl)
+	actionCacheCheckingBuildExecutor := builder.NewActionCacheCheckingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	// Actions that have do_not_cache set should not be looked up
+	// in the Action Cache, as their results may not be reused.
+	executeResponse, mayBeCached := actionCacheCheckingBuildExecutor.Execute(ctx, request, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"context"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type authorizingBuildQueue struct {
+	buildQueue BuildQueue
+	authorizer auth.Authorizer
+}
+
+// NewAuthorizingBuildQueue creates a decorator for BuildQueue that only
+// forwards Execute() and WaitExecution() requests if the client is
+// permitted to execute build actions on the instance. For
+// WaitExecution(), the instance name is extracted from the operation
+// name, meaning that this decorator must be placed in front of a
+// BuildQueue created through NewDemultiplexingBuildQueue().
+func NewAuthorizingBuildQueue(buildQueue BuildQueue, authorizer auth.Authorizer) BuildQueue {
+	return &authorizingBuildQueue{
+		buildQueue: buildQueue,
+		authorizer: authorizer,
+	}
+}
+
+func (bq *authorizingBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
+	return bq.buildQueue.GetCapabilities(ctx, in)
+}
+
+func (bq *authorizingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
+	instanceName, err := util.CanonicalizeInstanceName(in.InstanceName)
+	if err != nil {
+		return err
+	}
+	if err := bq.authorizer.Authorize(out.Context(), instanceName, pb.Operation_EXECUTE); err != nil {
+		return err
+	}
+	return bq.buildQueue.Execute(in, out)
+}
+
+func (bq *authorizingBuildQueue) WaitExecution(in *remoteexecution.WaitExecutionRequest, out remoteexecution.Execution_WaitExecutionServer) error {
+	target := strings.SplitN(in.Name, "|", 2)
+	if len(target) != 2 {
+		return status.Errorf(codes.InvalidArgument, "Unable to extract instance from operation name")
+	}
+	if err := bq.authorizer.Authorize(out.Context(), target[0], pb.Operation_EXECUTE); err != nil {
+		return err
+	}
+	return bq.buildQueue.WaitExecution(in, out)
+}
@@ -14,6 +14,11 @@ func convertErrorToExecuteResponse(err error) *remoteexecution.ExecuteResponse {
 
 // BuildExecutor is the interface for the ability to run Bazel execute
 // requests and yield an execute response.
+//
+// While the request is being executed, updated operation metadata
+// (e.g., containing the names of streams of live output) may be sent
+// over executionStateUpdates. This channel may be nil if the caller is
+// not interested in such updates.
 type BuildExecutor interface {
-	Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool)
+	Execute(ctx context.Context, request *remoteexecution.ExecuteRequest, executionStateUpdates chan<- *remoteexecution.ExecuteOperationMetadata) (*remoteexecution.ExecuteResponse, bool)
 }
@@ -36,51 +36,33 @@ func NewCachingBuildExecutor(base BuildExecutor, contentAddressableStorage cas.C
 	}
 }
 
-func (be *cachingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+func (be *cachingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest, executionStateUpdates chan<- *remoteexecution.ExecuteOperationMetadata) (*remoteexecution.ExecuteResponse, bool) {
 	actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to extract digest for action")), false
 	}
-	response, mayBeCached := be.base.Execute(ctx, request)
+	response, mayBeCached := be.base.Execute(ctx, request, executionStateUpdates)
 	if response.Result == nil {
 		// Action ran, but did not yield any results.
-		actionURL, err := be.browserURL.Parse(
-			fmt.Sprintf(
-				"/action/%s/%s/%d/",
-				actionDigest.GetInstance(),
-				actionDigest.GetHashString(),
-				actionDigest.GetSizeBytes()))
-		if err != nil {
-			log.Fatal(err)
-		}
-		response.Message = "Action details (no result): " + actionURL.String()
+		response.Message = "Action details (no result): " + be.getActionURL(actionDigest, response)
 	} else if mayBeCached {
 		// Store result in the Action Cache.
 		if err := be.actionCache.PutActionResult(ctx, actionDigest, response.Result); err != nil {
 			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store cached action result")), false
 		}
-
-		actionURL, err := be.browserURL.Parse(
-			fmt.Sprintf(
-				"/action/%s/%s/%d/",
-				actionDigest.GetInstance(),
-				actionDigest.GetHashString(),
-				actionDigest.GetSizeBytes()))
-		if err != nil {
-			log.Fatal(err)
-		}
-		response.Message = "Action details (cached result): " + actionURL.String()
+		response.Message = "Action details (cached result): " + be.getActionURL(actionDigest, response)
 	} else {
 		// Extension: store the result in the Content
 		// Addressable Storage, so the user can at least inspect
 		// it through bbb_browser.
-		actionFailureDigest, err := be.contentAddressableStorage.PutActionFailure(
-			ctx,
-			&failure.ActionFailure{
-				ActionDigest: request.ActionDigest,
-				ActionResult: response.Result,
-			},
-			actionDigest)
+		actionFailure := &failure.ActionFailure{
+			ActionDigest: request.ActionDigest,
+			ActionResult: response.Result,
+		}
+		if resourceUsage, ok := response.ServerLogs[ResourceUsageServerLogName]; ok {
+			actionFailure.ResourceUsageDigest = resourceUsage.Digest
+		}
+		actionFailureDigest, err := be.contentAddressableStorage.PutActionFailure(ctx, actionFailure, actionDigest)
 		if err != nil {
 			return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store uncached action result")), false
 		}
@@ -98,3 +80,25 @@ func (be *cachingBuildExecutor) Execute(ctx context.Context, request *remoteexec
 	}
 	return response, mayBeCached
 }
+
+// getActionURL returns a link to the page in bbb_browser that shows
+// the details of an action. As the Action Cache has no room for storing
+// resource usage statistics alongside the ActionResult, a reference to
+// them is added to the link as a query parameter.
+func (be *cachingBuildExecutor) getActionURL(actionDigest *util.Digest, response *remoteexecution.ExecuteResponse) string {
+	actionURL, err := be.browserURL.Parse(
+		fmt.Sprintf(
+			"/action/%s/%s/%d/",
+			actionDigest.GetInstance(),
+			actionDigest.GetHashString(),
+			actionDigest.GetSizeBytes()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resourceUsage, ok := response.ServerLogs[ResourceUsageServerLogName]; ok && resourceUsage.Digest != nil {
+		actionURL.RawQuery = url.Values{
+			ResourceUsageServerLogName: {fmt.Sprintf("%s-%d", resourceUsage.Digest.Hash, resourceUsage.Digest.SizeBytes)},
+		}.Encode()
+	}
+	return actionURL.String()
+}
@@ -28,7 +28,7 @@ func TestCachingBuildExecutorBadActionDigest(t *testing.T) {
 		Host:   "example.com",
 	})
 
-	executeResponse, mayBeCached := cachingBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{})
+	executeResponse, mayBeCached := cachingBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.InvalidArgument, "Failed to extract digest for action: No digest provided").Proto(),
 	}, executeResponse)
@@ -45,7 +45,7 @@ func TestCachingBuildExecutorNoResult(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	}).Return(&remoteexecution.ExecuteResponse{
+	}, nil).Return(&remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Hard disk on fire").Proto(),
 	}, false)
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
@@ -61,7 +61,7 @@ func TestCachingBuildExecutorNoResult(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status:  status.New(codes.Internal, "Hard disk on fire").Proto(),
 		Message: "Action details (no result): https://example.com/action/freebsd12/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c/11/",
@@ -79,7 +79,7 @@ func TestCachingBuildExecutorCachedSuccess(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	}).Return(&remoteexecution.ExecuteResponse{
+	}, nil).Return(&remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			StdoutRaw: []byte("Hello, world!"),
 		},
@@ -106,7 +106,7 @@ func TestCachingBuildExecutorCachedSuccess(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			StdoutRaw: []byte("Hello, world!"),
@@ -116,6 +116,69 @@ func TestCachingBuildExecutorCachedSuccess(t *testing.T) {
 	require.True(t, mayBeCached)
 }
 
+func TestCachingBuildExecutorCachedSuccessResourceUsage(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	baseBuildExecutor := mock.NewMockBuildExecutor(ctrl)
+	baseBuildExecutor.EXPECT().Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}, nil).Return(&remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+		ServerLogs: map[string]*remoteexecution.LogFile{
+			"resource_usage": {
+				Digest: &remoteexecution.Digest{
+					Hash:      "ce4ff36c6f6ddee1a2a3ab2d2bb2bb4cd41ad69a1e3e20b43e327fa1a9ce4e10",
+					SizeBytes: 42,
+				},
+			},
+		},
+	}, true)
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	actionCache := mock.NewMockActionCache(ctrl)
+	actionCache.EXPECT().PutActionResult(
+		ctx,
+		util.MustNewDigest("freebsd12", &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		}),
+		&remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		}).Return(nil)
+	cachingBuildExecutor := builder.NewCachingBuildExecutor(baseBuildExecutor, contentAddressableStorage, actionCache, &url.URL{
+		Scheme: "https",
+		Host:   "example.com",
+	})
+
+	executeResponse, mayBeCached := cachingBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "freebsd12",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+			SizeBytes: 11,
+		},
+	}, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Result: &remoteexecution.ActionResult{
+			StdoutRaw: []byte("Hello, world!"),
+		},
+		ServerLogs: map[string]*remoteexecution.LogFile{
+			"resource_usage": {
+				Digest: &remoteexecution.Digest{
+					Hash:      "ce4ff36c6f6ddee1a2a3ab2d2bb2bb4cd41ad69a1e3e20b43e327fa1a9ce4e10",
+					SizeBytes: 42,
+				},
+			},
+		},
+		Message: "Action details (cached result): https://example.com/action/freebsd12/64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c/11/?resource_usage=ce4ff36c6f6ddee1a2a3ab2d2bb2bb4cd41ad69a1e3e20b43e327fa1a9ce4e10-42",
+	}, executeResponse)
+	require.True(t, mayBeCached)
+}
+
 func TestCachingBuildExecutorCachedFailure(t *testing.T) {
 	ctrl, ctx := gomock.WithContext(context.Background(), t)
 	defer ctrl.Finish()
@@ -126,7 +189,7 @@ func TestCachingBuildExecutorCachedFailure(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	}).Return(&remoteexecution.ExecuteResponse{
+	}, nil).Return(&remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			StdoutRaw: []byte("Hello, world!"),
 		},
@@ -153,7 +216,7 @@ func TestCachingBuildExecutorCachedFailure(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Failed to store cached action result: Network problems").Proto(),
 	}, executeResponse)
@@ -170,7 +233,7 @@ func TestCachingBuildExecutorUncachedSuccess(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	}).Return(&remoteexecution.ExecuteResponse{
+	}, nil).Return(&remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			ExitCode:  1,
 			StderrRaw: []byte("Compilation failed"),
@@ -205,7 +268,7 @@ func TestCachingBuildExecutorUncachedSuccess(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			ExitCode:  1,
@@ -226,7 +289,7 @@ func TestCachingBuildExecutorUncachedFailure(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	}).Return(&remoteexecution.ExecuteResponse{
+	}, nil).Return(&remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			ExitCode:  1,
 			StderrRaw: []byte("Compilation failed"),
@@ -258,7 +321,7 @@ func TestCachingBuildExecutorUncachedFailure(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Failed to store uncached action result: Network problems").Proto(),
 	}, executeResponse)
@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"context"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type capabilitiesServer struct {
+	cacheCapabilities *remoteexecution.CacheCapabilities
+	buildQueueGetter  BuildQueueGetter
+	authorizer        auth.Authorizer
+}
+
+// NewCapabilitiesServer creates a GRPC service for the Capabilities
+// service that composes the capabilities of a frontend. Cache
+// capabilities are provided by the caller, as they depend on the
+// storage configuration of the frontend. Execution capabilities are
+// obtained from the scheduler that is responsible for the instance.
+//
+// If the BuildQueueGetter returns NOT_FOUND for an instance, no
+// execution capabilities are announced. This permits frontends that
+// only provide storage to answer requests as well.
+//
+// Action Cache updates and remote execution are only announced as
+// being enabled if the client is permitted to perform these operations
+// on the instance.
+func NewCapabilitiesServer(cacheCapabilities *remoteexecution.CacheCapabilities, buildQueueGetter BuildQueueGetter, authorizer auth.Authorizer) remoteexecution.CapabilitiesServer {
+	return &capabilitiesServer{
+		cacheCapabilities: cacheCapabilities,
+		buildQueueGetter:  buildQueueGetter,
+		authorizer:        authorizer,
+	}
+}
+
+func (s *capabilitiesServer) GetCapabilities(ctx context.Context, in *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
+	instanceName, err := util.CanonicalizeInstanceName(in.InstanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Obtain execution capabilities from the scheduler, if any.
+	capabilities := &remoteexecution.ServerCapabilities{
+		LowApiVersion:  &semver.SemVer{Major: 2},
+		HighApiVersion: &semver.SemVer{Major: 2},
+	}
+	if buildQueue, err := s.buildQueueGetter(instanceName); err == nil {
+		requestCopy := *in
+		requestCopy.InstanceName = instanceName
+		schedulerCapabilities, err := buildQueue.GetCapabilities(ctx, &requestCopy)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to obtain capabilities of scheduler for instance %#v", instanceName)
+		}
+		capabilities = proto.Clone(schedulerCapabilities).(*remoteexecution.ServerCapabilities)
+		if executionCapabilities := capabilities.ExecutionCapabilities; executionCapabilities != nil && executionCapabilities.ExecEnabled {
+			executionCapabilities.ExecEnabled = s.authorizer.Authorize(ctx, instanceName, pb.Operation_EXECUTE) == nil
+		}
+	} else if status.Code(err) != codes.NotFound {
+		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instanceName)
+	}
+
+	// Replace the cache capabilities announced by the scheduler by
+	// the ones of this process, as clients access storage through
+	// this process.
+	cacheCapabilities := proto.Clone(s.cacheCapabilities).(*remoteexecution.CacheCapabilities)
+	if updateCapabilities := cacheCapabilities.ActionCacheUpdateCapabilities; updateCapabilities != nil && updateCapabilities.UpdateEnabled {
+		updateCapabilities.UpdateEnabled = s.authorizer.Authorize(ctx, instanceName, pb.Operation_AC_WRITE) == nil
+	}
+	capabilities.CacheCapabilities = cacheCapabilities
+	return capabilities, nil
+}
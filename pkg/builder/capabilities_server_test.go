@@ -0,0 +1,128 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/auth"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/bazelbuild/remote-apis/build/bazel/semver"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCapabilitiesServer(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	buildQueueGetter := mock.NewMockBuildQueueGetter(ctrl)
+	capabilitiesServer := builder.NewCapabilitiesServer(
+		&remoteexecution.CacheCapabilities{
+			DigestFunction: []remoteexecution.DigestFunction{
+				remoteexecution.DigestFunction_SHA256,
+			},
+			ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
+				UpdateEnabled: true,
+			},
+			MaxBatchTotalSizeBytes: 1 << 20,
+		},
+		buildQueueGetter.Call,
+		auth.NewRuleBasedAuthorizer([]*pb.AuthorizationRule{
+			// Only CI may write into the Action Cache and
+			// execute build actions.
+			{
+				Identities: []string{"ci"},
+				Operations: []pb.Operation{pb.Operation_AC_WRITE, pb.Operation_EXECUTE},
+			},
+		}))
+	ci := auth.NewContextWithIdentity(ctx, "ci")
+
+	t.Run("InvalidInstanceName", func(t *testing.T) {
+		_, err := capabilitiesServer.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{
+			InstanceName: "Hello|World",
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Instance name \"Hello|World\" contains invalid character U+007C '|'"), err)
+	})
+
+	t.Run("StorageOnly", func(t *testing.T) {
+		// Instances without a scheduler should only announce
+		// cache capabilities.
+		buildQueueGetter.EXPECT().Call("storage").Return(nil, status.Error(codes.NotFound, "No scheduler configured for instance"))
+		capabilities, err := capabilitiesServer.GetCapabilities(ci, &remoteexecution.GetCapabilitiesRequest{
+			InstanceName: "/storage/",
+		})
+		require.NoError(t, err)
+		require.Equal(t, &remoteexecution.ServerCapabilities{
+			CacheCapabilities: &remoteexecution.CacheCapabilities{
+				DigestFunction: []remoteexecution.DigestFunction{
+					remoteexecution.DigestFunction_SHA256,
+				},
+				ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
+					UpdateEnabled: true,
+				},
+				MaxBatchTotalSizeBytes: 1 << 20,
+			},
+			LowApiVersion:  &semver.SemVer{Major: 2},
+			HighApiVersion: &semver.SemVer{Major: 2},
+		}, capabilities)
+	})
+
+	t.Run("SchedulerFailure", func(t *testing.T) {
+		buildQueueGetter.EXPECT().Call("linux").Return(nil, status.Error(codes.Unavailable, "Scheduler offline"))
+		_, err := capabilitiesServer.GetCapabilities(ci, &remoteexecution.GetCapabilitiesRequest{
+			InstanceName: "linux",
+		})
+		require.Equal(t, status.Error(codes.Unavailable, "Failed to obtain backend for instance \"linux\": Scheduler offline"), err)
+	})
+
+	t.Run("WithScheduler", func(t *testing.T) {
+		// Cache capabilities announced by the scheduler should
+		// be replaced. Clients that are not permitted to write
+		// into the Action Cache or execute build actions should
+		// see these features as being disabled.
+		buildQueue := mock.NewMockBuildQueue(ctrl)
+		buildQueueGetter.EXPECT().Call("linux").Return(buildQueue, nil)
+		buildQueue.EXPECT().GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{
+			InstanceName: "linux",
+		}).Return(&remoteexecution.ServerCapabilities{
+			CacheCapabilities: &remoteexecution.CacheCapabilities{
+				DigestFunction: []remoteexecution.DigestFunction{
+					remoteexecution.DigestFunction_MD5,
+				},
+			},
+			ExecutionCapabilities: &remoteexecution.ExecutionCapabilities{
+				DigestFunction: remoteexecution.DigestFunction_SHA256,
+				ExecEnabled:    true,
+			},
+			LowApiVersion:  &semver.SemVer{Major: 2},
+			HighApiVersion: &semver.SemVer{Major: 2},
+		}, nil)
+		capabilities, err := capabilitiesServer.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{
+			InstanceName: "linux",
+		})
+		require.NoError(t, err)
+		require.Equal(t, &remoteexecution.ServerCapabilities{
+			CacheCapabilities: &remoteexecution.CacheCapabilities{
+				DigestFunction: []remoteexecution.DigestFunction{
+					remoteexecution.DigestFunction_SHA256,
+				},
+				ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
+					UpdateEnabled: false,
+				},
+				MaxBatchTotalSizeBytes: 1 << 20,
+			},
+			ExecutionCapabilities: &remoteexecution.ExecutionCapabilities{
+				DigestFunction: remoteexecution.DigestFunction_SHA256,
+				ExecEnabled:    false,
+			},
+			LowApiVersion:  &semver.SemVer{Major: 2},
+			HighApiVersion: &semver.SemVer{Major: 2},
+		}, capabilities)
+	})
+}
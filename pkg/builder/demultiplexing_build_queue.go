@@ -34,27 +34,33 @@ func NewDemultiplexingBuildQueue(buildQueueGetter BuildQueueGetter) BuildQueue {
 }
 
 func (bq *demultiplexingBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
-	if strings.ContainsRune(in.InstanceName, '|') {
-		return nil, status.Errorf(codes.InvalidArgument, "Instance name cannot contain a pipe character")
+	instanceName, err := util.CanonicalizeInstanceName(in.InstanceName)
+	if err != nil {
+		return nil, err
 	}
-	backend, err := bq.buildQueueGetter(in.InstanceName)
+	backend, err := bq.buildQueueGetter(instanceName)
 	if err != nil {
-		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", in.InstanceName)
+		return nil, util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instanceName)
 	}
-	return backend.GetCapabilities(ctx, in)
+	requestCopy := *in
+	requestCopy.InstanceName = instanceName
+	return backend.GetCapabilities(ctx, &requestCopy)
 }
 
 func (bq *demultiplexingBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
-	if strings.ContainsRune(in.InstanceName, '|') {
-		return status.Errorf(codes.InvalidArgument, "Instance name cannot contain a pipe character")
+	instanceName, err := util.CanonicalizeInstanceName(in.InstanceName)
+	if err != nil {
+		return err
 	}
-	backend, err := bq.buildQueueGetter(in.InstanceName)
+	backend, err := bq.buildQueueGetter(instanceName)
 	if err != nil {
-		return util.StatusWrapf(err, "Failed to obtain backend for instance %#v", in.InstanceName)
+		return util.StatusWrapf(err, "Failed to obtain backend for instance %#v", instanceName)
 	}
-	return backend.Execute(in, &operationNamePrepender{
+	requestCopy := *in
+	requestCopy.InstanceName = instanceName
+	return backend.Execute(&requestCopy, &operationNamePrepender{
 		Execution_ExecuteServer: out,
-		prefix:                  in.InstanceName,
+		prefix:                  instanceName,
 	})
 }
 
@@ -63,6 +69,9 @@ func (bq *demultiplexingBuildQueue) WaitExecution(in *remoteexecution.WaitExecut
 	if len(target) != 2 {
 		return status.Errorf(codes.InvalidArgument, "Unable to extract instance from operation name")
 	}
+	if _, err := util.CanonicalizeInstanceName(target[0]); err != nil {
+		return err
+	}
 	backend, err := bq.buildQueueGetter(target[0])
 	if err != nil {
 		return util.StatusWrapf(err, "Failed to obtain backend for instance %#v", target[0])
@@ -23,7 +23,7 @@ func TestDemultiplexingBuildQueueBadInstanceName(t *testing.T) {
 	_, err := demultiplexingBuildQueue.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{
 		InstanceName: "Hello|World",
 	})
-	require.Equal(t, status.Error(codes.InvalidArgument, "Instance name cannot contain a pipe character"), err)
+	require.Equal(t, status.Error(codes.InvalidArgument, "Instance name \"Hello|World\" contains invalid character U+007C '|'"), err)
 
 	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
 	err = demultiplexingBuildQueue.Execute(&remoteexecution.ExecuteRequest{
@@ -33,7 +33,7 @@ func TestDemultiplexingBuildQueueBadInstanceName(t *testing.T) {
 			SizeBytes: 0,
 		},
 	}, executeServer)
-	require.Equal(t, status.Error(codes.InvalidArgument, "Instance name cannot contain a pipe character"), err)
+	require.Equal(t, status.Error(codes.InvalidArgument, "Instance name \"Hello|World\" contains invalid character U+007C '|'"), err)
 
 	waitExecutionServer := mock.NewMockExecution_WaitExecutionServer(ctrl)
 	err = demultiplexingBuildQueue.WaitExecution(&remoteexecution.WaitExecutionRequest{
@@ -48,29 +48,29 @@ func TestDemultiplexingBuildQueueFailedToGetBackend(t *testing.T) {
 	buildQueueGetter := mock.NewMockBuildQueueGetter(ctrl)
 	demultiplexingBuildQueue := builder.NewDemultiplexingBuildQueue(buildQueueGetter.Call)
 
-	buildQueueGetter.EXPECT().Call("Nonexistent backend").Return(nil, status.Error(codes.NotFound, "Backend not found"))
+	buildQueueGetter.EXPECT().Call("nonexistent-backend").Return(nil, status.Error(codes.NotFound, "Backend not found"))
 	_, err := demultiplexingBuildQueue.GetCapabilities(ctx, &remoteexecution.GetCapabilitiesRequest{
-		InstanceName: "Nonexistent backend",
+		InstanceName: "nonexistent-backend",
 	})
-	require.Equal(t, status.Error(codes.NotFound, "Failed to obtain backend for instance \"Nonexistent backend\": Backend not found"), err)
+	require.Equal(t, status.Error(codes.NotFound, "Failed to obtain backend for instance \"nonexistent-backend\": Backend not found"), err)
 
-	buildQueueGetter.EXPECT().Call("Nonexistent backend").Return(nil, status.Error(codes.NotFound, "Backend not found"))
+	buildQueueGetter.EXPECT().Call("nonexistent-backend").Return(nil, status.Error(codes.NotFound, "Backend not found"))
 	executeServer := mock.NewMockExecution_ExecuteServer(ctrl)
 	err = demultiplexingBuildQueue.Execute(&remoteexecution.ExecuteRequest{
-		InstanceName: "Nonexistent backend",
+		InstanceName: "nonexistent-backend",
 		ActionDigest: &remoteexecution.Digest{
 			Hash:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
 			SizeBytes: 0,
 		},
 	}, executeServer)
-	require.Equal(t, status.Error(codes.NotFound, "Failed to obtain backend for instance \"Nonexistent backend\": Backend not found"), err)
+	require.Equal(t, status.Error(codes.NotFound, "Failed to obtain backend for instance \"nonexistent-backend\": Backend not found"), err)
 
-	buildQueueGetter.EXPECT().Call("Nonexistent backend").Return(nil, status.Error(codes.NotFound, "Backend not found"))
+	buildQueueGetter.EXPECT().Call("nonexistent-backend").Return(nil, status.Error(codes.NotFound, "Backend not found"))
 	waitExecutionServer := mock.NewMockExecution_WaitExecutionServer(ctrl)
 	err = demultiplexingBuildQueue.WaitExecution(&remoteexecution.WaitExecutionRequest{
-		Name: "Nonexistent backend|df4ab561-4e81-48c7-a387-edc7d899a76f",
+		Name: "nonexistent-backend|df4ab561-4e81-48c7-a387-edc7d899a76f",
 	}, waitExecutionServer)
-	require.Equal(t, status.Error(codes.NotFound, "Failed to obtain backend for instance \"Nonexistent backend\": Backend not found"), err)
+	require.Equal(t, status.Error(codes.NotFound, "Failed to obtain backend for instance \"nonexistent-backend\": Backend not found"), err)
 }
 
 // TODO(edsch): Improve coverage.
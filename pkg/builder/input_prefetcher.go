@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// InputPrefetcher is used by workers to load the inputs of an action
+// into local caches before the action is executed. This allows
+// downloading of inputs of the next action to overlap with execution
+// of the current one.
+type InputPrefetcher interface {
+	Prefetch(ctx context.Context, request *remoteexecution.ExecuteRequest) error
+}
+
+type contentAddressableStorageInputPrefetcher struct {
+	contentAddressableStorage cas.ContentAddressableStorage
+	scratchDirectory          filesystem.Directory
+	maximumInputSizeBytes     int64
+
+	nextScratchFile uint64
+}
+
+// NewContentAddressableStorageInputPrefetcher creates an InputPrefetcher
+// that obtains all input directories and files of an action through a
+// ContentAddressableStorage. This is only useful if the
+// ContentAddressableStorage is backed by caches (e.g.,
+// NewDirectoryCachingContentAddressableStorage and
+// NewHardlinkingContentAddressableStorage). The Action and Command
+// messages themselves are small and are not cached, meaning they are
+// fetched once more upon execution.
+//
+// Input files are downloaded into a scratch directory and removed
+// immediately afterwards, leaving only the copies in the cache. The
+// scratch directory must therefore reside on the same file system as
+// the cache directory. Prefetching stops once the total size of input
+// files exceeds maximumInputSizeBytes, so that large actions do not
+// needlessly evict the inputs of the current action from the cache.
+func NewContentAddressableStorageInputPrefetcher(contentAddressableStorage cas.ContentAddressableStorage, scratchDirectory filesystem.Directory, maximumInputSizeBytes int64) InputPrefetcher {
+	return &contentAddressableStorageInputPrefetcher{
+		contentAddressableStorage: contentAddressableStorage,
+		scratchDirectory:          scratchDirectory,
+		maximumInputSizeBytes:     maximumInputSizeBytes,
+	}
+}
+
+func (ip *contentAddressableStorageInputPrefetcher) prefetchInputDirectory(ctx context.Context, partialDigest *remoteexecution.Digest, parentDigest *util.Digest, components []string, totalInputSizeBytes *int64) error {
+	digest, err := parentDigest.NewDerivedDigest(partialDigest)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to extract digest for input directory %#v", path.Join(components...))
+	}
+	directory, err := ip.contentAddressableStorage.GetDirectory(ctx, digest)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to obtain input directory %#v", path.Join(components...))
+	}
+
+	for _, file := range directory.Files {
+		childComponents := append(components, file.Name)
+		childDigest, err := digest.NewDerivedDigest(file.Digest)
+		if err != nil {
+			return util.StatusWrapf(err, "Failed to extract digest for input file %#v", path.Join(childComponents...))
+		}
+		*totalInputSizeBytes += childDigest.GetSizeBytes()
+		if *totalInputSizeBytes > ip.maximumInputSizeBytes {
+			return status.Errorf(codes.ResourceExhausted, "Input file %#v causes the total size of all prefetched input files to exceed the maximum of %d bytes", path.Join(childComponents...), ip.maximumInputSizeBytes)
+		}
+		name := strconv.FormatUint(atomic.AddUint64(&ip.nextScratchFile, 1), 10)
+		if err := ip.contentAddressableStorage.GetFile(ctx, childDigest, ip.scratchDirectory, name, file.IsExecutable); err != nil {
+			return util.StatusWrapf(err, "Failed to obtain input file %#v", path.Join(childComponents...))
+		}
+		if err := ip.scratchDirectory.Remove(name); err != nil {
+			return util.StatusWrapf(err, "Failed to remove prefetched input file %#v", path.Join(childComponents...))
+		}
+	}
+	for _, directory := range directory.Directories {
+		if err := ip.prefetchInputDirectory(ctx, directory.Digest, digest, append(components, directory.Name), totalInputSizeBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ip *contentAddressableStorageInputPrefetcher) Prefetch(ctx context.Context, request *remoteexecution.ExecuteRequest) error {
+	actionDigest, err := util.NewDigest(request.InstanceName, request.ActionDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to extract digest for action")
+	}
+	action, err := ip.contentAddressableStorage.GetAction(ctx, actionDigest)
+	if err != nil {
+		return util.StatusWrap(err, "Failed to obtain action")
+	}
+	var totalInputSizeBytes int64
+	return ip.prefetchInputDirectory(ctx, action.InputRootDigest, actionDigest, []string{"."}, &totalInputSizeBytes)
+}
@@ -0,0 +1,107 @@
+package builder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContentAddressableStorageInputPrefetcher(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+		Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+		SizeBytes: 7,
+	})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 7,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil).Times(2)
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+		Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+		SizeBytes: 42,
+	})).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "a.txt",
+				Digest: &remoteexecution.Digest{
+					Hash:      "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+					SizeBytes: 300,
+				},
+			},
+		},
+		Directories: []*remoteexecution.DirectoryNode{
+			{
+				Name: "sub",
+				Digest: &remoteexecution.Digest{
+					Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+					SizeBytes: 23,
+				},
+			},
+		},
+		Symlinks: []*remoteexecution.SymlinkNode{
+			{
+				Name:   "link",
+				Target: "a.txt",
+			},
+		},
+	}, nil).Times(2)
+	contentAddressableStorage.EXPECT().GetDirectory(ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+		Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+		SizeBytes: 23,
+	})).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "b.txt",
+				Digest: &remoteexecution.Digest{
+					Hash:      "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+					SizeBytes: 400,
+				},
+				IsExecutable: true,
+			},
+		},
+	}, nil).Times(2)
+	scratchDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().GetFile(ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+		Hash:      "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		SizeBytes: 300,
+	}), scratchDirectory, "1", false).Return(nil).Times(2)
+	scratchDirectory.EXPECT().Remove("1").Return(nil).Times(2)
+	contentAddressableStorage.EXPECT().GetFile(ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+		Hash:      "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+		SizeBytes: 400,
+	}), scratchDirectory, "2", true).Return(nil)
+	scratchDirectory.EXPECT().Remove("2").Return(nil)
+	inputPrefetcher := builder.NewContentAddressableStorageInputPrefetcher(contentAddressableStorage, scratchDirectory, 700)
+
+	// Both input files fit within the maximum prefetch size.
+	request := &remoteexecution.ExecuteRequest{
+		InstanceName: "netbsd",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	}
+	require.NoError(t, inputPrefetcher.Prefetch(ctx, request))
+
+	// Prefetching should stop when exceeding the maximum size.
+	inputPrefetcher = builder.NewContentAddressableStorageInputPrefetcher(contentAddressableStorage, scratchDirectory, 500)
+	err := inputPrefetcher.Prefetch(ctx, request)
+	require.Equal(t, status.Error(codes.ResourceExhausted, "Input file \"sub/b.txt\" causes the total size of all prefetched input files to exceed the maximum of 500 bytes"), err)
+}
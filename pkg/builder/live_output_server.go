@@ -0,0 +1,304 @@
+package builder
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/google/uuid"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// LiveOutputResourceNameComponent is the pathname component
+	// that separates the address of a worker from the remainder of
+	// the name of a live output stream.
+	LiveOutputResourceNameComponent = "/live-output/"
+
+	// LiveOutputReadOffsetMetadataKey is the key of the header
+	// metadata entry that contains the offset at which the data
+	// returned by ByteStream Read() starts. It may be higher than
+	// the requested offset, as only the most recent output of
+	// every stream is retained.
+	LiveOutputReadOffsetMetadataKey = "live-output-read-offset"
+
+	// Maximum size of a single ByteStream ReadResponse.
+	liveOutputReadChunkSizeBytes = 64 * 1024
+)
+
+// LiveOutput is a pair of stdout and stderr streams of a single build
+// action that is running.
+type LiveOutput interface {
+	// GetStdoutStreamName returns the ByteStream resource name
+	// through which stdout of the build action may be read.
+	GetStdoutStreamName() string
+	// GetStderrStreamName returns the ByteStream resource name
+	// through which stderr of the build action may be read.
+	GetStderrStreamName() string
+
+	// Write a chunk of output, making it available to readers. This
+	// method is compatible with environment.OutputHandler.
+	Write(chunk *runner.OutputChunk) error
+	// Close the streams, causing readers to receive the end of the
+	// stream once all data has been read. Streams cannot be opened
+	// by new readers afterwards.
+	Close()
+}
+
+// LiveOutputServer is a ByteStream service that allows reading the
+// stdout and stderr streams of build actions, while they are running
+// on this worker.
+type LiveOutputServer interface {
+	bytestream.ByteStreamServer
+
+	// NewLiveOutput creates a pair of streams for the output of a
+	// single build action.
+	NewLiveOutput() LiveOutput
+}
+
+type liveOutputServer struct {
+	resourceNamePrefix     string
+	maximumStreamSizeBytes int
+
+	lock    sync.Mutex
+	streams map[string]*liveOutputStream
+}
+
+// NewLiveOutputServer creates a LiveOutputServer. The names of streams
+// are prefixed with the provided address, so that clients are capable
+// of determining which worker to contact to read them. Only the most
+// recent maximumStreamSizeBytes bytes of every stream are retained in
+// memory. Readers that request data that is no longer retained receive
+// data starting at the oldest retained offset, which is announced
+// through header metadata. Readers that fall behind while reading
+// have their stream terminated with OUT_OF_RANGE, so that they can
+// resume reading at a higher offset.
+func NewLiveOutputServer(address string, maximumStreamSizeBytes int) LiveOutputServer {
+	return &liveOutputServer{
+		resourceNamePrefix:     address + LiveOutputResourceNameComponent,
+		maximumStreamSizeBytes: maximumStreamSizeBytes,
+		streams:                map[string]*liveOutputStream{},
+	}
+}
+
+func (s *liveOutputServer) NewLiveOutput() LiveOutput {
+	name := s.resourceNamePrefix + uuid.Must(uuid.NewRandom()).String()
+	lo := &liveOutput{
+		server:     s,
+		stdoutName: name + "/stdout",
+		stderrName: name + "/stderr",
+		stdout:     newLiveOutputStream(s.maximumStreamSizeBytes),
+		stderr:     newLiveOutputStream(s.maximumStreamSizeBytes),
+	}
+
+	s.lock.Lock()
+	s.streams[lo.stdoutName] = lo.stdout
+	s.streams[lo.stderrName] = lo.stderr
+	s.lock.Unlock()
+	return lo
+}
+
+func (s *liveOutputServer) Read(in *bytestream.ReadRequest, out bytestream.ByteStream_ReadServer) error {
+	if in.ReadOffset < 0 {
+		return status.Errorf(codes.OutOfRange, "Negative read offset: %d", in.ReadOffset)
+	}
+	if in.ReadLimit < 0 {
+		return status.Errorf(codes.InvalidArgument, "Negative read limit: %d", in.ReadLimit)
+	}
+	s.lock.Lock()
+	stream, ok := s.streams[in.ResourceName]
+	s.lock.Unlock()
+	if !ok {
+		if !strings.HasPrefix(in.ResourceName, s.resourceNamePrefix) {
+			return status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+		}
+		return status.Errorf(codes.NotFound, "Stream %#v not found, as the build action may have completed", in.ResourceName)
+	}
+
+	ctx := out.Context()
+	offset := int(in.ReadOffset)
+	remaining := int(in.ReadLimit)
+	sentHeader := false
+	for {
+		maximumChunkSizeBytes := liveOutputReadChunkSizeBytes
+		if remaining > 0 && maximumChunkSizeBytes > remaining {
+			maximumChunkSizeBytes = remaining
+		}
+		data, dataOffset, closed, wakeup := stream.get(offset, maximumChunkSizeBytes)
+		if dataOffset != offset {
+			if sentHeader {
+				return status.Errorf(codes.OutOfRange, "Data at offset %d has been discarded, as only the most recent %d bytes of the stream are retained", offset, s.maximumStreamSizeBytes)
+			}
+			offset = dataOffset
+		}
+		if !sentHeader {
+			if err := out.SendHeader(metadata.Pairs(LiveOutputReadOffsetMetadataKey, strconv.Itoa(offset))); err != nil {
+				return err
+			}
+			sentHeader = true
+		}
+
+		if len(data) > 0 {
+			if err := out.Send(&bytestream.ReadResponse{Data: data}); err != nil {
+				return err
+			}
+			offset += len(data)
+			if remaining > 0 {
+				remaining -= len(data)
+				if remaining == 0 {
+					return nil
+				}
+			}
+			continue
+		}
+		if closed {
+			return nil
+		}
+
+		// Wait for more data to be written.
+		select {
+		case <-wakeup:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *liveOutputServer) Write(stream bytestream.ByteStream_WriteServer) error {
+	return status.Error(codes.Unimplemented, "Live output streams cannot be written to")
+}
+
+func (s *liveOutputServer) QueryWriteStatus(ctx context.Context, in *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "Live output streams cannot be written to")
+}
+
+type liveOutput struct {
+	server     *liveOutputServer
+	stdoutName string
+	stderrName string
+	stdout     *liveOutputStream
+	stderr     *liveOutputStream
+}
+
+func (lo *liveOutput) GetStdoutStreamName() string {
+	return lo.stdoutName
+}
+
+func (lo *liveOutput) GetStderrStreamName() string {
+	return lo.stderrName
+}
+
+func (lo *liveOutput) Write(chunk *runner.OutputChunk) error {
+	switch chunk.Stream {
+	case runner.OutputChunk_STDOUT:
+		lo.stdout.append(chunk.Data)
+	case runner.OutputChunk_STDERR:
+		lo.stderr.append(chunk.Data)
+	default:
+		return status.Errorf(codes.InvalidArgument, "Output chunk has unknown stream %d", chunk.Stream)
+	}
+	return nil
+}
+
+func (lo *liveOutput) Close() {
+	lo.server.lock.Lock()
+	delete(lo.server.streams, lo.stdoutName)
+	delete(lo.server.streams, lo.stderrName)
+	lo.server.lock.Unlock()
+
+	lo.stdout.close()
+	lo.stderr.close()
+}
+
+// liveOutputStream holds the most recent data written to a single
+// stream in a ring buffer. The buffer grows as data is written, up to
+// its maximum size. Readers waiting for more data are woken up by
+// closing the wakeup channel.
+type liveOutputStream struct {
+	maximumSizeBytes int
+
+	lock   sync.Mutex
+	buffer []byte
+	size   int
+	closed bool
+	wakeup chan struct{}
+}
+
+func newLiveOutputStream(maximumSizeBytes int) *liveOutputStream {
+	return &liveOutputStream{
+		maximumSizeBytes: maximumSizeBytes,
+		wakeup:           make(chan struct{}),
+	}
+}
+
+func (s *liveOutputStream) append(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || len(data) == 0 {
+		return
+	}
+
+	// Grow the buffer until it reaches its maximum size. Until
+	// then, the size of the buffer is equal to the amount of data
+	// written.
+	if newSize := s.size + len(data); len(s.buffer) < newSize && len(s.buffer) < s.maximumSizeBytes {
+		if newSize > s.maximumSizeBytes {
+			newSize = s.maximumSizeBytes
+		}
+		s.buffer = append(s.buffer, make([]byte, newSize-len(s.buffer))...)
+	}
+
+	// Data that would be overwritten by the same write right away
+	// doesn't need to be copied. The full output is still uploaded
+	// upon completion.
+	if discarded := len(data) - len(s.buffer); discarded > 0 {
+		s.size += discarded
+		data = data[discarded:]
+	}
+	for len(data) > 0 {
+		n := copy(s.buffer[s.size%len(s.buffer):], data)
+		s.size += n
+		data = data[n:]
+	}
+	close(s.wakeup)
+	s.wakeup = make(chan struct{})
+}
+
+func (s *liveOutputStream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.wakeup)
+	}
+}
+
+// get returns a copy of at most maximumSizeBytes bytes of data stored
+// at a given offset, whether the stream is closed and a channel that
+// is closed when new data is written. If the data at the offset has
+// been discarded, data is returned starting at the oldest offset that
+// is retained. The offset of the returned data is returned as well.
+func (s *liveOutputStream) get(offset int, maximumSizeBytes int) ([]byte, int, bool, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if oldestOffset := s.size - len(s.buffer); offset < oldestOffset {
+		offset = oldestOffset
+	}
+	length := s.size - offset
+	if length <= 0 {
+		return nil, offset, s.closed, s.wakeup
+	}
+	if length > maximumSizeBytes {
+		length = maximumSizeBytes
+	}
+	data := make([]byte, length)
+	n := copy(data, s.buffer[offset%len(s.buffer):])
+	copy(data[n:], s.buffer)
+	return data, offset, s.closed, s.wakeup
+}
@@ -0,0 +1,160 @@
+package builder_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestLiveOutputServer(t *testing.T) {
+	ctx := context.Background()
+
+	// Create an RPC server/client pair.
+	liveOutputServer := builder.NewLiveOutputServer("worker:8983", 10)
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	bytestream.RegisterByteStreamServer(server, liveOutputServer)
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer server.Stop()
+	defer conn.Close()
+	client := bytestream.NewByteStreamClient(conn)
+
+	liveOutput := liveOutputServer.NewLiveOutput()
+	require.True(t, strings.HasPrefix(liveOutput.GetStdoutStreamName(), "worker:8983/live-output/"))
+	require.True(t, strings.HasSuffix(liveOutput.GetStdoutStreamName(), "/stdout"))
+	require.True(t, strings.HasSuffix(liveOutput.GetStderrStreamName(), "/stderr"))
+
+	// Data that has already been written should be returned
+	// immediately. Data written afterwards should be returned as
+	// well.
+	require.NoError(t, liveOutput.Write(&runner.OutputChunk{
+		Stream: runner.OutputChunk_STDOUT,
+		Data:   []byte("Hello"),
+	}))
+	req, err := client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: liveOutput.GetStdoutStreamName(),
+		ReadOffset:   1,
+	})
+	require.NoError(t, err)
+	response, err := req.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ello"), response.Data)
+	header, err := req.Header()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, header.Get(builder.LiveOutputReadOffsetMetadataKey))
+
+	require.NoError(t, liveOutput.Write(&runner.OutputChunk{
+		Stream: runner.OutputChunk_STDERR,
+		Data:   []byte("Not on stdout"),
+	}))
+	require.NoError(t, liveOutput.Write(&runner.OutputChunk{
+		Stream: runner.OutputChunk_STDOUT,
+		Data:   []byte(", world"),
+	}))
+	response, err = req.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte(", world"), response.Data)
+
+	// Only the last ten bytes of every stream are retained. New
+	// readers should receive data starting at the oldest offset
+	// that is retained, which is announced through metadata.
+	req2, err := client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: liveOutput.GetStdoutStreamName(),
+	})
+	require.NoError(t, err)
+	response, err = req2.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("llo, world"), response.Data)
+	header, err = req2.Header()
+	require.NoError(t, err)
+	require.Equal(t, []string{"2"}, header.Get(builder.LiveOutputReadOffsetMetadataKey))
+
+	// Data wraps around within the ring buffer.
+	require.NoError(t, liveOutput.Write(&runner.OutputChunk{
+		Stream: runner.OutputChunk_STDOUT,
+		Data:   []byte("!!!"),
+	}))
+	response, err = req.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("!!!"), response.Data)
+	response, err = req2.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("!!!"), response.Data)
+
+	// Readers that fall behind should have their streams
+	// terminated, as data has been discarded. Readers requesting
+	// a range of data that has partially been discarded should
+	// receive the data that is still retained.
+	require.NoError(t, liveOutput.Write(&runner.OutputChunk{
+		Stream: runner.OutputChunk_STDERR,
+		Data:   []byte("Lots of output"),
+	}))
+	req3, err := client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: liveOutput.GetStderrStreamName(),
+		ReadOffset:   15,
+		ReadLimit:    5,
+	})
+	require.NoError(t, err)
+	response, err = req3.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte(" of o"), response.Data)
+	_, err = req3.Recv()
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, liveOutput.Write(&runner.OutputChunk{
+		Stream: runner.OutputChunk_STDOUT,
+		Data:   []byte("Too much output to keep up"),
+	}))
+	for _, r := range []bytestream.ByteStream_ReadClient{req, req2} {
+		_, err = r.Recv()
+		require.Equal(t, status.Error(codes.OutOfRange, "Data at offset 15 has been discarded, as only the most recent 10 bytes of the stream are retained"), err)
+	}
+	req, err = client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: liveOutput.GetStdoutStreamName(),
+		ReadOffset:   31,
+	})
+	require.NoError(t, err)
+	response, err = req.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("to keep up"), response.Data)
+
+	// Closing the streams should cause readers to terminate.
+	liveOutput.Close()
+	_, err = req.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// Streams can no longer be opened after closure.
+	req, err = client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: liveOutput.GetStderrStreamName(),
+	})
+	require.NoError(t, err)
+	_, err = req.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Resource names from other workers should be rejected.
+	req, err = client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: "blobs/e811818f80d9c3c22d577ba83d6196788e553bb408535bb42105cdff726a60ab/42",
+	})
+	require.NoError(t, err)
+	_, err = req.Recv()
+	require.Equal(t, status.Error(codes.InvalidArgument, "Invalid resource naming scheme"), err)
+}
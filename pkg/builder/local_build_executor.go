@@ -2,6 +2,7 @@ package builder
 
 import (
 	"context"
+	"log"
 	"math"
 	"os"
 	"path"
@@ -11,10 +12,12 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"google.golang.org/grpc/codes"
@@ -35,27 +38,185 @@ var (
 	localBuildExecutorDurationSecondsGetActionCommand  = localBuildExecutorDurationSeconds.WithLabelValues("GetActionCommand")
 	localBuildExecutorDurationSecondsRunCommand        = localBuildExecutorDurationSeconds.WithLabelValues("RunCommand")
 	localBuildExecutorDurationSecondsUploadOutput      = localBuildExecutorDurationSeconds.WithLabelValues("UploadOutput")
+
+	localBuildExecutorCPUTimeSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_cpu_time_seconds",
+			Help:      "Amount of CPU time consumed by build actions, in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, math.Pow(10.0, 1.0/3.0), 6*3+1),
+		},
+		[]string{"mode"})
+	localBuildExecutorCPUTimeSecondsUser   = localBuildExecutorCPUTimeSeconds.WithLabelValues("User")
+	localBuildExecutorCPUTimeSecondsSystem = localBuildExecutorCPUTimeSeconds.WithLabelValues("System")
+
+	localBuildExecutorMaximumResidentSetSizeBytes = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_maximum_resident_set_size_bytes",
+			Help:      "Maximum resident set size of build actions, in bytes.",
+			Buckets:   prometheus.ExponentialBuckets(1<<20, 2.0, 16),
+		})
+
+	localBuildExecutorBlockOperations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "buildbarn",
+			Subsystem: "builder",
+			Name:      "local_build_executor_block_operations",
+			Help:      "Number of block I/O operations performed by build actions.",
+			Buckets:   prometheus.ExponentialBuckets(1.0, 4.0, 12),
+		},
+		[]string{"direction"})
+	localBuildExecutorBlockOperationsInput  = localBuildExecutorBlockOperations.WithLabelValues("Input")
+	localBuildExecutorBlockOperationsOutput = localBuildExecutorBlockOperations.WithLabelValues("Output")
 )
 
 func init() {
 	prometheus.MustRegister(localBuildExecutorDurationSeconds)
+	prometheus.MustRegister(localBuildExecutorCPUTimeSeconds)
+	prometheus.MustRegister(localBuildExecutorMaximumResidentSetSizeBytes)
+	prometheus.MustRegister(localBuildExecutorBlockOperations)
+}
+
+// ResourceUsageServerLogName is the name of the server log in the
+// ExecuteResponse that refers to the ResourceUsage message of the
+// action, stored in the Content Addressable Storage. It is also used
+// as the name of the query parameter through which bbb_browser's
+// action pages may be provided with this message.
+const ResourceUsageServerLogName = "resource_usage"
+
+func observeResourceUsage(resourceUsage *resourceusage.ResourceUsage) {
+	if userTime, err := ptypes.Duration(resourceUsage.UserTime); err == nil {
+		localBuildExecutorCPUTimeSecondsUser.Observe(userTime.Seconds())
+	}
+	if systemTime, err := ptypes.Duration(resourceUsage.SystemTime); err == nil {
+		localBuildExecutorCPUTimeSecondsSystem.Observe(systemTime.Seconds())
+	}
+	localBuildExecutorMaximumResidentSetSizeBytes.Observe(float64(resourceUsage.MaximumResidentSetSizeBytes))
+	localBuildExecutorBlockOperationsInput.Observe(float64(resourceUsage.BlockInputOperations))
+	localBuildExecutorBlockOperationsOutput.Observe(float64(resourceUsage.BlockOutputOperations))
 }
 
 type localBuildExecutor struct {
 	contentAddressableStorage cas.ContentAddressableStorage
 	environmentManager        environment.Manager
+	liveOutputServer          LiveOutputServer
+
+	maximumInputSizeBytes      int64
+	maximumOutputSizeBytes     int64
+	maximumOutputFileSizeBytes int64
+	outputSizeCheckInterval    time.Duration
 }
 
 // NewLocalBuildExecutor returns a BuildExecutor that executes build
-// steps on the local system.
-func NewLocalBuildExecutor(contentAddressableStorage cas.ContentAddressableStorage, environmentManager environment.Manager) BuildExecutor {
+// steps on the local system. If a LiveOutputServer is provided, the
+// output of build steps is made available through it while running.
+//
+// To prevent build actions from exhausting the disk space of the
+// worker and the storage capacity of the Content Addressable Storage,
+// limits are placed on the total size of the input files, the total
+// size of the output files and the size of individual output files.
+// If outputSizeCheckInterval is non-zero, the size of the build
+// directory is also checked periodically while build steps run, so
+// that build steps writing excessive amounts of data are terminated
+// before they are able to exhaust the disk space of the worker.
+func NewLocalBuildExecutor(contentAddressableStorage cas.ContentAddressableStorage, environmentManager environment.Manager, liveOutputServer LiveOutputServer, maximumInputSizeBytes int64, maximumOutputSizeBytes int64, maximumOutputFileSizeBytes int64, outputSizeCheckInterval time.Duration) BuildExecutor {
 	return &localBuildExecutor{
-		contentAddressableStorage: contentAddressableStorage,
-		environmentManager:        environmentManager,
+		contentAddressableStorage:  contentAddressableStorage,
+		environmentManager:         environmentManager,
+		liveOutputServer:           liveOutputServer,
+		maximumInputSizeBytes:      maximumInputSizeBytes,
+		maximumOutputSizeBytes:     maximumOutputSizeBytes,
+		maximumOutputFileSizeBytes: maximumOutputFileSizeBytes,
+		outputSizeCheckInterval:    outputSizeCheckInterval,
+	}
+}
+
+// putOutputFile uploads an output file, while enforcing the limits on
+// the size of individual output files and the total size of all output
+// files. As processes spawned by the build action may still modify the
+// file, the size reported by the file system is only used to provide a
+// descriptive error early on. The limits are enforced while uploading.
+func (be *localBuildExecutor) putOutputFile(ctx context.Context, directory filesystem.Directory, name string, sizeBytes int64, parentDigest *util.Digest, totalOutputSizeBytes *int64, components []string) (*util.Digest, error) {
+	if sizeBytes > be.maximumOutputFileSizeBytes {
+		return nil, status.Errorf(codes.ResourceExhausted, "Output file %#v is %d bytes in size, which exceeds the maximum of %d bytes", path.Join(components...), sizeBytes, be.maximumOutputFileSizeBytes)
+	}
+	remainingOutputSizeBytes := be.maximumOutputSizeBytes - *totalOutputSizeBytes
+	if sizeBytes > remainingOutputSizeBytes {
+		return nil, status.Errorf(codes.ResourceExhausted, "Output file %#v causes the total size of all output files to exceed the maximum of %d bytes", path.Join(components...), be.maximumOutputSizeBytes)
+	}
+
+	maximumSizeBytes := be.maximumOutputFileSizeBytes
+	if maximumSizeBytes > remainingOutputSizeBytes {
+		maximumSizeBytes = remainingOutputSizeBytes
+	}
+	digest, err := be.contentAddressableStorage.PutFile(ctx, directory, name, parentDigest, maximumSizeBytes)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to store output file %#v", path.Join(components...))
+	}
+	*totalOutputSizeBytes += digest.GetSizeBytes()
+	return digest, nil
+}
+
+// getDirectorySizeBytes computes the total size of the regular files
+// stored in a directory and its subdirectories. As the build action may
+// still be modifying the directory, subdirectories that disappear while
+// being traversed are ignored.
+func getDirectorySizeBytes(directory filesystem.Directory) (int64, error) {
+	files, err := directory.ReadDir()
+	if err != nil {
+		return 0, err
+	}
+	var sizeBytes int64
+	for _, file := range files {
+		switch file.Mode() & os.ModeType {
+		case 0:
+			sizeBytes += file.Size()
+		case os.ModeDir:
+			childDirectory, err := directory.Enter(file.Name())
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			childSizeBytes, err := getDirectorySizeBytes(childDirectory)
+			childDirectory.Close()
+			if err != nil {
+				return 0, err
+			}
+			sizeBytes += childSizeBytes
+		}
 	}
+	return sizeBytes, nil
 }
 
-func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialDigest *remoteexecution.Digest, parentDigest *util.Digest, inputDirectory filesystem.Directory, components []string) error {
+// checkBuildDirectorySize periodically computes the size of the build
+// directory while a build action runs. Once it exceeds the maximum, the
+// build action is canceled and an error is returned. The function
+// returns nil once the build action completes without exceeding the
+// maximum.
+func (be *localBuildExecutor) checkBuildDirectorySize(buildDirectory filesystem.Directory, maximumSizeBytes int64, cancel context.CancelFunc, done <-chan struct{}) error {
+	ticker := time.NewTicker(be.outputSizeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sizeBytes, err := getDirectorySizeBytes(buildDirectory)
+			if err != nil {
+				log.Print("Failed to compute size of build directory: ", err)
+			} else if sizeBytes > maximumSizeBytes {
+				cancel()
+				return status.Errorf(codes.ResourceExhausted, "Build directory is %d bytes in size, which exceeds the total size of all input files plus the maximum total size of all output files of %d bytes", sizeBytes, maximumSizeBytes)
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialDigest *remoteexecution.Digest, parentDigest *util.Digest, inputDirectory filesystem.Directory, components []string, totalInputSizeBytes *int64) error {
 	// Obtain directory.
 	digest, err := parentDigest.NewDerivedDigest(partialDigest)
 	if err != nil {
@@ -73,6 +234,10 @@ func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialD
 		if err != nil {
 			return util.StatusWrapf(err, "Failed to extract digest for input file %#v", path.Join(childComponents...))
 		}
+		*totalInputSizeBytes += childDigest.GetSizeBytes()
+		if *totalInputSizeBytes > be.maximumInputSizeBytes {
+			return status.Errorf(codes.ResourceExhausted, "Input file %#v causes the total size of all input files to exceed the maximum of %d bytes", path.Join(childComponents...), be.maximumInputSizeBytes)
+		}
 		if err := be.contentAddressableStorage.GetFile(ctx, childDigest, inputDirectory, file.Name, file.IsExecutable); err != nil {
 			return util.StatusWrapf(err, "Failed to obtain input file %#v", path.Join(childComponents...))
 		}
@@ -86,7 +251,7 @@ func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialD
 		if err != nil {
 			return util.StatusWrapf(err, "Failed to enter input directory %#v", path.Join(childComponents...))
 		}
-		err = be.createInputDirectory(ctx, directory.Digest, digest, childDirectory, childComponents)
+		err = be.createInputDirectory(ctx, directory.Digest, digest, childDirectory, childComponents, totalInputSizeBytes)
 		childDirectory.Close()
 		if err != nil {
 			return err
@@ -101,7 +266,7 @@ func (be *localBuildExecutor) createInputDirectory(ctx context.Context, partialD
 	return nil
 }
 
-func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, children map[string]*remoteexecution.Directory, components []string) (*remoteexecution.Directory, error) {
+func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, children map[string]*remoteexecution.Directory, components []string, totalOutputSizeBytes *int64) (*remoteexecution.Directory, error) {
 	files, err := outputDirectory.ReadDir()
 	if err != nil {
 		return nil, util.StatusWrapf(err, "Failed to read output directory %#v", path.Join(components...))
@@ -113,9 +278,9 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirecto
 		childComponents := append(components, name)
 		switch mode := file.Mode(); mode & os.ModeType {
 		case 0:
-			digest, err := be.contentAddressableStorage.PutFile(ctx, outputDirectory, name, parentDigest)
+			digest, err := be.putOutputFile(ctx, outputDirectory, name, file.Size(), parentDigest, totalOutputSizeBytes, childComponents)
 			if err != nil {
-				return nil, util.StatusWrapf(err, "Failed to store output file %#v", path.Join(childComponents...))
+				return nil, err
 			}
 			directory.Files = append(directory.Files, &remoteexecution.FileNode{
 				Name:         name,
@@ -127,7 +292,7 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirecto
 			if err != nil {
 				return nil, util.StatusWrapf(err, "Failed to enter output directory %#v", path.Join(childComponents...))
 			}
-			child, err := be.uploadDirectory(ctx, childDirectory, parentDigest, children, childComponents)
+			child, err := be.uploadDirectory(ctx, childDirectory, parentDigest, children, childComponents, totalOutputSizeBytes)
 			childDirectory.Close()
 			if err != nil {
 				return nil, err
@@ -165,10 +330,10 @@ func (be *localBuildExecutor) uploadDirectory(ctx context.Context, outputDirecto
 	return &directory, nil
 }
 
-func (be *localBuildExecutor) uploadTree(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, components []string) (*util.Digest, error) {
+func (be *localBuildExecutor) uploadTree(ctx context.Context, outputDirectory filesystem.Directory, parentDigest *util.Digest, components []string, totalOutputSizeBytes *int64) (*util.Digest, error) {
 	// Gather all individual directory objects and turn them into a tree.
 	children := map[string]*remoteexecution.Directory{}
-	root, err := be.uploadDirectory(ctx, outputDirectory, parentDigest, children, components)
+	root, err := be.uploadDirectory(ctx, outputDirectory, parentDigest, children, components, totalOutputSizeBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -185,6 +350,16 @@ func (be *localBuildExecutor) uploadTree(ctx context.Context, outputDirectory fi
 	return digest, err
 }
 
+// putLog uploads a file containing the stdout or stderr output of the
+// command.
+func (be *localBuildExecutor) putLog(ctx context.Context, buildDirectory filesystem.Directory, name string, parentDigest *util.Digest, totalOutputSizeBytes *int64) (*util.Digest, error) {
+	fileInfo, err := buildDirectory.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return be.putOutputFile(ctx, buildDirectory, name, fileInfo.Size(), parentDigest, totalOutputSizeBytes, []string{name})
+}
+
 func (be *localBuildExecutor) createOutputParentDirectory(buildDirectory filesystem.Directory, outputParentPath string) (filesystem.Directory, error) {
 	// Create and enter successive components, closing the former.
 	components := strings.FieldsFunc(outputParentPath, func(r rune) bool { return r == '/' })
@@ -210,7 +385,7 @@ func (be *localBuildExecutor) createOutputParentDirectory(buildDirectory filesys
 	return d, nil
 }
 
-func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
+func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest, executionStateUpdates chan<- *remoteexecution.ExecuteOperationMetadata) (*remoteexecution.ExecuteResponse, bool) {
 	timeStart := time.Now()
 
 	// Fetch action and command.
@@ -241,15 +416,16 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 			platformProperties[platformProperty.Name] = platformProperty.Value
 		}
 	}
-	environment, err := be.environmentManager.Acquire(actionDigest, platformProperties)
+	buildEnvironment, err := be.environmentManager.Acquire(actionDigest, platformProperties)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to acquire build environment")), false
 	}
-	defer environment.Release()
+	defer buildEnvironment.Release()
 
 	// Set up inputs.
-	buildDirectory := environment.GetBuildDirectory()
-	if err := be.createInputDirectory(ctx, action.InputRootDigest, actionDigest, buildDirectory, []string{"."}); err != nil {
+	buildDirectory := buildEnvironment.GetBuildDirectory()
+	var totalInputSizeBytes int64
+	if err := be.createInputDirectory(ctx, action.InputRootDigest, actionDigest, buildDirectory, []string{"."}, &totalInputSizeBytes); err != nil {
 		return convertErrorToExecuteResponse(err), false
 	}
 
@@ -293,13 +469,53 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 	for _, environmentVariable := range command.EnvironmentVariables {
 		environmentVariables[environmentVariable.Name] = environmentVariable.Value
 	}
-	runResponse, err := environment.Run(ctx, &runner.RunRequest{
+
+	// Announce streams through which the output of the command
+	// may be read while it is running.
+	var outputHandler environment.OutputHandler
+	if be.liveOutputServer != nil && executionStateUpdates != nil {
+		liveOutput := be.liveOutputServer.NewLiveOutput()
+		defer liveOutput.Close()
+		outputHandler = liveOutput.Write
+		executionStateUpdates <- &remoteexecution.ExecuteOperationMetadata{
+			Stage:            remoteexecution.ExecuteOperationMetadata_EXECUTING,
+			ActionDigest:     request.ActionDigest,
+			StdoutStreamName: liveOutput.GetStdoutStreamName(),
+			StderrStreamName: liveOutput.GetStderrStreamName(),
+		}
+	}
+
+	// Terminate the command if it causes the build directory to
+	// grow beyond what could possibly be uploaded, as opposed to
+	// only discovering this after it completes.
+	runCtx := ctx
+	var runDone chan struct{}
+	var buildDirectorySizeErr chan error
+	if be.outputSizeCheckInterval > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		runDone = make(chan struct{})
+		buildDirectorySizeErr = make(chan error, 1)
+		go func() {
+			buildDirectorySizeErr <- be.checkBuildDirectorySize(buildDirectory, totalInputSizeBytes+be.maximumOutputSizeBytes, cancel, runDone)
+		}()
+	}
+
+	runResponse, err := buildEnvironment.Run(runCtx, &runner.RunRequest{
 		Arguments:            command.Arguments,
 		EnvironmentVariables: environmentVariables,
 		WorkingDirectory:     command.WorkingDirectory,
 		StdoutPath:           ".stdout.txt",
 		StderrPath:           ".stderr.txt",
-	})
+		PlatformProperties:   platformProperties,
+	}, outputHandler)
+	if runDone != nil {
+		close(runDone)
+		if sizeErr := <-buildDirectorySizeErr; sizeErr != nil {
+			return convertErrorToExecuteResponse(sizeErr), false
+		}
+	}
 	if err != nil {
 		return convertErrorToExecuteResponse(err), false
 	}
@@ -313,17 +529,39 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 		},
 	}
 
+	// Export statistics on resources consumed by the command and
+	// store them, so that they may be displayed by bbb_browser.
+	// The version of the Remote Execution API that is used does
+	// not allow attaching auxiliary metadata to the ActionResult,
+	// so it is attached as a server log instead. These statistics
+	// are merely informational, meaning that failures to store
+	// them are only logged.
+	if resourceUsage := runResponse.ResourceUsage; resourceUsage != nil {
+		observeResourceUsage(resourceUsage)
+		if resourceUsageDigest, err := be.contentAddressableStorage.PutResourceUsage(ctx, resourceUsage, actionDigest); err == nil {
+			response.ServerLogs = map[string]*remoteexecution.LogFile{
+				ResourceUsageServerLogName: {
+					Digest: resourceUsageDigest.GetPartialDigest(),
+				},
+			}
+		} else {
+			log.Print("Failed to store resource usage: ", err)
+		}
+	}
+
 	// Upload command output. In the common case, the files are
 	// empty. If that's the case, don't bother setting the digest to
-	// keep the ActionResult small.
-	stdoutDigest, err := be.contentAddressableStorage.PutFile(ctx, buildDirectory, ".stdout.txt", actionDigest)
+	// keep the ActionResult small. Command output is subject to the
+	// same size limits as output files.
+	var totalOutputSizeBytes int64
+	stdoutDigest, err := be.putLog(ctx, buildDirectory, ".stdout.txt", actionDigest, &totalOutputSizeBytes)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store stdout")), false
 	}
 	if stdoutDigest.GetSizeBytes() > 0 {
 		response.Result.StdoutDigest = stdoutDigest.GetPartialDigest()
 	}
-	stderrDigest, err := be.contentAddressableStorage.PutFile(ctx, buildDirectory, ".stderr.txt", actionDigest)
+	stderrDigest, err := be.putLog(ctx, buildDirectory, ".stderr.txt", actionDigest, &totalOutputSizeBytes)
 	if err != nil {
 		return convertErrorToExecuteResponse(util.StatusWrap(err, "Failed to store stderr")), false
 	}
@@ -344,9 +582,9 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 		}
 		switch mode := fileInfo.Mode(); mode & os.ModeType {
 		case 0:
-			digest, err := be.contentAddressableStorage.PutFile(ctx, outputParentDirectory, outputBaseName, actionDigest)
+			digest, err := be.putOutputFile(ctx, outputParentDirectory, outputBaseName, fileInfo.Size(), actionDigest, &totalOutputSizeBytes, []string{outputFile})
 			if err != nil {
-				return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to store output file %#v", outputFile)), false
+				return convertErrorToExecuteResponse(err), false
 			}
 			response.Result.OutputFiles = append(response.Result.OutputFiles, &remoteexecution.OutputFile{
 				Path:         outputFile,
@@ -384,7 +622,7 @@ func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecut
 			if err != nil {
 				return convertErrorToExecuteResponse(util.StatusWrapf(err, "Failed to enter output directory %#v", outputDirectory)), false
 			}
-			digest, err := be.uploadTree(ctx, directory, actionDigest, []string{outputDirectory})
+			digest, err := be.uploadTree(ctx, directory, actionDigest, []string{outputDirectory}, &totalOutputSizeBytes)
 			directory.Close()
 			if err != nil {
 				return convertErrorToExecuteResponse(err), false
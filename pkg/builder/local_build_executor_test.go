@@ -4,14 +4,18 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/environment"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/duration"
 	"github.com/stretchr/testify/require"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
@@ -31,11 +35,11 @@ func TestLocalBuildExecutorMissingActionDigest(t *testing.T) {
 	defer ctrl.Finish()
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "debian8",
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.InvalidArgument, "Failed to extract digest for action: No digest provided").Proto(),
 	}, executeResponse)
@@ -47,7 +51,7 @@ func TestLocalBuildExecutorMalformedActionDigest(t *testing.T) {
 	defer ctrl.Finish()
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "windows10",
@@ -55,7 +59,7 @@ func TestLocalBuildExecutorMalformedActionDigest(t *testing.T) {
 			Hash:      "This is a malformed hash",
 			SizeBytes: 123,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.InvalidArgument, "Failed to extract digest for action: Unknown digest hash length: 24 characters").Proto(),
 	}, executeResponse)
@@ -80,7 +84,7 @@ func TestLocalBuildExecutorActionNotInStorage(t *testing.T) {
 			},
 		})).Err())
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "freebsd12",
@@ -88,7 +92,7 @@ func TestLocalBuildExecutorActionNotInStorage(t *testing.T) {
 			Hash:      "64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
 			SizeBytes: 11,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: mustStatus(status.New(codes.FailedPrecondition, "Failed to obtain action: Blob not found").WithDetails(
 			&errdetails.PreconditionFailure{
@@ -122,7 +126,7 @@ func TestLocalBuildExecutorMalformedCommandDigest(t *testing.T) {
 		},
 	}, nil)
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "macos",
@@ -130,7 +134,7 @@ func TestLocalBuildExecutorMalformedCommandDigest(t *testing.T) {
 			Hash:      "1234567890123456789012345678901234567890123456789012345678901234",
 			SizeBytes: 42,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.InvalidArgument, "Failed to extract digest for command: Invalid digest size: -123 bytes").Proto(),
 	}, executeResponse)
@@ -161,7 +165,7 @@ func TestLocalBuildExecutorCommandNotInStorage(t *testing.T) {
 			SizeBytes: 123,
 		})).Return(nil, status.Error(codes.Internal, "Storage unavailable"))
 	environmentManager := mock.NewMockManager(ctrl)
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "macos",
@@ -169,7 +173,7 @@ func TestLocalBuildExecutorCommandNotInStorage(t *testing.T) {
 			Hash:      "3333333333333333333333333333333333333333333333333333333333333333",
 			SizeBytes: 7,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Failed to obtain command: Storage unavailable").Proto(),
 	}, executeResponse)
@@ -213,7 +217,7 @@ func TestLocalBuildExecutorEnvironmentAcquireFailed(t *testing.T) {
 		}),
 		map[string]string{},
 	).Return(nil, status.Error(codes.InvalidArgument, "Platform requirements not provided"))
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "netbsd",
@@ -221,7 +225,7 @@ func TestLocalBuildExecutorEnvironmentAcquireFailed(t *testing.T) {
 			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
 			SizeBytes: 7,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.InvalidArgument, "Failed to acquire build environment: Platform requirements not provided").Proto(),
 	}, executeResponse)
@@ -303,7 +307,7 @@ func TestLocalBuildExecutorMissingInputDirectoryDigest(t *testing.T) {
 	worldDirectory.EXPECT().Close()
 	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "netbsd",
@@ -311,7 +315,7 @@ func TestLocalBuildExecutorMissingInputDirectoryDigest(t *testing.T) {
 			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
 			SizeBytes: 7,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.InvalidArgument, "Failed to extract digest for input directory \"Hello/World\": No digest provided").Proto(),
 	}, executeResponse)
@@ -364,7 +368,7 @@ func TestLocalBuildExecutorInputRootNotInStorage(t *testing.T) {
 	buildDirectory := mock.NewMockDirectory(ctrl)
 	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "netbsd",
@@ -372,13 +376,94 @@ func TestLocalBuildExecutorInputRootNotInStorage(t *testing.T) {
 			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
 			SizeBytes: 7,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Failed to obtain input directory \".\": Storage is offline").Proto(),
 	}, executeResponse)
 	require.False(t, mayBeCached)
 }
 
+func TestLocalBuildExecutorInputTooLarge(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments: []string{"cat", "a.txt", "b.txt"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{
+				Name: "a.txt",
+				Digest: &remoteexecution.Digest{
+					Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+					SizeBytes: 6000,
+				},
+			},
+			{
+				Name: "b.txt",
+				Digest: &remoteexecution.Digest{
+					Hash:      "9999999999999999999999999999999999999999999999999999999999999999",
+					SizeBytes: 5000,
+				},
+			},
+		},
+	}, nil)
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	contentAddressableStorage.EXPECT().GetFile(
+		ctx, util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "8888888888888888888888888888888888888888888888888888888888888888",
+			SizeBytes: 6000,
+		}), buildDirectory, "a.txt", false).Return(nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	environment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("netbsd", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{},
+	).Return(environment, nil)
+	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	environment.EXPECT().Release()
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
+
+	// The second input file causes the limit on the total size of
+	// all input files to be exceeded.
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "netbsd",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	}, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.ResourceExhausted, "Input file \"b.txt\" causes the total size of all input files to exceed the maximum of 10000 bytes").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
 func TestLocalBuildExecutorOutputDirectoryCreationFailure(t *testing.T) {
 	ctrl, ctx := gomock.WithContext(context.Background(), t)
 	defer ctrl.Finish()
@@ -426,7 +511,7 @@ func TestLocalBuildExecutorOutputDirectoryCreationFailure(t *testing.T) {
 	buildDirectory.EXPECT().Mkdir("foo", os.FileMode(0777)).Return(status.Error(codes.Internal, "Out of disk space"))
 	environment.EXPECT().GetBuildDirectory().Return(buildDirectory)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "fedora",
@@ -434,7 +519,7 @@ func TestLocalBuildExecutorOutputDirectoryCreationFailure(t *testing.T) {
 			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
 			SizeBytes: 7,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Failed to create output directory \"foo\": Out of disk space").Proto(),
 	}, executeResponse)
@@ -476,12 +561,14 @@ func TestLocalBuildExecutorOutputSymlinkReadingFailure(t *testing.T) {
 			SizeBytes: 42,
 		})).Return(&remoteexecution.Directory{}, nil)
 	buildDirectory := mock.NewMockDirectory(ctrl)
-	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+	buildDirectory.EXPECT().Lstat(".stdout.txt").Return(filesystem.NewSimpleFileInfo(".stdout.txt", 0666, 567), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any(), int64(1000)).Return(
 		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
 			SizeBytes: 567,
 		}), nil)
-	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+	buildDirectory.EXPECT().Lstat(".stderr.txt").Return(filesystem.NewSimpleFileInfo(".stderr.txt", 0666, 678), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any(), int64(1000)).Return(
 		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
 			SizeBytes: 678,
@@ -502,19 +589,20 @@ func TestLocalBuildExecutorOutputSymlinkReadingFailure(t *testing.T) {
 		WorkingDirectory:     "",
 		StdoutPath:           ".stdout.txt",
 		StderrPath:           ".stderr.txt",
-	}).Return(&runner.RunResponse{
+		PlatformProperties:   map[string]string{},
+	}, nil).Return(&runner.RunResponse{
 		ExitCode: 0,
 	}, nil)
 	environment.EXPECT().Release()
-	buildDirectory.EXPECT().Lstat("foo").Return(filesystem.NewSimpleFileInfo("foo", 0777|os.ModeDir), nil)
+	buildDirectory.EXPECT().Lstat("foo").Return(filesystem.NewSimpleFileInfo("foo", 0777|os.ModeDir, 0), nil)
 	fooDirectory := mock.NewMockDirectory(ctrl)
 	buildDirectory.EXPECT().Enter("foo").Return(fooDirectory, nil)
 	fooDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
-		filesystem.NewSimpleFileInfo("bar", 0777|os.ModeSymlink),
+		filesystem.NewSimpleFileInfo("bar", 0777|os.ModeSymlink, 0),
 	}, nil)
 	fooDirectory.EXPECT().Readlink("bar").Return("", status.Error(codes.Internal, "Cosmic rays caused interference"))
 	fooDirectory.EXPECT().Close()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "nintendo64",
@@ -522,13 +610,89 @@ func TestLocalBuildExecutorOutputSymlinkReadingFailure(t *testing.T) {
 			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
 			SizeBytes: 7,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Status: status.New(codes.Internal, "Failed to read output symlink \"foo/bar\": Cosmic rays caused interference").Proto(),
 	}, executeResponse)
 	require.False(t, mayBeCached)
 }
 
+func TestLocalBuildExecutorOutputSizeExceededWhileRunning(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
+	contentAddressableStorage.EXPECT().GetAction(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		})).Return(&remoteexecution.Action{
+		CommandDigest: &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		},
+		InputRootDigest: &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetCommand(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "6666666666666666666666666666666666666666666666666666666666666666",
+			SizeBytes: 123,
+		})).Return(&remoteexecution.Command{
+		Arguments: []string{"yes"},
+	}, nil)
+	contentAddressableStorage.EXPECT().GetDirectory(
+		ctx, util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "7777777777777777777777777777777777777777777777777777777777777777",
+			SizeBytes: 42,
+		})).Return(&remoteexecution.Directory{}, nil)
+	environmentManager := mock.NewMockManager(ctrl)
+	buildEnvironment := mock.NewMockManagedEnvironment(ctrl)
+	environmentManager.EXPECT().Acquire(
+		util.MustNewDigest("nintendo64", &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		}),
+		map[string]string{},
+	).Return(buildEnvironment, nil)
+	buildDirectory := mock.NewMockDirectory(ctrl)
+	buildEnvironment.EXPECT().GetBuildDirectory().Return(buildDirectory)
+	buildEnvironment.EXPECT().Release()
+
+	// The command keeps on writing output until it gets canceled.
+	// This should happen as soon as the size of the build
+	// directory is found to exceed the maximum output size.
+	buildEnvironment.EXPECT().Run(gomock.Any(), &runner.RunRequest{
+		Arguments:            []string{"yes"},
+		EnvironmentVariables: map[string]string{},
+		WorkingDirectory:     "",
+		StdoutPath:           ".stdout.txt",
+		StderrPath:           ".stderr.txt",
+		PlatformProperties:   map[string]string{},
+	}, nil).DoAndReturn(func(ctx context.Context, request *runner.RunRequest, outputHandler environment.OutputHandler) (*runner.RunResponse, error) {
+		<-ctx.Done()
+		return nil, status.Error(codes.Canceled, "Process was killed")
+	})
+	buildDirectory.EXPECT().ReadDir().Return([]filesystem.FileInfo{
+		filesystem.NewSimpleFileInfo(".stdout.txt", 0666, 20000),
+		filesystem.NewSimpleFileInfo(".stderr.txt", 0666, 0),
+	}, nil)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, time.Millisecond)
+
+	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "nintendo64",
+		ActionDigest: &remoteexecution.Digest{
+			Hash:      "5555555555555555555555555555555555555555555555555555555555555555",
+			SizeBytes: 7,
+		},
+	}, nil)
+	require.Equal(t, &remoteexecution.ExecuteResponse{
+		Status: status.New(codes.ResourceExhausted, "Build directory is 20000 bytes in size, which exceeds the total size of all input files plus the maximum total size of all output files of 10000 bytes").Proto(),
+	}, executeResponse)
+	require.False(t, mayBeCached)
+}
+
 // TestLocalBuildExecutorSuccess tests a full invocation of a simple
 // build step, equivalent to compiling a simple C++ file.
 func TestLocalBuildExecutorSuccess(t *testing.T) {
@@ -558,8 +722,8 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 	helloDirectory := mock.NewMockDirectory(ctrl)
 	objsDirectory.EXPECT().Enter("hello").Return(helloDirectory, nil)
 	helloDirectory.EXPECT().Close()
-	helloDirectory.EXPECT().Lstat("hello.pic.d").Return(filesystem.NewSimpleFileInfo("hello.pic.d", 0666), nil)
-	helloDirectory.EXPECT().Lstat("hello.pic.o").Return(filesystem.NewSimpleFileInfo("hello.pic.o", 0777), nil)
+	helloDirectory.EXPECT().Lstat("hello.pic.d").Return(filesystem.NewSimpleFileInfo("hello.pic.d", 0666, 789), nil)
+	helloDirectory.EXPECT().Lstat("hello.pic.o").Return(filesystem.NewSimpleFileInfo("hello.pic.o", 0777, 890), nil)
 
 	// Read operations against the Content Addressable Storage.
 	contentAddressableStorage := mock.NewMockContentAddressableStorage(ctrl)
@@ -632,27 +796,42 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 		}), buildDirectory, "hello.cc", false).Return(nil)
 
 	// Write operations against the Content Addressable Storage.
-	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any()).Return(
+	buildDirectory.EXPECT().Lstat(".stdout.txt").Return(filesystem.NewSimpleFileInfo(".stdout.txt", 0666, 567), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stdout.txt", gomock.Any(), int64(1000)).Return(
 		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000005",
 			SizeBytes: 567,
 		}), nil)
-	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any()).Return(
+	buildDirectory.EXPECT().Lstat(".stderr.txt").Return(filesystem.NewSimpleFileInfo(".stderr.txt", 0666, 678), nil)
+	contentAddressableStorage.EXPECT().PutFile(ctx, buildDirectory, ".stderr.txt", gomock.Any(), int64(1000)).Return(
 		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000006",
 			SizeBytes: 678,
 		}), nil)
-	contentAddressableStorage.EXPECT().PutFile(ctx, helloDirectory, "hello.pic.d", gomock.Any()).Return(
+	contentAddressableStorage.EXPECT().PutFile(ctx, helloDirectory, "hello.pic.d", gomock.Any(), int64(1000)).Return(
 		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000007",
 			SizeBytes: 789,
 		}), nil)
-	contentAddressableStorage.EXPECT().PutFile(ctx, helloDirectory, "hello.pic.o", gomock.Any()).Return(
+	contentAddressableStorage.EXPECT().PutFile(ctx, helloDirectory, "hello.pic.o", gomock.Any(), int64(1000)).Return(
 		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000008",
 			SizeBytes: 890,
 		}), nil)
 
+	// Resource usage of the command, which should be stored and
+	// attached to the ExecuteResponse as a server log.
+	resourceUsage := &resourceusage.ResourceUsage{
+		UserTime:                    &duration.Duration{Seconds: 1, Nanos: 500000000},
+		SystemTime:                  &duration.Duration{Nanos: 250000000},
+		MaximumResidentSetSizeBytes: 123456789,
+	}
+	contentAddressableStorage.EXPECT().PutResourceUsage(ctx, resourceUsage, gomock.Any()).Return(
+		util.MustNewDigest("ubuntu1804", &remoteexecution.Digest{
+			Hash:      "0000000000000000000000000000000000000000000000000000000000000009",
+			SizeBytes: 42,
+		}), nil)
+
 	// Command execution.
 	environmentManager := mock.NewMockManager(ctrl)
 	environment := mock.NewMockManagedEnvironment(ctrl)
@@ -684,11 +863,15 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 		WorkingDirectory: "",
 		StdoutPath:       ".stdout.txt",
 		StderrPath:       ".stderr.txt",
-	}).Return(&runner.RunResponse{
-		ExitCode: 0,
+		PlatformProperties: map[string]string{
+			"container-image": "docker://gcr.io/cloud-marketplace/google/rbe-debian8@sha256:4893599fb00089edc8351d9c26b31d3f600774cb5addefb00c70fdb6ca797abf",
+		},
+	}, nil).Return(&runner.RunResponse{
+		ExitCode:      0,
+		ResourceUsage: resourceUsage,
 	}, nil)
 	environment.EXPECT().Release()
-	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager)
+	localBuildExecutor := builder.NewLocalBuildExecutor(contentAddressableStorage, environmentManager, nil, 10000, 10000, 1000, 0)
 
 	executeResponse, mayBeCached := localBuildExecutor.Execute(ctx, &remoteexecution.ExecuteRequest{
 		InstanceName: "ubuntu1804",
@@ -696,7 +879,7 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 			Hash:      "0000000000000000000000000000000000000000000000000000000000000001",
 			SizeBytes: 123,
 		},
-	})
+	}, nil)
 	require.Equal(t, &remoteexecution.ExecuteResponse{
 		Result: &remoteexecution.ActionResult{
 			OutputFiles: []*remoteexecution.OutputFile{
@@ -725,6 +908,14 @@ func TestLocalBuildExecutorSuccess(t *testing.T) {
 				SizeBytes: 678,
 			},
 		},
+		ServerLogs: map[string]*remoteexecution.LogFile{
+			"resource_usage": {
+				Digest: &remoteexecution.Digest{
+					Hash:      "0000000000000000000000000000000000000000000000000000000000000009",
+					SizeBytes: 42,
+				},
+			},
+		},
 	}, executeResponse)
 	require.True(t, mayBeCached)
 }
@@ -23,8 +23,8 @@ func NewStorageFlushingBuildExecutor(base BuildExecutor, flush func(context.Cont
 	}
 }
 
-func (be *storageFlushingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, bool) {
-	response, mayBeCached := be.base.Execute(ctx, request)
+func (be *storageFlushingBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest, executionStateUpdates chan<- *remoteexecution.ExecuteOperationMetadata) (*remoteexecution.ExecuteResponse, bool) {
+	response, mayBeCached := be.base.Execute(ctx, request, executionStateUpdates)
 	if err := be.flush(ctx); err != nil {
 		return convertErrorToExecuteResponse(err), false
 	}
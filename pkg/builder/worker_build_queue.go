@@ -29,6 +29,8 @@ type workerBuildJob struct {
 	insertionOrder   uint64
 
 	stage                   remoteexecution.ExecuteOperationMetadata_Stage
+	stdoutStreamName        string
+	stderrStreamName        string
 	executeResponse         *remoteexecution.ExecuteResponse
 	executeTransitionWakeup *sync.Cond
 }
@@ -74,8 +76,10 @@ func (job *workerBuildJob) waitExecution(out remoteexecution.Execution_ExecuteSe
 	for {
 		// Send current state.
 		metadata, err := ptypes.MarshalAny(&remoteexecution.ExecuteOperationMetadata{
-			Stage:        job.stage,
-			ActionDigest: job.actionDigest,
+			Stage:            job.stage,
+			ActionDigest:     job.actionDigest,
+			StdoutStreamName: job.stdoutStreamName,
+			StderrStreamName: job.stderrStreamName,
 		})
 		if err != nil {
 			log.Fatal("Failed to marshal execute operation metadata: ", err)
@@ -106,6 +110,13 @@ func (job *workerBuildJob) waitExecution(out remoteexecution.Execution_ExecuteSe
 	}
 }
 
+// prefetchWaiter is created for a worker that has requested to
+// prefetch the next job, while no job could be handed out to it yet.
+type prefetchWaiter struct {
+	job      *workerBuildJob
+	assigned chan struct{}
+}
+
 type workerBuildQueue struct {
 	deduplicationKeyFormat util.DigestKeyFormat
 	jobsPendingMax         uint
@@ -116,6 +127,8 @@ type workerBuildQueue struct {
 	jobsDeduplicationMap       map[string]*workerBuildJob
 	jobsPending                workerBuildJobHeap
 	jobsPendingInsertionWakeup *sync.Cond
+	workersIdle                int
+	prefetchWaiters            []*prefetchWaiter
 }
 
 // NewWorkerBuildQueue creates an execution server that places execution
@@ -136,17 +149,13 @@ func NewWorkerBuildQueue(deduplicationKeyFormat util.DigestKeyFormat, jobsPendin
 func (bq *workerBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecution.GetCapabilitiesRequest) (*remoteexecution.ServerCapabilities, error) {
 	return &remoteexecution.ServerCapabilities{
 		CacheCapabilities: &remoteexecution.CacheCapabilities{
-			DigestFunction: []remoteexecution.DigestFunction{
-				remoteexecution.DigestFunction_MD5,
-				remoteexecution.DigestFunction_SHA1,
-				remoteexecution.DigestFunction_SHA256,
-			},
+			DigestFunction: util.InferableDigestFunctions(),
+			// Clients access storage through bbb_frontend, which
+			// replaces these cache capabilities by its own.
 			ActionCacheUpdateCapabilities: &remoteexecution.ActionCacheUpdateCapabilities{
-				// TODO(edsch): Let bbb-frontend flip this to true when enabled?
 				UpdateEnabled: false,
 			},
 			// CachePriorityCapabilities: Priorities not supported.
-			// MaxBatchTotalSize: Not used by Bazel yet.
 			SymlinkAbsolutePathStrategy: remoteexecution.CacheCapabilities_ALLOWED,
 		},
 		ExecutionCapabilities: &remoteexecution.ExecutionCapabilities{
@@ -165,7 +174,7 @@ func (bq *workerBuildQueue) GetCapabilities(ctx context.Context, in *remoteexecu
 }
 
 func (bq *workerBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remoteexecution.Execution_ExecuteServer) error {
-	digest, err := util.NewDigest(in.InstanceName, in.ActionDigest)
+	digest, err := util.NewDigestFromClient(in.InstanceName, in.ActionDigest)
 	if err != nil {
 		return err
 	}
@@ -190,15 +199,42 @@ func (bq *workerBuildQueue) Execute(in *remoteexecution.ExecuteRequest, out remo
 			stage:                   remoteexecution.ExecuteOperationMetadata_QUEUED,
 			executeTransitionWakeup: sync.NewCond(&bq.jobsLock),
 		}
+		job.executeRequest.InstanceName = digest.GetInstance()
 		bq.jobsNameMap[job.name] = job
 		bq.jobsDeduplicationMap[deduplicationKey] = job
 		heap.Push(&bq.jobsPending, job)
 		bq.jobsPendingInsertionWakeup.Signal()
 		bq.nextInsertionOrder++
+		bq.assignPrefetchJobs()
 	}
 	return job.waitExecution(out)
 }
 
+// assignPrefetchJobs hands out pending jobs to workers that have
+// requested to prefetch the next job. Idle workers take precedence, as
+// jobs handed out ahead of time are only started once the worker has
+// finished executing its current job. The lock must be held.
+func (bq *workerBuildQueue) assignPrefetchJobs() {
+	for len(bq.prefetchWaiters) > 0 && bq.jobsPending.Len() > bq.workersIdle {
+		waiter := bq.prefetchWaiters[0]
+		bq.prefetchWaiters[0] = nil
+		bq.prefetchWaiters = bq.prefetchWaiters[1:]
+		waiter.job = heap.Pop(&bq.jobsPending).(*workerBuildJob)
+		close(waiter.assigned)
+	}
+}
+
+// removePrefetchWaiter removes a worker from the list of workers that
+// have requested to prefetch the next job. The lock must be held.
+func (bq *workerBuildQueue) removePrefetchWaiter(waiter *prefetchWaiter) {
+	for i, w := range bq.prefetchWaiters {
+		if w == waiter {
+			bq.prefetchWaiters = append(bq.prefetchWaiters[:i], bq.prefetchWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
 func (bq *workerBuildQueue) WaitExecution(in *remoteexecution.WaitExecutionRequest, out remoteexecution.Execution_WaitExecutionServer) error {
 	bq.jobsLock.Lock()
 	defer bq.jobsLock.Unlock()
@@ -210,16 +246,88 @@ func (bq *workerBuildQueue) WaitExecution(in *remoteexecution.WaitExecutionReque
 	return job.waitExecution(out)
 }
 
-func executeOnWorker(stream scheduler.Scheduler_GetWorkServer, request *remoteexecution.ExecuteRequest) *remoteexecution.ExecuteResponse {
-	// TODO(edsch): Any way we can set a timeout here?
-	if err := stream.Send(request); err != nil {
-		return convertErrorToExecuteResponse(err)
+// executeOnWorker waits for a job that has already been sent to a
+// worker to complete. Updates to the operation metadata sent by the
+// worker in the meantime are forwarded to clients waiting on the job.
+//
+// If the worker requests to prefetch the next job, a pending job is
+// sent to the worker ahead of time, either immediately or once a job
+// is enqueued while no other workers are idle. This job is returned,
+// so that it may be executed next. An error is returned if
+// communication with the worker failed.
+func (bq *workerBuildQueue) executeOnWorker(stream scheduler.Scheduler_GetWorkServer, job *workerBuildJob) (*remoteexecution.ExecuteResponse, *workerBuildJob, error) {
+	// Jobs handed out ahead of time are sent to the worker in the
+	// background, as we cannot wait for the queue and the worker
+	// simultaneously.
+	var waiter *prefetchWaiter
+	stopPrefetching := make(chan struct{})
+	prefetchSent := make(chan error, 1)
+	finishPrefetching := func() (*workerBuildJob, error) {
+		if waiter == nil {
+			return nil, nil
+		}
+		bq.jobsLock.Lock()
+		bq.removePrefetchWaiter(waiter)
+		bq.jobsLock.Unlock()
+		close(stopPrefetching)
+		if err, sent := <-prefetchSent; sent {
+			return waiter.job, err
+		}
+		if waiter.job != nil {
+			// The job was assigned, but not sent. Return it
+			// to the queue.
+			bq.jobsLock.Lock()
+			heap.Push(&bq.jobsPending, waiter.job)
+			bq.jobsPendingInsertionWakeup.Signal()
+			bq.assignPrefetchJobs()
+			bq.jobsLock.Unlock()
+		}
+		return nil, nil
 	}
-	response, err := stream.Recv()
-	if err != nil {
-		return convertErrorToExecuteResponse(err)
+
+	// TODO(edsch): Any way we can set a timeout here?
+	for {
+		workerUpdate, err := stream.Recv()
+		if err != nil {
+			prefetchedJob, _ := finishPrefetching()
+			return convertErrorToExecuteResponse(err), prefetchedJob, err
+		}
+		switch update := workerUpdate.Update.(type) {
+		case *scheduler.WorkerUpdate_ExecuteOperationMetadata:
+			bq.jobsLock.Lock()
+			job.stdoutStreamName = update.ExecuteOperationMetadata.StdoutStreamName
+			job.stderrStreamName = update.ExecuteOperationMetadata.StderrStreamName
+			job.executeTransitionWakeup.Broadcast()
+			bq.jobsLock.Unlock()
+		case *scheduler.WorkerUpdate_ExecuteResponse:
+			prefetchedJob, err := finishPrefetching()
+			return update.ExecuteResponse, prefetchedJob, err
+		case *scheduler.WorkerUpdate_PrefetchRequest:
+			// Only hand out a single job ahead of time.
+			if waiter != nil {
+				break
+			}
+			waiter = &prefetchWaiter{
+				assigned: make(chan struct{}),
+			}
+			bq.jobsLock.Lock()
+			bq.prefetchWaiters = append(bq.prefetchWaiters, waiter)
+			bq.assignPrefetchJobs()
+			bq.jobsLock.Unlock()
+			go func(waiter *prefetchWaiter) {
+				select {
+				case <-waiter.assigned:
+					prefetchSent <- stream.Send(&waiter.job.executeRequest)
+				case <-stopPrefetching:
+					close(prefetchSent)
+				}
+			}(waiter)
+		default:
+			prefetchedJob, _ := finishPrefetching()
+			err := status.Error(codes.Internal, "Worker sent an update of an unknown type")
+			return convertErrorToExecuteResponse(err), prefetchedJob, err
+		}
 	}
-	return response
 }
 
 func (bq *workerBuildQueue) GetWork(stream scheduler.Scheduler_GetWorkServer) error {
@@ -227,30 +335,65 @@ func (bq *workerBuildQueue) GetWork(stream scheduler.Scheduler_GetWorkServer) er
 	defer bq.jobsLock.Unlock()
 
 	// TODO(edsch): Purge jobs from the jobsNameMap after some amount of time.
+	var job *workerBuildJob
 	for {
-		// Wait for jobs to appear.
-		// TODO(edsch): sync.Cond.WaitWithContext() would be helpful here.
-		for bq.jobsPending.Len() == 0 {
-			bq.jobsPendingInsertionWakeup.Wait()
-		}
-		if err := stream.Context().Err(); err != nil {
-			bq.jobsPendingInsertionWakeup.Signal()
-			return err
-		}
+		if job == nil {
+			// Wait for jobs to appear. Jobs are not handed out
+			// to busy workers ahead of time while this worker
+			// is idle.
+			// TODO(edsch): sync.Cond.WaitWithContext() would be helpful here.
+			bq.workersIdle++
+			for bq.jobsPending.Len() == 0 {
+				bq.jobsPendingInsertionWakeup.Wait()
+			}
+			bq.workersIdle--
+			if err := stream.Context().Err(); err != nil {
+				bq.jobsPendingInsertionWakeup.Signal()
+				bq.assignPrefetchJobs()
+				return err
+			}
 
-		// Extract job from queue.
-		job := heap.Pop(&bq.jobsPending).(*workerBuildJob)
+			// Extract job from queue and send it to the worker.
+			job = heap.Pop(&bq.jobsPending).(*workerBuildJob)
+			bq.jobsLock.Unlock()
+			err := stream.Send(&job.executeRequest)
+			bq.jobsLock.Lock()
+			if err != nil {
+				bq.completeJob(job, convertErrorToExecuteResponse(err))
+				return err
+			}
+		}
 		job.stage = remoteexecution.ExecuteOperationMetadata_EXECUTING
+		job.executeTransitionWakeup.Broadcast()
 
 		// Perform execution of the job.
 		bq.jobsLock.Unlock()
-		executeResponse := executeOnWorker(stream, &job.executeRequest)
+		executeResponse, prefetchedJob, err := bq.executeOnWorker(stream, job)
 		bq.jobsLock.Lock()
 
-		// Mark completion.
-		delete(bq.jobsDeduplicationMap, job.deduplicationKey)
-		job.stage = remoteexecution.ExecuteOperationMetadata_COMPLETED
-		job.executeResponse = executeResponse
-		job.executeTransitionWakeup.Broadcast()
+		bq.completeJob(job, executeResponse)
+		if err != nil {
+			// The worker will not execute the job that was
+			// sent ahead of time. Return it to the queue, so
+			// that it may be picked up by another worker.
+			if prefetchedJob != nil {
+				heap.Push(&bq.jobsPending, prefetchedJob)
+				bq.jobsPendingInsertionWakeup.Signal()
+				bq.assignPrefetchJobs()
+			}
+			return err
+		}
+		job = prefetchedJob
 	}
 }
+
+// completeJob marks a job as completed, waking up clients waiting on
+// the job.
+func (bq *workerBuildQueue) completeJob(job *workerBuildJob, executeResponse *remoteexecution.ExecuteResponse) {
+	delete(bq.jobsDeduplicationMap, job.deduplicationKey)
+	job.stage = remoteexecution.ExecuteOperationMetadata_COMPLETED
+	job.stdoutStreamName = ""
+	job.stderrStreamName = ""
+	job.executeResponse = executeResponse
+	job.executeTransitionWakeup.Broadcast()
+}
@@ -0,0 +1,163 @@
+package builder_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/builder"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/scheduler"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestActionDigest(c byte) *remoteexecution.Digest {
+	hash := make([]byte, 64)
+	for i := range hash {
+		hash[i] = c
+	}
+	return &remoteexecution.Digest{
+		Hash:      string(hash),
+		SizeBytes: 123,
+	}
+}
+
+// executeOnTestQueue enqueues an action, returning a stream of
+// operations once the action has been enqueued.
+func executeOnTestQueue(ctx context.Context, t *testing.T, client remoteexecution.ExecutionClient, c byte) remoteexecution.Execution_ExecuteClient {
+	operations, err := client.Execute(ctx, &remoteexecution.ExecuteRequest{
+		InstanceName: "main",
+		ActionDigest: newTestActionDigest(c),
+	})
+	require.NoError(t, err)
+	operation, err := operations.Recv()
+	require.NoError(t, err)
+	require.False(t, operation.Done)
+	return operations
+}
+
+// waitForStdoutStreamName waits until the operation metadata of an
+// action contains a given stdout stream name.
+func waitForStdoutStreamName(t *testing.T, operations remoteexecution.Execution_ExecuteClient, stdoutStreamName string) {
+	for {
+		operation, err := operations.Recv()
+		require.NoError(t, err)
+		var metadata remoteexecution.ExecuteOperationMetadata
+		require.NoError(t, ptypes.UnmarshalAny(operation.Metadata, &metadata))
+		if metadata.StdoutStreamName == stdoutStreamName {
+			return
+		}
+	}
+}
+
+// waitForCompletion waits until an action has completed.
+func waitForCompletion(t *testing.T, operations remoteexecution.Execution_ExecuteClient) {
+	for {
+		operation, err := operations.Recv()
+		require.NoError(t, err)
+		if operation.Done {
+			return
+		}
+	}
+}
+
+func requireExecuteRequest(t *testing.T, worker scheduler.Scheduler_GetWorkClient, c byte) {
+	request, err := worker.Recv()
+	require.NoError(t, err)
+	require.Equal(t, newTestActionDigest(c), request.ActionDigest)
+}
+
+func completeOnTestWorker(t *testing.T, worker scheduler.Scheduler_GetWorkClient) {
+	require.NoError(t, worker.Send(&scheduler.WorkerUpdate{
+		Update: &scheduler.WorkerUpdate_ExecuteResponse{
+			ExecuteResponse: &remoteexecution.ExecuteResponse{},
+		},
+	}))
+}
+
+func TestWorkerBuildQueuePrefetching(t *testing.T) {
+	ctx := context.Background()
+
+	// Create an RPC server/client pair.
+	buildQueue, schedulerServer := builder.NewWorkerBuildQueue(util.DigestKeyWithInstance, 10)
+	l := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	remoteexecution.RegisterExecutionServer(server, buildQueue)
+	scheduler.RegisterSchedulerServer(server, schedulerServer)
+	go func() {
+		require.NoError(t, server.Serve(l))
+	}()
+	conn, err := grpc.DialContext(ctx, "bufnet", grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return l.Dial()
+	}), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer server.Stop()
+	defer conn.Close()
+	executionClient := remoteexecution.NewExecutionClient(conn)
+	schedulerClient := scheduler.NewSchedulerClient(conn)
+
+	// Let worker A execute a first action.
+	workerA, err := schedulerClient.GetWork(ctx)
+	require.NoError(t, err)
+	operations1 := executeOnTestQueue(ctx, t, executionClient, '1')
+	requireExecuteRequest(t, workerA, '1')
+
+	// Request to prefetch the next action while the queue is
+	// empty. The action enqueued afterwards should still be sent
+	// to the worker ahead of time, as no other workers are idle.
+	require.NoError(t, workerA.Send(&scheduler.WorkerUpdate{
+		Update: &scheduler.WorkerUpdate_PrefetchRequest{
+			PrefetchRequest: &scheduler.PrefetchRequest{},
+		},
+	}))
+	operations2 := executeOnTestQueue(ctx, t, executionClient, '2')
+	requireExecuteRequest(t, workerA, '2')
+
+	// Let worker B execute an action, so that it becomes idle. The
+	// scheduler considers the worker to be idle by the time
+	// completion of the action is reported to the client.
+	workerB, err := schedulerClient.GetWork(ctx)
+	require.NoError(t, err)
+	operations3 := executeOnTestQueue(ctx, t, executionClient, '3')
+	requireExecuteRequest(t, workerB, '3')
+	completeOnTestWorker(t, workerB)
+	waitForCompletion(t, operations3)
+
+	// Let worker A complete its first action and start executing
+	// the prefetched action, requesting to prefetch another one.
+	// Metadata sent afterwards acts as a barrier, guaranteeing
+	// that the prefetch request has been processed.
+	completeOnTestWorker(t, workerA)
+	waitForCompletion(t, operations1)
+	require.NoError(t, workerA.Send(&scheduler.WorkerUpdate{
+		Update: &scheduler.WorkerUpdate_PrefetchRequest{
+			PrefetchRequest: &scheduler.PrefetchRequest{},
+		},
+	}))
+	require.NoError(t, workerA.Send(&scheduler.WorkerUpdate{
+		Update: &scheduler.WorkerUpdate_ExecuteOperationMetadata{
+			ExecuteOperationMetadata: &remoteexecution.ExecuteOperationMetadata{
+				StdoutStreamName: "worker-a/stdout",
+			},
+		},
+	}))
+	waitForStdoutStreamName(t, operations2, "worker-a/stdout")
+
+	// The next action should be handed out to idle worker B, as
+	// opposed to being prefetched by busy worker A.
+	operations4 := executeOnTestQueue(ctx, t, executionClient, '4')
+	requireExecuteRequest(t, workerB, '4')
+	completeOnTestWorker(t, workerB)
+	waitForCompletion(t, operations4)
+
+	// The pending prefetch request of worker A is discarded once
+	// it completes its action.
+	completeOnTestWorker(t, workerA)
+	waitForCompletion(t, operations2)
+}
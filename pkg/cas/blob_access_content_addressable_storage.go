@@ -10,35 +10,59 @@ import (
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/failure"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type blobAccessContentAddressableStorage struct {
-	blobAccess blobstore.BlobAccess
+	blobAccess              blobstore.BlobAccess
+	maximumMessageSizeBytes int
 }
 
 // NewBlobAccessContentAddressableStorage creates a
 // ContentAddressableStorage that reads and writes Content Adressable
 // Storage (CAS) objects from a BlobAccess based store.
-func NewBlobAccessContentAddressableStorage(blobAccess blobstore.BlobAccess) ContentAddressableStorage {
+//
+// Protobuf messages (e.g., Actions, Directories) are loaded into
+// memory entirely. To prevent excessive memory usage, messages larger
+// than maximumMessageSizeBytes are rejected.
+func NewBlobAccessContentAddressableStorage(blobAccess blobstore.BlobAccess, maximumMessageSizeBytes int) ContentAddressableStorage {
 	return &blobAccessContentAddressableStorage{
-		blobAccess: blobAccess,
+		blobAccess:              blobAccess,
+		maximumMessageSizeBytes: maximumMessageSizeBytes,
 	}
 }
 
+func (cas *blobAccessContentAddressableStorage) checkMessageSize(digest *util.Digest, sizeBytes int64) error {
+	if sizeBytes > int64(cas.maximumMessageSizeBytes) {
+		return status.Errorf(codes.ResourceExhausted, "Message %s is %d bytes in size, which exceeds the maximum of %d bytes", digest, sizeBytes, cas.maximumMessageSizeBytes)
+	}
+	return nil
+}
+
 func (cas *blobAccessContentAddressableStorage) getMessage(ctx context.Context, digest *util.Digest, message proto.Message) error {
-	// TODO(edsch): Reject fetching overly large blobs.
+	if err := cas.checkMessageSize(digest, digest.GetSizeBytes()); err != nil {
+		return err
+	}
 	_, r, err := cas.blobAccess.Get(ctx, digest)
 	if err != nil {
 		return err
 	}
-	data, err := ioutil.ReadAll(r)
+	// Don't trust the storage backend to return the amount of
+	// data described by the digest.
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(cas.maximumMessageSizeBytes)+1))
 	r.Close()
 	if err != nil {
 		return err
 	}
+	if err := cas.checkMessageSize(digest, int64(len(data))); err != nil {
+		return err
+	}
 	return proto.Unmarshal(data, message)
 }
 
@@ -99,6 +123,14 @@ func (cas *blobAccessContentAddressableStorage) GetFile(ctx context.Context, dig
 	return err
 }
 
+func (cas *blobAccessContentAddressableStorage) GetResourceUsage(ctx context.Context, digest *util.Digest) (*resourceusage.ResourceUsage, error) {
+	var resourceUsage resourceusage.ResourceUsage
+	if err := cas.getMessage(ctx, digest, &resourceUsage); err != nil {
+		return nil, err
+	}
+	return &resourceUsage, nil
+}
+
 func (cas *blobAccessContentAddressableStorage) GetTree(ctx context.Context, digest *util.Digest) (*remoteexecution.Tree, error) {
 	var tree remoteexecution.Tree
 	if err := cas.getMessage(ctx, digest, &tree); err != nil {
@@ -107,14 +139,19 @@ func (cas *blobAccessContentAddressableStorage) GetTree(ctx context.Context, dig
 	return &tree, nil
 }
 
-func (cas *blobAccessContentAddressableStorage) putBlob(ctx context.Context, data []byte, parentDigest *util.Digest) (*util.Digest, error) {
-	// Compute new digest of data.
+func (cas *blobAccessContentAddressableStorage) getBlobDigest(data []byte, parentDigest *util.Digest) (*util.Digest, error) {
 	digestGenerator := parentDigest.NewDigestGenerator()
 	if _, err := digestGenerator.Write(data); err != nil {
 		return nil, err
 	}
-	digest := digestGenerator.Sum()
+	return digestGenerator.Sum(), nil
+}
 
+func (cas *blobAccessContentAddressableStorage) putBlob(ctx context.Context, data []byte, parentDigest *util.Digest) (*util.Digest, error) {
+	digest, err := cas.getBlobDigest(data, parentDigest)
+	if err != nil {
+		return nil, err
+	}
 	if err := cas.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))); err != nil {
 		return nil, err
 	}
@@ -126,33 +163,54 @@ func (cas *blobAccessContentAddressableStorage) putMessage(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	return cas.putBlob(ctx, data, parentDigest)
+	digest, err := cas.getBlobDigest(data, parentDigest)
+	if err != nil {
+		return nil, err
+	}
+	if err := cas.checkMessageSize(digest, digest.GetSizeBytes()); err != nil {
+		return nil, err
+	}
+	if err := cas.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewBuffer(data))); err != nil {
+		return nil, err
+	}
+	return digest, nil
 }
 
 func (cas *blobAccessContentAddressableStorage) PutActionFailure(ctx context.Context, actionFailure *failure.ActionFailure, parentDigest *util.Digest) (*util.Digest, error) {
 	return cas.putMessage(ctx, actionFailure, parentDigest)
 }
 
-func (cas *blobAccessContentAddressableStorage) PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest) (*util.Digest, error) {
+func (cas *blobAccessContentAddressableStorage) PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest, maximumSizeBytes int64) (*util.Digest, error) {
 	file, err := directory.OpenFile(name, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	// Walk through the file to compute the digest.
+	// Walk through the file to compute the digest. The size limit
+	// is applied to the data that is read, as the file may still
+	// be modified while being read.
 	digestGenerator := parentDigest.NewDigestGenerator()
-	if _, err = io.Copy(digestGenerator, file); err != nil {
+	n, err := io.Copy(digestGenerator, io.LimitReader(file, maximumSizeBytes+1))
+	if err != nil {
 		file.Close()
 		return nil, err
 	}
+	if n > maximumSizeBytes {
+		file.Close()
+		return nil, status.Errorf(codes.ResourceExhausted, "File is larger than the maximum of %d bytes", maximumSizeBytes)
+	}
 	digest := digestGenerator.Sum()
 
-	// Rewind and store it.
+	// Rewind and store it. Only store the data from which the
+	// digest was computed.
 	if _, err := file.Seek(0, 0); err != nil {
 		file.Close()
 		return nil, err
 	}
-	if err := cas.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), file); err != nil {
+	if err := cas.blobAccess.Put(ctx, digest, digest.GetSizeBytes(), struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, digest.GetSizeBytes()), file}); err != nil {
 		return nil, err
 	}
 	return digest, nil
@@ -162,6 +220,10 @@ func (cas *blobAccessContentAddressableStorage) PutLog(ctx context.Context, log
 	return cas.putBlob(ctx, log, parentDigest)
 }
 
+func (cas *blobAccessContentAddressableStorage) PutResourceUsage(ctx context.Context, resourceUsage *resourceusage.ResourceUsage, parentDigest *util.Digest) (*util.Digest, error) {
+	return cas.putMessage(ctx, resourceUsage, parentDigest)
+}
+
 func (cas *blobAccessContentAddressableStorage) PutTree(ctx context.Context, tree *remoteexecution.Tree, parentDigest *util.Digest) (*util.Digest, error) {
 	return cas.putMessage(ctx, tree, parentDigest)
 }
@@ -0,0 +1,82 @@
+package cas_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBlobAccessContentAddressableStorageGetActionTooLarge(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+
+	// Messages that are too large should be rejected without
+	// loading them, mentioning the digest of the message.
+	_, err := contentAddressableStorage.GetAction(ctx, util.MustNewDigest("main", &remoteexecution.Digest{
+		Hash:      "4ae7c3b6ac0beff671efa8cf57386151c06e58ca53a78d83f36107316cec125f",
+		SizeBytes: 2000,
+	}))
+	require.Equal(t, status.Error(codes.ResourceExhausted, "Message 4ae7c3b6ac0beff671efa8cf57386151c06e58ca53a78d83f36107316cec125f-2000-main is 2000 bytes in size, which exceeds the maximum of 1000 bytes"), err)
+}
+
+func TestBlobAccessContentAddressableStoragePutFile(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(p, "hello.txt"), []byte("Hello, world"), 0666))
+	directory, err := filesystem.NewLocalDirectory(p)
+	require.NoError(t, err)
+	defer directory.Close()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorage := cas.NewBlobAccessContentAddressableStorage(blobAccess, 1000)
+	parentDigest := util.MustNewDigest("main", &remoteexecution.Digest{
+		Hash:      "0000000000000000000000000000000000000000000000000000000000000000",
+		SizeBytes: 123,
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		// The size limit should be enforced based on the data
+		// that is read, as opposed to the size of the file
+		// reported by the file system.
+		_, err := contentAddressableStorage.PutFile(ctx, directory, "hello.txt", parentDigest, 11)
+		require.Equal(t, status.Error(codes.ResourceExhausted, "File is larger than the maximum of 11 bytes"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		digest := util.MustNewDigest("main", &remoteexecution.Digest{
+			Hash:      "4ae7c3b6ac0beff671efa8cf57386151c06e58ca53a78d83f36107316cec125f",
+			SizeBytes: 12,
+		})
+		blobAccess.EXPECT().Put(ctx, digest, int64(12), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+				data, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello, world"), data)
+				return r.Close()
+			})
+
+		storedDigest, err := contentAddressableStorage.PutFile(ctx, directory, "hello.txt", parentDigest, 12)
+		require.NoError(t, err)
+		require.Equal(t, digest, storedDigest)
+	})
+}
@@ -15,60 +15,91 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-// parseResourceNameRead parses resource name strings in one of the following two forms:
-//
-// - blobs/${hash}/${size}
-// - ${instance}/blobs/${hash}/${size}
-//
-// In the process, the hash, size and instance are extracted.
-func parseResourceNameRead(resourceName string) (*util.Digest, error) {
-	fields := strings.FieldsFunc(resourceName, func(r rune) bool { return r == '/' })
+// getBlobsIndex returns the index of the "blobs" keyword in a resource
+// name that has been split into pathname components. The keyword is
+// followed by an optional digest function name, the hash and the size.
+// If the keyword cannot be found, -1 is returned.
+func getBlobsIndex(fields []string) int {
 	l := len(fields)
-	if (l != 3 && l != 4) || fields[l-3] != "blobs" {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+	if l >= 3 && fields[l-3] == "blobs" {
+		return l - 3
 	}
+	if l >= 4 && fields[l-4] == "blobs" {
+		return l - 4
+	}
+	return -1
+}
+
+// newDigestFromResourceName creates a digest from the instance name and
+// the pathname components that follow the "blobs" keyword in a resource
+// name. These components are either of the form ${hash}/${size} or
+// ${function}/${hash}/${size}. The latter form is needed for digest
+// functions that cannot be inferred from the length of the hash.
+func newDigestFromResourceName(instance string, fields []string) (*util.Digest, error) {
+	l := len(fields)
 	size, err := strconv.ParseInt(fields[l-1], 10, 64)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
 	}
-	instance := ""
-	if l == 4 {
-		instance = fields[0]
+	partialDigest := &remoteexecution.Digest{
+		Hash:      fields[l-2],
+		SizeBytes: size,
+	}
+	if l == 2 {
+		return util.NewDigestFromClient(instance, partialDigest)
+	}
+
+	digestFunction, err := util.NewDigestFunctionFromName(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	canonicalInstance, err := util.CanonicalizeInstanceName(instance)
+	if err != nil {
+		return nil, err
 	}
-	return util.NewDigest(
-		instance,
-		&remoteexecution.Digest{
-			Hash:      fields[l-2],
-			SizeBytes: size,
-		})
+	return util.NewDigestWithFunction(canonicalInstance, digestFunction, partialDigest)
 }
 
-// parseResourceNameWrite parses resource name strings in one of the following two forms:
+// parseResourceNameRead parses resource name strings in one of the following forms:
+//
+// - blobs/${hash}/${size}
+// - blobs/${function}/${hash}/${size}
+// - ${instance}/blobs/${hash}/${size}
+// - ${instance}/blobs/${function}/${hash}/${size}
+//
+// In the process, the hash, size, digest function and instance are
+// extracted. The instance name may consist of multiple pathname
+// components.
+func parseResourceNameRead(resourceName string) (*util.Digest, error) {
+	fields := strings.Split(resourceName, "/")
+	blobsIndex := getBlobsIndex(fields)
+	if blobsIndex < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
+	}
+	return newDigestFromResourceName(
+		strings.Join(fields[:blobsIndex], "/"),
+		fields[blobsIndex+1:])
+}
+
+// parseResourceNameWrite parses resource name strings in one of the following forms:
 //
 // - uploads/${uuid}/blobs/${hash}/${size}
+// - uploads/${uuid}/blobs/${function}/${hash}/${size}
 // - ${instance}/uploads/${uuid}/blobs/${hash}/${size}
+// - ${instance}/uploads/${uuid}/blobs/${function}/${hash}/${size}
 //
-// In the process, the hash, size and instance are extracted.
+// In the process, the hash, size, digest function and instance are
+// extracted. The instance name may consist of multiple pathname
+// components.
 func parseResourceNameWrite(resourceName string) (*util.Digest, error) {
-	fields := strings.FieldsFunc(resourceName, func(r rune) bool { return r == '/' })
-	l := len(fields)
-	if (l != 5 && l != 6) || fields[l-5] != "uploads" || fields[l-3] != "blobs" {
+	fields := strings.Split(resourceName, "/")
+	blobsIndex := getBlobsIndex(fields)
+	if blobsIndex < 2 || fields[blobsIndex-2] != "uploads" {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
 	}
-	size, err := strconv.ParseInt(fields[l-1], 10, 64)
-	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "Invalid resource naming scheme")
-	}
-	instance := ""
-	if l == 6 {
-		instance = fields[0]
-	}
-	return util.NewDigest(
-		instance,
-		&remoteexecution.Digest{
-			Hash:      fields[l-2],
-			SizeBytes: size,
-		})
+	return newDigestFromResourceName(
+		strings.Join(fields[:blobsIndex-2], "/"),
+		fields[blobsIndex+1:])
 }
 
 type byteStreamServer struct {
@@ -37,10 +37,16 @@ func TestExistenceByteStreamServer(t *testing.T) {
 		Hash:      "3538d378083b9afa5ffad767f7269509",
 		SizeBytes: 22,
 	})).Return(int64(22), ioutil.NopCloser(bytes.NewBufferString("This is a long message")), nil)
-	blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("fedora28", &remoteexecution.Digest{
+	blobAccess.EXPECT().Get(gomock.Any(), util.MustNewDigest("fedora28/x86_64", &remoteexecution.Digest{
 		Hash:      "09f34d28e9c8bb445ec996388968a9e8",
 		SizeBytes: 7,
 	})).Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+	blake3Digest, err := util.NewDigestWithFunction("ubuntu", util.DigestFunctionBLAKE3, &remoteexecution.Digest{
+		Hash:      "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+		SizeBytes: 0,
+	})
+	require.NoError(t, err)
+	blobAccess.EXPECT().Get(gomock.Any(), blake3Digest).Return(int64(0), ioutil.NopCloser(bytes.NewBuffer(nil)), nil)
 
 	blobAccess.EXPECT().Put(gomock.Any(), util.MustNewDigest("", &remoteexecution.Digest{
 		Hash:      "94876e5b1ce62c7b2b5ff6e661624841",
@@ -169,9 +175,21 @@ func TestExistenceByteStreamServer(t *testing.T) {
 	_, err = req.Recv()
 	require.Equal(t, io.EOF, err)
 
-	// Attempt to fetch a nonexistent blob.
+	// Instance names containing empty pathname components are
+	// ambiguous and should be rejected.
 	req, err = client.Read(ctx, &bytestream.ReadRequest{
-		ResourceName: "///fedora28//blobs/09f34d28e9c8bb445ec996388968a9e8/////7/",
+		ResourceName: "fedora28//x86_64/blobs/09f34d28e9c8bb445ec996388968a9e8/7",
+	})
+	require.NoError(t, err)
+	_, err = req.Recv()
+	s = status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, s.Code())
+	require.Equal(t, "Instance name \"fedora28//x86_64\" contains an empty pathname component", s.Message())
+
+	// Attempt to fetch a nonexistent blob, using an instance name
+	// consisting of multiple pathname components.
+	req, err = client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: "fedora28/x86_64/blobs/09f34d28e9c8bb445ec996388968a9e8/7",
 	})
 	require.NoError(t, err)
 	_, err = req.Recv()
@@ -179,6 +197,25 @@ func TestExistenceByteStreamServer(t *testing.T) {
 	require.Equal(t, codes.NotFound, s.Code())
 	require.Equal(t, "Blob not found", s.Message())
 
+	// BLAKE3 hashes have the same length as SHA-256 hashes, meaning
+	// that the digest function needs to be provided explicitly.
+	req, err = client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: "ubuntu/blobs/blake3/af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262/0",
+	})
+	require.NoError(t, err)
+	_, err = req.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// Unknown digest functions should be rejected.
+	req, err = client.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: "ubuntu/blobs/crc32/af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262/0",
+	})
+	require.NoError(t, err)
+	_, err = req.Recv()
+	s = status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, s.Code())
+	require.Equal(t, "Unknown digest function \"crc32\"", s.Message())
+
 	// Attempt to write to a bad resource name.
 	stream, err := client.Write(ctx)
 	require.NoError(t, err)
@@ -5,6 +5,7 @@ import (
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/failure"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 )
@@ -17,10 +18,12 @@ type ContentAddressableStorage interface {
 	GetCommand(ctx context.Context, digest *util.Digest) (*remoteexecution.Command, error)
 	GetDirectory(ctx context.Context, digest *util.Digest) (*remoteexecution.Directory, error)
 	GetFile(ctx context.Context, digest *util.Digest, directory filesystem.Directory, name string, isExecutable bool) error
+	GetResourceUsage(ctx context.Context, digest *util.Digest) (*resourceusage.ResourceUsage, error)
 	GetTree(ctx context.Context, digest *util.Digest) (*remoteexecution.Tree, error)
 
 	PutActionFailure(ctx context.Context, failure *failure.ActionFailure, parentDigest *util.Digest) (*util.Digest, error)
-	PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest) (*util.Digest, error)
+	PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest, maximumSizeBytes int64) (*util.Digest, error)
 	PutLog(ctx context.Context, log []byte, parentDigest *util.Digest) (*util.Digest, error)
+	PutResourceUsage(ctx context.Context, resourceUsage *resourceusage.ResourceUsage, parentDigest *util.Digest) (*util.Digest, error)
 	PutTree(ctx context.Context, tree *remoteexecution.Tree, parentDigest *util.Digest) (*util.Digest, error)
 }
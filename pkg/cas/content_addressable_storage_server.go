@@ -1,7 +1,9 @@
 package cas
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
@@ -13,20 +15,28 @@ import (
 
 type contentAddressableStorageServer struct {
 	contentAddressableStorage blobstore.BlobAccess
+	maximumBatchSizeBytes     int64
 }
 
 // NewContentAddressableStorageServer creates a GRPC service for serving
 // the contents of a Bazel Content Addressable Storage (CAS) to Bazel.
-func NewContentAddressableStorageServer(contentAddressableStorage blobstore.BlobAccess) remoteexecution.ContentAddressableStorageServer {
+//
+// Batched reading and uploading of blobs is only supported if
+// maximumBatchSizeBytes is positive. Requests for which the total size
+// of the blobs exceeds this limit are rejected. This limit should be
+// announced to clients as MaxBatchTotalSizeBytes through the
+// Capabilities service.
+func NewContentAddressableStorageServer(contentAddressableStorage blobstore.BlobAccess, maximumBatchSizeBytes int64) remoteexecution.ContentAddressableStorageServer {
 	return &contentAddressableStorageServer{
 		contentAddressableStorage: contentAddressableStorage,
+		maximumBatchSizeBytes:     maximumBatchSizeBytes,
 	}
 }
 
 func (s *contentAddressableStorageServer) FindMissingBlobs(ctx context.Context, in *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
 	var inDigests []*util.Digest
 	for _, partialDigest := range in.BlobDigests {
-		digest, err := util.NewDigest(in.InstanceName, partialDigest)
+		digest, err := util.NewDigestFromClient(in.InstanceName, partialDigest)
 		if err != nil {
 			return nil, err
 		}
@@ -46,11 +56,78 @@ func (s *contentAddressableStorageServer) FindMissingBlobs(ctx context.Context,
 }
 
 func (s *contentAddressableStorageServer) BatchReadBlobs(ctx context.Context, in *remoteexecution.BatchReadBlobsRequest) (*remoteexecution.BatchReadBlobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "This service does not support batched reading of blobs")
+	if s.maximumBatchSizeBytes <= 0 {
+		return nil, status.Error(codes.Unimplemented, "This service does not support batched reading of blobs")
+	}
+	// Validate all digests before computing the total size, so that
+	// negative sizes cannot be used to bypass the limit.
+	digests := make([]*util.Digest, 0, len(in.Digests))
+	var totalSizeBytes int64
+	for _, partialDigest := range in.Digests {
+		digest, err := util.NewDigestFromClient(in.InstanceName, partialDigest)
+		if err != nil {
+			return nil, err
+		}
+		if digest.GetSizeBytes() > s.maximumBatchSizeBytes-totalSizeBytes {
+			return nil, status.Errorf(codes.InvalidArgument, "Attempted to read more than the maximum of %d bytes of data", s.maximumBatchSizeBytes)
+		}
+		totalSizeBytes += digest.GetSizeBytes()
+		digests = append(digests, digest)
+	}
+
+	response := &remoteexecution.BatchReadBlobsResponse{}
+	for i, digest := range digests {
+		data, err := s.readBlob(ctx, digest)
+		response.Responses = append(response.Responses, &remoteexecution.BatchReadBlobsResponse_Response{
+			Digest: in.Digests[i],
+			Data:   data,
+			Status: status.Convert(err).Proto(),
+		})
+	}
+	return response, nil
+}
+
+func (s *contentAddressableStorageServer) readBlob(ctx context.Context, digest *util.Digest) ([]byte, error) {
+	_, r, err := s.contentAddressableStorage.Get(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
 
 func (s *contentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context, in *remoteexecution.BatchUpdateBlobsRequest) (*remoteexecution.BatchUpdateBlobsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "This service does not support batched uploading of blobs")
+	if s.maximumBatchSizeBytes <= 0 {
+		return nil, status.Error(codes.Unimplemented, "This service does not support batched uploading of blobs")
+	}
+	var totalSizeBytes int64
+	for _, request := range in.Requests {
+		totalSizeBytes += int64(len(request.Data))
+	}
+	if totalSizeBytes > s.maximumBatchSizeBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "Attempted to upload %d bytes of data, while a maximum of %d bytes is permitted", totalSizeBytes, s.maximumBatchSizeBytes)
+	}
+
+	response := &remoteexecution.BatchUpdateBlobsResponse{}
+	for _, request := range in.Requests {
+		err := s.updateBlob(ctx, in.InstanceName, request)
+		response.Responses = append(response.Responses, &remoteexecution.BatchUpdateBlobsResponse_Response{
+			Digest: request.Digest,
+			Status: status.Convert(err).Proto(),
+		})
+	}
+	return response, nil
+}
+
+func (s *contentAddressableStorageServer) updateBlob(ctx context.Context, instance string, request *remoteexecution.BatchUpdateBlobsRequest_Request) error {
+	digest, err := util.NewDigestFromClient(instance, request.Digest)
+	if err != nil {
+		return err
+	}
+	if sizeBytes := int64(len(request.Data)); sizeBytes != digest.GetSizeBytes() {
+		return status.Errorf(codes.InvalidArgument, "Blob is %d bytes in size, while %d bytes were expected", sizeBytes, digest.GetSizeBytes())
+	}
+	return s.contentAddressableStorage.Put(ctx, digest, digest.GetSizeBytes(), ioutil.NopCloser(bytes.NewReader(request.Data)))
 }
 
 func (s *contentAddressableStorageServer) GetTree(in *remoteexecution.GetTreeRequest, stream remoteexecution.ContentAddressableStorage_GetTreeServer) error {
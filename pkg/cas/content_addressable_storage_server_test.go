@@ -0,0 +1,162 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContentAddressableStorageServerBatchingDisabled(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorageServer := cas.NewContentAddressableStorageServer(blobAccess, 0)
+
+	_, err := contentAddressableStorageServer.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{})
+	require.Equal(t, status.Error(codes.Unimplemented, "This service does not support batched reading of blobs"), err)
+	_, err = contentAddressableStorageServer.BatchUpdateBlobs(ctx, &remoteexecution.BatchUpdateBlobsRequest{})
+	require.Equal(t, status.Error(codes.Unimplemented, "This service does not support batched uploading of blobs"), err)
+}
+
+func TestContentAddressableStorageServerBatchReadBlobs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorageServer := cas.NewContentAddressableStorageServer(blobAccess, 10)
+	helloDigest := &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}
+	missingDigest := &remoteexecution.Digest{
+		Hash:      "09f34d28e9c8bb445ec996388968a9e8",
+		SizeBytes: 5,
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		_, err := contentAddressableStorageServer.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			Digests: []*remoteexecution.Digest{helloDigest, missingDigest, helloDigest},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Attempted to read more than the maximum of 10 bytes of data"), err)
+	})
+
+	t.Run("NegativeSize", func(t *testing.T) {
+		// Negative sizes should not be able to compensate for
+		// blobs exceeding the maximum size.
+		_, err := contentAddressableStorageServer.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			Digests: []*remoteexecution.Digest{
+				{
+					Hash:      "8b1a9953c4611296a827abf8c47804d7",
+					SizeBytes: -1000,
+				},
+				{
+					Hash:      "09f34d28e9c8bb445ec996388968a9e8",
+					SizeBytes: 1000,
+				},
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Invalid digest size: -1000 bytes"), err)
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		_, err := contentAddressableStorageServer.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			Digests: []*remoteexecution.Digest{
+				helloDigest,
+				{
+					Hash:      "09f34d28e9c8bb445ec996388968a9e8",
+					SizeBytes: math.MaxInt64,
+				},
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Attempted to read more than the maximum of 10 bytes of data"), err)
+	})
+
+	t.Run("InvalidInstanceName", func(t *testing.T) {
+		_, err := contentAddressableStorageServer.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			InstanceName: "debian8/blobs",
+			Digests:      []*remoteexecution.Digest{helloDigest},
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		blobAccess.EXPECT().Get(ctx, util.MustNewDigest("debian8", helloDigest)).
+			Return(int64(5), ioutil.NopCloser(bytes.NewBufferString("Hello")), nil)
+		blobAccess.EXPECT().Get(ctx, util.MustNewDigest("debian8", missingDigest)).
+			Return(int64(0), nil, status.Error(codes.NotFound, "Blob not found"))
+		response, err := contentAddressableStorageServer.BatchReadBlobs(ctx, &remoteexecution.BatchReadBlobsRequest{
+			InstanceName: "debian8",
+			Digests:      []*remoteexecution.Digest{helloDigest, missingDigest},
+		})
+		require.NoError(t, err)
+		require.Len(t, response.Responses, 2)
+		require.Equal(t, helloDigest, response.Responses[0].Digest)
+		require.Equal(t, []byte("Hello"), response.Responses[0].Data)
+		require.Equal(t, int32(codes.OK), response.Responses[0].Status.GetCode())
+		require.Equal(t, missingDigest, response.Responses[1].Digest)
+		require.Equal(t, int32(codes.NotFound), response.Responses[1].Status.GetCode())
+		require.Equal(t, "Blob not found", response.Responses[1].Status.GetMessage())
+	})
+}
+
+func TestContentAddressableStorageServerBatchUpdateBlobs(t *testing.T) {
+	ctrl, ctx := gomock.WithContext(context.Background(), t)
+	defer ctrl.Finish()
+
+	blobAccess := mock.NewMockBlobAccess(ctrl)
+	contentAddressableStorageServer := cas.NewContentAddressableStorageServer(blobAccess, 10)
+	helloDigest := &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7",
+		SizeBytes: 5,
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		_, err := contentAddressableStorageServer.BatchUpdateBlobs(ctx, &remoteexecution.BatchUpdateBlobsRequest{
+			Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{
+				{Digest: helloDigest, Data: []byte("Hello")},
+				{Digest: helloDigest, Data: []byte("Hello")},
+				{Digest: helloDigest, Data: []byte("Hello")},
+			},
+		})
+		require.Equal(t, status.Error(codes.InvalidArgument, "Attempted to upload 15 bytes of data, while a maximum of 10 bytes is permitted"), err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		blobAccess.EXPECT().Put(ctx, util.MustNewDigest("debian8", helloDigest), int64(5), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, digest *util.Digest, sizeBytes int64, r io.ReadCloser) error {
+				buf, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, []byte("Hello"), buf)
+				require.NoError(t, r.Close())
+				return nil
+			})
+		response, err := contentAddressableStorageServer.BatchUpdateBlobs(ctx, &remoteexecution.BatchUpdateBlobsRequest{
+			InstanceName: "debian8",
+			Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{
+				{Digest: helloDigest, Data: []byte("Hello")},
+				{Digest: helloDigest, Data: []byte("Bye")},
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, response.Responses, 2)
+		require.Equal(t, helloDigest, response.Responses[0].Digest)
+		require.Equal(t, int32(codes.OK), response.Responses[0].Status.GetCode())
+		require.Equal(t, helloDigest, response.Responses[1].Digest)
+		require.Equal(t, int32(codes.InvalidArgument), response.Responses[1].Status.GetCode())
+		require.Equal(t, "Blob is 3 bytes in size, while 5 bytes were expected", response.Responses[1].Status.GetMessage())
+	})
+}
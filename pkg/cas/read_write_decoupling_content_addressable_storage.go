@@ -5,6 +5,7 @@ import (
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/failure"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 )
@@ -46,6 +47,10 @@ func (cas *readWriteDecouplingContentAddressableStorage) GetFile(ctx context.Con
 	return cas.reader.GetFile(ctx, digest, directory, name, isExecutable)
 }
 
+func (cas *readWriteDecouplingContentAddressableStorage) GetResourceUsage(ctx context.Context, digest *util.Digest) (*resourceusage.ResourceUsage, error) {
+	return cas.reader.GetResourceUsage(ctx, digest)
+}
+
 func (cas *readWriteDecouplingContentAddressableStorage) GetTree(ctx context.Context, digest *util.Digest) (*remoteexecution.Tree, error) {
 	return cas.reader.GetTree(ctx, digest)
 }
@@ -54,14 +59,18 @@ func (cas *readWriteDecouplingContentAddressableStorage) PutActionFailure(ctx co
 	return cas.writer.PutActionFailure(ctx, actionFailure, parentDigest)
 }
 
-func (cas *readWriteDecouplingContentAddressableStorage) PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest) (*util.Digest, error) {
-	return cas.writer.PutFile(ctx, directory, name, parentDigest)
+func (cas *readWriteDecouplingContentAddressableStorage) PutFile(ctx context.Context, directory filesystem.Directory, name string, parentDigest *util.Digest, maximumSizeBytes int64) (*util.Digest, error) {
+	return cas.writer.PutFile(ctx, directory, name, parentDigest, maximumSizeBytes)
 }
 
 func (cas *readWriteDecouplingContentAddressableStorage) PutLog(ctx context.Context, log []byte, parentDigest *util.Digest) (*util.Digest, error) {
 	return cas.writer.PutLog(ctx, log, parentDigest)
 }
 
+func (cas *readWriteDecouplingContentAddressableStorage) PutResourceUsage(ctx context.Context, resourceUsage *resourceusage.ResourceUsage, parentDigest *util.Digest) (*util.Digest, error) {
+	return cas.writer.PutResourceUsage(ctx, resourceUsage, parentDigest)
+}
+
 func (cas *readWriteDecouplingContentAddressableStorage) PutTree(ctx context.Context, tree *remoteexecution.Tree, parentDigest *util.Digest) (*util.Digest, error) {
 	return cas.writer.PutTree(ctx, tree, parentDigest)
 }
@@ -0,0 +1,13 @@
+package containerimage
+
+import (
+	"context"
+	"io"
+)
+
+// ImageSource provides access to the manifests and layers of container
+// images. Both manifests and layers are addressed by their digest.
+type ImageSource interface {
+	GetManifest(ctx context.Context, reference *Reference, digest string) ([]byte, error)
+	GetBlob(ctx context.Context, reference *Reference, digest string) (io.ReadCloser, error)
+}
@@ -0,0 +1,263 @@
+package containerimage
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Prefix of files in a layer that indicate that the file with
+	// the same name in a lower layer should be removed.
+	whiteoutPrefix = ".wh."
+	// Name of the file in a layer that indicates that all files in
+	// the same directory in lower layers should be removed.
+	whiteoutOpaqueDirectory = ".wh..wh..opq"
+)
+
+// splitPath converts a pathname stored in a tarball to a list of
+// pathname components. Pathnames that attempt to escape the root
+// directory are rejected.
+func splitPath(p string) ([]string, error) {
+	var components []string
+	for _, component := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' }) {
+		switch component {
+		case ".":
+		case "..":
+			return nil, status.Errorf(codes.InvalidArgument, "Pathname %#v escapes root directory", p)
+		default:
+			components = append(components, component)
+		}
+	}
+	return components, nil
+}
+
+// maximumSymlinkExpansions is the maximum number of symbolic links
+// that are followed while traversing into a directory, similar to
+// MAXSYMLINKS on Linux.
+const maximumSymlinkExpansions = 40
+
+// openDirectory traverses into a directory in the root filesystem
+// whose pathname is known not to contain any symbolic links.
+func openDirectory(root filesystem.Directory, components []string) (filesystem.Directory, error) {
+	d := root
+	for n, component := range components {
+		d2, err := d.Enter(component)
+		if d != root {
+			d.Close()
+		}
+		if err != nil {
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to enter directory %#v", path.Join(components[:n+1]...))
+		}
+		d = d2
+	}
+	return d, nil
+}
+
+// enterDirectory traverses into a directory in the root filesystem,
+// creating directories that do not exist. Symbolic links are resolved
+// relative to the root filesystem, as images may for example contain
+// /bin as a symbolic link to /usr/bin. The caller must close the
+// returned handle if it differs from the root directory.
+func enterDirectory(root filesystem.Directory, components []string) (filesystem.Directory, error) {
+	d := root
+	var resolved []string
+	remaining := components
+	symlinkExpansions := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case ".":
+			continue
+		case "..":
+			// Symbolic links may refer to parent directories.
+			// Like in a chroot, these cannot escape the root.
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+				if d != root {
+					d.Close()
+				}
+				var err error
+				if d, err = openDirectory(root, resolved); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		p := path.Join(append(resolved, component)...)
+		fileInfo, err := d.Lstat(component)
+		if os.IsNotExist(err) {
+			err = d.Mkdir(component, 0755)
+			if err != nil && !os.IsExist(err) {
+				if d != root {
+					d.Close()
+				}
+				return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to create directory %#v", p)
+			}
+		} else if err != nil {
+			if d != root {
+				d.Close()
+			}
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to obtain attributes of %#v", p)
+		} else if fileInfo.Mode()&os.ModeType == os.ModeSymlink {
+			symlinkExpansions++
+			if symlinkExpansions > maximumSymlinkExpansions {
+				if d != root {
+					d.Close()
+				}
+				return nil, status.Errorf(codes.InvalidArgument, "Maximum number of symbolic link expansions reached while resolving %#v", path.Join(components...))
+			}
+			target, err := d.Readlink(component)
+			if err != nil {
+				if d != root {
+					d.Close()
+				}
+				return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to read symbolic link %#v", p)
+			}
+			remaining = append(strings.FieldsFunc(target, func(r rune) bool { return r == '/' }), remaining...)
+			if strings.HasPrefix(target, "/") {
+				// Absolute targets are relative to the
+				// root filesystem.
+				if d != root {
+					d.Close()
+				}
+				d = root
+				resolved = nil
+			}
+			continue
+		}
+
+		d2, err := d.Enter(component)
+		if d != root {
+			d.Close()
+		}
+		if err != nil {
+			return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to enter directory %#v", p)
+		}
+		d = d2
+		resolved = append(resolved, component)
+	}
+	return d, nil
+}
+
+// extractLayerEntry applies a single entry of a layer tarball to the
+// root filesystem.
+func extractLayerEntry(root filesystem.Directory, header *tar.Header, r io.Reader) error {
+	components, err := splitPath(header.Name)
+	if err != nil {
+		return err
+	}
+	if len(components) == 0 {
+		// Entry for the root directory itself.
+		return nil
+	}
+	parent, err := enterDirectory(root, components[:len(components)-1])
+	if err != nil {
+		return err
+	}
+	if parent != root {
+		defer parent.Close()
+	}
+	name := components[len(components)-1]
+
+	// Process whiteouts, removing data from lower layers.
+	if name == whiteoutOpaqueDirectory {
+		if err := parent.RemoveAllChildren(); err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to apply opaque whiteout %#v", header.Name)
+		}
+		return nil
+	}
+	if strings.HasPrefix(name, whiteoutPrefix) {
+		if err := parent.RemoveAll(strings.TrimPrefix(name, whiteoutPrefix)); err != nil && !os.IsNotExist(err) {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to apply whiteout %#v", header.Name)
+		}
+		return nil
+	}
+
+	// Directories are merged with ones from lower layers. Other
+	// kinds of files replace existing files.
+	mode := os.FileMode(header.Mode) & os.ModePerm
+	if header.Typeflag == tar.TypeDir {
+		if fileInfo, err := parent.Lstat(name); err == nil && fileInfo.Mode()&os.ModeType != os.ModeDir {
+			if err := parent.RemoveAll(name); err != nil {
+				return util.StatusWrapfWithCode(err, codes.Internal, "Failed to replace %#v with directory", header.Name)
+			}
+		}
+		if err := parent.Mkdir(name, mode|0700); err != nil && !os.IsExist(err) {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to create directory %#v", header.Name)
+		}
+		return nil
+	}
+	if err := parent.RemoveAll(name); err != nil && !os.IsNotExist(err) {
+		return util.StatusWrapfWithCode(err, codes.Internal, "Failed to remove %#v from lower layer", header.Name)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := parent.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to create file %#v", header.Name)
+		}
+		_, err = io.Copy(f, r)
+		f.Close()
+		if err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to write file %#v", header.Name)
+		}
+	case tar.TypeSymlink:
+		if err := parent.Symlink(header.Linkname, name); err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to create symlink %#v", header.Name)
+		}
+	case tar.TypeLink:
+		targetComponents, err := splitPath(header.Linkname)
+		if err != nil {
+			return err
+		}
+		if len(targetComponents) == 0 {
+			return status.Errorf(codes.InvalidArgument, "Hard link %#v has an empty target", header.Name)
+		}
+		targetParent, err := enterDirectory(root, targetComponents[:len(targetComponents)-1])
+		if err != nil {
+			return err
+		}
+		err = targetParent.Link(targetComponents[len(targetComponents)-1], parent, name)
+		if targetParent != root {
+			targetParent.Close()
+		}
+		if err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to create hard link %#v", header.Name)
+		}
+	default:
+		// Character devices, block devices and FIFOs cannot be
+		// created without privileges. Build actions should not
+		// depend on them, so they are omitted.
+	}
+	return nil
+}
+
+// ExtractLayer applies the contents of an uncompressed layer tarball
+// on top of a root filesystem, processing whiteouts as described in
+// the OCI image specification. File ownership is not preserved.
+func ExtractLayer(root filesystem.Directory, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return util.StatusWrapWithCode(err, codes.InvalidArgument, "Failed to read layer tarball")
+		}
+		if err := extractLayerEntry(root, header, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package containerimage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/containerimage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func createLayer(t *testing.T, headers []*tar.Header) *bytes.Buffer {
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, header := range headers {
+		require.NoError(t, w.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := w.Write(bytes.Repeat([]byte("x"), int(header.Size)))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, w.Close())
+	return &b
+}
+
+func TestExtractLayerWhiteouts(t *testing.T) {
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	root, err := filesystem.NewLocalDirectory(p)
+	require.NoError(t, err)
+	defer root.Close()
+
+	// Lower layer, containing a couple of files and directories.
+	require.NoError(t, containerimage.ExtractLayer(root, createLayer(t, []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "./", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "bin/sh", Mode: 0755, Size: 3},
+		{Typeflag: tar.TypeLink, Name: "bin/bash", Linkname: "bin/sh"},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeDir, Name: "var/cache/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "var/cache/a", Mode: 0644, Size: 1},
+	})))
+
+	// Upper layer, removing and replacing files.
+	require.NoError(t, containerimage.ExtractLayer(root, createLayer(t, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "bin/.wh.bash", Mode: 0644},
+		{Typeflag: tar.TypeSymlink, Name: "etc/passwd", Linkname: "../usr/passwd"},
+		{Typeflag: tar.TypeReg, Name: "var/cache/.wh..wh..opq", Mode: 0644},
+		{Typeflag: tar.TypeReg, Name: "var/cache/b", Mode: 0644, Size: 2},
+	})))
+
+	data, err := ioutil.ReadFile(filepath.Join(p, "bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xxx"), data)
+	_, err = os.Lstat(filepath.Join(p, "bin/bash"))
+	require.True(t, os.IsNotExist(err))
+	target, err := os.Readlink(filepath.Join(p, "etc/passwd"))
+	require.NoError(t, err)
+	require.Equal(t, "../usr/passwd", target)
+	_, err = os.Lstat(filepath.Join(p, "var/cache/a"))
+	require.True(t, os.IsNotExist(err))
+	data, err = ioutil.ReadFile(filepath.Join(p, "var/cache/b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xx"), data)
+}
+
+func TestExtractLayerEscape(t *testing.T) {
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	root, err := filesystem.NewLocalDirectory(p)
+	require.NoError(t, err)
+	defer root.Close()
+
+	require.Equal(
+		t,
+		status.Error(codes.InvalidArgument, "Pathname \"../etc/passwd\" escapes root directory"),
+		containerimage.ExtractLayer(root, createLayer(t, []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "../etc/passwd", Mode: 0644, Size: 1},
+		})))
+}
+
+func TestExtractLayerSymlinkedDirectories(t *testing.T) {
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	root, err := filesystem.NewLocalDirectory(p)
+	require.NoError(t, err)
+	defer root.Close()
+
+	// Lower layer of an image with a merged /usr, where top-level
+	// directories are symbolic links to directories in /usr.
+	require.NoError(t, containerimage.ExtractLayer(root, createLayer(t, []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "usr/lib/", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin"},
+		{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "/usr/lib"},
+		{Typeflag: tar.TypeSymlink, Name: "usr/lib64", Linkname: "../lib"},
+		{Typeflag: tar.TypeSymlink, Name: "escape", Linkname: "../../../usr"},
+		{Typeflag: tar.TypeSymlink, Name: "loop", Linkname: "loop"},
+	})))
+
+	// Upper layer, placing files in directories through symbolic
+	// links. These should be resolved within the root filesystem.
+	require.NoError(t, containerimage.ExtractLayer(root, createLayer(t, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "bin/sh", Mode: 0755, Size: 3},
+		{Typeflag: tar.TypeReg, Name: "usr/lib64/libc.so", Mode: 0644, Size: 4},
+		{Typeflag: tar.TypeReg, Name: "escape/passwd", Mode: 0644, Size: 5},
+		{Typeflag: tar.TypeLink, Name: "bin/bash", Linkname: "bin/sh"},
+	})))
+
+	data, err := ioutil.ReadFile(filepath.Join(p, "usr/bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xxx"), data)
+	data, err = ioutil.ReadFile(filepath.Join(p, "usr/lib/libc.so"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xxxx"), data)
+	data, err = ioutil.ReadFile(filepath.Join(p, "usr/passwd"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xxxxx"), data)
+	data, err = ioutil.ReadFile(filepath.Join(p, "usr/bin/bash"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xxx"), data)
+
+	// Symbolic link loops should be detected.
+	require.Equal(
+		t,
+		status.Error(codes.InvalidArgument, "Maximum number of symbolic link expansions reached while resolving \"loop\""),
+		containerimage.ExtractLayer(root, createLayer(t, []*tar.Header{
+			{Typeflag: tar.TypeReg, Name: "loop/file", Mode: 0644, Size: 1},
+		})))
+}
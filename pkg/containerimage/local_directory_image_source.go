@@ -0,0 +1,61 @@
+package containerimage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type localDirectoryImageSource struct {
+	path string
+}
+
+// NewLocalDirectoryImageSource creates an ImageSource that reads
+// manifests and layers from a directory on the local system that uses
+// the OCI image layout (i.e., having a "blobs/sha256" subdirectory).
+// As all objects are addressed by digest, the registry and repository
+// names of image references are ignored.
+//
+// Such directories can be populated using tools like skopeo (e.g.,
+// "skopeo copy docker://... oci:/path/to/directory").
+func NewLocalDirectoryImageSource(path string) ImageSource {
+	return &localDirectoryImageSource{
+		path: path,
+	}
+}
+
+func (is *localDirectoryImageSource) open(digest string) (*os.File, error) {
+	if !manifestDigestPattern.MatchString(digest) {
+		return nil, status.Errorf(codes.InvalidArgument, "Unsupported digest %#v", digest)
+	}
+	f, err := os.Open(filepath.Join(is.path, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "Blob %#v not present in local image directory", digest)
+	}
+	return f, err
+}
+
+func (is *localDirectoryImageSource) GetManifest(ctx context.Context, reference *Reference, digest string) ([]byte, error) {
+	f, err := is.open(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, util.StatusWrapfWithCode(err, codes.Internal, "Failed to read manifest %#v", digest)
+	}
+	return data, nil
+}
+
+func (is *localDirectoryImageSource) GetBlob(ctx context.Context, reference *Reference, digest string) (io.ReadCloser, error) {
+	return is.open(digest)
+}
@@ -0,0 +1,65 @@
+package containerimage
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var manifestDigestPattern = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+// Reference to a container image. Only references that are pinned to
+// a manifest digest are supported, as tags may change over time,
+// causing build actions to be executed non-deterministically.
+type Reference struct {
+	Registry   string
+	Repository string
+	Digest     string
+}
+
+// ParseReference parses the value of a "container-image" platform
+// property (e.g.,
+// "docker://gcr.io/cloud-marketplace/google/rbe-debian8@sha256:...").
+func ParseReference(s string) (*Reference, error) {
+	name := strings.TrimPrefix(s, "docker://")
+	at := strings.LastIndexByte(name, '@')
+	if at < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Container image %#v is not pinned to a manifest digest", s)
+	}
+	digest := name[at+1:]
+	if !manifestDigestPattern.MatchString(digest) {
+		return nil, status.Errorf(codes.InvalidArgument, "Container image %#v has an unsupported manifest digest", s)
+	}
+	name = name[:at]
+
+	// Strip off any tag that is provided in addition to the digest.
+	if colon := strings.LastIndexByte(name, ':'); colon > strings.LastIndexByte(name, '/') {
+		name = name[:colon]
+	}
+
+	// Split off the registry, using the same heuristics as Docker.
+	reference := &Reference{
+		Registry:   "docker.io",
+		Repository: name,
+		Digest:     digest,
+	}
+	if slash := strings.IndexByte(name, '/'); slash >= 0 {
+		if registry := name[:slash]; strings.ContainsAny(registry, ".:") || registry == "localhost" {
+			reference.Registry = registry
+			reference.Repository = name[slash+1:]
+		}
+	} else {
+		reference.Repository = "library/" + name
+	}
+	if reference.Repository == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Container image %#v has no repository name", s)
+	}
+	return reference, nil
+}
+
+// GetHashString returns the hexadecimal hash of the manifest digest.
+func (r *Reference) GetHashString() string {
+	return strings.TrimPrefix(r.Digest, "sha256:")
+}
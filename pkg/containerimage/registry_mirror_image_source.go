@@ -0,0 +1,79 @@
+package containerimage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context/ctxhttp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type registryMirrorImageSource struct {
+	address string
+}
+
+// NewRegistryMirrorImageSource creates an ImageSource that downloads
+// manifests and layers from a local registry mirror (e.g., a Docker
+// registry configured as a pull-through cache), using the Docker
+// Registry HTTP API V2. The registry name of image references is
+// ignored, as it is assumed that the mirror serves all images under
+// their repository name.
+func NewRegistryMirrorImageSource(address string) ImageSource {
+	return &registryMirrorImageSource{
+		address: strings.TrimSuffix(address, "/"),
+	}
+}
+
+func (is *registryMirrorImageSource) get(ctx context.Context, url string, accept []string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Failed to create request for %#v: %s", url, err)
+	}
+	for _, mediaType := range accept {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, err := ctxhttp.Do(ctx, http.DefaultClient, req)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "Failed to fetch %#v: %s", url, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, status.Errorf(codes.NotFound, "Object %#v not present in registry mirror", url)
+	default:
+		resp.Body.Close()
+		return nil, status.Errorf(codes.Unknown, "Unexpected status code from registry mirror: %d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+}
+
+func (is *registryMirrorImageSource) GetManifest(ctx context.Context, reference *Reference, digest string) ([]byte, error) {
+	r, err := is.get(ctx, fmt.Sprintf("%s/v2/%s/manifests/%s", is.address, reference.Repository, digest), manifestMediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "Failed to read manifest %#v: %s", digest, err)
+	}
+	return data, nil
+}
+
+func (is *registryMirrorImageSource) GetBlob(ctx context.Context, reference *Reference, digest string) (io.ReadCloser, error) {
+	return is.get(ctx, fmt.Sprintf("%s/v2/%s/blobs/%s", is.address, reference.Repository, digest), nil)
+}
@@ -0,0 +1,213 @@
+package containerimage
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RootFilesystemCache provides root filesystems for container images
+// that may be used to run build actions in.
+type RootFilesystemCache interface {
+	// GetRootFilesystem returns the path of a directory containing
+	// the unpacked root filesystem of a container image.
+	GetRootFilesystem(ctx context.Context, reference *Reference) (string, error)
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+	Layers    []descriptor `json:"layers"`
+}
+
+type localRootFilesystemCache struct {
+	source ImageSource
+	path   string
+
+	lock    sync.Mutex
+	unpacks map[string]*sync.Mutex
+}
+
+// NewLocalRootFilesystemCache creates a RootFilesystemCache that
+// unpacks the layers of container images obtained from an ImageSource
+// into a directory on the local system. Every image is only unpacked
+// once. Root filesystems are stored in subdirectories named after the
+// manifest digest, so that they survive restarts.
+func NewLocalRootFilesystemCache(source ImageSource, path string) RootFilesystemCache {
+	return &localRootFilesystemCache{
+		source:  source,
+		path:    path,
+		unpacks: map[string]*sync.Mutex{},
+	}
+}
+
+func verifyDigest(data []byte, digest string) error {
+	hash := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(hash[:]) != digest {
+		return status.Errorf(codes.InvalidArgument, "Manifest does not match digest %#v", digest)
+	}
+	return nil
+}
+
+// getLayers obtains the list of layers of a container image, resolving
+// manifest lists and image indices to the manifest that corresponds to
+// the operating system and architecture of the current system.
+func (rfc *localRootFilesystemCache) getLayers(ctx context.Context, reference *Reference) ([]descriptor, error) {
+	digest := reference.Digest
+	for {
+		data, err := rfc.source.GetManifest(ctx, reference, digest)
+		if err != nil {
+			return nil, util.StatusWrapf(err, "Failed to obtain manifest %#v", digest)
+		}
+		if err := verifyDigest(data, digest); err != nil {
+			return nil, err
+		}
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Failed to parse manifest %#v: %s", digest, err)
+		}
+		if len(m.Manifests) == 0 {
+			return m.Layers, nil
+		}
+
+		// Manifest list. Pick the manifest for this platform.
+		found := false
+		for _, d := range m.Manifests {
+			if d.Platform != nil && d.Platform.OS == runtime.GOOS && d.Platform.Architecture == runtime.GOARCH {
+				digest = d.Digest
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, status.Errorf(codes.FailedPrecondition, "Manifest list %#v contains no manifest for %s/%s", digest, runtime.GOOS, runtime.GOARCH)
+		}
+	}
+}
+
+// extractLayer downloads a single layer and applies it on top of the
+// root filesystem, while validating its digest.
+func (rfc *localRootFilesystemCache) extractLayer(ctx context.Context, reference *Reference, layer descriptor, root filesystem.Directory) error {
+	if !manifestDigestPattern.MatchString(layer.Digest) {
+		return status.Errorf(codes.InvalidArgument, "Layer has unsupported digest %#v", layer.Digest)
+	}
+	blob, err := rfc.source.GetBlob(ctx, reference, layer.Digest)
+	if err != nil {
+		return util.StatusWrapf(err, "Failed to obtain layer %#v", layer.Digest)
+	}
+	defer blob.Close()
+
+	hasher := sha256.New()
+	var r io.Reader = io.TeeReader(blob, hasher)
+	if strings.HasSuffix(layer.MediaType, "gzip") {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return util.StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to decompress layer %#v", layer.Digest)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	} else if !strings.HasSuffix(layer.MediaType, ".tar") {
+		return status.Errorf(codes.Unimplemented, "Layer %#v has unsupported media type %#v", layer.Digest, layer.MediaType)
+	}
+	if err := ExtractLayer(root, r); err != nil {
+		return util.StatusWrapf(err, "Failed to extract layer %#v", layer.Digest)
+	}
+
+	// Consume trailing data, so that the digest can be validated.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return util.StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to read layer %#v", layer.Digest)
+	}
+	if _, err := io.Copy(ioutil.Discard, blob); err != nil {
+		return util.StatusWrapfWithCode(err, codes.Unavailable, "Failed to read layer %#v", layer.Digest)
+	}
+	if "sha256:"+hex.EncodeToString(hasher.Sum(nil)) != layer.Digest {
+		return status.Errorf(codes.InvalidArgument, "Layer does not match digest %#v", layer.Digest)
+	}
+	return nil
+}
+
+func (rfc *localRootFilesystemCache) unpack(ctx context.Context, reference *Reference, rootPath string) error {
+	layers, err := rfc.getLayers(ctx, reference)
+	if err != nil {
+		return err
+	}
+
+	// Unpack into a temporary directory first, so that partially
+	// unpacked images are never used.
+	tmpPath, err := ioutil.TempDir(rfc.path, "tmp")
+	if err != nil {
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to create temporary directory")
+	}
+	root, err := filesystem.NewLocalDirectory(tmpPath)
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to open temporary directory")
+	}
+	for _, layer := range layers {
+		if err := rfc.extractLayer(ctx, reference, layer, root); err != nil {
+			root.Close()
+			os.RemoveAll(tmpPath)
+			return err
+		}
+	}
+	root.Close()
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		os.RemoveAll(tmpPath)
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to change permissions of root filesystem")
+	}
+	if err := os.Rename(tmpPath, rootPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return util.StatusWrapWithCode(err, codes.Internal, "Failed to move root filesystem into place")
+	}
+	return nil
+}
+
+func (rfc *localRootFilesystemCache) GetRootFilesystem(ctx context.Context, reference *Reference) (string, error) {
+	hash := reference.GetHashString()
+	rootPath := filepath.Join(rfc.path, hash)
+
+	// Prevent concurrent unpacking of the same image.
+	rfc.lock.Lock()
+	unpackLock, ok := rfc.unpacks[hash]
+	if !ok {
+		unpackLock = &sync.Mutex{}
+		rfc.unpacks[hash] = unpackLock
+	}
+	rfc.lock.Unlock()
+	unpackLock.Lock()
+	defer unpackLock.Unlock()
+
+	if _, err := os.Stat(rootPath); err == nil {
+		return rootPath, nil
+	} else if !os.IsNotExist(err) {
+		return "", util.StatusWrapWithCode(err, codes.Internal, "Failed to check for existing root filesystem")
+	}
+	if err := rfc.unpack(ctx, reference, rootPath); err != nil {
+		return "", err
+	}
+	return rootPath, nil
+}
@@ -74,13 +74,13 @@ func (e *actionDigestSubdirectoryEnvironment) GetBuildDirectory() filesystem.Dir
 	return e.subdirectory
 }
 
-func (e *actionDigestSubdirectoryEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+func (e *actionDigestSubdirectoryEnvironment) Run(ctx context.Context, request *runner.RunRequest, outputHandler OutputHandler) (*runner.RunResponse, error) {
 	// Prepend subdirectory name to working directory and log files of build action.
 	newRequest := *request
 	newRequest.WorkingDirectory = path.Join(e.subdirectoryName, newRequest.WorkingDirectory)
 	newRequest.StdoutPath = path.Join(e.subdirectoryName, newRequest.StdoutPath)
 	newRequest.StderrPath = path.Join(e.subdirectoryName, newRequest.StderrPath)
-	return e.base.Run(ctx, &newRequest)
+	return e.base.Run(ctx, &newRequest, outputHandler)
 }
 
 func (e *actionDigestSubdirectoryEnvironment) Release() {
@@ -153,7 +153,7 @@ func TestActionDigestSubdirectoryManagerSuccess(t *testing.T) {
 		WorkingDirectory: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855-0/some/sub/directory",
 		StdoutPath:       "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855-0/.stdout.txt",
 		StderrPath:       "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855-0/.stderr.txt",
-	}).Return(&runner.RunResponse{
+	}, nil).Return(&runner.RunResponse{
 		ExitCode: 123,
 	}, nil)
 	subDirectory.EXPECT().Close()
@@ -181,7 +181,7 @@ func TestActionDigestSubdirectoryManagerSuccess(t *testing.T) {
 		WorkingDirectory: "some/sub/directory",
 		StdoutPath:       ".stdout.txt",
 		StderrPath:       ".stderr.txt",
-	})
+	}, nil)
 	require.NoError(t, err)
 	require.Equal(t, &runner.RunResponse{
 		ExitCode: 123,
@@ -0,0 +1,205 @@
+package environment
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// cgroup is a handle to a control group (cgroup v2) that is created
+// for the duration of a single build action. It is used to obtain
+// resource usage statistics that also cover processes that have been
+// daemonized by the build action.
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates a new uniquely named control group underneath an
+// existing control group that is delegated to the runner.
+func newCgroup(parentPath string) (*cgroup, error) {
+	path, err := ioutil.TempDir(parentPath, "action")
+	if err != nil {
+		return nil, err
+	}
+	return &cgroup{path: path}, nil
+}
+
+// StartProcess starts a process inside the control group. The process
+// is started in a stopped state by tracing it, so that it is only
+// resumed after it has been moved into the control group. This
+// prevents it from spawning children that escape the control group.
+func (cg *cgroup) StartProcess(cmd *exec.Cmd) error {
+	// Tracing requests need to be issued by the thread that
+	// started the process.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Ptrace = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Wait for the process to stop after calling execve(), move it
+	// into the control group and let it continue.
+	pid := cmd.Process.Pid
+	var waitStatus syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &waitStatus, 0, nil); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if !waitStatus.Stopped() {
+		cmd.Wait()
+		return fmt.Errorf("Process did not stop after starting, but has status %#x", waitStatus)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cg.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0); err != nil {
+		cmd.Process.Kill()
+		syscall.PtraceDetach(pid)
+		cmd.Wait()
+		return err
+	}
+	if err := syscall.PtraceDetach(pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// readKeyValues parses files in the flat keyed format that is used by
+// files like "cpu.stat" and "memory.stat".
+func (cg *cgroup) readKeyValues(name string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(cg.path, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				values[fields[0]] = v
+			}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// readIOOperations sums up the number of read and write operations
+// stored in "io.stat" across all block devices.
+func (cg *cgroup) readIOOperations() (int64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cg.path, "io.stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	var reads, writes int64
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, field := range strings.Fields(line) {
+			if v := strings.TrimPrefix(field, "rios="); v != field {
+				n, _ := strconv.ParseInt(v, 10, 64)
+				reads += n
+			} else if v := strings.TrimPrefix(field, "wios="); v != field {
+				n, _ := strconv.ParseInt(v, 10, 64)
+				writes += n
+			}
+		}
+	}
+	return reads, writes, nil
+}
+
+// GetResourceUsage returns the resources consumed by all processes
+// that have been part of the control group.
+func (cg *cgroup) GetResourceUsage() (*resourceusage.ResourceUsage, error) {
+	cpuStat, err := cg.readKeyValues("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	memoryStat, err := cg.readKeyValues("memory.stat")
+	if err != nil {
+		return nil, err
+	}
+	maximumResidentSetSize, err := ioutil.ReadFile(filepath.Join(cg.path, "memory.peak"))
+	if err != nil {
+		return nil, err
+	}
+	maximumResidentSetSizeBytes, err := strconv.ParseInt(strings.TrimSpace(string(maximumResidentSetSize)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	blockInputOperations, blockOutputOperations, err := cg.readIOOperations()
+	if err != nil {
+		return nil, err
+	}
+	return &resourceusage.ResourceUsage{
+		UserTime:                    ptypes.DurationProto(time.Duration(cpuStat["user_usec"]) * time.Microsecond),
+		SystemTime:                  ptypes.DurationProto(time.Duration(cpuStat["system_usec"]) * time.Microsecond),
+		MaximumResidentSetSizeBytes: maximumResidentSetSizeBytes,
+		PageReclaims:                memoryStat["pgfault"] - memoryStat["pgmajfault"],
+		PageFaults:                  memoryStat["pgmajfault"],
+		BlockInputOperations:        blockInputOperations,
+		BlockOutputOperations:       blockOutputOperations,
+		FromCgroup:                  true,
+	}, nil
+}
+
+// kill terminates all processes that are part of the control group.
+func (cg *cgroup) kill() error {
+	err := ioutil.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0)
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Kernels older than Linux 5.14 don't provide "cgroup.kill".
+	// Terminate processes individually until none are left.
+	for i := 0; i < 10; i++ {
+		data, err := ioutil.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+		if err != nil {
+			return err
+		}
+		pids := strings.Fields(string(data))
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, pid := range pids {
+			if n, err := strconv.Atoi(pid); err == nil {
+				syscall.Kill(n, syscall.SIGKILL)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.New("Processes remain present after being killed")
+}
+
+// Destroy the control group, terminating any processes that are still
+// part of it.
+func (cg *cgroup) Destroy() error {
+	if err := cg.kill(); err != nil {
+		return err
+	}
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cg.path); err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
@@ -112,7 +112,7 @@ func TestCleanBuildDirectoryManagerSuccess(t *testing.T) {
 		WorkingDirectory: "some/sub/directory",
 		StdoutPath:       ".stdout.txt",
 		StderrPath:       ".stderr.txt",
-	}).Return(&runner.RunResponse{
+	}, nil).Return(&runner.RunResponse{
 		ExitCode: 123,
 	}, nil)
 	baseEnvironment.EXPECT().Release()
@@ -138,7 +138,7 @@ func TestCleanBuildDirectoryManagerSuccess(t *testing.T) {
 		WorkingDirectory: "some/sub/directory",
 		StdoutPath:       ".stdout.txt",
 		StderrPath:       ".stderr.txt",
-	})
+	}, nil)
 	require.NoError(t, err)
 	require.Equal(t, &runner.RunResponse{
 		ExitCode: 123,
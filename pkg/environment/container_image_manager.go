@@ -0,0 +1,113 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/containerimage"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ContainerImagePlatformProperty is the name of the platform property
+// that selects the container image in which a build action is run.
+const ContainerImagePlatformProperty = "container-image"
+
+// Directories in which file systems are mounted when running build
+// actions inside a root filesystem, in addition to the build directory.
+var containerImageMountPoints = []string{"/dev", "/proc"}
+
+type containerImageManager struct {
+	base            Manager
+	rootFilesystems containerimage.RootFilesystemCache
+	buildDirectory  filesystem.Directory
+	buildPath       string
+	cgroupPath      string
+
+	lock              sync.Mutex
+	preparedRootPaths map[string]bool
+}
+
+// NewContainerImageManager is an adapter for Manager that runs build
+// actions inside the root filesystem of the container image that is
+// specified through the "container-image" platform property. Build
+// actions without this platform property are run by the underlying
+// Manager directly.
+//
+// Build actions are run in private mount and PID namespaces, in which
+// the root filesystem is made read-only, the build directory is bind
+// mounted into it and a fresh /proc and minimal /dev are provided.
+// These mounts are released when the build action terminates. This
+// requires the process to have the CAP_SYS_ADMIN and CAP_SYS_CHROOT
+// capabilities. The runner must call RunContainerInitIfRequested() at
+// the start of main().
+func NewContainerImageManager(base Manager, rootFilesystems containerimage.RootFilesystemCache, buildDirectory filesystem.Directory, buildPath string, cgroupPath string) Manager {
+	return &containerImageManager{
+		base:              base,
+		rootFilesystems:   rootFilesystems,
+		buildDirectory:    buildDirectory,
+		buildPath:         buildPath,
+		cgroupPath:        cgroupPath,
+		preparedRootPaths: map[string]bool{},
+	}
+}
+
+// prepareRootPath makes a root filesystem ready for use, by creating
+// the mount points that are used when running build actions.
+func (em *containerImageManager) prepareRootPath(rootPath string) error {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	if em.preparedRootPaths[rootPath] {
+		return nil
+	}
+
+	for _, mountPoint := range append([]string{em.buildPath}, containerImageMountPoints...) {
+		if err := os.MkdirAll(filepath.Join(rootPath, mountPoint), 0755); err != nil {
+			return util.StatusWrapfWithCode(err, codes.Internal, "Failed to create mount point for %#v", mountPoint)
+		}
+	}
+	em.preparedRootPaths[rootPath] = true
+	return nil
+}
+
+func (em *containerImageManager) Acquire(actionDigest *util.Digest, platformProperties map[string]string) (ManagedEnvironment, error) {
+	imageName, ok := platformProperties[ContainerImagePlatformProperty]
+	if !ok {
+		return em.base.Acquire(actionDigest, platformProperties)
+	}
+	reference, err := containerimage.ParseReference(imageName)
+	if err != nil {
+		return nil, err
+	}
+	rootPath, err := em.rootFilesystems.GetRootFilesystem(context.Background(), reference)
+	if err != nil {
+		return nil, util.StatusWrapf(err, "Failed to obtain root filesystem of container image %#v", imageName)
+	}
+	if err := em.prepareRootPath(rootPath); err != nil {
+		return nil, err
+	}
+
+	// Allocate underlying environment.
+	environment, err := em.base.Acquire(actionDigest, platformProperties)
+	if err != nil {
+		return nil, err
+	}
+	return &containerImageEnvironment{
+		ManagedEnvironment: environment,
+		chrooted:           newChrootedLocalExecutionEnvironment(em.buildDirectory, em.buildPath, em.cgroupPath, rootPath),
+	}, nil
+}
+
+type containerImageEnvironment struct {
+	ManagedEnvironment
+	chrooted Environment
+}
+
+func (e *containerImageEnvironment) Run(ctx context.Context, request *runner.RunRequest, outputHandler OutputHandler) (*runner.RunResponse, error) {
+	return e.chrooted.Run(ctx, request, outputHandler)
+}
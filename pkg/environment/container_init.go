@@ -0,0 +1,183 @@
+package environment
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// containerInitName is the value of argv[0] with which the runner
+// re-executes itself to set up the root filesystem of a container
+// image, prior to executing a build action within it.
+const containerInitName = "bbb_container_init"
+
+// containerInitErrorFD is the file descriptor through which the
+// container init process reports setup failures to its parent.
+const containerInitErrorFD = 3
+
+// Character devices of the host system that are exposed through the
+// /dev directory of a container.
+var containerDevices = []string{"full", "null", "random", "tty", "urandom", "zero"}
+
+// Symbolic links that are created in the /dev directory of a container.
+var containerDeviceSymlinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+}
+
+// containerCommand is a command that runs a build action inside the
+// root filesystem of a container image. The command is launched in
+// private mount and PID namespaces, so that all mounts created for the
+// container are released once the build action terminates.
+type containerCommand struct {
+	*exec.Cmd
+	errorReader *os.File
+	errorWriter *os.File
+}
+
+func newContainerCommand(rootPath string, buildPath string, workingDirectory string, path string, arguments []string) (*containerCommand, error) {
+	errorReader, errorWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &containerCommand{
+		Cmd: &exec.Cmd{
+			Path:       "/proc/self/exe",
+			Args:       append([]string{containerInitName, rootPath, buildPath, workingDirectory, path}, arguments...),
+			ExtraFiles: []*os.File{errorWriter},
+			SysProcAttr: &syscall.SysProcAttr{
+				Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+			},
+		},
+		errorReader: errorReader,
+		errorWriter: errorWriter,
+	}, nil
+}
+
+// Close the pipe through which setup failures are reported.
+func (c *containerCommand) Close() {
+	c.errorReader.Close()
+	c.errorWriter.Close()
+}
+
+// WaitForSetup blocks until the container init process has executed
+// the build action, returning an error if setting up the container
+// failed. This function must be called after starting the command.
+func (c *containerCommand) WaitForSetup() error {
+	c.errorWriter.Close()
+	message, err := ioutil.ReadAll(c.errorReader)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to read container setup status: %s", err)
+	}
+	if len(message) > 0 {
+		c.Cmd.Wait()
+		return status.Errorf(codes.Internal, "Failed to set up container: %s", message)
+	}
+	return nil
+}
+
+// RunContainerInitIfRequested must be called at the start of main()
+// of the runner. When the runner has re-executed itself to run a build
+// action inside a container, it sets up the container and executes
+// the build action. This function does not return in that case.
+func RunContainerInitIfRequested() {
+	if len(os.Args) < 6 || os.Args[0] != containerInitName {
+		return
+	}
+	errorFile := os.NewFile(containerInitErrorFD, "error")
+	syscall.CloseOnExec(containerInitErrorFD)
+	err := runContainerInit(os.Args[1], os.Args[2], os.Args[3], os.Args[4], os.Args[5:])
+	fmt.Fprint(errorFile, err)
+	os.Exit(1)
+}
+
+func mountContainerFilesystem(source string, target string, fstype string, flags uintptr, data string) error {
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("Failed to mount %#v: %s", target, err)
+	}
+	return nil
+}
+
+// runContainerInit sets up the root filesystem of a container and
+// executes a build action within it. It is run as the initial process
+// of a private mount and PID namespace, meaning that none of the
+// mounts are visible to the host system.
+func runContainerInit(rootPath string, buildPath string, workingDirectory string, path string, arguments []string) error {
+	// Prevent mounts from propagating back to the host system.
+	if err := mountContainerFilesystem("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
+	// Make the root filesystem read-only, with only the build
+	// directory being writable.
+	if err := mountContainerFilesystem(rootPath, rootPath, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if err := mountContainerFilesystem("", rootPath, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return err
+	}
+	if err := mountContainerFilesystem(buildPath, filepath.Join(rootPath, buildPath), "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+
+	// Provide a procfs that only exposes the processes of the
+	// build action.
+	if err := mountContainerFilesystem("proc", filepath.Join(rootPath, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+
+	// Provide a /dev that only contains a minimal set of devices,
+	// as opposed to exposing all devices of the host system.
+	devPath := filepath.Join(rootPath, "dev")
+	if err := mountContainerFilesystem("tmpfs", devPath, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return err
+	}
+	for _, device := range containerDevices {
+		target := filepath.Join(devPath, device)
+		if err := ioutil.WriteFile(target, nil, 0666); err != nil {
+			return fmt.Errorf("Failed to create mount point %#v: %s", target, err)
+		}
+		if err := mountContainerFilesystem(filepath.Join("/dev", device), target, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+	for _, symlink := range containerDeviceSymlinks {
+		if err := os.Symlink(symlink[1], filepath.Join(devPath, symlink[0])); err != nil {
+			return fmt.Errorf("Failed to create symbolic link %#v: %s", symlink[0], err)
+		}
+	}
+	shmPath := filepath.Join(devPath, "shm")
+	if err := os.Mkdir(shmPath, 01777); err != nil {
+		return fmt.Errorf("Failed to create mount point %#v: %s", shmPath, err)
+	}
+	if err := mountContainerFilesystem("shm", shmPath, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777"); err != nil {
+		return err
+	}
+
+	// Execute the build action within the root filesystem.
+	if err := syscall.Chroot(rootPath); err != nil {
+		return fmt.Errorf("Failed to change root directory: %s", err)
+	}
+	if err := os.Chdir(workingDirectory); err != nil {
+		return fmt.Errorf("Failed to change working directory: %s", err)
+	}
+	// Resolve the executable against the PATH of the build action
+	// only after changing the root directory, so that symbolic
+	// links in the container image are resolved within the image.
+	resolvedPath, err := exec.LookPath(path)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve %#v: %s", path, err)
+	}
+	if err := syscall.Exec(resolvedPath, arguments, os.Environ()); err != nil {
+		return fmt.Errorf("Failed to execute %#v: %s", resolvedPath, err)
+	}
+	return nil
+}
@@ -1,10 +1,17 @@
 package environment
 
 import (
+	"context"
+
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 )
 
+// OutputHandler is invoked by Environment.Run() for chunks of data
+// written to stdout and stderr by a command, while it is still
+// running.
+type OutputHandler func(chunk *runner.OutputChunk) error
+
 // Environment represents a context in which build commands may be
 // invoked. Examples of environments may include Docker containers,
 // simple chroots, local execution, etc., etc.
@@ -13,7 +20,10 @@ type Environment interface {
 	// arguments, environment variables, a working directory
 	// relative to the build directory and a pair of pathnames for
 	// writing stdout/stderr diagnostics output.
-	runner.RunnerServer
+	//
+	// If an OutputHandler is provided, the data written to stdout
+	// and stderr is also passed to it while the command is running.
+	Run(ctx context.Context, request *runner.RunRequest, outputHandler OutputHandler) (*runner.RunResponse, error)
 
 	// GetBuildDirectory returns a handle to a directory in which a
 	// BuildExecutor may place the input files of the build step and
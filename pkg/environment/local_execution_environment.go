@@ -2,16 +2,20 @@ package environment
 
 import (
 	"context"
+	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/resourceusage"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/golang/protobuf/ptypes"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -20,14 +24,36 @@ import (
 type localExecutionEnvironment struct {
 	buildDirectory filesystem.Directory
 	buildPath      string
+	cgroupPath     string
+	rootPath       string
 }
 
 // NewLocalExecutionEnvironment returns an Environment capable of running
 // commands on the local system directly.
-func NewLocalExecutionEnvironment(buildDirectory filesystem.Directory, buildPath string) Environment {
+//
+// Resource usage of commands is obtained through getrusage(). If a
+// path to a cgroup v2 directory is provided, every command is run in
+// its own child cgroup instead, so that resource usage can be reported
+// for all processes spawned by the command.
+func NewLocalExecutionEnvironment(buildDirectory filesystem.Directory, buildPath string, cgroupPath string) Environment {
 	return &localExecutionEnvironment{
 		buildDirectory: buildDirectory,
 		buildPath:      buildPath,
+		cgroupPath:     cgroupPath,
+	}
+}
+
+// newChrootedLocalExecutionEnvironment returns an Environment capable
+// of running commands on the local system, chrooted into a root
+// filesystem. Commands are run in private mount and PID namespaces, in
+// which the build directory is made accessible within the root
+// filesystem under the same path.
+func newChrootedLocalExecutionEnvironment(buildDirectory filesystem.Directory, buildPath string, cgroupPath string, rootPath string) Environment {
+	return &localExecutionEnvironment{
+		buildDirectory: buildDirectory,
+		buildPath:      buildPath,
+		cgroupPath:     cgroupPath,
+		rootPath:       rootPath,
 	}
 }
 
@@ -35,7 +61,7 @@ func (e *localExecutionEnvironment) GetBuildDirectory() filesystem.Directory {
 	return e.buildDirectory
 }
 
-func (e *localExecutionEnvironment) openLog(logPath string) (filesystem.File, error) {
+func (e *localExecutionEnvironment) openLog(logPath string, flag int) (filesystem.File, error) {
 	components := strings.FieldsFunc(logPath, func(r rune) bool { return r == '/' })
 	if len(components) < 1 {
 		return nil, status.Error(codes.InvalidArgument, "Insufficient pathname components in filename")
@@ -55,57 +81,195 @@ func (e *localExecutionEnvironment) openLog(logPath string) (filesystem.File, er
 	}
 
 	// Create log file within.
-	f, err := d.OpenFile(components[len(components)-1], os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	f, err := d.OpenFile(components[len(components)-1], flag, 0666)
 	if d != e.buildDirectory {
 		d.Close()
 	}
 	return f, err
 }
 
-func (e *localExecutionEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
+func (e *localExecutionEnvironment) Run(ctx context.Context, request *runner.RunRequest, outputHandler OutputHandler) (*runner.RunResponse, error) {
 	if len(request.Arguments) < 1 {
 		return nil, status.Error(codes.InvalidArgument, "Insufficient number of command arguments")
 	}
-	cmd := exec.CommandContext(ctx, request.Arguments[0], request.Arguments[1:]...)
 	// TODO(edsch): Convert workingDirectory to use platform
 	// specific path delimiter.
-	cmd.Dir = filepath.Join(e.buildPath, request.WorkingDirectory)
+	workingDirectory := filepath.Join(e.buildPath, request.WorkingDirectory)
+	var cmd *exec.Cmd
+	var container *containerCommand
+	if e.rootPath == "" {
+		cmd = exec.CommandContext(ctx, request.Arguments[0], request.Arguments[1:]...)
+	} else {
+		// exec.Command() resolves the executable on the host
+		// system. Let the container init process resolve it
+		// within the root filesystem instead.
+		var err error
+		container, err = newContainerCommand(
+			e.rootPath,
+			e.buildPath,
+			workingDirectory,
+			request.Arguments[0],
+			request.Arguments)
+		if err != nil {
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create container setup pipe")
+		}
+		defer container.Close()
+		cmd = container.Cmd
+	}
+	cmd.Dir = workingDirectory
 	for name, value := range request.EnvironmentVariables {
 		cmd.Env = append(cmd.Env, name+"="+value)
 	}
 
 	// Open output files for logging.
-	stdout, err := e.openLog(request.StdoutPath)
+	logFlag := os.O_APPEND | os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	stdout, err := e.openLog(request.StdoutPath, logFlag)
 	if err != nil {
 		return nil, util.StatusWrap(err, "Failed to open stdout")
 	}
 	cmd.Stdout = stdout
 
-	stderr, err := e.openLog(request.StderrPath)
+	stderr, err := e.openLog(request.StderrPath, logFlag)
 	if err != nil {
 		stdout.Close()
 		return nil, util.StatusWrap(err, "Failed to open stderr")
 	}
 	cmd.Stderr = stderr
 
+	// Create a cgroup in which the process is placed, if enabled.
+	var cg *cgroup
+	if e.cgroupPath != "" {
+		cg, err = newCgroup(e.cgroupPath)
+		if err != nil {
+			stdout.Close()
+			stderr.Close()
+			return nil, util.StatusWrapWithCode(err, codes.Internal, "Failed to create cgroup")
+		}
+		defer func() {
+			if err := cg.Destroy(); err != nil {
+				log.Print("Failed to destroy cgroup: ", err)
+			}
+		}()
+	}
+
 	// Start the subprocess. We can already close the output files
 	// while the process is running.
-	err = cmd.Start()
+	if cg == nil {
+		err = cmd.Start()
+	} else {
+		err = cg.StartProcess(cmd)
+	}
 	stdout.Close()
 	stderr.Close()
 	if err != nil {
 		return nil, util.StatusWrap(err, "Failed to start process")
 	}
 
+	if container != nil {
+		if err := container.WaitForSetup(); err != nil {
+			return nil, err
+		}
+
+		// Commands created without exec.CommandContext() need
+		// to be killed explicitly upon cancelation.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				cmd.Process.Kill()
+			case <-done:
+			}
+		}()
+	}
+
+	// Stream output written by the process to the caller, if
+	// requested. This is done by reading back the log files.
+	// Streaming output is merely informational, as the log files
+	// are uploaded upon completion. Failures to stream output are
+	// therefore only logged.
+	var tailDone chan struct{}
+	var tailErr chan error
+	if outputHandler != nil {
+		if tailers, err := e.openTailers(request); err == nil {
+			tailDone = make(chan struct{})
+			tailErr = make(chan error, 1)
+			go func() {
+				tailErr <- tailOutput(tailers, outputHandler, tailDone)
+				for _, tailer := range tailers {
+					tailer.file.Close()
+				}
+			}()
+		} else {
+			log.Print("Failed to stream output: ", err)
+		}
+	}
+
 	// Wait for execution to complete.
+	var response runner.RunResponse
 	err = cmd.Wait()
+	if tailDone != nil {
+		close(tailDone)
+		if err := <-tailErr; err != nil {
+			log.Print("Failed to stream output: ", err)
+		}
+	}
 	if exitError, ok := err.(*exec.ExitError); ok {
 		waitStatus := exitError.Sys().(syscall.WaitStatus)
-		return &runner.RunResponse{
-			ExitCode: int32(waitStatus.ExitStatus()),
-		}, nil
+		response.ExitCode = int32(waitStatus.ExitStatus())
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Attach statistics on the resources consumed by the process.
+	// These are merely informational, meaning that failures to
+	// obtain them from the cgroup should not cause the action to
+	// fail. Fall back to the statistics of the process itself,
+	// which exclude any processes it spawned that were not waited
+	// for.
+	if cg != nil {
+		resourceUsage, err := cg.GetResourceUsage()
+		if err == nil {
+			response.ResourceUsage = resourceUsage
+			return &response, nil
+		}
+		log.Print("Failed to obtain resource usage from cgroup: ", err)
+	}
+	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		response.ResourceUsage = getResourceUsageFromRusage(rusage)
+	}
+	return &response, nil
+}
+
+// openTailers opens the log files of a command for reading, so that
+// their contents may be streamed while the command is running.
+func (e *localExecutionEnvironment) openTailers(request *runner.RunRequest) ([]*outputTailer, error) {
+	stdout, err := e.openLog(request.StdoutPath, os.O_RDONLY)
+	if err != nil {
+		return nil, util.StatusWrap(err, "Failed to open stdout for streaming")
+	}
+	stderr, err := e.openLog(request.StderrPath, os.O_RDONLY)
+	if err != nil {
+		stdout.Close()
+		return nil, util.StatusWrap(err, "Failed to open stderr for streaming")
+	}
+	return []*outputTailer{
+		newOutputTailer(stdout, runner.OutputChunk_STDOUT),
+		newOutputTailer(stderr, runner.OutputChunk_STDERR),
+	}, nil
+}
+
+func getResourceUsageFromRusage(rusage *syscall.Rusage) *resourceusage.ResourceUsage {
+	return &resourceusage.ResourceUsage{
+		UserTime:   ptypes.DurationProto(time.Duration(rusage.Utime.Nano())),
+		SystemTime: ptypes.DurationProto(time.Duration(rusage.Stime.Nano())),
+		// ru_maxrss is expressed in kilobytes.
+		MaximumResidentSetSizeBytes: rusage.Maxrss * 1024,
+		PageReclaims:                rusage.Minflt,
+		PageFaults:                  rusage.Majflt,
+		BlockInputOperations:        rusage.Inblock,
+		BlockOutputOperations:       rusage.Oublock,
+		VoluntaryContextSwitches:    rusage.Nvcsw,
+		InvoluntaryContextSwitches:  rusage.Nivcsw,
 	}
-	return &runner.RunResponse{
-		ExitCode: 0,
-	}, err
 }
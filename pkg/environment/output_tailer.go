@@ -0,0 +1,83 @@
+package environment
+
+import (
+	"io"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
+)
+
+const (
+	// Interval at which log files are checked for new data.
+	outputTailerPollInterval = 100 * time.Millisecond
+	// Maximum size of a single chunk passed to an OutputHandler.
+	outputTailerChunkSizeBytes = 64 * 1024
+)
+
+// outputTailer reads data that is appended to a log file while a
+// command is running, passing it on to an OutputHandler.
+//
+// Log files are read back from disk, as opposed to connecting the
+// command to a pipe. This prevents the command from blocking when the
+// consumer of the output is slow, and prevents us from waiting
+// indefinitely on daemonized processes that keep the pipe open.
+type outputTailer struct {
+	file   filesystem.File
+	stream runner.OutputChunk_Stream
+	offset int64
+}
+
+func newOutputTailer(file filesystem.File, stream runner.OutputChunk_Stream) *outputTailer {
+	return &outputTailer{
+		file:   file,
+		stream: stream,
+	}
+}
+
+// poll passes all data that has been appended to the log file since
+// the previous call to the OutputHandler.
+func (t *outputTailer) poll(outputHandler OutputHandler) error {
+	for {
+		buf := make([]byte, outputTailerChunkSizeBytes)
+		n, err := t.file.ReadAt(buf, t.offset)
+		if n > 0 {
+			t.offset += int64(n)
+			if err := outputHandler(&runner.OutputChunk{
+				Stream: t.stream,
+				Data:   buf[:n],
+			}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || n == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// tailOutput repeatedly polls a set of log files until the done channel
+// is closed. After closure, the log files are polled one last time to
+// pick up any data that was written right before completion.
+func tailOutput(tailers []*outputTailer, outputHandler OutputHandler, done <-chan struct{}) error {
+	ticker := time.NewTicker(outputTailerPollInterval)
+	defer ticker.Stop()
+	for {
+		finished := false
+		select {
+		case <-ticker.C:
+		case <-done:
+			finished = true
+		}
+		for _, tailer := range tailers {
+			if err := tailer.poll(outputHandler); err != nil {
+				return err
+			}
+		}
+		if finished {
+			return nil
+		}
+	}
+}
@@ -2,11 +2,15 @@ package environment
 
 import (
 	"context"
+	"io"
+	"log"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/filesystem"
 	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/runner"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type remoteExecutionEnvironment struct {
@@ -27,6 +31,39 @@ func (e *remoteExecutionEnvironment) GetBuildDirectory() filesystem.Directory {
 	return e.buildDirectory
 }
 
-func (e *remoteExecutionEnvironment) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
-	return e.runner.Run(ctx, request)
+func (e *remoteExecutionEnvironment) Run(ctx context.Context, request *runner.RunRequest, outputHandler OutputHandler) (*runner.RunResponse, error) {
+	if outputHandler == nil {
+		return e.runner.Run(ctx, request)
+	}
+
+	// Forward chunks of output until the final response is received.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := e.runner.RunStreaming(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return nil, status.Error(codes.Internal, "Runner closed stream without returning a response")
+		} else if err != nil {
+			return nil, err
+		}
+		switch r := response.Response.(type) {
+		case *runner.RunStreamingResponse_OutputChunk:
+			// Streaming output is merely informational. Upon
+			// failure, discard any further output.
+			if outputHandler != nil {
+				if err := outputHandler(r.OutputChunk); err != nil {
+					log.Print("Failed to stream output: ", err)
+					outputHandler = nil
+				}
+			}
+		case *runner.RunStreamingResponse_RunResponse:
+			return r.RunResponse, nil
+		default:
+			return nil, status.Error(codes.Internal, "Runner returned a response of an unknown type")
+		}
+	}
 }
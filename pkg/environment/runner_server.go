@@ -19,10 +19,33 @@ func NewRunnerServer(manager Manager) runner.RunnerServer {
 }
 
 func (rs *runnerServer) Run(ctx context.Context, request *runner.RunRequest) (*runner.RunResponse, error) {
-	env, err := rs.manager.Acquire(nil, map[string]string{})
+	env, err := rs.manager.Acquire(nil, request.PlatformProperties)
 	if err != nil {
 		return nil, err
 	}
 	defer env.Release()
-	return env.Run(ctx, request)
+	return env.Run(ctx, request, nil)
+}
+
+func (rs *runnerServer) RunStreaming(request *runner.RunRequest, stream runner.Runner_RunStreamingServer) error {
+	env, err := rs.manager.Acquire(nil, request.PlatformProperties)
+	if err != nil {
+		return err
+	}
+	defer env.Release()
+	response, err := env.Run(stream.Context(), request, func(chunk *runner.OutputChunk) error {
+		return stream.Send(&runner.RunStreamingResponse{
+			Response: &runner.RunStreamingResponse_OutputChunk{
+				OutputChunk: chunk,
+			},
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&runner.RunStreamingResponse{
+		Response: &runner.RunStreamingResponse_RunResponse{
+			RunResponse: response,
+		},
+	})
 }
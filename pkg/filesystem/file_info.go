@@ -9,4 +9,5 @@ import (
 type FileInfo interface {
 	Name() string
 	Mode() os.FileMode
+	Size() int64
 }
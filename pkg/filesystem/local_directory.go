@@ -101,7 +101,7 @@ func (d *localDirectory) Lstat(name string) (FileInfo, error) {
 	default:
 		mode |= os.ModeIrregular
 	}
-	return NewSimpleFileInfo(name, mode), nil
+	return NewSimpleFileInfo(name, mode, stat.Size), nil
 }
 
 func (d *localDirectory) Mkdir(name string, perm os.FileMode) error {
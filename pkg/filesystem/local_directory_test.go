@@ -160,11 +160,14 @@ func TestLocalDirectoryLstatFile(t *testing.T) {
 	d := openTmpDir(t)
 	f, err := d.OpenFile("file", os.O_CREATE|os.O_WRONLY, 0644)
 	require.NoError(t, err)
+	_, err = f.Write([]byte("Hello"))
+	require.NoError(t, err)
 	require.NoError(t, f.Close())
 	fi, err := d.Lstat("file")
 	require.NoError(t, err)
 	require.Equal(t, "file", fi.Name())
 	require.Equal(t, os.FileMode(0644), fi.Mode())
+	require.Equal(t, int64(5), fi.Size())
 	require.NoError(t, d.Close())
 }
 
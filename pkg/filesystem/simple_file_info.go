@@ -5,16 +5,18 @@ import (
 )
 
 type simpleFileInfo struct {
-	name string
-	mode os.FileMode
+	name      string
+	mode      os.FileMode
+	sizeBytes int64
 }
 
 // NewSimpleFileInfo constructs a FileInfo object that returns fixed
 // values for its methods.
-func NewSimpleFileInfo(name string, mode os.FileMode) FileInfo {
+func NewSimpleFileInfo(name string, mode os.FileMode, sizeBytes int64) FileInfo {
 	return &simpleFileInfo{
-		name: name,
-		mode: mode,
+		name:      name,
+		mode:      mode,
+		sizeBytes: sizeBytes,
 	}
 }
 
@@ -25,3 +27,7 @@ func (fi *simpleFileInfo) Name() string {
 func (fi *simpleFileInfo) Mode() os.FileMode {
 	return fi.mode
 }
+
+func (fi *simpleFileInfo) Size() int64 {
+	return fi.sizeBytes
+}
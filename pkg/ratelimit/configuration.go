@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"math"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/ratelimit"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateInterceptorsFromConfig creates GRPC interceptors that enforce
+// the quotas provided in a configuration message. If no configuration
+// is provided, interceptors are returned that don't enforce any
+// quotas.
+func CreateInterceptorsFromConfig(config *pb.RateLimitConfiguration) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor, error) {
+	var quotas []*pb.QuotaConfiguration
+	if config != nil {
+		names := map[string]bool{}
+		for i, quota := range config.Quotas {
+			if quota.Name == "" {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "Quota at index %d has no name", i)
+			}
+			if names[quota.Name] {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "Multiple quotas have name %#v", quota.Name)
+			}
+			names[quota.Name] = true
+			if quota.RequestsPerSecond < 0 || math.IsNaN(quota.RequestsPerSecond) || math.IsInf(quota.RequestsPerSecond, 0) {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "Quota %#v has an invalid request rate", quota.Name)
+			}
+			if quota.RequestsPerSecond == 0 && quota.MaximumConcurrentRequests == 0 {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "Quota %#v limits neither the request rate, nor the number of concurrent requests", quota.Name)
+			}
+		}
+		quotas = config.Quotas
+	}
+	limiter := NewQuotaLimiter(quotas)
+	return NewRateLimitingUnaryInterceptor(limiter), NewRateLimitingStreamInterceptor(limiter), nil
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc"
+)
+
+// getInstanceName extracts the instance name from a request message.
+// Most messages of the Remote Execution API contain the instance name
+// as a separate field. For ByteStream requests, it is the part of the
+// resource name preceding the "blobs" or "uploads" keyword. For
+// WaitExecution requests, it is stored in the operation name by
+// NewDemultiplexingBuildQueue().
+func getInstanceName(req interface{}) string {
+	var instanceName string
+	switch r := req.(type) {
+	case interface{ GetInstanceName() string }:
+		instanceName = r.GetInstanceName()
+	case *remoteexecution.WaitExecutionRequest:
+		instanceName = strings.SplitN(r.Name, "|", 2)[0]
+	case interface{ GetResourceName() string }:
+		var components []string
+		for _, component := range strings.Split(r.GetResourceName(), "/") {
+			if component == "blobs" || component == "uploads" {
+				break
+			}
+			components = append(components, component)
+		}
+		instanceName = strings.Join(components, "/")
+	}
+
+	// Invalid instance names are rejected by the services
+	// themselves. Let them be subject to the quotas in their
+	// original form.
+	if canonical, err := util.CanonicalizeInstanceName(instanceName); err == nil {
+		return canonical
+	}
+	return instanceName
+}
+
+func newRequest(ctx context.Context, method string, req interface{}) *Request {
+	identity, _ := auth.GetIdentity(ctx)
+	return &Request{
+		Method:       method,
+		InstanceName: getInstanceName(req),
+		Identity:     identity,
+	}
+}
+
+// NewRateLimitingUnaryInterceptor creates a GRPC interceptor for unary
+// calls that enforces quotas. It needs to be placed after the
+// interceptor that authenticates clients, so that quotas can be
+// enforced per identity.
+func NewRateLimitingUnaryInterceptor(limiter Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, err := limiter.Acquire(newRequest(ctx, info.FullMethod, req))
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// rateLimitedServerStream is a wrapper around a ServerStream that
+// enforces quotas when the first request message is received, as the
+// instance name can only be extracted from the request message.
+type rateLimitedServerStream struct {
+	grpc.ServerStream
+	limiter Limiter
+	method  string
+
+	once    sync.Once
+	release func()
+}
+
+func (s *rateLimitedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	var err error
+	s.once.Do(func() {
+		s.release, err = s.limiter.Acquire(newRequest(s.Context(), s.method, m))
+	})
+	return err
+}
+
+// NewRateLimitingStreamInterceptor creates a GRPC interceptor for
+// streaming calls that enforces quotas. Requests are subject to the
+// quotas until the stream is closed. It needs to be placed after the
+// interceptor that authenticates clients, so that quotas can be
+// enforced per identity.
+func NewRateLimitingStreamInterceptor(limiter Limiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		stream := &rateLimitedServerStream{
+			ServerStream: ss,
+			limiter:      limiter,
+			method:       info.FullMethod,
+		}
+		err := handler(srv, stream)
+		// Wait for any pending acquisition to complete and prevent
+		// acquisitions after the stream has been closed.
+		stream.once.Do(func() {})
+		if stream.release != nil {
+			stream.release()
+		}
+		return err
+	}
+}
@@ -0,0 +1,132 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/auth"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/mock"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ratelimit"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimitingUnaryInterceptor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	limiter := mock.NewMockLimiter(ctrl)
+	interceptor := ratelimit.NewRateLimitingUnaryInterceptor(limiter)
+	ctx := auth.NewContextWithIdentity(context.Background(), "alice")
+	info := &grpc.UnaryServerInfo{FullMethod: findMissingBlobsMethod}
+	request := &remoteexecution.FindMissingBlobsRequest{InstanceName: "debian8"}
+
+	t.Run("Allowed", func(t *testing.T) {
+		// The budget should be released once the handler
+		// completes.
+		released := false
+		limiter.EXPECT().Acquire(&ratelimit.Request{
+			Method:       findMissingBlobsMethod,
+			InstanceName: "debian8",
+			Identity:     "alice",
+		}).Return(func() { released = true }, nil)
+
+		response, err := interceptor(ctx, request, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			require.False(t, released)
+			return &remoteexecution.FindMissingBlobsResponse{}, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, &remoteexecution.FindMissingBlobsResponse{}, response)
+		require.True(t, released)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		// Rejected requests should not reach the handler.
+		limiter.EXPECT().Acquire(gomock.Any()).Return(nil, status.Error(codes.ResourceExhausted, "Quota exceeded"))
+
+		_, err := interceptor(ctx, request, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatal("Handler should not be called")
+			return nil, nil
+		})
+		require.Equal(t, status.Error(codes.ResourceExhausted, "Quota exceeded"), err)
+	})
+}
+
+func TestRateLimitingStreamInterceptor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	limiter := mock.NewMockLimiter(ctrl)
+	interceptor := ratelimit.NewRateLimitingStreamInterceptor(limiter)
+	ctx := auth.NewContextWithIdentity(context.Background(), "alice")
+
+	t.Run("WaitExecution", func(t *testing.T) {
+		// Quotas can only be acquired after receiving the first
+		// request message, as it contains the instance name. For
+		// WaitExecution, it is part of the operation name.
+		ss := mock.NewMockExecution_WaitExecutionServer(ctrl)
+		ss.EXPECT().Context().Return(ctx).AnyTimes()
+		ss.EXPECT().RecvMsg(gomock.Any()).DoAndReturn(func(m interface{}) error {
+			m.(*remoteexecution.WaitExecutionRequest).Name = "ubuntu1804|a4d9d5f1-9f6c-4bc1-a09e-a5e6f4c4bb1a"
+			return nil
+		}).Times(2)
+		released := false
+		limiter.EXPECT().Acquire(&ratelimit.Request{
+			Method:       "/build.bazel.remote.execution.v2.Execution/WaitExecution",
+			InstanceName: "ubuntu1804",
+			Identity:     "alice",
+		}).Return(func() { released = true }, nil)
+
+		info := &grpc.StreamServerInfo{FullMethod: "/build.bazel.remote.execution.v2.Execution/WaitExecution"}
+		require.NoError(t, interceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+			// Subsequent messages should not be charged.
+			for i := 0; i < 2; i++ {
+				var request remoteexecution.WaitExecutionRequest
+				require.NoError(t, stream.RecvMsg(&request))
+			}
+			require.False(t, released)
+			return nil
+		}))
+		require.True(t, released)
+	})
+
+	t.Run("ByteStreamWrite", func(t *testing.T) {
+		// For ByteStream, the instance name is the part of the
+		// resource name preceding the "uploads" keyword.
+		ss := mock.NewMockExecution_WaitExecutionServer(ctrl)
+		ss.EXPECT().Context().Return(ctx).AnyTimes()
+		ss.EXPECT().RecvMsg(gomock.Any()).DoAndReturn(func(m interface{}) error {
+			m.(*bytestream.WriteRequest).ResourceName = "debian8/x86_64/uploads/a4d9d5f1-9f6c-4bc1-a09e-a5e6f4c4bb1a/blobs/8b1a9953c4611296a827abf8c47804d7/5"
+			return nil
+		})
+		limiter.EXPECT().Acquire(&ratelimit.Request{
+			Method:       "/google.bytestream.ByteStream/Write",
+			InstanceName: "debian8/x86_64",
+			Identity:     "alice",
+		}).Return(nil, status.Error(codes.ResourceExhausted, "Quota exceeded"))
+
+		// Errors acquiring quotas should be returned by RecvMsg().
+		// As nothing was acquired, nothing is released.
+		info := &grpc.StreamServerInfo{FullMethod: "/google.bytestream.ByteStream/Write"}
+		require.Equal(t, status.Error(codes.ResourceExhausted, "Quota exceeded"), interceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+			var request bytestream.WriteRequest
+			return stream.RecvMsg(&request)
+		}))
+	})
+
+	t.Run("NoMessagesReceived", func(t *testing.T) {
+		// Streams that terminate before receiving a request
+		// message should not be subject to quotas.
+		ss := mock.NewMockExecution_WaitExecutionServer(ctrl)
+		info := &grpc.StreamServerInfo{FullMethod: "/google.bytestream.ByteStream/Read"}
+		require.Equal(t, status.Error(codes.Internal, "Handler failed"), interceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+			return status.Error(codes.Internal, "Handler failed")
+		}))
+	})
+}
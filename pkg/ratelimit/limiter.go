@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/ratelimit"
+)
+
+// Limiter enforces a set of quotas on requests.
+type Limiter interface {
+	// Acquire charges the budgets of all quotas that apply to a
+	// request. If one of the quotas is exceeded, an error with code
+	// RESOURCE_EXHAUSTED is returned. Otherwise, a function is
+	// returned that must be called when the request completes.
+	Acquire(request *Request) (func(), error)
+}
+
+type acquiredQuota struct {
+	quota *quota
+	key   bucketKey
+}
+
+type quotaLimiter struct {
+	quotas []*quota
+}
+
+// NewQuotaLimiter creates a Limiter that enforces quotas, as described
+// by configuration messages. The configuration messages are assumed
+// to be validated already.
+func NewQuotaLimiter(configs []*pb.QuotaConfiguration) Limiter {
+	l := &quotaLimiter{}
+	for _, config := range configs {
+		l.quotas = append(l.quotas, newQuota(config))
+	}
+	return l
+}
+
+func (l *quotaLimiter) Acquire(request *Request) (func(), error) {
+	var acquired []acquiredQuota
+	for _, q := range l.quotas {
+		if !q.appliesTo(request) {
+			continue
+		}
+		key, err := q.acquire(request)
+		if err != nil {
+			// Undo the changes made to the budgets of other
+			// quotas, as the request is not processed.
+			for _, a := range acquired {
+				a.quota.release(a.key, true)
+			}
+			return nil, err
+		}
+		acquired = append(acquired, acquiredQuota{quota: q, key: key})
+	}
+	return func() {
+		for _, a := range acquired {
+			a.quota.release(a.key, false)
+		}
+	}, nil
+}
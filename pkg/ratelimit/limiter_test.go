@@ -0,0 +1,131 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/ratelimit"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/ratelimit"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const findMissingBlobsMethod = "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs"
+
+func requireResourceExhausted(t *testing.T, err error, message string, minimumDelay time.Duration, maximumDelay time.Duration) {
+	s := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, s.Code())
+	require.Equal(t, message, s.Message())
+	details := s.Details()
+	require.Len(t, details, 1)
+	retryInfo, ok := details[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	delay, err := ptypes.Duration(retryInfo.RetryDelay)
+	require.NoError(t, err)
+	require.True(t, delay >= minimumDelay && delay <= maximumDelay, "Unexpected retry delay: %s", delay)
+}
+
+func TestQuotaLimiterRate(t *testing.T) {
+	limiter := ratelimit.NewQuotaLimiter([]*pb.QuotaConfiguration{
+		{
+			Name:              "find-missing",
+			Methods:           []string{findMissingBlobsMethod},
+			PerIdentity:       true,
+			RequestsPerSecond: 0.001,
+			Burst:             2,
+		},
+	})
+	alice := &ratelimit.Request{Method: findMissingBlobsMethod, Identity: "alice"}
+	bob := &ratelimit.Request{Method: findMissingBlobsMethod, Identity: "bob"}
+
+	// The burst permits two requests, after which requests need to
+	// wait for the bucket to refill.
+	for i := 0; i < 2; i++ {
+		release, err := limiter.Acquire(alice)
+		require.NoError(t, err)
+		release()
+	}
+	_, err := limiter.Acquire(alice)
+	requireResourceExhausted(t, err, "Request rate of quota \"find-missing\" exceeded", 999*time.Second, 1000*time.Second)
+
+	// Other identities have their own budget.
+	release, err := limiter.Acquire(bob)
+	require.NoError(t, err)
+	release()
+
+	// Other methods are not subject to this quota.
+	release, err = limiter.Acquire(&ratelimit.Request{
+		Method:   "/google.bytestream.ByteStream/Read",
+		Identity: "alice",
+	})
+	require.NoError(t, err)
+	release()
+}
+
+func TestQuotaLimiterConcurrency(t *testing.T) {
+	limiter := ratelimit.NewQuotaLimiter([]*pb.QuotaConfiguration{
+		{
+			Name:              "global",
+			RequestsPerSecond: 0.001,
+			Burst:             3,
+		},
+		{
+			Name:                      "execute",
+			InstanceNames:             []string{"ubuntu"},
+			PerInstanceName:           true,
+			MaximumConcurrentRequests: 1,
+		},
+	})
+	ubuntu := &ratelimit.Request{Method: "/build.bazel.remote.execution.v2.Execution/Execute", InstanceName: "ubuntu"}
+
+	release1, err := limiter.Acquire(ubuntu)
+	require.NoError(t, err)
+
+	// Requests exceeding the concurrency limit should be rejected.
+	// The token consumed from the global quota should be refunded.
+	_, err = limiter.Acquire(ubuntu)
+	requireResourceExhausted(t, err, "Concurrency limit of quota \"execute\" exceeded", time.Second, time.Second)
+
+	// Capacity should become available again once the request
+	// completes.
+	release1()
+	release2, err := limiter.Acquire(ubuntu)
+	require.NoError(t, err)
+	release2()
+
+	// The global quota has now been charged for two requests,
+	// permitting one more.
+	release3, err := limiter.Acquire(&ratelimit.Request{Method: findMissingBlobsMethod})
+	require.NoError(t, err)
+	release3()
+	_, err = limiter.Acquire(&ratelimit.Request{Method: findMissingBlobsMethod})
+	requireResourceExhausted(t, err, "Request rate of quota \"global\" exceeded", 999*time.Second, 1000*time.Second)
+}
+
+func TestQuotaLimiterBucketKeys(t *testing.T) {
+	limiter := ratelimit.NewQuotaLimiter([]*pb.QuotaConfiguration{
+		{
+			Name:              "per-client",
+			PerIdentity:       true,
+			PerInstanceName:   true,
+			RequestsPerSecond: 0.001,
+			Burst:             1,
+		},
+	})
+
+	// Budgets should be tracked separately, even if the identities
+	// and instance names contain characters that could be used to
+	// join them.
+	release, err := limiter.Acquire(&ratelimit.Request{Method: findMissingBlobsMethod, Identity: "alice|ci", InstanceName: "ubuntu"})
+	require.NoError(t, err)
+	release()
+	release, err = limiter.Acquire(&ratelimit.Request{Method: findMissingBlobsMethod, Identity: "alice", InstanceName: "ci|ubuntu"})
+	require.NoError(t, err)
+	release()
+	_, err = limiter.Acquire(&ratelimit.Request{Method: findMissingBlobsMethod, Identity: "alice|ci", InstanceName: "ubuntu"})
+	requireResourceExhausted(t, err, "Request rate of quota \"per-client\" exceeded", 999*time.Second, 1000*time.Second)
+}
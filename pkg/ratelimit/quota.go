@@ -0,0 +1,246 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/ratelimit"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	quotaRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "buildbarn",
+			Subsystem: "ratelimit",
+			Name:      "quota_requests_total",
+			Help:      "Total number of requests to which a quota applied, by result.",
+		},
+		[]string{"quota", "result"})
+	quotaConcurrentRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "ratelimit",
+			Name:      "quota_concurrent_requests",
+			Help:      "Number of requests to which a quota applies that are currently being processed.",
+		},
+		[]string{"quota"})
+	quotaBuckets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "buildbarn",
+			Subsystem: "ratelimit",
+			Name:      "quota_buckets",
+			Help:      "Number of separate budgets tracked for a quota.",
+		},
+		[]string{"quota"})
+)
+
+func init() {
+	prometheus.MustRegister(quotaRequestsTotal)
+	prometheus.MustRegister(quotaConcurrentRequests)
+	prometheus.MustRegister(quotaBuckets)
+}
+
+const (
+	// concurrencyRetryDelay is the delay announced to clients whose
+	// requests are rejected due to the concurrency limit being
+	// reached. Unlike for the request rate, there is no way to
+	// determine when capacity becomes available.
+	concurrencyRetryDelay = time.Second
+
+	// bucketPruneInterval is the interval at which budgets that are
+	// in their initial state are discarded, so that the number of
+	// budgets tracked for identities and instance names that are no
+	// longer in use doesn't grow indefinitely.
+	bucketPruneInterval = time.Minute
+)
+
+// Request contains the properties of a request that are used to
+// determine which quotas apply to it and which budget is charged.
+type Request struct {
+	Method       string
+	InstanceName string
+	Identity     string
+}
+
+// bucket holds the budget of a quota for a set of requests: a token
+// bucket for limiting the request rate and a counter for limiting the
+// number of concurrent requests.
+type bucket struct {
+	tokens             float64
+	lastRefill         time.Time
+	concurrentRequests uint32
+}
+
+type quota struct {
+	config          *pb.QuotaConfiguration
+	burst           float64
+	methods         map[string]bool
+	instanceNames   map[string]bool
+	allowedTotal    prometheus.Counter
+	rateLimited     prometheus.Counter
+	concurrencyFull prometheus.Counter
+	concurrent      prometheus.Gauge
+	bucketsGauge    prometheus.Gauge
+
+	lock      sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastPrune time.Time
+}
+
+func newQuota(config *pb.QuotaConfiguration) *quota {
+	q := &quota{
+		config:          config,
+		burst:           float64(config.Burst),
+		methods:         map[string]bool{},
+		instanceNames:   map[string]bool{},
+		allowedTotal:    quotaRequestsTotal.WithLabelValues(config.Name, "Allowed"),
+		rateLimited:     quotaRequestsTotal.WithLabelValues(config.Name, "RateLimited"),
+		concurrencyFull: quotaRequestsTotal.WithLabelValues(config.Name, "ConcurrencyLimited"),
+		concurrent:      quotaConcurrentRequests.WithLabelValues(config.Name),
+		bucketsGauge:    quotaBuckets.WithLabelValues(config.Name),
+		buckets:         map[bucketKey]*bucket{},
+		lastPrune:       time.Now(),
+	}
+	if q.burst == 0 {
+		q.burst = math.Max(1, math.Ceil(config.RequestsPerSecond))
+	}
+	for _, method := range config.Methods {
+		q.methods[method] = true
+	}
+	for _, instanceName := range config.InstanceNames {
+		q.instanceNames[instanceName] = true
+	}
+	return q
+}
+
+// appliesTo returns whether the quota needs to be enforced for a
+// request.
+func (q *quota) appliesTo(request *Request) bool {
+	return (len(q.methods) == 0 || q.methods[request.Method]) &&
+		(len(q.instanceNames) == 0 || q.instanceNames[request.InstanceName])
+}
+
+// bucketKey identifies the budget of a quota that is charged for a
+// request. Fields by which the quota is not partitioned are left
+// empty. A struct is used, as opposed to concatenating the fields, so
+// that distinct values can never map to the same budget.
+type bucketKey struct {
+	identity     string
+	instanceName string
+	method       string
+}
+
+// getBucketKey returns the key of the budget that is charged for a
+// request.
+func (q *quota) getBucketKey(request *Request) bucketKey {
+	var key bucketKey
+	if q.config.PerIdentity {
+		key.identity = request.Identity
+	}
+	if q.config.PerInstanceName {
+		key.instanceName = request.InstanceName
+	}
+	if q.config.PerMethod {
+		key.method = request.Method
+	}
+	return key
+}
+
+// refill adds tokens to a bucket for the time that has passed since
+// the last refill.
+func (q *quota) refill(b *bucket, now time.Time) {
+	b.tokens = math.Min(q.burst, b.tokens+now.Sub(b.lastRefill).Seconds()*q.config.RequestsPerSecond)
+	b.lastRefill = now
+}
+
+// pruneBuckets removes budgets that are in their initial state. The
+// lock must be held.
+func (q *quota) pruneBuckets(now time.Time) {
+	for key, b := range q.buckets {
+		q.refill(b, now)
+		if b.concurrentRequests == 0 && b.tokens >= q.burst {
+			delete(q.buckets, key)
+		}
+	}
+	q.lastPrune = now
+	q.bucketsGauge.Set(float64(len(q.buckets)))
+}
+
+// acquire charges the budget for a request. Upon success, the key of
+// the bucket is returned, which needs to be passed to release() once
+// the request completes.
+func (q *quota) acquire(request *Request) (bucketKey, error) {
+	key := q.getBucketKey(request)
+	now := time.Now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if now.Sub(q.lastPrune) >= bucketPruneInterval {
+		q.pruneBuckets(now)
+	}
+	b, ok := q.buckets[key]
+	if !ok {
+		b = &bucket{
+			tokens:     q.burst,
+			lastRefill: now,
+		}
+		q.buckets[key] = b
+		q.bucketsGauge.Set(float64(len(q.buckets)))
+	}
+
+	rateLimited := q.config.RequestsPerSecond > 0
+	if rateLimited {
+		q.refill(b, now)
+		if b.tokens < 1 {
+			q.rateLimited.Inc()
+			delay := time.Duration((1 - b.tokens) / q.config.RequestsPerSecond * float64(time.Second))
+			return bucketKey{}, newResourceExhaustedError(delay, "Request rate of quota %#v exceeded", q.config.Name)
+		}
+	}
+	if max := q.config.MaximumConcurrentRequests; max > 0 && b.concurrentRequests >= max {
+		q.concurrencyFull.Inc()
+		return bucketKey{}, newResourceExhaustedError(concurrencyRetryDelay, "Concurrency limit of quota %#v exceeded", q.config.Name)
+	}
+
+	if rateLimited {
+		b.tokens--
+	}
+	b.concurrentRequests++
+	q.allowedTotal.Inc()
+	q.concurrent.Inc()
+	return key, nil
+}
+
+// release marks a request for which acquire() succeeded as completed.
+// If the request was not processed at all (e.g., because another quota
+// rejected it), the token used by the request may be refunded.
+func (q *quota) release(key bucketKey, refund bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	b := q.buckets[key]
+	b.concurrentRequests--
+	if refund && q.config.RequestsPerSecond > 0 {
+		b.tokens = math.Min(q.burst, b.tokens+1)
+	}
+	q.concurrent.Dec()
+}
+
+func newResourceExhaustedError(delay time.Duration, format string, args ...interface{}) error {
+	s, err := status.Newf(codes.ResourceExhausted, format, args...).WithDetails(
+		&errdetails.RetryInfo{
+			RetryDelay: ptypes.DurationProto(delay),
+		})
+	if err != nil {
+		return err
+	}
+	return s.Err()
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-jsonnet"
+
+	"google.golang.org/grpc/codes"
+)
+
+// UnmarshalConfigurationFromFile reads a configuration file and
+// stores its contents in a protobuf message. The format of the file is
+// derived from its extension. Files ending with ".jsonnet" are
+// evaluated as Jsonnet, having all environment variables available as
+// external variables (i.e., std.extVar()). Files ending with ".yaml"
+// or ".yml" are parsed as YAML. All other files are parsed as JSON.
+//
+// Fields are named according to the protobuf to JSON mapping, meaning
+// both "listen_addresses" and "listenAddresses" are accepted. Unknown
+// fields are rejected, so that typos are detected at startup.
+func UnmarshalConfigurationFromFile(path string, configuration proto.Message) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to read configuration file %#v", path)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonnet":
+		vm := jsonnet.MakeVM()
+		for _, variable := range os.Environ() {
+			if parts := strings.SplitN(variable, "=", 2); len(parts) == 2 {
+				vm.ExtVar(parts[0], parts[1])
+			}
+		}
+		evaluated, err := vm.EvaluateSnippet(path, string(data))
+		if err != nil {
+			return StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to evaluate configuration file %#v", path)
+		}
+		data = []byte(evaluated)
+	case ".yaml", ".yml":
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to parse configuration file %#v", path)
+		}
+	}
+
+	if err := jsonpb.Unmarshal(bytes.NewReader(data), configuration); err != nil {
+		return StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to unmarshal configuration file %#v", path)
+	}
+	return nil
+}
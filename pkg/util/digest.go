@@ -1,13 +1,12 @@
 package util
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"hash"
 	"log"
+	"strconv"
+	"strings"
 
 	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 
@@ -25,28 +24,49 @@ import (
 //   hexadecimal to binary. The size is non-negative.
 // - They keep track of the instance as part of the digest, which allows
 //   us to keep function signatures across the codebase simple.
+// - They keep track of the hash function that was used to compute the
+//   digest, as it cannot always be inferred from the length of the
+//   hash.
 // - They provide utility functions for deriving new digests from them.
 //   This ensures that outputs of build actions automatically use the
 //   same instance name and hashing algorithm.
 type Digest struct {
-	instance      string
-	partialDigest remoteexecution.Digest
+	instance       string
+	digestFunction DigestFunction
+	partialDigest  remoteexecution.Digest
 }
 
 // NewDigest constructs a Digest object from an instance name and a
-// protocol-level digest object. The instance returned by this function
-// is guaranteed to be non-degenerate.
+// protocol-level digest object. The digest function is inferred from
+// the length of the hash. The instance returned by this function is
+// guaranteed to be non-degenerate.
 func NewDigest(instance string, partialDigest *remoteexecution.Digest) (*Digest, error) {
 	if partialDigest == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "No digest provided")
 	}
+	digestFunction, err := inferDigestFunction(len(partialDigest.Hash))
+	if err != nil {
+		return nil, err
+	}
+	return NewDigestWithFunction(instance, digestFunction, partialDigest)
+}
+
+// NewDigestWithFunction constructs a Digest object similar to
+// NewDigest, except that the digest function is provided explicitly.
+// This is needed for digest functions that cannot be inferred from the
+// length of the hash (e.g., BLAKE3).
+func NewDigestWithFunction(instance string, digestFunction DigestFunction, partialDigest *remoteexecution.Digest) (*Digest, error) {
+	if partialDigest == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "No digest provided")
+	}
 
-	// TODO(edsch): Validate the instance name. Maybe have a
-	// restrictive character set? What about length?
+	// The instance name is not validated here, as decorators may
+	// derive instance names for internal use. Instance names
+	// provided by clients are validated by NewDigestFromClient().
 
 	// Validate the hash.
-	if len(partialDigest.Hash) != md5.Size*2 && len(partialDigest.Hash) != sha1.Size*2 && len(partialDigest.Hash) != sha256.Size*2 {
-		return nil, status.Errorf(codes.InvalidArgument, "Unknown digest hash length: %d characters", len(partialDigest.Hash))
+	if expectedLength := digestFunctionInfos[digestFunction].hashSize * 2; len(partialDigest.Hash) != expectedLength {
+		return nil, status.Errorf(codes.InvalidArgument, "Digest hash has length %d, while %d characters were expected for digest function %s", len(partialDigest.Hash), expectedLength, digestFunction)
 	}
 	for _, c := range partialDigest.Hash {
 		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
@@ -60,8 +80,9 @@ func NewDigest(instance string, partialDigest *remoteexecution.Digest) (*Digest,
 	}
 
 	return &Digest{
-		instance:      instance,
-		partialDigest: *partialDigest,
+		instance:       instance,
+		digestFunction: digestFunction,
+		partialDigest:  *partialDigest,
 	}, nil
 }
 
@@ -77,12 +98,22 @@ func MustNewDigest(instance string, partialDigest *remoteexecution.Digest) *Dige
 }
 
 // NewDerivedDigest creates a Digest object that uses the same instance
-// name as the one from which it is derived. This can be used to refer
-// to inputs (command, directories, files) of an action.
+// name and digest function as the one from which it is derived. This
+// can be used to refer to inputs (command, directories, files) of an
+// action.
 func (d *Digest) NewDerivedDigest(partialDigest *remoteexecution.Digest) (*Digest, error) {
-	// TODO(edsch): Check whether the resulting digest uses the same
-	// hashing algorithm?
-	return NewDigest(d.instance, partialDigest)
+	return NewDigestWithFunction(d.instance, d.digestFunction, partialDigest)
+}
+
+// NewDigestWithInstance creates a copy of the Digest object that uses
+// a different instance name. This can be used by decorators that
+// rewrite instance names.
+func (d *Digest) NewDigestWithInstance(instance string) *Digest {
+	return &Digest{
+		instance:       instance,
+		digestFunction: d.digestFunction,
+		partialDigest:  d.partialDigest,
+	}
 }
 
 // GetPartialDigest encodes the digest into the format used by the remote
@@ -97,6 +128,12 @@ func (d *Digest) GetInstance() string {
 	return d.instance
 }
 
+// GetDigestFunction returns the hash function that was used to compute
+// the digest.
+func (d *Digest) GetDigestFunction() DigestFunction {
+	return d.digestFunction
+}
+
 // GetHashBytes returns the hash of the object as a slice of bytes.
 func (d *Digest) GetHashBytes() []byte {
 	hash, err := hex.DecodeString(d.partialDigest.Hash)
@@ -116,6 +153,15 @@ func (d *Digest) GetSizeBytes() int64 {
 	return d.partialDigest.SizeBytes
 }
 
+// GetByteStreamPath returns the part of a ByteStream resource name that
+// identifies the object, having the form "blobs/${hash}/${size}". For
+// digest functions that cannot be inferred from the length of the
+// hash, the name of the digest function is added, resulting in
+// "blobs/${function}/${hash}/${size}".
+func (d *Digest) GetByteStreamPath() string {
+	return "blobs/" + d.digestFunction.addPrefix(fmt.Sprintf("%s/%d", d.partialDigest.Hash, d.partialDigest.SizeBytes), "/")
+}
+
 // DigestKeyFormat is an enumeration type that determines the format of
 // object keys returned by Digest.GetKey().
 type DigestKeyFormat int
@@ -131,19 +177,54 @@ const (
 )
 
 // GetKey generates a string representation of the digest object that
-// may be used as keys in hash tables.
+// may be used as keys in hash tables. For digest functions that cannot
+// be inferred from the length of the hash, the key is prefixed with
+// the name of the digest function (e.g., "blake3:"), so that keys don't
+// collide with the ones of other digest functions.
 func (d *Digest) GetKey(format DigestKeyFormat) string {
 	switch format {
 	case DigestKeyWithoutInstance:
-		return fmt.Sprintf("%s-%d", d.partialDigest.Hash, d.partialDigest.SizeBytes)
+		return d.digestFunction.addPrefix(fmt.Sprintf("%s-%d", d.partialDigest.Hash, d.partialDigest.SizeBytes), ":")
 	case DigestKeyWithInstance:
-		return fmt.Sprintf("%s-%d-%s", d.partialDigest.Hash, d.partialDigest.SizeBytes, d.instance)
+		return d.digestFunction.addPrefix(fmt.Sprintf("%s-%d-%s", d.partialDigest.Hash, d.partialDigest.SizeBytes, d.instance), ":")
 	default:
 		log.Fatal("Invalid digest key format")
 		return ""
 	}
 }
 
+// NewDigestFromKey parses a key that was generated by Digest.GetKey()
+// using the provided format, reconstructing the original Digest.
+func NewDigestFromKey(key string, format DigestKeyFormat) (*Digest, error) {
+	digestFunction, hasDigestFunction, unprefixedKey := trimPrefix(key, ":")
+	var fields []string
+	switch format {
+	case DigestKeyWithoutInstance:
+		fields = strings.SplitN(unprefixedKey, "-", 2)
+		fields = append(fields, "")
+	case DigestKeyWithInstance:
+		// Instance names may contain dashes themselves.
+		fields = strings.SplitN(unprefixedKey, "-", 3)
+	default:
+		log.Fatal("Invalid digest key format")
+	}
+	if len(fields) != 3 {
+		return nil, status.Errorf(codes.InvalidArgument, "Key %#v does not contain the expected number of fields", key)
+	}
+	sizeBytes, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Key %#v contains an invalid size", key)
+	}
+	partialDigest := &remoteexecution.Digest{
+		Hash:      fields[0],
+		SizeBytes: sizeBytes,
+	}
+	if hasDigestFunction {
+		return NewDigestWithFunction(fields[2], digestFunction, partialDigest)
+	}
+	return NewDigest(fields[2], partialDigest)
+}
+
 func (d *Digest) String() string {
 	return d.GetKey(DigestKeyWithInstance)
 }
@@ -153,34 +234,26 @@ func (d *Digest) String() string {
 // algorithm as the one that was used to create the digest, making it
 // possible to validate data against a digest.
 func (d *Digest) NewHasher() hash.Hash {
-	switch len(d.partialDigest.Hash) {
-	case md5.Size * 2:
-		return md5.New()
-	case sha1.Size * 2:
-		return sha1.New()
-	case sha256.Size * 2:
-		return sha256.New()
-	default:
-		log.Fatal("Digest hash is of unknown type")
-		return nil
-	}
+	return d.digestFunction.NewHasher()
 }
 
 // NewDigestGenerator creates a writer that may be used to compute
 // digests of newly created files.
 func (d *Digest) NewDigestGenerator() *DigestGenerator {
 	return &DigestGenerator{
-		instance:    d.instance,
-		partialHash: d.NewHasher(),
+		instance:       d.instance,
+		digestFunction: d.digestFunction,
+		partialHash:    d.NewHasher(),
 	}
 }
 
 // DigestGenerator is a writer that may be used to compute digests of
 // newly created files.
 type DigestGenerator struct {
-	instance    string
-	partialHash hash.Hash
-	sizeBytes   int64
+	instance       string
+	digestFunction DigestFunction
+	partialHash    hash.Hash
+	sizeBytes      int64
 }
 
 // Write a chunk of data from a newly created file into the state of the
@@ -195,7 +268,8 @@ func (dg *DigestGenerator) Write(p []byte) (int, error) {
 // DigestGenerator.
 func (dg *DigestGenerator) Sum() *Digest {
 	return &Digest{
-		instance: dg.instance,
+		instance:       dg.instance,
+		digestFunction: dg.digestFunction,
 		partialDigest: remoteexecution.Digest{
 			Hash:      hex.EncodeToString(dg.partialHash.Sum(nil)),
 			SizeBytes: dg.sizeBytes,
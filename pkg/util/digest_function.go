@@ -0,0 +1,187 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strings"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/zeebo/blake3"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DigestFunction is an enumeration of the hash functions that may be
+// used to compute digests.
+type DigestFunction int
+
+const (
+	// DigestFunctionMD5 computes digests using MD5.
+	DigestFunctionMD5 DigestFunction = iota
+	// DigestFunctionSHA1 computes digests using SHA-1.
+	DigestFunctionSHA1
+	// DigestFunctionSHA256 computes digests using SHA-256.
+	DigestFunctionSHA256
+	// DigestFunctionSHA384 computes digests using SHA-384.
+	DigestFunctionSHA384
+	// DigestFunctionSHA512 computes digests using SHA-512.
+	DigestFunctionSHA512
+	// DigestFunctionBLAKE3 computes digests using BLAKE3, having an
+	// output size of 256 bits.
+	DigestFunctionBLAKE3
+)
+
+type digestFunctionInfo struct {
+	name      string
+	hashSize  int
+	newHasher func() hash.Hash
+	// The value of the function in the Remote Execution API. Not all
+	// of these are known to the version of the protocol against which
+	// this code is built, which is why numerical values are used.
+	protocolValue remoteexecution.DigestFunction
+	// Whether the function can be inferred from the length of the
+	// hash. For functions where this is not the case, the name of
+	// the function needs to be provided explicitly (e.g., in
+	// ByteStream resource names) and is made part of storage keys.
+	inferable bool
+}
+
+var digestFunctionInfos = [...]digestFunctionInfo{
+	DigestFunctionMD5: {
+		name:          "md5",
+		hashSize:      md5.Size,
+		newHasher:     md5.New,
+		protocolValue: remoteexecution.DigestFunction(3),
+		inferable:     true,
+	},
+	DigestFunctionSHA1: {
+		name:          "sha1",
+		hashSize:      sha1.Size,
+		newHasher:     sha1.New,
+		protocolValue: remoteexecution.DigestFunction(2),
+		inferable:     true,
+	},
+	DigestFunctionSHA256: {
+		name:          "sha256",
+		hashSize:      sha256.Size,
+		newHasher:     sha256.New,
+		protocolValue: remoteexecution.DigestFunction(1),
+		inferable:     true,
+	},
+	DigestFunctionSHA384: {
+		name:          "sha384",
+		hashSize:      sha512.Size384,
+		newHasher:     sha512.New384,
+		protocolValue: remoteexecution.DigestFunction(5),
+		inferable:     true,
+	},
+	DigestFunctionSHA512: {
+		name:          "sha512",
+		hashSize:      sha512.Size,
+		newHasher:     sha512.New,
+		protocolValue: remoteexecution.DigestFunction(6),
+		inferable:     true,
+	},
+	DigestFunctionBLAKE3: {
+		name:          "blake3",
+		hashSize:      32,
+		newHasher:     func() hash.Hash { return blake3.New() },
+		protocolValue: remoteexecution.DigestFunction(9),
+		inferable:     false,
+	},
+}
+
+// InferableDigestFunctions returns the values in the Remote Execution
+// API of all digest functions that can be inferred from the length of
+// the hash. As the version of the protocol used does not allow clients
+// to specify the digest function as part of requests, these are the
+// ones that may be announced through GetCapabilities().
+func InferableDigestFunctions() []remoteexecution.DigestFunction {
+	var values []remoteexecution.DigestFunction
+	for _, info := range digestFunctionInfos {
+		if info.inferable {
+			values = append(values, info.protocolValue)
+		}
+	}
+	return values
+}
+
+// inferDigestFunction determines the digest function that was used to
+// compute a hash, based on its length in hexadecimal characters.
+func inferDigestFunction(hashLength int) (DigestFunction, error) {
+	for digestFunction, info := range digestFunctionInfos {
+		if info.inferable && hashLength == info.hashSize*2 {
+			return DigestFunction(digestFunction), nil
+		}
+	}
+	return 0, status.Errorf(codes.InvalidArgument, "Unknown digest hash length: %d characters", hashLength)
+}
+
+// NewDigestFunctionFromName converts the lowercase name of a digest
+// function (e.g., "blake3"), as used in ByteStream resource names, to
+// a DigestFunction.
+func NewDigestFunctionFromName(name string) (DigestFunction, error) {
+	for digestFunction, info := range digestFunctionInfos {
+		if name == info.name {
+			return DigestFunction(digestFunction), nil
+		}
+	}
+	return 0, status.Errorf(codes.InvalidArgument, "Unknown digest function %#v", name)
+}
+
+func (f DigestFunction) String() string {
+	return digestFunctionInfos[f].name
+}
+
+// IsValid returns whether the value corresponds to a digest function
+// that is supported. This can be used to validate values that have
+// been deserialized.
+func (f DigestFunction) IsValid() bool {
+	return f >= 0 && int(f) < len(digestFunctionInfos)
+}
+
+// NewHasher creates a standard hash.Hash object that computes hashes
+// using the digest function.
+func (f DigestFunction) NewHasher() hash.Hash {
+	return digestFunctionInfos[f].newHasher()
+}
+
+// IsInferable returns whether the digest function can be inferred from
+// the length of hashes computed with it. If not, the name of the
+// digest function needs to be passed along with these hashes.
+func (f DigestFunction) IsInferable() bool {
+	return digestFunctionInfos[f].inferable
+}
+
+// GetProtocolValue returns the value of the digest function, as used
+// by the Remote Execution API.
+func (f DigestFunction) GetProtocolValue() remoteexecution.DigestFunction {
+	return digestFunctionInfos[f].protocolValue
+}
+
+// addPrefix prepends the name of the digest function to a string
+// (e.g., a storage key), followed by a separator, if the digest
+// function cannot be inferred from the length of the hash.
+func (f DigestFunction) addPrefix(s string, separator string) string {
+	if f.IsInferable() {
+		return s
+	}
+	return f.String() + separator + s
+}
+
+// trimPrefix is the inverse of addPrefix. It returns the digest
+// function whose name is prepended to the string, if any. As hashes
+// are hexadecimal, they cannot be mistaken for names of digest
+// functions.
+func trimPrefix(s string, separator string) (DigestFunction, bool, string) {
+	for digestFunction, info := range digestFunctionInfos {
+		if !info.inferable && strings.HasPrefix(s, info.name+separator) {
+			return DigestFunction(digestFunction), true, s[len(info.name)+len(separator):]
+		}
+	}
+	return 0, false, s
+}
@@ -0,0 +1,124 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewDigestFromKeySuccess(t *testing.T) {
+	sha256Digest := &remoteexecution.Digest{
+		Hash:      "8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4",
+		SizeBytes: 123,
+	}
+	blake3Digest := &remoteexecution.Digest{
+		Hash:      "d74981efa70a0c880b8d8c1985d075dbcbf679b99a5f9914e5aaf96b831a9e24",
+		SizeBytes: 456,
+	}
+	newBLAKE3Digest := func(instance string) *util.Digest {
+		digest, err := util.NewDigestWithFunction(instance, util.DigestFunctionBLAKE3, blake3Digest)
+		require.NoError(t, err)
+		return digest
+	}
+
+	for _, entry := range []struct {
+		key    string
+		format util.DigestKeyFormat
+		digest *util.Digest
+	}{
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123",
+			util.DigestKeyWithoutInstance,
+			util.MustNewDigest("", sha256Digest),
+		},
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123-",
+			util.DigestKeyWithInstance,
+			util.MustNewDigest("", sha256Digest),
+		},
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123-debian8",
+			util.DigestKeyWithInstance,
+			util.MustNewDigest("debian8", sha256Digest),
+		},
+		// Instance names may contain dashes.
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123-ubuntu-18.04/x86-64",
+			util.DigestKeyWithInstance,
+			util.MustNewDigest("ubuntu-18.04/x86-64", sha256Digest),
+		},
+		// Digest functions that cannot be inferred from the
+		// length of the hash are prefixed.
+		{
+			"blake3:d74981efa70a0c880b8d8c1985d075dbcbf679b99a5f9914e5aaf96b831a9e24-456",
+			util.DigestKeyWithoutInstance,
+			newBLAKE3Digest(""),
+		},
+		{
+			"blake3:d74981efa70a0c880b8d8c1985d075dbcbf679b99a5f9914e5aaf96b831a9e24-456-my-instance",
+			util.DigestKeyWithInstance,
+			newBLAKE3Digest("my-instance"),
+		},
+	} {
+		digest, err := util.NewDigestFromKey(entry.key, entry.format)
+		require.NoError(t, err, "Key %#v", entry.key)
+		require.Equal(t, entry.digest, digest, "Key %#v", entry.key)
+		require.Equal(t, entry.key, digest.GetKey(entry.format))
+	}
+}
+
+func TestNewDigestFromKeyFailure(t *testing.T) {
+	for _, entry := range []struct {
+		key    string
+		format util.DigestKeyFormat
+		err    error
+	}{
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4",
+			util.DigestKeyWithoutInstance,
+			status.Error(codes.InvalidArgument, "Key \"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4\" does not contain the expected number of fields"),
+		},
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123",
+			util.DigestKeyWithInstance,
+			status.Error(codes.InvalidArgument, "Key \"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123\" does not contain the expected number of fields"),
+		},
+		// Keys containing an instance name cannot be parsed
+		// when no instance name is expected.
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123-debian8",
+			util.DigestKeyWithoutInstance,
+			status.Error(codes.InvalidArgument, "Key \"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123-debian8\" contains an invalid size"),
+		},
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-abc-debian8",
+			util.DigestKeyWithInstance,
+			status.Error(codes.InvalidArgument, "Key \"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-abc-debian8\" contains an invalid size"),
+		},
+		{
+			"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4--123-debian8",
+			util.DigestKeyWithInstance,
+			status.Error(codes.InvalidArgument, "Key \"8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4--123-debian8\" contains an invalid size"),
+		},
+		// Only digest functions that cannot be inferred from the
+		// length of the hash are stripped as a prefix.
+		{
+			"sha256:8b1a9953c4611296a827abf8c47804d7e6c49c6b1a9953c4611296a827abf8c4-123",
+			util.DigestKeyWithoutInstance,
+			status.Error(codes.InvalidArgument, "Unknown digest hash length: 71 characters"),
+		},
+		{
+			"blake3:8b1a9953c4611296a827abf8c47804d7e6c49c6b-123",
+			util.DigestKeyWithoutInstance,
+			status.Error(codes.InvalidArgument, "Digest hash has length 40, while 64 characters were expected for digest function blake3"),
+		},
+	} {
+		_, err := util.NewDigestFromKey(entry.key, entry.format)
+		require.Equal(t, entry.err, err, "Key %#v", entry.key)
+	}
+}
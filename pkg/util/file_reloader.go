@@ -0,0 +1,83 @@
+package util
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileReloader holds a value that is derived from the contents of one
+// or more files on disk. The value is recomputed when any of these
+// files is modified, which makes it possible to rotate certificates
+// and keys without restarting processes.
+type FileReloader struct {
+	paths []string
+	load  func() (interface{}, error)
+
+	lock     sync.Mutex
+	modTimes []time.Time
+	value    interface{}
+}
+
+// NewFileReloader creates a FileReloader that derives its value from
+// a set of files by calling a load function. The initial call to the
+// load function is performed immediately.
+func NewFileReloader(paths []string, load func() (interface{}, error)) (*FileReloader, error) {
+	r := &FileReloader{
+		paths: paths,
+		load:  load,
+	}
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		return nil, err
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r.modTimes = modTimes
+	r.value = value
+	return r, nil
+}
+
+func (r *FileReloader) getModTimes() ([]time.Time, error) {
+	modTimes := make([]time.Time, 0, len(r.paths))
+	for _, path := range r.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// Get returns the value, reloading it if any of the files has been
+// modified. Files may be replaced one by one (e.g., a certificate
+// before its private key). Failures to reload are therefore not
+// fatal. The previous value remains in use and reloading is retried
+// on the next call.
+func (r *FileReloader) Get() interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modTimes, err := r.getModTimes()
+	if err != nil {
+		log.Print("Failed to check for modified files: ", err)
+		return r.value
+	}
+	for i, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[i]) {
+			value, err := r.load()
+			if err != nil {
+				log.Printf("Failed to reload files %v: %s", r.paths, err)
+				return r.value
+			}
+			r.modTimes = modTimes
+			r.value = value
+			break
+		}
+	}
+	return r.value
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/grpc"
+	"github.com/grpc-ecosystem/go-grpc-prometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// NewChainedUnaryServerInterceptor combines multiple GRPC interceptors
+// for unary calls into a single one, as GRPC servers only accept a
+// single interceptor. Interceptors are invoked in the order provided.
+func NewChainedUnaryServerInterceptor(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// NewChainedStreamServerInterceptor combines multiple GRPC
+// interceptors for streaming calls into a single one, as GRPC servers
+// only accept a single interceptor. Interceptors are invoked in the
+// order provided.
+func NewChainedStreamServerInterceptor(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// NewGRPCClientFromConfiguration creates a GRPC client connection
+// based on parameters provided in a configuration file. Prometheus
+// metrics are collected for all calls performed through the
+// connection.
+func NewGRPCClientFromConfiguration(configuration *pb.ClientConfiguration) (*grpc.ClientConn, error) {
+	if configuration == nil {
+		return nil, status.Error(codes.InvalidArgument, "No GRPC client configuration provided")
+	}
+	if configuration.Address == "" {
+		return nil, status.Error(codes.InvalidArgument, "No GRPC server address provided")
+	}
+	transportOption, err := NewGRPCTransportDialOption(configuration.Tls)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Dial(
+		configuration.Address,
+		transportOption,
+		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
+		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor))
+}
+
+// NewGRPCTransportDialOption returns an option for grpc.Dial() that
+// either enables TLS or disables transport security, depending on
+// whether a TLS configuration is provided.
+func NewGRPCTransportDialOption(configuration *blobstore.ClientTLSConfiguration) (grpc.DialOption, error) {
+	tlsConfigProvider, err := NewClientTLSConfigFromConfiguration(configuration)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfigProvider == nil {
+		return grpc.WithInsecure(), nil
+	}
+	return grpc.WithTransportCredentials(&reloadingTLSCredentials{
+		tlsConfigProvider: tlsConfigProvider,
+	}), nil
+}
+
+// reloadingTLSCredentials is an implementation of GRPC's
+// TransportCredentials that obtains a fresh TLS configuration for every
+// connection, so that reloaded certificates and certificate
+// authorities are used. The server name defaults to the host name in
+// the address being dialed.
+type reloadingTLSCredentials struct {
+	tlsConfigProvider ClientTLSConfigProvider
+	serverName        string
+}
+
+func (c *reloadingTLSCredentials) getCredentials(authority string) credentials.TransportCredentials {
+	serverName := c.serverName
+	if serverName == "" {
+		serverName = authority
+		if host, _, err := net.SplitHostPort(authority); err == nil {
+			serverName = host
+		}
+	}
+	return credentials.NewTLS(c.tlsConfigProvider(serverName))
+}
+
+func (c *reloadingTLSCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.getCredentials(authority).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *reloadingTLSCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, status.Error(codes.Unimplemented, "Client credentials cannot be used by servers")
+}
+
+func (c *reloadingTLSCredentials) Info() credentials.ProtocolInfo {
+	return c.getCredentials("").Info()
+}
+
+func (c *reloadingTLSCredentials) Clone() credentials.TransportCredentials {
+	newCredentials := *c
+	return &newCredentials
+}
+
+func (c *reloadingTLSCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+	return nil
+}
+
+// ServeGRPC creates GRPC servers based on parameters provided in a
+// configuration file and lets them process incoming requests.
+// Prometheus metrics are collected for all calls, after which the
+// provided interceptors are invoked. The registration function is
+// called once for every server to register services. This function
+// only returns if one of the servers fails.
+func ServeGRPC(configurations []*pb.ServerConfiguration, unaryInterceptors []grpc.UnaryServerInterceptor, streamInterceptors []grpc.StreamServerInterceptor, registrationFunc func(s *grpc.Server)) error {
+	if len(configurations) == 0 {
+		return status.Error(codes.InvalidArgument, "No GRPC servers configured")
+	}
+	grpc_prometheus.EnableHandlingTimeHistogram()
+
+	// Create all servers and listening sockets up front, so that
+	// configuration errors are reported before serving requests.
+	type listener struct {
+		server *grpc.Server
+		sock   net.Listener
+	}
+	var listeners []listener
+	for i, configuration := range configurations {
+		if len(configuration.ListenAddresses) == 0 && len(configuration.ListenPaths) == 0 {
+			return status.Errorf(codes.InvalidArgument, "GRPC server at index %d has no listen addresses or paths", i)
+		}
+		var serverOptions []grpc.ServerOption
+		tlsConfig, err := NewServerTLSConfigFromConfiguration(configuration.Tls)
+		if err != nil {
+			return StatusWrapf(err, "Failed to create TLS configuration for GRPC server at index %d", i)
+		}
+		if tlsConfig != nil {
+			serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		s := grpc.NewServer(
+			append(
+				serverOptions,
+				grpc.UnaryInterceptor(NewChainedUnaryServerInterceptor(append([]grpc.UnaryServerInterceptor{grpc_prometheus.UnaryServerInterceptor}, unaryInterceptors...)...)),
+				grpc.StreamInterceptor(NewChainedStreamServerInterceptor(append([]grpc.StreamServerInterceptor{grpc_prometheus.StreamServerInterceptor}, streamInterceptors...)...)))...)
+		registrationFunc(s)
+		grpc_prometheus.Register(s)
+
+		for _, listenAddress := range configuration.ListenAddresses {
+			sock, err := net.Listen("tcp", listenAddress)
+			if err != nil {
+				return StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to create listening socket for %#v", listenAddress)
+			}
+			listeners = append(listeners, listener{server: s, sock: sock})
+		}
+		for _, listenPath := range configuration.ListenPaths {
+			if err := os.Remove(listenPath); err != nil && !os.IsNotExist(err) {
+				return StatusWrapfWithCode(err, codes.Internal, "Could not remove stale socket %#v", listenPath)
+			}
+			sock, err := net.Listen("unix", listenPath)
+			if err != nil {
+				return StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to create listening socket for %#v", listenPath)
+			}
+			listeners = append(listeners, listener{server: s, sock: sock})
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			errs <- l.server.Serve(l.sock)
+		}(l)
+	}
+	return <-errs
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"strings"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maximumInstanceNameLength is the maximum length of an instance name
+// in bytes. Instance names end up in storage keys and file names, so
+// they should be kept reasonably short.
+const maximumInstanceNameLength = 200
+
+// reservedInstanceNameComponents contains the keywords that the Remote
+// Execution API uses in resource names. Permitting these as pathname
+// components of instance names would make resource names ambiguous.
+var reservedInstanceNameComponents = map[string]bool{
+	"actionResults":    true,
+	"actions":          true,
+	"blobs":            true,
+	"capabilities":     true,
+	"compressed-blobs": true,
+	"operations":       true,
+	"uploads":          true,
+}
+
+// CanonicalizeInstanceName validates an instance name provided by a
+// client and converts it to its canonical form. Instance names consist
+// of pathname components separated by slashes. A single leading or
+// trailing slash is removed. Components may only contain letters,
+// digits, '-', '_' and '.', may not be empty, "." or "..", and may not
+// be equal to one of the keywords used in resource names.
+//
+// Characters that are used internally to separate instance names from
+// other data (e.g., '|' in operation names) are thereby rejected.
+func CanonicalizeInstanceName(instance string) (string, error) {
+	canonical := strings.TrimSuffix(strings.TrimPrefix(instance, "/"), "/")
+	if canonical == "" {
+		return "", nil
+	}
+	if len(canonical) > maximumInstanceNameLength {
+		return "", status.Errorf(codes.InvalidArgument, "Instance name is %d bytes in size, which exceeds the maximum of %d bytes", len(canonical), maximumInstanceNameLength)
+	}
+	for _, component := range strings.Split(canonical, "/") {
+		if component == "" {
+			return "", status.Errorf(codes.InvalidArgument, "Instance name %#v contains an empty pathname component", instance)
+		}
+		if component == "." || component == ".." {
+			return "", status.Errorf(codes.InvalidArgument, "Instance name %#v contains pathname component %#v", instance, component)
+		}
+		if reservedInstanceNameComponents[component] {
+			return "", status.Errorf(codes.InvalidArgument, "Instance name %#v contains reserved keyword %#v", instance, component)
+		}
+		for _, c := range component {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+				return "", status.Errorf(codes.InvalidArgument, "Instance name %#v contains invalid character %#U", instance, c)
+			}
+		}
+	}
+	return canonical, nil
+}
+
+// NewDigestFromClient is identical to NewDigest, except that it first
+// validates and canonicalizes the instance name. It should be used to
+// construct digests from instance names provided by clients.
+func NewDigestFromClient(instance string, partialDigest *remoteexecution.Digest) (*Digest, error) {
+	canonical, err := CanonicalizeInstanceName(instance)
+	if err != nil {
+		return nil, err
+	}
+	return NewDigest(canonical, partialDigest)
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/proto/blobstore"
+	pb "github.com/EdSchouten/bazel-buildbarn/pkg/proto/configuration/grpc"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newCertificateReloader(certificateFile string, privateKeyFile string) (*FileReloader, error) {
+	return NewFileReloader([]string{certificateFile, privateKeyFile}, func() (interface{}, error) {
+		certificate, err := tls.LoadX509KeyPair(certificateFile, privateKeyFile)
+		if err != nil {
+			return nil, StatusWrapWithCode(err, codes.InvalidArgument, "Failed to load certificate")
+		}
+		return &certificate, nil
+	})
+}
+
+func loadCertificateAuthorities(certificateAuthoritiesFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(certificateAuthoritiesFile)
+	if err != nil {
+		return nil, StatusWrapfWithCode(err, codes.InvalidArgument, "Failed to read certificate authorities file %#v", certificateAuthoritiesFile)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, status.Errorf(codes.InvalidArgument, "No certificates found in %#v", certificateAuthoritiesFile)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig creates a TLS configuration for servers. The
+// server's certificate and private key are reloaded from disk when
+// modified. If clientCertificateAuthoritiesFile is non-empty, clients
+// are required to present a certificate signed by one of the
+// certificate authorities in that file (i.e., mutual TLS). This file
+// is reloaded when modified as well.
+func NewServerTLSConfig(certificateFile string, privateKeyFile string, clientCertificateAuthoritiesFile string) (*tls.Config, error) {
+	certificates, err := newCertificateReloader(certificateFile, privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return certificates.Get().(*tls.Certificate), nil
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCertificateAuthoritiesFile != "" {
+		clientCertificateAuthorities, err := NewFileReloader([]string{clientCertificateAuthoritiesFile}, func() (interface{}, error) {
+			return loadCertificateAuthorities(clientCertificateAuthoritiesFile)
+		})
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = clientCertificateAuthorities.Get().(*x509.CertPool)
+		// The set of certificate authorities can only be
+		// replaced by providing a new configuration for every
+		// incoming connection. GRPC's transport requires HTTP/2
+		// to be negotiated through ALPN.
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate: getCertificate,
+				MinVersion:     tls.VersionTLS12,
+				ClientAuth:     tls.RequireAndVerifyClientCert,
+				ClientCAs:      clientCertificateAuthorities.Get().(*x509.CertPool),
+				NextProtos:     []string{"h2"},
+			}, nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// ClientTLSConfigProvider returns TLS configurations for clients. As
+// the host name against which the server's certificate is validated
+// may depend on the address that is being dialed, it is provided as an
+// argument. It is only used if no server name is configured explicitly.
+type ClientTLSConfigProvider func(defaultServerName string) *tls.Config
+
+// NewClientTLSConfig creates a provider of TLS configurations for
+// clients. If serverCertificateAuthoritiesFile is empty, the server's
+// certificate is validated against the system's certificate
+// authorities. If clientCertificateFile and clientPrivateKeyFile are
+// non-empty, a client certificate is presented to the server. Both the
+// server certificate authorities and the client certificate are
+// reloaded from disk when modified.
+func NewClientTLSConfig(serverCertificateAuthoritiesFile string, clientCertificateFile string, clientPrivateKeyFile string, serverName string) (ClientTLSConfigProvider, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	var serverCertificateAuthorities *FileReloader
+	if serverCertificateAuthoritiesFile != "" {
+		var err error
+		serverCertificateAuthorities, err = NewFileReloader([]string{serverCertificateAuthoritiesFile}, func() (interface{}, error) {
+			return loadCertificateAuthorities(serverCertificateAuthoritiesFile)
+		})
+		if err != nil {
+			return nil, err
+		}
+		// The set of certificate authorities used by the
+		// standard verification process cannot be replaced.
+		// Validate the server's certificate manually instead.
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if clientCertificateFile != "" || clientPrivateKeyFile != "" {
+		certificates, err := newCertificateReloader(clientCertificateFile, clientPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificates.Get().(*tls.Certificate), nil
+		}
+	}
+	return func(defaultServerName string) *tls.Config {
+		newConfig := tlsConfig.Clone()
+		newConfig.ServerName = serverName
+		if newConfig.ServerName == "" {
+			newConfig.ServerName = defaultServerName
+		}
+		if serverCertificateAuthorities != nil {
+			name := newConfig.ServerName
+			newConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				return verifyServerCertificate(rawCerts, serverCertificateAuthorities.Get().(*x509.CertPool), name)
+			}
+		}
+		return newConfig
+	}, nil
+}
+
+// verifyServerCertificate validates the certificate chain presented by
+// a server against a set of certificate authorities and a host name.
+// It performs the same validation as crypto/tls does when
+// InsecureSkipVerify is not set.
+func verifyServerCertificate(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	if serverName == "" {
+		return status.Error(codes.InvalidArgument, "No server name provided against which to validate the server's certificate")
+	}
+	if len(rawCerts) == 0 {
+		return status.Error(codes.Unauthenticated, "Server did not provide a certificate")
+	}
+	certificates := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, rawCert := range rawCerts {
+		certificate, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return StatusWrapWithCode(err, codes.Unauthenticated, "Failed to parse server certificate")
+		}
+		certificates = append(certificates, certificate)
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	if _, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+	}); err != nil {
+		return StatusWrapWithCode(err, codes.Unauthenticated, "Failed to validate server certificate")
+	}
+	return nil
+}
+
+// NewServerTLSConfigFromConfiguration creates a TLS configuration for
+// a GRPC server based on parameters provided in a configuration file.
+// It returns nil if TLS is not enabled.
+func NewServerTLSConfigFromConfiguration(configuration *pb.ServerTLSConfiguration) (*tls.Config, error) {
+	if configuration == nil {
+		return nil, nil
+	}
+	if configuration.ServerCertificateFile == "" || configuration.ServerPrivateKeyFile == "" {
+		return nil, status.Error(codes.InvalidArgument, "TLS requires both a server certificate and a private key")
+	}
+	return NewServerTLSConfig(configuration.ServerCertificateFile, configuration.ServerPrivateKeyFile, configuration.ClientCertificateAuthoritiesFile)
+}
+
+// NewClientTLSConfigFromConfiguration creates a provider of TLS
+// configurations for a client based on parameters provided in a
+// configuration file. It returns nil if TLS is not enabled.
+func NewClientTLSConfigFromConfiguration(configuration *blobstore.ClientTLSConfiguration) (ClientTLSConfigProvider, error) {
+	if configuration == nil {
+		return nil, nil
+	}
+	return NewClientTLSConfig(
+		configuration.ServerCertificateAuthoritiesFile,
+		configuration.ClientCertificateFile,
+		configuration.ClientPrivateKeyFile,
+		configuration.ServerName)
+}
@@ -0,0 +1,137 @@
+package util_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate creates a certificate for a given host name. It
+// is signed by a parent certificate, or self-signed if none is
+// provided.
+func newTestCertificate(t *testing.T, commonName string, parent *tls.Certificate) *tls.Certificate {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, privateKey
+	if parent == nil {
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{commonName}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		signer = parent.Leaf
+		signerKey = parent.PrivateKey.(*ecdsa.PrivateKey)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &privateKey.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  privateKey,
+		Leaf:        leaf,
+	}
+}
+
+func writeTestCertificateAuthority(t *testing.T, path string, certificate *tls.Certificate, modTime time.Time) {
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: certificate.Certificate[0],
+	}), 0666))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// handshakeWithTestServer performs a TLS handshake against a server
+// presenting a given certificate.
+func handshakeWithTestServer(t *testing.T, tlsConfig *tls.Config, certificate *tls.Certificate) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{*certificate},
+		})
+		server.Handshake()
+		server.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), tlsConfig)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestNewClientTLSConfigReloadServerCertificateAuthorities(t *testing.T) {
+	oldAuthority := newTestCertificate(t, "Old CA", nil)
+	newAuthority := newTestCertificate(t, "New CA", nil)
+	serverCertificate := newTestCertificate(t, "server.example.com", newAuthority)
+
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	authoritiesFile := filepath.Join(p, "ca.pem")
+	writeTestCertificateAuthority(t, authoritiesFile, oldAuthority, time.Unix(1000, 0))
+
+	tlsConfigProvider, err := util.NewClientTLSConfig(authoritiesFile, "", "", "")
+	require.NoError(t, err)
+
+	// The server's certificate is not signed by the initial
+	// certificate authority.
+	require.Error(t, handshakeWithTestServer(t, tlsConfigProvider("server.example.com"), serverCertificate))
+
+	// Once the certificate authorities file is replaced, the
+	// server's certificate should be accepted, both by existing
+	// and new configurations.
+	oldTLSConfig := tlsConfigProvider("server.example.com")
+	writeTestCertificateAuthority(t, authoritiesFile, newAuthority, time.Unix(2000, 0))
+	require.NoError(t, handshakeWithTestServer(t, oldTLSConfig, serverCertificate))
+	require.NoError(t, handshakeWithTestServer(t, tlsConfigProvider("server.example.com"), serverCertificate))
+
+	// The host name should still be validated.
+	require.Error(t, handshakeWithTestServer(t, tlsConfigProvider("other.example.com"), serverCertificate))
+	require.Error(t, handshakeWithTestServer(t, tlsConfigProvider(""), serverCertificate))
+}
+
+func TestNewClientTLSConfigServerName(t *testing.T) {
+	authority := newTestCertificate(t, "CA", nil)
+	serverCertificate := newTestCertificate(t, "server.example.com", authority)
+
+	p := filepath.Join(os.Getenv("TEST_TMPDIR"), t.Name())
+	require.NoError(t, os.Mkdir(p, 0777))
+	authoritiesFile := filepath.Join(p, "ca.pem")
+	writeTestCertificateAuthority(t, authoritiesFile, authority, time.Unix(1000, 0))
+
+	// An explicitly configured server name takes precedence over
+	// the one derived from the address being dialed.
+	tlsConfigProvider, err := util.NewClientTLSConfig(authoritiesFile, "", "", "server.example.com")
+	require.NoError(t, err)
+	tlsConfig := tlsConfigProvider("10.0.0.1")
+	require.Equal(t, "server.example.com", tlsConfig.ServerName)
+	require.NoError(t, handshakeWithTestServer(t, tlsConfig, serverCertificate))
+}